@@ -0,0 +1,89 @@
+package syncig
+
+import (
+	"sync"
+	"time"
+)
+
+// 調整の判断に使う完了数
+const adaptiveWindow = 8
+
+// ADAPTIVE_CONCURRENCY: コピーにかかった時間とエラーの発生状況から、
+// 同時にコピーするファイル数を min から max の範囲で増減させる
+type adaptiveLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	min, max int
+	limit    int
+	active   int
+	// 直近の完了分の集計
+	count  int
+	sum    float64
+	errors int
+	// これまでで最も良かった 1 ファイルあたりの所要時間
+	baseline float64
+}
+
+// 無効な場合は nil（調整しない）を返す
+func newAdaptiveLimiter(enabled bool, lower, upper int) *adaptiveLimiter {
+	if !enabled || upper <= 1 {
+		return nil
+	}
+	lower = max(1, min(lower, upper))
+	l := &adaptiveLimiter{min: lower, max: upper, limit: lower}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// 現在の上限に空きができるまで待つ
+func (l *adaptiveLimiter) acquire() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+// 1 ファイルのコピーの結果を記録して上限を調整する
+func (l *adaptiveLimiter) release(d time.Duration, size int64, err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	// 大きいファイルほど時間がかかるため、1MiB を 1 ファイル分として正規化する
+	l.sum += d.Seconds() / (1 + float64(size)/(1<<20))
+	l.count++
+	if err != nil {
+		l.errors++
+	}
+	if l.count >= adaptiveWindow {
+		l.adjust(l.sum / float64(l.count))
+		l.count, l.sum, l.errors = 0, 0, 0
+	}
+	l.cond.Broadcast()
+}
+
+func (l *adaptiveLimiter) adjust(latency float64) {
+	switch {
+	case l.errors > 0:
+		// エラーが出たら半分に減らす
+		l.limit = max(l.min, l.limit/2)
+	case l.baseline == 0 || latency <= l.baseline*1.3:
+		// 所要時間が悪化していなければ 1 つずつ増やす
+		l.limit = min(l.max, l.limit+1)
+	case latency > l.baseline*2:
+		l.limit = max(l.min, l.limit-1)
+	}
+	// 環境の変化に追従するよう、基準は少しずつ緩める
+	if l.baseline == 0 || latency < l.baseline {
+		l.baseline = latency
+	} else {
+		l.baseline *= 1.05
+	}
+}
@@ -0,0 +1,534 @@
+package syncig
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// syncig serve（エージェント）と syncig:// の同期先。拠点間で SMB・NFS を公開せずに同期できるよう、
+// 受け側で syncig serve を起動し、送り側は DIST_DIR に syncig://host:port/path を指定する。
+// 通信は HTTPS で、共有のトークンで認証する
+
+// syncig serve の既定のポート
+const agentDefaultPort = "7443"
+
+// これ以下のファイルはメモリに読み込んでから送り、一時的なエラーの場合に送り直す
+const agentBufferSize = 16 << 20
+
+// エージェントの API のパス。後ろにリモートでのパスを続ける
+const (
+	agentFilesPath = "/v1/files"
+	agentStatPath  = "/v1/stat"
+	agentListPath  = "/v1/list"
+)
+
+// 受け付けない Content-Encoding
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// stat と一覧で返すファイルの情報
+type agentEntry struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+	Dir   bool      `json:"dir,omitempty"`
+}
+
+// エージェントのトークン。-token-file がなければ SYNCIG_TOKEN
+func agentToken(file string) (string, error) {
+	if file == "" {
+		if t := os.Getenv("SYNCIG_TOKEN"); t != "" {
+			return t, nil
+		}
+		return "", errors.New("no token: set SYNCIG_TOKEN or -token-file")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	t := strings.TrimSpace(string(b))
+	if t == "" {
+		return "", fmt.Errorf("%s: token is empty", file)
+	}
+	return t, nil
+}
+
+// syncig serve
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":"+agentDefaultPort, "待ち受けるアドレス")
+	root := fs.String("root", "", "受け取ったファイルを置くディレクトリ（必須）")
+	cert := fs.String("cert", "", "TLS の証明書ファイル（必須）")
+	key := fs.String("key", "", "TLS の秘密鍵ファイル（必須）")
+	tokenFile := fs.String("token-file", "", "認証に使うトークンのファイル（未指定の場合は SYNCIG_TOKEN）")
+	fs.Parse(args)
+	if *root == "" || *cert == "" || *key == "" {
+		return errors.New("-root, -cert and -key are required")
+	}
+	token, err := agentToken(*tokenFile)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(*root)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("-root %q is not a directory", *root)
+	}
+	// 要求のパスは os.Root で開き、シンボリックリンクや .. で -root の外を指す場合は失敗させる
+	rootFS, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer rootFS.Close()
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	srv := &http.Server{Handler: &agentServer{root: rootFS, token: token}, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+	fmt.Printf("Serving %s on %s\n", dir, ln.Addr())
+	if err := srv.ServeTLS(ln, *cert, *key); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// エージェントの要求を root の下のファイルの操作にする
+type agentServer struct {
+	root  *os.Root
+	token string
+}
+
+func (a *agentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 要求の本文に使える圧縮方式（RFC 7694）。送り側はこれを見てから圧縮する
+	w.Header().Set("Accept-Encoding", "gzip")
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	var (
+		op, name string
+		found    bool
+	)
+	for _, p := range []string{agentFilesPath, agentStatPath, agentListPath} {
+		if name, found = strings.CutPrefix(r.URL.Path, p); found && (name == "" || name[0] == '/') {
+			op = p
+			break
+		}
+	}
+	if op == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	// os.Root のパス。root の外を指すパスは os.Root の操作が失敗する
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	file := "."
+	if rel != "" {
+		file = filepath.FromSlash(rel)
+	}
+	var err error
+	switch {
+	case op == agentStatPath && r.Method == http.MethodGet:
+		var info fs.FileInfo
+		if info, err = a.root.Stat(file); err == nil {
+			writeAgentJSON(w, agentEntry{Name: info.Name(), Size: info.Size(), MTime: info.ModTime(), Dir: info.IsDir()})
+		}
+	case op == agentListPath && r.Method == http.MethodGet:
+		var entries []os.DirEntry
+		if entries, err = a.readDir(file); err == nil {
+			list := make([]agentEntry, 0, len(entries))
+			for _, e := range entries {
+				if info, ierr := e.Info(); ierr == nil {
+					list = append(list, agentEntry{Name: e.Name(), Size: info.Size(), MTime: info.ModTime(), Dir: e.IsDir()})
+				}
+			}
+			writeAgentJSON(w, list)
+		}
+	case op == agentFilesPath && r.Method == http.MethodGet:
+		var f *os.File
+		if f, err = a.root.Open(file); err == nil {
+			defer f.Close()
+			var info fs.FileInfo
+			if info, err = f.Stat(); err == nil && info.IsDir() {
+				err = fs.ErrNotExist
+			}
+			if err == nil {
+				http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+			}
+		}
+	case op == agentFilesPath && r.Method == http.MethodPut && rel != "":
+		if err = a.store(file, r); err == nil {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Printf("Received: %s\n", filepath.Join(a.root.Name(), file))
+		}
+	case op == agentFilesPath && r.Method == http.MethodDelete && rel != "":
+		if err = a.root.Remove(file); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrExist):
+		http.Error(w, "already exists", http.StatusPreconditionFailed)
+	case err == errUnsupportedEncoding:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		fmt.Fprintf(os.Stderr, "serve: %s %s: %v\n", r.Method, filepath.Join(a.root.Name(), file), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// root の下のディレクトリの一覧を名前順に返す
+func (a *agentServer) readDir(dir string) ([]os.DirEntry, error) {
+	d, err := a.root.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	entries, err := d.ReadDir(-1)
+	slices.SortFunc(entries, func(x, y os.DirEntry) int { return strings.Compare(x.Name(), y.Name()) })
+	return entries, err
+}
+
+// 受け取った内容を同じディレクトリの一時ファイルに書き込んで fsync し、元の名前に置き換える。
+// 同じファイルへの要求が重なっても書き込みが混ざらないよう、一時ファイルは要求ごとに作る。
+// If-None-Match: * の場合は既にあれば fs.ErrExist を返す（リモートのロックに使う）
+func (a *agentServer) store(file string, r *http.Request) error {
+	body := io.Reader(r.Body)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		body = zr
+	default:
+		return errUnsupportedEncoding
+	}
+	dir := filepath.Dir(file)
+	if err := a.root.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		f, err := a.root.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			a.root.Remove(file)
+		}
+		return err
+	}
+	f, tmp, err := a.createTemp(file)
+	if err != nil {
+		return err
+	}
+	// 送り側が途中で切断した場合は本文の読み込みが失敗するため、置き換えない
+	_, err = io.Copy(f, body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = a.root.Rename(tmp, file)
+	}
+	if err != nil {
+		a.root.Remove(tmp)
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := a.root.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// file と同じディレクトリに <名前>.<乱数>.partial を作る。os.Root には os.CreateTemp がないため、
+// 同じく既にない名前が見つかるまで O_EXCL で作り直す
+func (a *agentServer) createTemp(file string) (*os.File, string, error) {
+	for range 10000 {
+		tmp := file + "." + strconv.FormatUint(uint64(rand.Uint32()), 10) + partialExt
+		f, err := a.root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, tmp, err
+		}
+	}
+	return nil, "", &fs.PathError{Op: "createtemp", Path: file + ".*" + partialExt, Err: fs.ErrExist}
+}
+
+func writeAgentJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// syncig://host:port/path の同期先。リモートでのパスは syncig serve の -root からのパス
+type agentStore struct {
+	client *http.Client
+	// https://host:port
+	base  string
+	token string
+	// COMPRESSION_LEVEL（0 は圧縮しない）と、エージェントが gzip の本文を受け付けると応答したか
+	level   int
+	gzip    atomic.Bool
+	checked atomic.Bool
+}
+
+func openAgentStore(u *url.URL, job Job) (*agentStore, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: host is empty", u.Redacted())
+	}
+	token, err := credential(job, "SYNCIG_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("%s: no token: set SYNCIG_TOKEN", u.Redacted())
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), agentDefaultPort)
+	}
+	client, err := newHTTPClient(job)
+	if err != nil {
+		return nil, err
+	}
+	return &agentStore{client: client, base: "https://" + host, token: token, level: job.COMPRESSION_LEVEL}, nil
+}
+
+func (s *agentStore) url(prefix, name string) string {
+	return s.base + prefix + (&url.URL{Path: path.Clean("/" + name)}).EscapedPath()
+}
+
+// 失敗した応答をエラーに変換して本文を閉じる
+func (s *agentStore) responseError(op, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	msg := resp.Status
+	if m := strings.TrimSpace(string(b)); m != "" {
+		msg += ": " + m
+	}
+	return &fs.PathError{Op: op, Path: s.base + path.Clean("/"+name), Err: &httpStatusError{code: resp.StatusCode, msg: msg}}
+}
+
+func (s *agentStore) do(ctx context.Context, method, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestBody(req, body)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	resp, err := s.client.Do(req)
+	s.negotiate(resp)
+	return resp, err
+}
+
+// 応答の Accept-Encoding から、本文を圧縮して送れるかを記録する
+func (s *agentStore) negotiate(resp *http.Response) {
+	if resp != nil {
+		s.checked.Store(true)
+		if strings.Contains(resp.Header.Get("Accept-Encoding"), "gzip") {
+			s.gzip.Store(true)
+		}
+	}
+}
+
+// エージェントが gzip の本文を受け付けるか。まだ応答を受け取っていなければルートを stat して確かめる
+func (s *agentStore) acceptsGzip(ctx context.Context) bool {
+	if !s.checked.Load() {
+		if resp, err := s.do(ctx, http.MethodGet, s.url(agentStatPath, "/"), nil, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+	return s.gzip.Load()
+}
+
+// 要求を送り、want のステータスが返るまで一時的なエラーを送り直す。返した応答の本文は呼び出し側で閉じる
+func (s *agentStore) send(ctx context.Context, op, name, method, rawURL string, header http.Header, body []byte, want int) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.do(ctx, method, rawURL, header, body)
+		if err == nil {
+			if resp.StatusCode == want {
+				return resp, nil
+			}
+			err = s.responseError(op, name, resp)
+		}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return nil, err
+		}
+	}
+}
+
+// 一時ファイルへの書き込みと置き換えはエージェントが行う。COMPRESSION_LEVEL が指定されていて、
+// エージェントが受け付ける場合は gzip で圧縮して送る
+func (s *agentStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	first, err := readPart(r, size, agentBufferSize)
+	if err != nil {
+		return err
+	}
+	compress := s.level > 0 && s.acceptsGzip(ctx)
+	var header http.Header
+	if compress {
+		header = http.Header{"Content-Encoding": {"gzip"}}
+	}
+	if len(first) <= agentBufferSize {
+		if compress {
+			var buf bytes.Buffer
+			zw, _ := gzip.NewWriterLevel(&buf, s.level)
+			zw.Write(first)
+			zw.Close()
+			first = buf.Bytes()
+		}
+		resp, err := s.send(ctx, "put", name, http.MethodPut, s.url(agentFilesPath, name), header, first, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	src := activityReader{io.MultiReader(bytes.NewReader(first), r)}
+	body := io.Reader(src)
+	if compress {
+		pr, pw := io.Pipe()
+		go func() {
+			zw, _ := gzip.NewWriterLevel(pw, s.level)
+			_, err := io.Copy(zw, src)
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		body = pr
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url(agentFilesPath, name), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = -1
+	if size >= int64(len(first)) && !compress {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	resp, err := s.client.Do(req)
+	s.negotiate(resp)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return s.responseError("put", name, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *agentStore) Create(ctx context.Context, name string, data []byte) error {
+	resp, err := s.send(ctx, "create", name, http.MethodPut, s.url(agentFilesPath, name), http.Header{"If-None-Match": {"*"}}, data, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *agentStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.send(ctx, "open", name, http.MethodGet, s.url(agentFilesPath, name), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *agentStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	resp, err := s.send(ctx, "stat", name, http.MethodGet, s.url(agentStatPath, name), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var e agentEntry
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, fmt.Errorf("syncig stat %s: %w", name, err)
+	}
+	return &remoteFileInfo{name: e.Name, size: e.Size, mtime: e.MTime, dir: e.Dir}, nil
+}
+
+func (s *agentStore) Remove(ctx context.Context, name string) error {
+	resp, err := s.send(ctx, "remove", name, http.MethodDelete, s.url(agentFilesPath, name), nil, nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *agentStore) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	resp, err := s.send(ctx, "readdir", dir, http.MethodGet, s.url(agentListPath, dir), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list []agentEntry
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("syncig readdir %s: %w", dir, err)
+	}
+	infos := make([]fs.FileInfo, len(list))
+	for i, e := range list {
+		infos[i] = &remoteFileInfo{name: e.Name, size: e.Size, mtime: e.MTime, dir: e.Dir}
+	}
+	return infos, nil
+}
+
+func (s *agentStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,66 @@
+package syncig
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// コピー中の同期先ファイルに付ける拡張子。コピーが終わると元の名前に置き換える
+const partialExt = ".partial"
+
+// 同じディレクトリの一時ファイルに書き込んで fsync し、rename で置き換える。
+// 途中でクラッシュしても元のファイルか新しいファイルのどちらかが残る
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil && runtime.GOOS != "windows" {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return fsyncDir(dir)
+}
+
+// rename の結果を永続化するためディレクトリを fsync する。Windows では対応していないため何もしない
+func fsyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// 書き込み済みのファイルの内容をディスクに書き出す
+func fsyncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
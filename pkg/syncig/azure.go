@@ -0,0 +1,390 @@
+package syncig
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Azure Blob Storage にブロック BLOB として書き込む。認証は SAS トークンかマネージド ID
+
+// 1 ブロックの大きさ。これ以下のファイルは 1 回の要求でアップロードする。
+// 1 BLOB は 50000 ブロックまでのため、800GB 程度まで書き込める
+const azureBlockSize = 16 << 20
+
+// 要求に付ける REST API のバージョン。マネージド ID のトークンには 2017-11-09 以降が必要
+const azureAPIVersion = "2021-08-06"
+
+// マネージド ID のトークンを要求するリソース
+const azureStorageResource = "https://storage.azure.com/"
+
+// azblob://container/prefix の同期先
+type azureStore struct {
+	client    *http.Client
+	base      string
+	container string
+	// SAS トークン（先頭の ? を除いたクエリ文字列）。空の場合はマネージド ID のトークンを使う
+	sas    string
+	tokens *tokenSource
+}
+
+func openAzureStore(u *url.URL, job Job) (*azureStore, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: container is empty", u.Redacted())
+	}
+	client, err := newHTTPClient(job)
+	if err != nil {
+		return nil, err
+	}
+	s := &azureStore{client: client, container: u.Host, base: strings.TrimRight(job.AZURE_ENDPOINT, "/")}
+	if s.base == "" {
+		account := job.AZURE_ACCOUNT
+		if account == "" {
+			account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+		}
+		if account == "" {
+			return nil, fmt.Errorf("%s: set AZURE_ACCOUNT or AZURE_STORAGE_ACCOUNT", u.Redacted())
+		}
+		s.base = "https://" + account + ".blob.core.windows.net"
+	}
+	sas, err := credential(job, "AZURE_STORAGE_SAS_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	s.sas = strings.TrimPrefix(sas, "?")
+	if s.sas == "" {
+		s.tokens = azureManagedIdentity(s.client)
+	}
+	return s, nil
+}
+
+// マネージド ID のトークン。App Service・Functions は IDENTITY_ENDPOINT、VM などは IMDS から取得する。
+// ユーザー割り当てのマネージド ID は AZURE_CLIENT_ID でクライアント ID を指定する
+func azureManagedIdentity(client *http.Client) *tokenSource {
+	return &tokenSource{label: "azure", fetch: func(ctx context.Context) (string, int, error) {
+		q := url.Values{"resource": {azureStorageResource}}
+		if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+			q.Set("client_id", id)
+		}
+		endpoint, header := "http://169.254.169.254/metadata/identity/oauth2/token", http.Header{"Metadata": {"true"}}
+		q.Set("api-version", "2018-02-01")
+		if e := os.Getenv("IDENTITY_ENDPOINT"); e != "" {
+			endpoint, header = e, http.Header{"X-Identity-Header": {os.Getenv("IDENTITY_HEADER")}}
+			q.Set("api-version", "2019-08-01")
+		}
+		// Azure の外では IMDS のアドレスに接続できず待たされるため、早めに諦める
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+q.Encode(), nil)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header = header
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", 0, fmt.Errorf("no managed identity (%v); set AZURE_STORAGE_SAS_TOKEN", err)
+		}
+		return decodeTokenResponse(resp)
+	}}
+}
+
+// リモートでのパスを BLOB 名にする。BLOB 名は / で始めない
+func (s *azureStore) blob(name string) string {
+	name = path.Clean(name)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+// BLOB の URL。query は SAS トークンの前に付ける
+func (s *azureStore) blobURL(blob string, query url.Values) string {
+	segs := strings.Split(blob, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	u := s.base + "/" + url.PathEscape(s.container)
+	if blob != "" {
+		u += "/" + strings.Join(segs, "/")
+	}
+	q := query.Encode()
+	if s.sas != "" {
+		if q != "" {
+			q += "&"
+		}
+		q += s.sas
+	}
+	if q != "" {
+		u += "?" + q
+	}
+	return u
+}
+
+// 失敗した応答をエラーに変換して本文を閉じる。HEAD の応答には本文がないため x-ms-error-code を使う
+func (s *azureStore) responseError(op, blob string, resp *http.Response) error {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.Unmarshal(b, &e)
+	if e.Code == "" {
+		e.Code = resp.Header.Get("x-ms-error-code")
+	}
+	msg := resp.Status
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	// メッセージの 2 行目以降は RequestId と時刻
+	if m, _, _ := strings.Cut(strings.TrimSpace(e.Message), "\n"); m != "" {
+		msg += ": " + m
+	}
+	return &fs.PathError{Op: op, Path: "azblob://" + s.container + "/" + blob, Err: &httpStatusError{code: resp.StatusCode, msg: msg}}
+}
+
+func (s *azureStore) do(ctx context.Context, method, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestBody(req, body)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	if s.tokens != nil {
+		token, err := s.tokens.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return s.client.Do(req)
+}
+
+// 要求を送り、want のステータスが返るまで一時的なエラーを送り直す
+func (s *azureStore) send(ctx context.Context, op, blob, method, rawURL string, header http.Header, body []byte, want int) error {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.do(ctx, method, rawURL, header, body)
+		if err == nil {
+			if resp.StatusCode == want {
+				resp.Body.Close()
+				return nil
+			}
+			err = s.responseError(op, blob, resp)
+		}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return err
+		}
+	}
+}
+
+// データの MD5 を Content-MD5 ヘッダーの形式で返す
+func contentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// azureBlockSize 以下のファイルは Put Blob で、それより大きいファイルはブロックに分けて送る。
+// 各要求に Content-MD5 を付けてサーバーに確認させ、BLOB 全体の MD5 も記録する
+func (s *azureStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	blob := s.blob(name)
+	first, err := readPart(r, size, azureBlockSize)
+	if err != nil {
+		return err
+	}
+	if len(first) <= azureBlockSize {
+		return s.send(ctx, "put", blob, http.MethodPut, s.blobURL(blob, nil), http.Header{
+			"x-ms-blob-type": {"BlockBlob"},
+			"Content-Type":   {"application/octet-stream"},
+			"Content-MD5":    {contentMD5(first)},
+		}, first, http.StatusCreated)
+	}
+	return s.putBlocks(ctx, blob, first[:azureBlockSize], io.MultiReader(bytes.NewReader(first[azureBlockSize:]), r))
+}
+
+// ブロックを送ってからブロックの一覧をコミットする。BLOB はコミットするまで置き換わらず、
+// 失敗した場合や中断した場合のコミットしていないブロックはサーバーが 1 週間後に破棄する
+func (s *azureStore) putBlocks(ctx context.Context, blob string, first []byte, rest io.Reader) error {
+	whole := md5.New()
+	var ids []string
+	buf := first
+	for len(buf) > 0 {
+		// ブロック ID は 1 つの BLOB の中で同じ長さにする
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(ids))))
+		q := url.Values{"comp": {"block"}, "blockid": {id}}
+		if err := s.send(ctx, "put", blob, http.MethodPut, s.blobURL(blob, q), http.Header{"Content-MD5": {contentMD5(buf)}}, buf, http.StatusCreated); err != nil {
+			return err
+		}
+		whole.Write(buf)
+		ids = append(ids, id)
+		if len(ids) == 1 {
+			buf = make([]byte, azureBlockSize)
+		}
+		n, err := io.ReadFull(rest, buf[:azureBlockSize])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		buf = buf[:n]
+	}
+	var list bytes.Buffer
+	list.WriteString(xml.Header + "<BlockList>")
+	for _, id := range ids {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+	return s.send(ctx, "put", blob, http.MethodPut, s.blobURL(blob, url.Values{"comp": {"blocklist"}}), http.Header{
+		"Content-Type":           {"application/xml"},
+		"Content-MD5":            {contentMD5(list.Bytes())},
+		"x-ms-blob-content-type": {"application/octet-stream"},
+		"x-ms-blob-content-md5":  {base64.StdEncoding.EncodeToString(whole.Sum(nil))},
+	}, list.Bytes(), http.StatusCreated)
+}
+
+// If-None-Match: * の条件で作る。既にある場合は 409 BlobAlreadyExists が返る
+func (s *azureStore) Create(ctx context.Context, name string, data []byte) error {
+	blob := s.blob(name)
+	err := s.send(ctx, "create", blob, http.MethodPut, s.blobURL(blob, nil), http.Header{
+		"x-ms-blob-type": {"BlockBlob"},
+		"Content-Type":   {"application/octet-stream"},
+		"Content-MD5":    {contentMD5(data)},
+		"If-None-Match":  {"*"},
+	}, data, http.StatusCreated)
+	var se *httpStatusError
+	if errors.As(err, &se) && se.code == http.StatusConflict {
+		return &fs.PathError{Op: "create", Path: "azblob://" + s.container + "/" + blob, Err: fs.ErrExist}
+	}
+	return err
+}
+
+// BLOB の内容。MD5 が記録されていれば、読み終えた時点で一致しない場合にエラーを返す
+func (s *azureStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	blob := s.blob(name)
+	resp, err := s.do(ctx, http.MethodGet, s.blobURL(blob, nil), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("open", blob, resp)
+	}
+	want, err := base64.StdEncoding.DecodeString(resp.Header.Get("Content-MD5"))
+	if err != nil || len(want) != md5.Size {
+		return resp.Body, nil
+	}
+	return &md5CheckReader{ReadCloser: resp.Body, h: md5.New(), want: want, name: "azblob://" + s.container + "/" + blob}, nil
+}
+
+// 読み込んだ内容の MD5 を記録された値と比べる
+type md5CheckReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	want []byte
+	name string
+}
+
+func (r *md5CheckReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.h.Sum(nil), r.want) {
+		return n, fmt.Errorf("%s: content does not match Content-MD5", r.name)
+	}
+	return n, err
+}
+
+func (s *azureStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	blob := s.blob(name)
+	resp, err := s.do(ctx, http.MethodHead, s.blobURL(blob, nil), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("stat", blob, resp)
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &remoteFileInfo{name: path.Base(blob), size: resp.ContentLength, mtime: mtime}, nil
+}
+
+func (s *azureStore) Remove(ctx context.Context, name string) error {
+	blob := s.blob(name)
+	resp, err := s.do(ctx, http.MethodDelete, s.blobURL(blob, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return s.responseError("remove", blob, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// 区切り文字を / として、dir の直下の BLOB と接頭辞（ディレクトリ）を一覧にする
+func (s *azureStore) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	prefix := s.blob(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var infos []fs.FileInfo
+	marker := ""
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := s.do(ctx, http.MethodGet, s.blobURL("", q), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s.responseError("readdir", prefix, resp)
+		}
+		var result struct {
+			Blobs []struct {
+				Name       string `xml:"Name"`
+				Properties struct {
+					LastModified  string `xml:"Last-Modified"`
+					ContentLength int64  `xml:"Content-Length"`
+				} `xml:"Properties"`
+			} `xml:"Blobs>Blob"`
+			Prefixes []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>BlobPrefix"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("azblob list %s: %w", prefix, err)
+		}
+		for _, b := range result.Blobs {
+			mtime, _ := http.ParseTime(b.Properties.LastModified)
+			infos = append(infos, &remoteFileInfo{name: strings.TrimPrefix(b.Name, prefix), size: b.Properties.ContentLength, mtime: mtime})
+		}
+		for _, p := range result.Prefixes {
+			infos = append(infos, &remoteFileInfo{name: strings.TrimSuffix(strings.TrimPrefix(p.Name, prefix), "/"), dir: true})
+		}
+		if result.NextMarker == "" {
+			return infos, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (s *azureStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,24 @@
+package syncig
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// BACKUP_DIR が指定されている場合、上書きする前の同期先のファイルを
+// 実行ごとのディレクトリの下に同期先と同じ相対パスで移す
+func (s *syncer) backupReplaced(distFile string) error {
+	if s.backupDir == "" {
+		return nil
+	}
+	if _, err := os.Lstat(distFile); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(s.distRoot, distFile)
+	if err != nil {
+		return err
+	}
+	return s.moveFile(distFile, s.keepPath(rel))
+}
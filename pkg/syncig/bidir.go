@@ -0,0 +1,245 @@
+package syncig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 双方向同期で、前回の同期以降に両側で変更されたファイルの扱い（CONFLICT_RESOLUTION）
+const (
+	// 更新日時の新しい方で他方を置き換える（既定）
+	resolveNewerWins = "newer-wins"
+	// 両側とも置き換えず、他方の内容を <名前>.conflict-src / .conflict-dist として置く
+	resolveRenameBoth = "rename-both"
+	// 両側とも置き換えず、STATE_DIR の syncig_conflicts.txt に書き出して手動での解決を待つ
+	resolveManual = "manual"
+)
+
+// 手動で解決する衝突の一覧
+const conflictsFileName = "syncig_conflicts.txt"
+
+// 双方向同期の各方向の同期状態を置く STATE_DIR の下のディレクトリ
+const (
+	forwardStateDir = "forward"
+	reverseStateDir = "reverse"
+)
+
+// 両方向の処理で見つかった衝突（SRC_DIR からの相対パス）
+type conflictList struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+func (c *conflictList) add(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paths[path] {
+		return false
+	}
+	c.paths[path] = true
+	return true
+}
+
+// SRC_DIR → DIST_DIR と DIST_DIR → SRC_DIR の 2 つのジョブ。
+// 同期状態はそれぞれ STATE_DIR の forward / reverse に置く
+func (j Job) directions() (forward, reverse Job) {
+	forward, reverse = j, j
+	forward.stateSub = forwardStateDir
+	reverse.SRC_DIR, reverse.DIST_DIR = j.DIST_DIR, j.SRC_DIR
+	reverse.stateSub = reverseStateDir
+	return forward, reverse
+}
+
+// 双方向同期。SRC_DIR → DIST_DIR の後に DIST_DIR → SRC_DIR を同期する。
+// 各方向はコピーしたファイルを他方の同期状態にも記録し、コピーし返さないようにする
+func runBidirectional(ctx context.Context, job Job, opts RunOptions) error {
+	forward, reverse := job.directions()
+	// 初回は DIST_DIR がまだない。-dry-run では作成せずに SRC_DIR → DIST_DIR のみ表示する
+	if _, err := os.Stat(job.DIST_DIR); os.IsNotExist(err) && opts.DryRun {
+		s, err := newSyncer(ctx, forward, opts)
+		if err != nil {
+			return err
+		}
+		defer s.close()
+		return s.run()
+	}
+	if err := ensureDir(job.DIST_DIR); err != nil {
+		return err
+	}
+	fwd, err := newSyncer(ctx, forward, opts)
+	if err != nil {
+		return err
+	}
+	defer fwd.close()
+	rev, err := newSyncer(ctx, reverse, opts)
+	if err != nil {
+		return err
+	}
+	defer rev.close()
+	conflicts := &conflictList{paths: map[string]bool{}}
+	fwd.peer, fwd.conflicts, fwd.conflictSide = rev.state, conflicts, "src"
+	rev.peer, rev.conflicts, rev.conflictSide = fwd.state, conflicts, "dist"
+	if err := fwd.run(); err != nil {
+		return err
+	}
+	if err := rev.run(); err != nil {
+		return err
+	}
+	if opts.DryRun {
+		return nil
+	}
+	return fwd.writeConflicts(job.STATE_DIR, conflicts)
+}
+
+// 手動で解決する衝突の一覧を書き出す。衝突がなければ一覧を削除する
+func (s *syncer) writeConflicts(dir string, c *conflictList) error {
+	path := filepath.Join(dir, conflictsFileName)
+	if len(c.paths) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	paths := make([]string, 0, len(c.paths))
+	for p := range c.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	s.printf("%d conflicts need manual resolution; see %s\n", len(paths), path)
+	return writeFileAtomic(path, []byte(strings.Join(paths, "\n")+"\n"), 0644)
+}
+
+// コピー予定のファイルのうち、前回の同期以降に同期先でも変更されたものを衝突として
+// CONFLICT_RESOLUTION に従って扱う。両側が同じ内容の場合は同期済みとして両方に記録する
+func (s *syncer) resolveConflicts(path, rel string, sc *dirScan) error {
+	peer, err := s.peer.load(rel)
+	if err != nil {
+		return err
+	}
+	distDir := filepath.Join(s.distRoot, rel)
+	peerDirty := false
+	var toCopy []string
+	for _, f := range sc.toCopy {
+		distFile := filepath.Join(distDir, f)
+		dst, err := os.Stat(distFile)
+		if os.IsNotExist(err) {
+			toCopy = append(toCopy, f)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// 前回の同期以降に同期先が変わっていなければ衝突ではない
+		if prec, ok := peer.Files[f]; ok && prec.Size == dst.Size() && prec.ModTime.Equal(dst.ModTime()) {
+			toCopy = append(toCopy, f)
+			continue
+		}
+		info := sc.infos[f]
+		if info.Size() == dst.Size() {
+			a, err := s.hashFile(filepath.Join(path, f))
+			if err != nil {
+				return err
+			}
+			b, err := s.hashFile(distFile)
+			if err != nil {
+				return err
+			}
+			if a == b {
+				sc.state.record(f, info, a, s.hashAlgo, s.less)
+				peer.record(f, dst, b, s.hashAlgo, s.less)
+				sc.dirty, peerDirty = true, true
+				continue
+			}
+		}
+		switch s.conflictResolution {
+		case resolveRenameBoth:
+			sc.conflicted = append(sc.conflicted, f)
+		case resolveManual:
+			relFile := filepath.ToSlash(filepath.Join(rel, f))
+			if s.conflicts.add(relFile) {
+				s.observer.OnFileDone(FileEvent{Src: filepath.Join(path, f), Dist: distFile, Action: FileConflict})
+			}
+		default:
+			// 更新日時が同じ場合は SRC_DIR 側を優先する。負けた側は他方向の処理でコピーされる
+			if info.ModTime().After(dst.ModTime()) || (info.ModTime().Equal(dst.ModTime()) && s.conflictSide == "src") {
+				toCopy = append(toCopy, f)
+			}
+		}
+	}
+	sc.toCopy = toCopy
+	if peerDirty && !s.opts.DryRun {
+		return s.peer.save(rel, peer)
+	}
+	return nil
+}
+
+// rename-both: 両側の内容を他方に <名前>.conflict-<側>-<実行日時> としてコピーし、
+// 元のファイルは両側とも現在の内容を同期済みとして記録する。以降の変更は通常どおり他方に反映する。
+// peer には同期先に書き込んだファイルを加え、後で他方の同期状態に記録する
+func (s *syncer) copyConflicts(path, rel string, state *manifest, names []string, peer map[string]string) error {
+	distDir := filepath.Join(s.distRoot, rel)
+	other := map[string]string{"src": "dist", "dist": "src"}[s.conflictSide]
+	for _, f := range names {
+		srcFile, distFile := filepath.Join(path, f), filepath.Join(distDir, f)
+		toDist := f + ".conflict-" + s.conflictSide + "-" + s.runStamp
+		toSrc := f + ".conflict-" + other + "-" + s.runStamp
+		sum, err := s.copyPlain(srcFile, filepath.Join(distDir, toDist))
+		if err != nil {
+			return err
+		}
+		peer[toDist] = sum
+		if sum, err = s.copyPlain(distFile, filepath.Join(path, toSrc)); err != nil {
+			return err
+		}
+		// 同期元に置いたコピーは他方にコピーし返さない
+		for name, sum := range map[string]string{toSrc: sum, f: ""} {
+			info, err := os.Stat(filepath.Join(path, name))
+			if err != nil {
+				return err
+			}
+			state.record(name, info, sum, s.hashAlgo, s.less)
+		}
+		peer[f] = ""
+		s.observer.OnFileDone(FileEvent{Src: srcFile, Dist: distFile, Action: FileConflict, Reason: "kept both as " + toDist + " and " + toSrc})
+	}
+	return nil
+}
+
+// 一時ファイルにコピーしてから置き換え、ハッシュ値を返す
+func (s *syncer) copyPlain(src, dst string) (string, error) {
+	buf := s.buffers.get()
+	defer s.buffers.put(buf)
+	sum, err := copyFile(s.ctx, src, dst+partialExt, s.hashAlgo, *buf, s.wrapReader)
+	if err == nil {
+		err = os.Rename(dst+partialExt, dst)
+	}
+	if err != nil {
+		os.Remove(dst + partialExt)
+	}
+	return sum, err
+}
+
+// 同期先に書き込んだファイルを、他方向の同期元のファイルとして他方の同期状態に記録する。
+// names は名前とハッシュ値（不明な場合は空）
+func (s *syncer) updatePeer(rel string, names map[string]string) error {
+	if s.peer == nil || len(names) == 0 {
+		return nil
+	}
+	peer, err := s.peer.load(rel)
+	if err != nil {
+		return err
+	}
+	distDir := filepath.Join(s.distRoot, rel)
+	for name, sum := range names {
+		info, err := os.Stat(filepath.Join(distDir, name))
+		if err != nil {
+			return err
+		}
+		peer.record(name, info, sum, s.hashAlgo, s.less)
+	}
+	return s.peer.save(rel, peer)
+}
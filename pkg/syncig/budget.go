@@ -0,0 +1,69 @@
+package syncig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// MAX_RUN_DURATION・MAX_FILES_PER_RUN・MAX_BYTES_PER_RUN に達して途中で止めた。
+// 失敗としては扱わず、残りは次回の同期でコピーする
+var errRunBudget = errors.New("run budget reached")
+
+// 1 回の実行でコピーしたファイル数とバイト数
+type runBudget struct {
+	mu       sync.Mutex
+	maxFiles int
+	maxBytes int64
+	files    int
+	bytes    int64
+}
+
+// MAX_RUN_DURATION が指定されている場合は、その時間で終了する context を返す
+func jobContext(ctx context.Context, job Job) (context.Context, context.CancelFunc) {
+	if job.MAX_RUN_DURATION <= 0 {
+		return ctx, func() {}
+	}
+	d := time.Duration(job.MAX_RUN_DURATION)
+	return context.WithTimeoutCause(ctx, d, fmt.Errorf("MAX_RUN_DURATION (%s): %w", d, errRunBudget))
+}
+
+// size バイトのファイルをコピーできるか確認して予約する。上限を超える場合は errRunBudget を返す。
+// MAX_BYTES_PER_RUN より大きいファイルもコピーできるよう、最初の 1 ファイルは常にコピーする
+func (b *runBudget) reserve(info fs.FileInfo) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxFiles > 0 && b.files >= b.maxFiles {
+		return fmt.Errorf("MAX_FILES_PER_RUN (%d): %w", b.maxFiles, errRunBudget)
+	}
+	if b.maxBytes > 0 && b.files > 0 && b.bytes+info.Size() > b.maxBytes {
+		return fmt.Errorf("MAX_BYTES_PER_RUN (%s): %w", ByteSize(b.maxBytes), errRunBudget)
+	}
+	b.files++
+	b.bytes += info.Size()
+	return nil
+}
+
+func newRunBudget(job Job) *runBudget {
+	if job.MAX_FILES_PER_RUN <= 0 && job.MAX_BYTES_PER_RUN <= 0 {
+		return nil
+	}
+	return &runBudget{maxFiles: job.MAX_FILES_PER_RUN, maxBytes: int64(job.MAX_BYTES_PER_RUN)}
+}
+
+// 上限に達して止めた場合は表示して成功として扱う（Observer を指定した場合は表示しない）
+func budgetResult(err error, opts RunOptions) error {
+	if errors.Is(err, errRunBudget) {
+		if opts.observer == nil {
+			fmt.Printf("Stopped: %v; the rest will be synced next time\n", err)
+		}
+		return nil
+	}
+	return err
+}
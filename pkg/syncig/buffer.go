@@ -0,0 +1,26 @@
+package syncig
+
+import "sync"
+
+// COPY_BUFFER_SIZE を省略した場合のコピー用バッファのサイズ
+const defaultCopyBufferSize = 1 << 20
+
+// 同じサイズのコピー用バッファを使い回す
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}}}
+}
+
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
@@ -0,0 +1,60 @@
+package syncig
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 同期先に書き出すチェックサムファイルの形式（CHECKSUM_FILES）
+const (
+	// コピーしたファイルごとに <ファイル名>.<HASH_ALGO> を置く
+	checksumSidecar = "sidecar"
+	// ディレクトリごとに MANIFEST.<HASH_ALGO> を置く
+	checksumManifest = "manifest"
+)
+
+// sha256sum -c や xxhsum -c で検証できる形式の 1 行
+func checksumLine(sum, name string) string {
+	return sum + "  " + name + "\n"
+}
+
+// CHECKSUM_FILES が sidecar の場合、同期先のファイルの横にハッシュ値を書き出す
+func (s *syncer) writeSidecar(distFile, sum string) error {
+	if s.checksums != checksumSidecar || sum == "" {
+		return nil
+	}
+	return writeFileAtomic(distFile+"."+s.hashAlgo, []byte(checksumLine(sum, filepath.Base(distFile))), 0644)
+}
+
+// CHECKSUM_FILES が sidecar の場合、同期先から消えたファイルのハッシュ値を削除する
+func (s *syncer) removeSidecar(distFile string) error {
+	if s.checksums != checksumSidecar {
+		return nil
+	}
+	if err := os.Remove(distFile + "." + s.hashAlgo); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CHECKSUM_FILES が manifest の場合、同期状態に記録されているファイルの一覧を書き出す。
+// 同期元で削除されたファイル・RETENTION_DAYS で削除したファイルと、ハッシュ値が記録されていないファイルは含めない
+func (s *syncer) writeChecksumManifest(distDir string, state *manifest) error {
+	if s.checksums != checksumManifest {
+		return nil
+	}
+	names := make([]string, 0, len(state.Files))
+	for name, rec := range state.Files {
+		if rec.DeletedAt.IsZero() && rec.PrunedAt.IsZero() && rec.digest(s.hashAlgo) != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return s.less(names[i], names[j]) })
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(checksumLine(state.Files[name].SHA256, name))
+	}
+	return writeFileAtomic(filepath.Join(distDir, "MANIFEST."+s.hashAlgo), []byte(b.String()), 0644)
+}
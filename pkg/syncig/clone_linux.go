@@ -0,0 +1,34 @@
+//go:build linux
+
+package syncig
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// linux/fs.h の FICLONE
+const ioctlFICLONE = 0x40049409
+
+// 同期先を同期元のクローン（reflink）として作成する。
+// btrfs や XFS など対応していないファイルシステムでは copy_file_range（io.Copy が内部で使用）でコピーする
+func cloneFile(srcFile, distFile string) (bool, error) {
+	srcF, err := os.Open(srcFile)
+	if err != nil {
+		return false, err
+	}
+	defer srcF.Close()
+	dstF, err := os.OpenFile(distFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer dstF.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dstF.Fd(), ioctlFICLONE, srcF.Fd()); errno == 0 {
+		return true, nil
+	}
+	if _, err := io.Copy(dstF, srcF); err != nil {
+		return false, err
+	}
+	return true, dstF.Close()
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package syncig
+
+// このプラットフォームではクローンに対応していないため、通常のコピーを行う
+func cloneFile(srcFile, distFile string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package syncig
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procCopyFileExW = syscall.NewLazyDLL("kernel32.dll").NewProc("CopyFileExW")
+
+// CopyFileEx でコピーする。ReFS など対応しているボリュームではブロックの複製で済む
+func cloneFile(srcFile, distFile string) (bool, error) {
+	if procCopyFileExW.Find() != nil {
+		return false, nil
+	}
+	src, err := syscall.UTF16PtrFromString(srcFile)
+	if err != nil {
+		return false, err
+	}
+	dst, err := syscall.UTF16PtrFromString(distFile)
+	if err != nil {
+		return false, err
+	}
+	r, _, err := procCopyFileExW.Call(uintptr(unsafe.Pointer(src)), uintptr(unsafe.Pointer(dst)), 0, 0, 0, 0)
+	if r == 0 {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,271 @@
+package syncig
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// サブコマンドの定義
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"sync", "SRC_DIR から DIST_DIR へ同期する（既定）", runSync},
+		{"push", "syncig serve を起動した拠点へ同期する", runPush},
+		{"serve", "syncig push から受け取ったファイルを書き込む", runServe},
+		{"proxy-connect", "PROXY を経由して接続する（SFTP の ssh が ProxyCommand として起動する）", runProxyConnect},
+		{"plan", "コピーせずに同期内容のみ表示する", runPlan},
+		{"watch", "SRC_DIR の変更を監視して同期する", runWatch},
+		{"status", "サブディレクトリごとの同期状態を表示する", runStatus},
+		{"verify", "同期先のファイルを記録したハッシュ値と照合する", runVerify},
+		{"prune", "RETENTION_DAYS・MAX_DIST_SIZE に従って同期先から古いファイルを削除する", runPrune},
+		{"init", "対話形式で設定ファイルを作成する", runInit},
+		{"state", "同期状態を操作する（state reset）", runState},
+		{"help", "コマンド一覧を表示する", runHelp},
+	}
+}
+
+// syncig コマンドを実行し、終了コードを返す。args はコマンド名を除いた引数（os.Args[1:]）
+func Main(args []string) int {
+	name := "sync"
+	// サブコマンドを省略した場合は sync として扱う（従来の呼び出し方との互換）
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		printUsage()
+		return 2
+	}
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s error: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: syncig [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'syncig <command> -h' for command flags.")
+}
+
+func runHelp(args []string) error {
+	printUsage()
+	return nil
+}
+
+// フラグと位置引数が混在していても解析できるよう、位置引数を取り除きながら解析する
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...)
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// 設定ファイルの読み込みとジョブの選択に関する共通フラグ
+type jobFlags struct {
+	config    string
+	configSet bool
+	src       string
+	dist      string
+	job       string
+	// 署名が一致しない同期状態も読み込む
+	force bool
+}
+
+func (f *jobFlags) register(fs *flag.FlagSet) {
+	defaultConfig := "config.json"
+	if env := os.Getenv(envPrefix + "CONFIG"); env != "" {
+		defaultConfig = env
+		f.configSet = true
+	}
+	fs.StringVar(&f.config, "config", defaultConfig, "設定ファイルのパス")
+	fs.StringVar(&f.src, "src", "", "SRC_DIR を上書き")
+	fs.StringVar(&f.dist, "dist", "", "DIST_DIR を上書き")
+	fs.StringVar(&f.job, "job", "", "指定した NAME のジョブのみ実行")
+	fs.BoolVar(&f.force, "force", false, "STATE_KEY_FILE の署名が一致しない同期状態も読み込む")
+}
+
+// 設定ファイル・環境変数・フラグを反映した実行対象のジョブを返す
+func (f *jobFlags) jobs(fs *flag.FlagSet) ([]Job, error) {
+	fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == "config" {
+			f.configSet = true
+		}
+	})
+
+	cfg, err := LoadConfig(f.config)
+	// 設定ファイルを明示していない場合は、ファイルがなくても環境変数とフラグだけで実行できる
+	if os.IsNotExist(err) && !f.configSet {
+		cfg = &Config{}
+		err = prepareConfig(cfg, "")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loadConfig: %w", err)
+	}
+	var jobs []Job
+	for _, job := range cfg.Jobs() {
+		if f.job == "" || job.NAME == f.job {
+			jobs = append(jobs, job)
+		}
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("job not found: %s", f.job)
+	}
+	if (f.src != "" || f.dist != "") && len(jobs) > 1 {
+		return nil, errors.New("-src/-dist cannot be used with multiple jobs; select one with -job")
+	}
+	if f.src != "" {
+		jobs[0].SRC_DIR = f.src
+	}
+	if f.dist != "" {
+		// -dist は DIST_DIRS の同期先をすべて置き換える
+		jobs[0].DIST_DIR, jobs[0].DIST_DIRS = f.dist, nil
+	}
+	if jobs, err = expandDestinations(jobs); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	for _, job := range jobs {
+		if err := validateJob(job); err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+	}
+	return jobs, nil
+}
+
+// syncig sync
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	var jf jobFlags
+	jf.register(fs)
+	dryRun := fs.Bool("dry-run", false, "コピーせずに同期内容のみ表示")
+	fullScan := fs.Bool("full-scan", false, "同期先にない・内容が異なるファイルをすべてコピー")
+	showProgress := fs.Bool("progress", false, "コピーの進捗を定期的に表示")
+	deleteDryRun := fs.Bool("delete-dry-run", false, "コピーは行い、同期先からの削除は予定の表示のみにする")
+	pprofAddr := fs.String("pprof", "", "実行中に net/http/pprof とカウンタを公開するアドレス（例: :6060）")
+	daemon := fs.Bool("daemon", false, "終了せずに -interval ごとに同期を繰り返す")
+	interval := fs.Duration("interval", defaultDaemonInterval, "-daemon で前回の終了から次の同期までの間隔")
+	fs.Parse(args)
+	if *pprofAddr != "" {
+		if err := startDebugServer(*pprofAddr); err != nil {
+			return err
+		}
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	opts := RunOptions{DryRun: *dryRun, FullScan: *fullScan, Progress: *showProgress, DeleteDryRun: *deleteDryRun}
+	if *daemon {
+		// 設定ファイルは実行のたびに読み込み直す
+		opts.ForceState = jf.force
+		return runDaemon(ctx, *interval, func() ([]Job, error) { return jf.jobs(fs) }, opts, reloadSignals(jf.config))
+	}
+	return syncJobs(ctx, fs, &jf, opts)
+}
+
+// syncig push [SRC_DIR DIST_DIR]。DIST_DIR が syncig:// の sync で、位置引数で同期元と同期先を指定できる
+func runPush(args []string) error {
+	fs := flag.NewFlagSet("push", flag.ExitOnError)
+	var jf jobFlags
+	jf.register(fs)
+	dryRun := fs.Bool("dry-run", false, "コピーせずに同期内容のみ表示")
+	showProgress := fs.Bool("progress", false, "コピーの進捗を定期的に表示")
+	switch positional := parseInterspersed(fs, args); len(positional) {
+	case 0:
+	case 2:
+		jf.src, jf.dist = positional[0], positional[1]
+	default:
+		return errors.New("specify both SRC_DIR and DIST_DIR, or neither")
+	}
+	jobs, err := jf.jobs(fs)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if !strings.HasPrefix(job.DIST_DIR, "syncig://") {
+			return fmt.Errorf("DIST_DIR %q is not a syncig:// URL", job.DIST_DIR)
+		}
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	return runJobs(ctx, jobs, RunOptions{DryRun: *dryRun, Progress: *showProgress, ForceState: jf.force})
+}
+
+// syncig plan
+func runPlan(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	var jf jobFlags
+	jf.register(fs)
+	fullScan := fs.Bool("full-scan", false, "同期先にない・内容が異なるファイルをすべてコピー")
+	fs.Parse(args)
+	return syncJobs(context.Background(), fs, &jf, RunOptions{DryRun: true, FullScan: *fullScan})
+}
+
+func syncJobs(ctx context.Context, fs *flag.FlagSet, jf *jobFlags, opts RunOptions) error {
+	jobs, err := jf.jobs(fs)
+	if err != nil {
+		return err
+	}
+	opts.ForceState = jf.force
+	return runJobs(ctx, jobs, opts)
+}
+
+// ジョブを順に実行する。失敗したジョブ（DIST_DIRS の同期先）があっても残りのジョブは実行し、
+// 終了の指示を受けた場合は実行しない
+func runJobs(ctx context.Context, jobs []Job, opts RunOptions) error {
+	failed := 0
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		printJobHeader(job)
+		if err := runJob(ctx, job, opts); err != nil {
+			if len(job.DIST_DIRS) > 0 {
+				err = fmt.Errorf("%s: %w", job.DIST_DIR, err)
+			}
+			fmt.Fprintf(os.Stderr, "syncDir error: %v\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(jobs))
+	}
+	if opts.DryRun {
+		fmt.Println("Dry run completed.")
+		return nil
+	}
+	fmt.Println("Sync completed.")
+	return nil
+}
@@ -0,0 +1,802 @@
+package syncig
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 1 組の同期元・同期先の設定
+type Job struct {
+	NAME         string   `json:"NAME"`
+	SRC_DIR      string   `json:"SRC_DIR"`
+	DIST_DIR     string   `json:"DIST_DIR"`
+	EXCLUDED_EXT []string `json:"EXCLUDED_EXT"`
+	// DIST_DIR の代わりに指定した場合は、同じファイルをすべての同期先にコピーする（同期状態は同期先ごと）
+	DIST_DIRS []string `json:"DIST_DIRS"`
+	// 実行の開始時に DIST_DIR に接続できない場合に代わりに書き込む同期先（STATE_DIR が必要）
+	FAILOVER_DIST_DIR string `json:"FAILOVER_DIST_DIR"`
+	// 指定した場合はこの拡張子のファイルのみをコピー対象にする
+	INCLUDED_EXT []string `json:"INCLUDED_EXT"`
+	// SRC_DIR からの相対パスに対する doublestar 形式のパターン
+	INCLUDE_GLOBS []string `json:"INCLUDE_GLOBS"`
+	EXCLUDE_GLOBS []string `json:"EXCLUDE_GLOBS"`
+	// ファイル名に対する正規表現
+	INCLUDE_REGEX []string `json:"INCLUDE_REGEX"`
+	EXCLUDE_REGEX []string `json:"EXCLUDE_REGEX"`
+	// 走査しないディレクトリの名前またはパターン
+	EXCLUDED_DIRS []string `json:"EXCLUDED_DIRS"`
+	// 同期状態の保存形式（"json" / "kv"）
+	STATE_BACKEND string `json:"STATE_BACKEND"`
+	// 同期状態の保存先（未指定の場合は DIST_DIR）
+	STATE_DIR string `json:"STATE_DIR"`
+	// 同期状態を HMAC で署名する鍵のファイル（未指定の場合は署名しない）
+	STATE_KEY_FILE string `json:"STATE_KEY_FILE"`
+	// DIST_DIR が sftp:// の場合に起動する ssh のコマンドと引数（未指定の場合は ssh）
+	SSH_COMMAND string `json:"SSH_COMMAND"`
+	// 転送の圧縮（0 は圧縮しない、1 は速度優先〜9 は圧縮率優先）。sftp:// は ssh の圧縮、syncig:// は gzip を使う
+	COMPRESSION_LEVEL int `json:"COMPRESSION_LEVEL"`
+	// DIST_DIR が s3:// の場合のリージョン（未指定の場合は AWS_REGION）と、S3 互換のストレージのエンドポイント
+	S3_REGION   string `json:"S3_REGION"`
+	S3_ENDPOINT string `json:"S3_ENDPOINT"`
+	// アップロードするオブジェクトのストレージクラス（"STANDARD_IA" など）
+	S3_STORAGE_CLASS string `json:"S3_STORAGE_CLASS"`
+	// マルチパートアップロードの 1 パートの大きさ（既定 16MiB）。これより大きいファイルはマルチパートでアップロードする
+	S3_PART_SIZE ByteSize `json:"S3_PART_SIZE"`
+	// DIST_DIR が azblob:// の場合のストレージアカウント（未指定の場合は AZURE_STORAGE_ACCOUNT）と、Azurite などのエンドポイント
+	AZURE_ACCOUNT  string `json:"AZURE_ACCOUNT"`
+	AZURE_ENDPOINT string `json:"AZURE_ENDPOINT"`
+	// DIST_DIR が http:// ・https:// の場合のメソッド（"PUT" / "POST"、既定 "PUT"）と、追加するヘッダー（値の $VAR は環境変数に展開する）
+	HTTP_METHOD  string            `json:"HTTP_METHOD"`
+	HTTP_HEADERS map[string]string `json:"HTTP_HEADERS"`
+	// 指定した場合は multipart/form-data のこの名前のフィールドでファイルを送る
+	HTTP_FORM_FIELD string `json:"HTTP_FORM_FIELD"`
+	// 認証情報の取得元。同期先が読む環境変数の名前（WEBDAV_PASSWORD など）ごとに "env:NAME"・"file:PATH"・"keychain:SERVICE[/ACCOUNT]" を指定する
+	CREDENTIALS map[string]string `json:"CREDENTIALS"`
+	// リモートの同期先・同期元への接続に使うプロキシ（socks5://user@host:1080・http://host:3128）。パスワードは PROXY_PASSWORD
+	PROXY string `json:"PROXY"`
+	// s3:// で AssumeRole により引き受ける IAM ロールと、ロールの信頼ポリシーが求める外部 ID
+	S3_ROLE_ARN    string `json:"S3_ROLE_ARN"`
+	S3_EXTERNAL_ID string `json:"S3_EXTERNAL_ID"`
+	// 新しいファイルの判定方式（"manifest" / "name" / "natural" / "mtime"）
+	TRACKING string `json:"TRACKING"`
+	// ファイル名の並び順（"name" / "natural"）。コピーする順序と名前が最大のファイルの判定に使う
+	SORT_ORDER string `json:"SORT_ORDER"`
+	// コピー済みのファイルの変更を検出して再コピーする方式（"none" / "mtime" / "hash"）
+	DETECT string `json:"DETECT"`
+	// サイズが増えたファイルは追記分のみコピーする（DETECT が必要）
+	APPEND bool `json:"APPEND"`
+	// コピー前にこの間隔を空けてサイズと更新日時が変わらないことを確認する（0 は確認しない）
+	STABLE_INTERVAL Duration `json:"STABLE_INTERVAL"`
+	// inode 番号（Windows ではファイル ID）で同期元の名前の変更を検出し、同期先にも反映する
+	DETECT_RENAMES bool `json:"DETECT_RENAMES"`
+	// 同期元で削除されたファイルの扱い（"record" / "tombstone" / "delete"）
+	ON_DELETE string `json:"ON_DELETE"`
+	// 同期先に既にファイルがある場合の扱い（"overwrite" / "skip" / "newer-only" / "error"）
+	ON_CONFLICT string `json:"ON_CONFLICT"`
+	// 同期の方式（"copy" / "mirror" / "move" / "bidirectional"）。mirror は同期元にないファイルを同期先から削除し、
+	// move はコピーを検証した後に同期元のファイルを削除する。bidirectional は両側の変更を互いに反映する
+	MODE string `json:"MODE"`
+	// MODE が bidirectional の場合に両側で変更されたファイルの扱い（"newer-wins" / "rename-both" / "manual"）
+	CONFLICT_RESOLUTION string `json:"CONFLICT_RESOLUTION"`
+	// MODE が move の場合、同期元のファイルを削除する代わりに同じ相対パスで移すディレクトリ
+	ARCHIVE_DIR string `json:"ARCHIVE_DIR"`
+	// MODE が move の場合、ファイルを削除して空になった同期元のディレクトリも削除する
+	REMOVE_EMPTY_DIRS bool `json:"REMOVE_EMPTY_DIRS"`
+	// MODE が mirror の場合、同期元から消えたディレクトリも同期先から削除する
+	MIRROR_DIRS bool `json:"MIRROR_DIRS"`
+	// 同期先から削除するファイルを DIST_DIR/.syncig-trash に移す
+	TRASH bool `json:"TRASH"`
+	// ゴミ箱に移してからこの日数が経過したら削除する（0 は削除しない）
+	TRASH_RETENTION_DAYS int `json:"TRASH_RETENTION_DAYS"`
+	// コピーしてからこの日数が経過したファイルを同期先から削除する（0 は削除しない）
+	RETENTION_DAYS int `json:"RETENTION_DAYS"`
+	// 同期先に残っているコピー済みのファイルの合計の上限。超えた場合は同期の終わりに古いものから削除する（0 は制限なし）
+	MAX_DIST_SIZE ByteSize `json:"MAX_DIST_SIZE"`
+	// 同期先から上書き・削除するファイルを移すディレクトリ（rsync の --backup-dir に相当）
+	BACKUP_DIR string `json:"BACKUP_DIR"`
+	// BACKUP_DIR に移してからこの日数が経過したら削除する（0 は削除しない）
+	BACKUP_RETENTION_DAYS int `json:"BACKUP_RETENTION_DAYS"`
+	// コピーの判定を実行 ID 付きで syncig_journal.jsonl に記録する
+	JOURNAL bool `json:"JOURNAL"`
+	// コピーに使うバッファのサイズ（0 は 1MiB）
+	COPY_BUFFER_SIZE ByteSize `json:"COPY_BUFFER_SIZE"`
+	// コピーしたファイルを読み直し、同期元とハッシュ値が一致することを確認してから記録する
+	VERIFY_AFTER_COPY bool `json:"VERIFY_AFTER_COPY"`
+	// 変更の検出・検証・チェックサムファイルに使うハッシュ値の計算方式
+	// （"sha256" / "sha512" / "sha3-256" / "xxh64"、未指定は sha256）
+	HASH_ALGO string `json:"HASH_ALGO"`
+	// コピーしたファイルのハッシュ値を同期先に書き出す形式（"sidecar" / "manifest"）
+	CHECKSUM_FILES string `json:"CHECKSUM_FILES"`
+	// 内容が記録と異なる同期先ファイルを再コピーする前に退避するディレクトリ
+	QUARANTINE_DIR string `json:"QUARANTINE_DIR"`
+	// 1 ファイルのコピーにかける時間の上限（0 は制限なし）。超えた場合は失敗として次回に再コピーする
+	COPY_TIMEOUT Duration `json:"COPY_TIMEOUT"`
+	// 1 回の実行の時間・コピーするファイル数・バイト数の上限（0 は制限なし）。達した時点で止め、残りは次回にコピーする
+	MAX_RUN_DURATION  Duration `json:"MAX_RUN_DURATION"`
+	MAX_FILES_PER_RUN int      `json:"MAX_FILES_PER_RUN"`
+	MAX_BYTES_PER_RUN ByteSize `json:"MAX_BYTES_PER_RUN"`
+	// このサイズ以上のファイルは中断したコピーを次回に続きから再開する（0 は再開しない）
+	RESUME_THRESHOLD ByteSize `json:"RESUME_THRESHOLD"`
+	// 再開のために進捗を保存する間隔（0 は 64MiB）
+	RESUME_CHUNK_SIZE ByteSize `json:"RESUME_CHUNK_SIZE"`
+	// このサイズ以上のファイルは、sftp:// と s3:// の同期先で前回の版から変わったブロックだけを送る（0 は常にファイル全体を送る）
+	DELTA_MIN_SIZE ByteSize `json:"DELTA_MIN_SIZE"`
+	// 同期先のファイルを上書きする前の版を <ファイル名>.~1~ 〜 .~N~ として残す数（0 は残さない）
+	KEEP_VERSIONS int `json:"KEEP_VERSIONS"`
+	// コピーしたファイルとディレクトリを同期状態に記録する前に fsync する
+	DURABLE bool `json:"DURABLE"`
+	// reflink や copy_file_range などカーネル内でのコピーを使う
+	ZERO_COPY bool `json:"ZERO_COPY"`
+	// ジョブ全体のコピーの帯域（"20MB/s" など、0 は制限なし）
+	BANDWIDTH_LIMIT Bandwidth `json:"BANDWIDTH_LIMIT"`
+	// 1 秒あたりに開くファイル数の上限（0 は制限なし）
+	FILES_PER_SECOND int `json:"FILES_PER_SECOND"`
+	// 同時に開くファイル数の上限（0 は制限なし、1 ファイルのコピーに 2 つ使う）
+	MAX_OPEN_FILES int `json:"MAX_OPEN_FILES"`
+	// 並列にコピーするファイル数（0 は 1）
+	CONCURRENCY int `json:"CONCURRENCY"`
+	// コピーにかかる時間とエラーから同時にコピーするファイル数を
+	// MIN_CONCURRENCY から CONCURRENCY × DIR_CONCURRENCY の範囲で自動調整する
+	ADAPTIVE_CONCURRENCY bool `json:"ADAPTIVE_CONCURRENCY"`
+	MIN_CONCURRENCY      int  `json:"MIN_CONCURRENCY"`
+	// 並列に処理するサブディレクトリ数（0 は 1）
+	DIR_CONCURRENCY int `json:"DIR_CONCURRENCY"`
+	// コピー中に同期状態を途中保存する間隔（ファイル数・時間、0 は既定値）
+	CHECKPOINT_FILES    int      `json:"CHECKPOINT_FILES"`
+	CHECKPOINT_INTERVAL Duration `json:"CHECKPOINT_INTERVAL"`
+	// rsync の --exclude-from 形式の除外パターンファイル
+	EXCLUDE_FROM string `json:"EXCLUDE_FROM"`
+	// SRC_DIR 直下のサブディレクトリを 1 とした走査する深さの上限（0 は制限なし）
+	MAX_DEPTH int `json:"MAX_DEPTH"`
+	// ドットファイル・ドットディレクトリ（Windows では隠し属性のもの）を無視する
+	SKIP_HIDDEN bool `json:"SKIP_HIDDEN"`
+	// コピー対象とするファイルサイズの範囲（0 は制限なし）
+	MIN_SIZE ByteSize `json:"MIN_SIZE"`
+	MAX_SIZE ByteSize `json:"MAX_SIZE"`
+	// sync -daemon でこのジョブを実行する時刻の cron 式（未指定の場合は -interval ごと）
+	SCHEDULE string `json:"SCHEDULE"`
+	// watch でディレクトリごとに最後の変更からこの時間が経過してから同期する（0 は 2 秒）
+	WATCH_DEBOUNCE Duration `json:"WATCH_DEBOUNCE"`
+	// watch で変更がこの数に達したディレクトリは WATCH_DEBOUNCE を待たずに同期する（0 は制限なし）
+	WATCH_MAX_BATCH int `json:"WATCH_MAX_BATCH"`
+	// 最終更新からこの時間が経過していないファイルは書き込み中とみなして次回に回す
+	MIN_AGE Duration `json:"MIN_AGE"`
+	// この日時以前に更新されたファイルはコピーしない
+	MODIFIED_AFTER Timestamp `json:"MODIFIED_AFTER"`
+
+	// MODE が bidirectional の場合の方向ごと、DIST_DIRS の場合の同期先ごとの STATE_DIR の下のディレクトリ
+	stateSub string
+	// FAILOVER_DIST_DIR に書き込むジョブの元の DIST_DIR
+	primary string
+}
+
+// トップレベルに単一ジョブを書く従来形式と、JOBS に複数ジョブを並べる形式の両方を受け付ける
+type Config struct {
+	Job
+	JOBS []Job `json:"JOBS"`
+}
+
+// 実行対象のジョブ一覧を返す
+func (c *Config) Jobs() []Job {
+	if len(c.JOBS) > 0 {
+		return c.JOBS
+	}
+	return []Job{c.Job}
+}
+
+// 拡張子に応じて JSON / YAML / TOML の設定ファイルを読み込み、環境変数の上書きを反映する。
+// 相対パスの SRC_DIR / DIST_DIR は設定ファイルのあるディレクトリを基準に解決する
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		raw, err = parseYAML(b, reflect.TypeOf(Config{}))
+	case ".toml":
+		raw, err = parseTOML(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		// YAML / TOML は一度 JSON に変換して同じ経路でデコードする
+		if b, err = json.Marshal(raw); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := decodeConfig(b)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareConfig(cfg, filepath.Dir(abs)); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// 環境変数の上書きを反映してからパスを展開し、相対パスを baseDir を基準に解決する。
+// 環境変数で指定したパスも設定ファイルに書いた場合と同じく扱う。baseDir が空の場合は解決しない
+func prepareConfig(cfg *Config, baseDir string) error {
+	if err := applyEnvOverrides(cfg); err != nil {
+		return fmt.Errorf("env: %w", err)
+	}
+	jobs := []*Job{&cfg.Job}
+	for i := range cfg.JOBS {
+		jobs = append(jobs, &cfg.JOBS[i])
+	}
+	for _, job := range jobs {
+		if err := expandJobPaths(job); err != nil {
+			return err
+		}
+		if baseDir != "" {
+			resolveJobPaths(job, baseDir)
+		}
+	}
+	return nil
+}
+
+func resolveJobPaths(job *Job, baseDir string) {
+	if job.SRC_DIR != "" && !filepath.IsAbs(job.SRC_DIR) && !isRemoteURL(job.SRC_DIR) {
+		job.SRC_DIR = filepath.Join(baseDir, job.SRC_DIR)
+	}
+	if job.DIST_DIR != "" && !filepath.IsAbs(job.DIST_DIR) && !isRemoteURL(job.DIST_DIR) {
+		job.DIST_DIR = filepath.Join(baseDir, job.DIST_DIR)
+	}
+	if job.FAILOVER_DIST_DIR != "" && !filepath.IsAbs(job.FAILOVER_DIST_DIR) && !isRemoteURL(job.FAILOVER_DIST_DIR) {
+		job.FAILOVER_DIST_DIR = filepath.Join(baseDir, job.FAILOVER_DIST_DIR)
+	}
+	for i, dist := range job.DIST_DIRS {
+		if dist != "" && !filepath.IsAbs(dist) && !isRemoteURL(dist) {
+			job.DIST_DIRS[i] = filepath.Join(baseDir, dist)
+		}
+	}
+	if job.EXCLUDE_FROM != "" && !filepath.IsAbs(job.EXCLUDE_FROM) {
+		job.EXCLUDE_FROM = filepath.Join(baseDir, job.EXCLUDE_FROM)
+	}
+	if job.STATE_DIR != "" && !filepath.IsAbs(job.STATE_DIR) {
+		job.STATE_DIR = filepath.Join(baseDir, job.STATE_DIR)
+	}
+	if job.STATE_KEY_FILE != "" && !filepath.IsAbs(job.STATE_KEY_FILE) {
+		job.STATE_KEY_FILE = filepath.Join(baseDir, job.STATE_KEY_FILE)
+	}
+	if job.QUARANTINE_DIR != "" && !filepath.IsAbs(job.QUARANTINE_DIR) {
+		job.QUARANTINE_DIR = filepath.Join(baseDir, job.QUARANTINE_DIR)
+	}
+	if job.BACKUP_DIR != "" && !filepath.IsAbs(job.BACKUP_DIR) {
+		job.BACKUP_DIR = filepath.Join(baseDir, job.BACKUP_DIR)
+	}
+	if job.ARCHIVE_DIR != "" && !filepath.IsAbs(job.ARCHIVE_DIR) {
+		job.ARCHIVE_DIR = filepath.Join(baseDir, job.ARCHIVE_DIR)
+	}
+	for name, ref := range job.CREDENTIALS {
+		if p, ok := strings.CutPrefix(ref, credentialFile); ok && p != "" && !filepath.IsAbs(p) {
+			job.CREDENTIALS[name] = credentialFile + filepath.Join(baseDir, p)
+		}
+	}
+}
+
+// パスの先頭の ~ とパス中の環境変数（$VAR, ${VAR}, %VAR%）を展開する
+func expandPath(path string) (string, error) {
+	path = windowsEnvPattern.ReplaceAllStringFunc(path, func(m string) string {
+		if v, ok := os.LookupEnv(m[1 : len(m)-1]); ok {
+			return v
+		}
+		return m
+	})
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = home + path[1:]
+	}
+	return path, nil
+}
+
+var windowsEnvPattern = regexp.MustCompile(`%[A-Za-z_][A-Za-z0-9_]*%`)
+
+func expandJobPaths(job *Job) error {
+	var err error
+	if job.SRC_DIR, err = expandPath(job.SRC_DIR); err != nil {
+		return err
+	}
+	if job.DIST_DIR, err = expandPath(job.DIST_DIR); err != nil {
+		return err
+	}
+	if job.FAILOVER_DIST_DIR, err = expandPath(job.FAILOVER_DIST_DIR); err != nil {
+		return err
+	}
+	// DIST_DIRS も CREDENTIALS と同じく複製してから書き換える
+	if job.DIST_DIRS != nil {
+		dists := make([]string, len(job.DIST_DIRS))
+		for i, dist := range job.DIST_DIRS {
+			if dists[i], err = expandPath(dist); err != nil {
+				return err
+			}
+		}
+		job.DIST_DIRS = dists
+	}
+	if job.EXCLUDE_FROM, err = expandPath(job.EXCLUDE_FROM); err != nil {
+		return err
+	}
+	if job.STATE_DIR, err = expandPath(job.STATE_DIR); err != nil {
+		return err
+	}
+	if job.STATE_KEY_FILE, err = expandPath(job.STATE_KEY_FILE); err != nil {
+		return err
+	}
+	if job.QUARANTINE_DIR, err = expandPath(job.QUARANTINE_DIR); err != nil {
+		return err
+	}
+	if job.BACKUP_DIR, err = expandPath(job.BACKUP_DIR); err != nil {
+		return err
+	}
+	if job.ARCHIVE_DIR, err = expandPath(job.ARCHIVE_DIR); err != nil {
+		return err
+	}
+	// CREDENTIALS は他のジョブと共有しないよう複製してから書き換える
+	if job.CREDENTIALS != nil {
+		creds := make(map[string]string, len(job.CREDENTIALS))
+		for name, ref := range job.CREDENTIALS {
+			if p, ok := strings.CutPrefix(ref, credentialFile); ok {
+				if p, err = expandPath(p); err != nil {
+					return err
+				}
+				ref = credentialFile + p
+			}
+			creds[name] = ref
+		}
+		job.CREDENTIALS = creds
+	}
+	return nil
+}
+
+// 未知のキーはタイプミスの可能性が高いためエラーにする
+func decodeConfig(b []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.JOBS) > 0 && (cfg.SRC_DIR != "" || cfg.DIST_DIR != "") {
+		return nil, errors.New("SRC_DIR/DIST_DIR must be set inside each JOBS entry when JOBS is used")
+	}
+	return &cfg, nil
+}
+
+const envPrefix = "SYNCIG_"
+
+// SYNCIG_<フィールド名> の環境変数で設定値を上書きする。
+// JOBS を使う場合はすべてのジョブに適用される。
+func applyEnvOverrides(cfg *Config) error {
+	if err := applyEnvToJob(&cfg.Job); err != nil {
+		return err
+	}
+	for i := range cfg.JOBS {
+		if err := applyEnvToJob(&cfg.JOBS[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyEnvToJob(job *Job) error {
+	v := reflect.ValueOf(job).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("json")
+		if name == "" || name == "NAME" {
+			continue
+		}
+		env, ok := os.LookupEnv(envPrefix + name)
+		if !ok {
+			continue
+		}
+		if err := setFromString(v.Field(i), env); err != nil {
+			return fmt.Errorf("%s%s: %w", envPrefix, name, err)
+		}
+	}
+	return nil
+}
+
+// 文字列をフィールドの型に変換して設定する。スライスはカンマ区切りか、
+// カンマを含む正規表現などを指定できるよう JSON の配列（["a,b", "c"]）
+func setFromString(f reflect.Value, s string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Slice:
+		if strings.HasPrefix(strings.TrimSpace(s), "[") {
+			var items []string
+			if err := json.Unmarshal([]byte(s), &items); err != nil {
+				return fmt.Errorf("invalid JSON array: %w", err)
+			}
+			f.Set(reflect.ValueOf(items))
+			return nil
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		// HTTP_HEADERS などは JSON のオブジェクト（{"X-Api-Key": "..."}）で指定する
+		var m map[string]string
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			return fmt.Errorf("invalid JSON object: %w", err)
+		}
+		f.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
+
+// ジョブの設定値を検証する
+func validateJob(job Job) error {
+	name := job.NAME
+	if name == "" {
+		name = "(default)"
+	}
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("job %s: %s", name, fmt.Sprintf(format, args...))
+	}
+	if job.SRC_DIR == "" {
+		return fail("SRC_DIR is empty")
+	}
+	if job.DIST_DIR == "" {
+		return fail("DIST_DIR is empty")
+	}
+	if len(job.DIST_DIRS) > 0 {
+		if err := validateDestinations(job); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if job.FAILOVER_DIST_DIR != "" {
+		if err := validateFailover(job); err != nil {
+			return fail("%v", err)
+		}
+		if err := validateJob(job.failover()); err != nil {
+			return fmt.Errorf("%w (FAILOVER_DIST_DIR)", err)
+		}
+	}
+	remote := isRemoteURL(job.DIST_DIR)
+	if remote {
+		if err := validateRemoteDist(job); err != nil {
+			return fail("%v", err)
+		}
+	}
+	// SRC_DIR が URL の場合は同期元の中に書き込むことはないため、パスの重なりは確認しない
+	remoteSrc := isRemoteURL(job.SRC_DIR)
+	if remoteSrc {
+		if err := validateRemoteSource(job); err != nil {
+			return fail("%v", err)
+		}
+	}
+	// 同期先ごとの設定は、DIST_DIRS・FAILOVER_DIST_DIR の他の同期先で使う場合も指定できる
+	if !job.distHasPrefix("s3://") && !strings.HasPrefix(job.SRC_DIR, "s3://") && (job.S3_REGION != "" || job.S3_ENDPOINT != "" || job.S3_STORAGE_CLASS != "" || job.S3_PART_SIZE != 0 || job.S3_ROLE_ARN != "" || job.S3_EXTERNAL_ID != "") {
+		return fail("S3_REGION, S3_ENDPOINT, S3_STORAGE_CLASS, S3_PART_SIZE, S3_ROLE_ARN and S3_EXTERNAL_ID require an s3:// SRC_DIR or DIST_DIR")
+	}
+	if job.S3_EXTERNAL_ID != "" && job.S3_ROLE_ARN == "" {
+		return fail("S3_EXTERNAL_ID requires S3_ROLE_ARN")
+	}
+	if err := validateCredentials(job.CREDENTIALS); err != nil {
+		return fail("%v", err)
+	}
+	if job.PROXY != "" {
+		if !remoteSrc && !job.anyDist(isRemoteURL) {
+			return fail("PROXY requires a remote SRC_DIR or DIST_DIR")
+		}
+		if err := validateProxy(job.PROXY); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if !job.distHasPrefix("azblob://") && !strings.HasPrefix(job.SRC_DIR, "azblob://") && (job.AZURE_ACCOUNT != "" || job.AZURE_ENDPOINT != "") {
+		return fail("AZURE_ACCOUNT and AZURE_ENDPOINT require an azblob:// SRC_DIR or DIST_DIR")
+	}
+	if !job.distHasPrefix("http://", "https://") && (job.HTTP_METHOD != "" || job.HTTP_HEADERS != nil || job.HTTP_FORM_FIELD != "") {
+		return fail("HTTP_METHOD, HTTP_HEADERS and HTTP_FORM_FIELD require an http:// or https:// DIST_DIR")
+	}
+	src, err := filepath.Abs(job.SRC_DIR)
+	if err != nil {
+		return fail("SRC_DIR %q: %v", job.SRC_DIR, err)
+	}
+	dist, err := filepath.Abs(job.DIST_DIR)
+	if err != nil {
+		return fail("DIST_DIR %q: %v", job.DIST_DIR, err)
+	}
+	if !remoteSrc {
+		if err := checkSourceDir(job.SRC_DIR); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if src == dist && !remote && !remoteSrc {
+		return fail("SRC_DIR and DIST_DIR point to the same directory %q", src)
+	}
+	if rel, err := filepath.Rel(src, dist); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !remote && !remoteSrc {
+		return fail("DIST_DIR %q is inside SRC_DIR %q; copied files would be synced again", job.DIST_DIR, job.SRC_DIR)
+	}
+	if _, err := newFileFilter(job); err != nil {
+		return fail("%v", err)
+	}
+	for _, ext := range job.EXCLUDED_EXT {
+		if !strings.HasPrefix(ext, ".") {
+			return fail("EXCLUDED_EXT entry %q must start with \".\"", ext)
+		}
+	}
+	// 同期元の中に書き込むと、次回の同期で同期元のファイルとして扱われる
+	for _, d := range []struct{ key, path string }{
+		{"STATE_DIR", job.STATE_DIR},
+		{"QUARANTINE_DIR", job.QUARANTINE_DIR},
+		{"BACKUP_DIR", job.BACKUP_DIR},
+		{"ARCHIVE_DIR", job.ARCHIVE_DIR},
+	} {
+		if d.path == "" || remoteSrc {
+			continue
+		}
+		abs, err := filepath.Abs(d.path)
+		if err != nil {
+			return fail("%s %q: %v", d.key, d.path, err)
+		}
+		if rel, err := filepath.Rel(src, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fail("%s %q is inside SRC_DIR %q", d.key, d.path, job.SRC_DIR)
+		}
+	}
+	switch job.STATE_BACKEND {
+	case "", stateBackendJSON, stateBackendKV, stateBackendSQLite:
+	default:
+		return fail("unknown STATE_BACKEND %q", job.STATE_BACKEND)
+	}
+	switch job.TRACKING {
+	case "", trackManifest, trackMtime:
+	case trackName, trackNatural:
+		// 名前で判定する場合は並び順も同じでなければならない
+		if job.SORT_ORDER != "" && job.SORT_ORDER != job.TRACKING {
+			return fail("TRACKING %q conflicts with SORT_ORDER %q", job.TRACKING, job.SORT_ORDER)
+		}
+	default:
+		return fail("unknown TRACKING %q", job.TRACKING)
+	}
+	switch job.SORT_ORDER {
+	case "", sortByName, sortByNatural:
+	default:
+		return fail("unknown SORT_ORDER %q", job.SORT_ORDER)
+	}
+	switch job.DETECT {
+	case "", detectNone, detectMtime, detectHash:
+	default:
+		return fail("unknown DETECT %q", job.DETECT)
+	}
+	switch job.ON_DELETE {
+	case "", deleteRecord, deleteTombstone, deleteRemove:
+	default:
+		return fail("unknown ON_DELETE %q", job.ON_DELETE)
+	}
+	switch job.ON_CONFLICT {
+	case "", conflictOverwrite, conflictSkip, conflictNewerOnly, conflictError:
+	default:
+		return fail("unknown ON_CONFLICT %q", job.ON_CONFLICT)
+	}
+	if _, ok := hashAlgos[job.HASH_ALGO]; job.HASH_ALGO != "" && !ok {
+		return fail("unknown HASH_ALGO %q", job.HASH_ALGO)
+	}
+	switch job.CHECKSUM_FILES {
+	case "", checksumSidecar, checksumManifest:
+	default:
+		return fail("unknown CHECKSUM_FILES %q", job.CHECKSUM_FILES)
+	}
+	switch job.MODE {
+	case "", modeCopy:
+	case modeMirror:
+		if job.ON_DELETE != "" && job.ON_DELETE != deleteRemove {
+			return fail("MODE \"mirror\" cannot be used with ON_DELETE %q", job.ON_DELETE)
+		}
+	case modeBidirectional:
+		if job.STATE_DIR == "" {
+			return fail("MODE \"bidirectional\" requires STATE_DIR outside SRC_DIR and DIST_DIR")
+		}
+		if state, err := filepath.Abs(job.STATE_DIR); err == nil {
+			if rel, err := filepath.Rel(dist, state); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fail("STATE_DIR %q is inside DIST_DIR %q", job.STATE_DIR, job.DIST_DIR)
+			}
+		}
+		if rel, err := filepath.Rel(dist, src); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fail("SRC_DIR %q is inside DIST_DIR %q", job.SRC_DIR, job.DIST_DIR)
+		}
+		// 同期元から消えたファイルを検出しても、どちらの側で削除されたかを区別できない
+		if job.ON_DELETE != "" || job.DETECT_RENAMES || job.APPEND {
+			return fail("MODE \"bidirectional\" cannot be used with ON_DELETE, DETECT_RENAMES or APPEND")
+		}
+		if job.DETECT == detectNone {
+			return fail("MODE \"bidirectional\" requires DETECT \"mtime\" or \"hash\"")
+		}
+	case modeMove:
+		// 同期元から消えるのは syncig 自身が削除したファイルのため、削除の反映や名前の変更の検出はできない
+		if job.ON_DELETE != "" || job.DETECT_RENAMES || job.APPEND {
+			return fail("MODE \"move\" cannot be used with ON_DELETE, DETECT_RENAMES or APPEND")
+		}
+	default:
+		return fail("unknown MODE %q", job.MODE)
+	}
+	if job.TRASH && job.MODE != modeMirror && job.ON_DELETE != deleteRemove {
+		return fail("TRASH requires MODE \"mirror\" or ON_DELETE \"delete\"")
+	}
+	if job.KEEP_VERSIONS < 0 {
+		return fail("KEEP_VERSIONS must not be negative")
+	}
+	if job.BACKUP_DIR != "" && (job.TRASH || job.KEEP_VERSIONS > 0) {
+		return fail("BACKUP_DIR cannot be used with TRASH or KEEP_VERSIONS")
+	}
+	if job.RETENTION_DAYS < 0 || job.TRASH_RETENTION_DAYS < 0 || job.BACKUP_RETENTION_DAYS < 0 {
+		return fail("RETENTION_DAYS, TRASH_RETENTION_DAYS and BACKUP_RETENTION_DAYS must not be negative")
+	}
+	switch job.CONFLICT_RESOLUTION {
+	case "":
+	case resolveNewerWins, resolveRenameBoth, resolveManual:
+		if job.MODE != modeBidirectional {
+			return fail("CONFLICT_RESOLUTION requires MODE \"bidirectional\"")
+		}
+	default:
+		return fail("unknown CONFLICT_RESOLUTION %q", job.CONFLICT_RESOLUTION)
+	}
+	if job.MIRROR_DIRS && job.MODE != modeMirror {
+		return fail("MIRROR_DIRS requires MODE \"mirror\"")
+	}
+	if (job.REMOVE_EMPTY_DIRS || job.ARCHIVE_DIR != "") && job.MODE != modeMove {
+		return fail("REMOVE_EMPTY_DIRS and ARCHIVE_DIR require MODE \"move\"")
+	}
+	if job.APPEND && (job.DETECT == "" || job.DETECT == detectNone) {
+		return fail("APPEND requires DETECT")
+	}
+	if job.COPY_BUFFER_SIZE < 0 || job.COPY_BUFFER_SIZE > 1<<30 {
+		return fail("COPY_BUFFER_SIZE must be between 0 and 1GiB")
+	}
+	if job.BANDWIDTH_LIMIT < 0 {
+		return fail("BANDWIDTH_LIMIT must not be negative")
+	}
+	if job.FILES_PER_SECOND < 0 {
+		return fail("FILES_PER_SECOND must not be negative")
+	}
+	if job.MAX_OPEN_FILES < 0 || job.MAX_OPEN_FILES == 1 {
+		return fail("MAX_OPEN_FILES must be 0 or at least 2")
+	}
+	if job.MIN_CONCURRENCY < 0 {
+		return fail("MIN_CONCURRENCY must not be negative")
+	}
+	if job.CONCURRENCY < 0 || job.DIR_CONCURRENCY < 0 {
+		return fail("CONCURRENCY and DIR_CONCURRENCY must not be negative")
+	}
+	if job.STABLE_INTERVAL < 0 {
+		return fail("STABLE_INTERVAL must not be negative")
+	}
+	if job.RESUME_THRESHOLD < 0 || job.RESUME_CHUNK_SIZE < 0 {
+		return fail("RESUME_THRESHOLD and RESUME_CHUNK_SIZE must not be negative")
+	}
+	if job.COMPRESSION_LEVEL < 0 || job.COMPRESSION_LEVEL > 9 {
+		return fail("COMPRESSION_LEVEL must be between 0 and 9")
+	}
+	if job.COMPRESSION_LEVEL > 0 && !job.distHasPrefix("sftp://", "syncig://") && !strings.HasPrefix(job.SRC_DIR, "sftp://") {
+		return fail("COMPRESSION_LEVEL requires an sftp:// SRC_DIR or DIST_DIR, or a syncig:// DIST_DIR")
+	}
+	if job.DELTA_MIN_SIZE < 0 {
+		return fail("DELTA_MIN_SIZE must not be negative")
+	}
+	if job.DELTA_MIN_SIZE > 0 && !job.distHasPrefix("sftp://", "s3://") {
+		return fail("DELTA_MIN_SIZE requires an sftp:// or s3:// DIST_DIR")
+	}
+	if job.SCHEDULE != "" {
+		c, err := parseCron(job.SCHEDULE)
+		if err != nil {
+			return fail("SCHEDULE: %v", err)
+		}
+		if c.next(time.Now()).IsZero() {
+			return fail("SCHEDULE %q never matches", job.SCHEDULE)
+		}
+	}
+	if job.WATCH_DEBOUNCE < 0 {
+		return fail("WATCH_DEBOUNCE must not be negative")
+	}
+	if job.WATCH_MAX_BATCH < 0 {
+		return fail("WATCH_MAX_BATCH must not be negative")
+	}
+	if job.MAX_RUN_DURATION < 0 || job.MAX_FILES_PER_RUN < 0 || job.MAX_BYTES_PER_RUN < 0 {
+		return fail("MAX_RUN_DURATION, MAX_FILES_PER_RUN and MAX_BYTES_PER_RUN must not be negative")
+	}
+	if job.COPY_TIMEOUT < 0 {
+		return fail("COPY_TIMEOUT must not be negative")
+	}
+	if job.CHECKPOINT_FILES < 0 || job.CHECKPOINT_INTERVAL < 0 {
+		return fail("CHECKPOINT_FILES and CHECKPOINT_INTERVAL must not be negative")
+	}
+	if job.MAX_DEPTH < 0 {
+		return fail("MAX_DEPTH must not be negative")
+	}
+	if job.MAX_DIST_SIZE < 0 {
+		return fail("MAX_DIST_SIZE must not be negative")
+	}
+	if job.MAX_SIZE > 0 && job.MIN_SIZE > job.MAX_SIZE {
+		return fail("MIN_SIZE (%s) is larger than MAX_SIZE (%s)", job.MIN_SIZE, job.MAX_SIZE)
+	}
+	for _, ext := range job.INCLUDED_EXT {
+		if !strings.HasPrefix(ext, ".") {
+			return fail("INCLUDED_EXT entry %q must start with \".\"", ext)
+		}
+	}
+	return nil
+}
+
+// 同期元ディレクトリが存在するディレクトリか確認する
+func checkSourceDir(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("SRC_DIR %q does not exist", dir)
+	}
+	if err != nil {
+		return fmt.Errorf("SRC_DIR %q: %v", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("SRC_DIR %q is not a directory", dir)
+	}
+	return nil
+}
+
+// ファイル名の並び順。TRACKING が名前による判定の場合はその並び順を使う
+func (j Job) sortOrder() string {
+	if j.SORT_ORDER == "" && (j.TRACKING == trackName || j.TRACKING == trackNatural) {
+		return j.TRACKING
+	}
+	return j.SORT_ORDER
+}
+
+// 同期状態を保存するディレクトリ。双方向同期では方向ごとに分け、
+// status などの方向を指定しないコマンドは SRC_DIR → DIST_DIR の同期状態を使う
+func (j Job) stateRoot() string {
+	if j.MODE == modeBidirectional {
+		sub := j.stateSub
+		if sub == "" {
+			sub = forwardStateDir
+		}
+		return filepath.Join(j.STATE_DIR, sub)
+	}
+	if j.STATE_DIR != "" {
+		// DIST_DIRS の同期先ごとのジョブは同期先ごとに分ける
+		return filepath.Join(j.STATE_DIR, j.stateSub)
+	}
+	return j.DIST_DIR
+}
@@ -0,0 +1,247 @@
+package syncig
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 設定ファイル用の TOML パーサ。
+// テーブル・テーブル配列・キーと値（文字列、整数、浮動小数点数、真偽値、配列）のみを扱う。
+// インラインテーブルや日時型などは対象外。
+
+func parseTOML(data []byte) (map[string]any, error) {
+	root := map[string]any{}
+	current := root
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		num := i + 1
+		line := strings.TrimSpace(stripComment(strings.TrimRight(lines[i], "\r")))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[[") {
+			if !strings.HasSuffix(line, "]]") {
+				return nil, fmt.Errorf("toml: line %d: invalid table array header", num)
+			}
+			keys, err := splitTOMLKey(line[2 : len(line)-2])
+			if err != nil {
+				return nil, fmt.Errorf("toml: line %d: %w", num, err)
+			}
+			parent, err := tomlTable(root, keys[:len(keys)-1])
+			if err != nil {
+				return nil, fmt.Errorf("toml: line %d: %w", num, err)
+			}
+			last := keys[len(keys)-1]
+			arr, _ := parent[last].([]any)
+			if parent[last] != nil && arr == nil {
+				return nil, fmt.Errorf("toml: line %d: %q is not a table array", num, last)
+			}
+			current = map[string]any{}
+			parent[last] = append(arr, current)
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("toml: line %d: invalid table header", num)
+			}
+			keys, err := splitTOMLKey(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("toml: line %d: %w", num, err)
+			}
+			current, err = tomlTable(root, keys)
+			if err != nil {
+				return nil, fmt.Errorf("toml: line %d: %w", num, err)
+			}
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("toml: line %d: expected key = value", num)
+		}
+		keys, err := splitTOMLKey(line[:eq])
+		if err != nil {
+			return nil, fmt.Errorf("toml: line %d: %w", num, err)
+		}
+		value := strings.TrimSpace(line[eq+1:])
+		// 複数行にわたる配列は括弧が閉じるまで連結する
+		for strings.HasPrefix(value, "[") && !tomlBalanced(value) && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripComment(strings.TrimRight(lines[i], "\r")))
+		}
+		v, err := parseTOMLValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("toml: line %d: %w", num, err)
+		}
+		table, err := tomlTable(current, keys[:len(keys)-1])
+		if err != nil {
+			return nil, fmt.Errorf("toml: line %d: %w", num, err)
+		}
+		last := keys[len(keys)-1]
+		if _, dup := table[last]; dup {
+			return nil, fmt.Errorf("toml: line %d: duplicate key %q", num, last)
+		}
+		table[last] = v
+	}
+	return root, nil
+}
+
+// ドット区切りのキーを分割する
+func splitTOMLKey(text string) ([]string, error) {
+	var keys []string
+	for _, part := range splitOutsideQuotes(text, '.') {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "\"") || strings.HasPrefix(part, "'") {
+			v, err := parseTOMLString(part)
+			if err != nil {
+				return nil, err
+			}
+			part = v
+		}
+		if part == "" {
+			return nil, fmt.Errorf("empty key")
+		}
+		keys = append(keys, part)
+	}
+	return keys, nil
+}
+
+// キーをたどってテーブルを返す。存在しない場合は作成し、テーブル配列の場合は最後の要素を返す
+func tomlTable(root map[string]any, keys []string) (map[string]any, error) {
+	t := root
+	for _, k := range keys {
+		switch v := t[k].(type) {
+		case nil:
+			next := map[string]any{}
+			t[k] = next
+			t = next
+		case map[string]any:
+			t = v
+		case []any:
+			if len(v) == 0 {
+				return nil, fmt.Errorf("%q is not a table", k)
+			}
+			last, ok := v[len(v)-1].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%q is not a table", k)
+			}
+			t = last
+		default:
+			return nil, fmt.Errorf("%q is not a table", k)
+		}
+	}
+	return t, nil
+}
+
+func tomlBalanced(text string) bool {
+	depth := 0
+	inQuote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case inQuote != 0:
+			if c == '\\' && inQuote == '"' {
+				i++
+			} else if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'':
+			inQuote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth == 0
+}
+
+func splitOutsideQuotes(text string, sep byte) []string {
+	var parts []string
+	inQuote := byte(0)
+	depth := 0
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case inQuote != 0:
+			if c == '\\' && inQuote == '"' {
+				i++
+			} else if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'':
+			inQuote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
+
+func parseTOMLValue(text string) (any, error) {
+	switch {
+	case text == "":
+		return nil, fmt.Errorf("missing value")
+	case strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'"):
+		return parseTOMLString(text)
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		arr := []any{}
+		for _, item := range splitOutsideQuotes(text[1:len(text)-1], ',') {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				// 末尾のカンマは許容する
+				continue
+			}
+			v, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case strings.HasPrefix(text, "{"):
+		return nil, fmt.Errorf("inline tables are not supported")
+	case text == "true":
+		return true, nil
+	case text == "false":
+		return false, nil
+	}
+	num := strings.ReplaceAll(text, "_", "")
+	// 10 進数の先頭の 0 は認めない（ParseInt は 8 進数として読むため）
+	digits := strings.TrimLeft(num, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		return nil, fmt.Errorf("invalid value %s: leading zeros are not allowed", text)
+	}
+	if n, err := strconv.ParseInt(num, 0, 64); err == nil {
+		return n, nil
+	}
+	if strings.Trim(num, "0123456789+-.eE") == "" {
+		if f, err := strconv.ParseFloat(num, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %s", text)
+}
+
+func parseTOMLString(text string) (string, error) {
+	if strings.HasPrefix(text, "'") {
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("invalid string %s", text)
+		}
+		return text[1 : len(text)-1], nil
+	}
+	s, err := strconv.Unquote(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", text)
+	}
+	return s, nil
+}
@@ -0,0 +1,78 @@
+package syncig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]any
+	}{
+		{"scalars", "a = 1\nb = -2.5\nc = true\nd = false\ne = 1_000\nf = 0x1F\ng = 1e3\n",
+			map[string]any{"a": int64(1), "b": -2.5, "c": true, "d": false, "e": int64(1000), "f": int64(31), "g": 1000.0}},
+		{"basic string", `a = "x # y"` + "\n" + `b = "tab\there"` + "\n" + `c = "007"` + "\n",
+			map[string]any{"a": "x # y", "b": "tab\there", "c": "007"}},
+		{"literal string", `a = 'C:\dir\x'` + "\n",
+			map[string]any{"a": `C:\dir\x`}},
+		{"comments", "# header\na = 1 # trailing\n",
+			map[string]any{"a": int64(1)}},
+		{"arrays", "a = [\"x\", 'y', 3]\nb = []\nc = [\n  \"m\", # comment\n  \"n\",\n]\n",
+			map[string]any{"a": []any{"x", "y", int64(3)}, "b": []any{}, "c": []any{"m", "n"}}},
+		{"nested arrays", "a = [[1, 2], [\"x\"]]\n",
+			map[string]any{"a": []any{[]any{int64(1), int64(2)}, []any{"x"}}}},
+		{"tables", "a = 1\n[t]\nb = 2\n[t.u]\nc = 3\n",
+			map[string]any{"a": int64(1), "t": map[string]any{"b": int64(2), "u": map[string]any{"c": int64(3)}}}},
+		{"dotted and quoted keys", "t.u = 1\n\"a.b\" = 2\n",
+			map[string]any{"t": map[string]any{"u": int64(1)}, "a.b": int64(2)}},
+		{"table arrays", "[[JOBS]]\nNAME = \"a\"\n[JOBS.HTTP_HEADERS]\nX = \"1\"\n[[JOBS]]\nNAME = \"b\"\n",
+			map[string]any{"JOBS": []any{
+				map[string]any{"NAME": "a", "HTTP_HEADERS": map[string]any{"X": "1"}},
+				map[string]any{"NAME": "b"},
+			}}},
+		{"crlf", "a = 1\r\n[t]\r\nb = 'x'\r\n",
+			map[string]any{"a": int64(1), "t": map[string]any{"b": "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"leading zeros", "a = 007\n"},
+		{"bare string", "a = text\n"},
+		{"inf", "a = inf\n"},
+		{"missing value", "a =\n"},
+		{"no equals", "a\n"},
+		{"duplicate key", "a = 1\na = 2\n"},
+		{"inline table", "a = {b = 1}\n"},
+		{"unterminated array", "a = [1, 2\n"},
+		{"unterminated string", "a = \"x\n"},
+		{"bad table header", "[t\n"},
+		{"bad table array header", "[[t]\n"},
+		{"value used as table", "a = 1\n[a]\n"},
+		{"table used as table array", "[a]\n[[a]]\n"},
+		{"empty key", "[a..b]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := parseTOML([]byte(tt.in)); err == nil {
+				t.Errorf("got %#v, want error", got)
+			}
+		})
+	}
+}
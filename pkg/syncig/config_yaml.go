@@ -0,0 +1,355 @@
+package syncig
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// 設定ファイル用の YAML パーサ。
+// ブロック形式のマッピング・シーケンスとフロー形式のシーケンス、スカラー値のみを扱う。
+// アンカーや複数行文字列などは対象外。
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// クォートしていない数値・真偽値。文字列の項目に渡す場合は書いたとおりの文字列にする（NAME: 007 など）
+type yamlPlain struct {
+	text string
+	v    any
+}
+
+// target は値を渡す先の型（Config など）。nil の場合はクォートしていない数値・真偽値をそのまま数値・真偽値にする
+func parseYAML(data []byte, target reflect.Type) (map[string]any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		if strings.Contains(raw, "\t") && strings.TrimLeft(raw, " ") != strings.TrimLeft(raw, " \t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed for indentation", i+1)
+		}
+		text := strings.TrimRight(stripComment(raw), " ")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("yaml: line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("yaml: top level must be a mapping")
+	}
+	resolveYAMLScalars(m, target)
+	return m, nil
+}
+
+// yamlPlain を t の対応する項目の型に合わせて文字列か数値・真偽値に置き換える
+func resolveYAMLScalars(v any, t reflect.Type) any {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case yamlPlain:
+		if t != nil && t.Kind() == reflect.String {
+			return v.text
+		}
+		return v.v
+	case map[string]any:
+		for k, e := range v {
+			v[k] = resolveYAMLScalars(e, yamlFieldType(t, k))
+		}
+	case []any:
+		var et reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			et = t.Elem()
+		}
+		for i, e := range v {
+			v[i] = resolveYAMLScalars(e, et)
+		}
+	}
+	return v
+}
+
+// key の値をデコードする t の項目の型。encoding/json と同じく大文字・小文字を区別せずに探す
+func yamlFieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if f.Anonymous && name == "" {
+				if ft := yamlFieldType(f.Type, key); ft != nil {
+					return ft
+				}
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if strings.EqualFold(name, key) {
+				return f.Type
+			}
+		}
+	}
+	return nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseBlock(indent int) (any, error) {
+	if isSeqItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseMapping(indent int) (map[string]any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("yaml: line %d: unexpected indentation", line.num)
+		}
+		if isSeqItem(line.text) {
+			return nil, fmt.Errorf("yaml: line %d: unexpected sequence item", line.num)
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("yaml: line %d: expected key: value", line.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("yaml: line %d: duplicate key %q", line.num, key)
+		}
+		p.pos++
+		if rest != "" {
+			v, err := parseYAMLValue(rest)
+			if err != nil {
+				return nil, fmt.Errorf("yaml: line %d: %w", line.num, err)
+			}
+			m[key] = v
+			continue
+		}
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			// キーと同じインデントのシーケンスも値として扱う
+			if next.indent > indent || (next.indent == indent && isSeqItem(next.text)) {
+				v, err := p.parseBlock(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				continue
+			}
+		}
+		m[key] = nil
+	}
+	return m, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) ([]any, error) {
+	var seq []any
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || !isSeqItem(line.text) {
+			if line.indent > indent {
+				return nil, fmt.Errorf("yaml: line %d: unexpected indentation", line.num)
+			}
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err := p.parseBlock(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, v)
+			} else {
+				seq = append(seq, nil)
+			}
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); ok && !strings.HasPrefix(rest, "[") && !strings.HasPrefix(rest, "\"") && !strings.HasPrefix(rest, "'") {
+			// "- key: value" はその位置から始まるマッピングとして読む
+			p.lines[p.pos] = yamlLine{num: line.num, indent: line.indent + len(line.text) - len(rest), text: rest}
+			v, err := p.parseMapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		v, err := parseYAMLValue(rest)
+		if err != nil {
+			return nil, fmt.Errorf("yaml: line %d: %w", line.num, err)
+		}
+		seq = append(seq, v)
+		p.pos++
+	}
+	return seq, nil
+}
+
+// "key: value" をキーと値に分割する
+func splitYAMLKey(text string) (string, string, bool) {
+	inQuote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case inQuote != 0:
+			if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'':
+			inQuote = c
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key := strings.TrimSpace(text[:i])
+			if uq, err := parseYAMLScalar(key); err == nil {
+				if s, ok := uq.(string); ok && (strings.HasPrefix(key, "\"") || strings.HasPrefix(key, "'")) {
+					key = s
+				}
+			}
+			if key == "" {
+				return "", "", false
+			}
+			return key, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// クォートの外にある "#" 以降をコメントとして取り除く
+func stripComment(line string) string {
+	inQuote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inQuote != 0:
+			if c == '\\' && inQuote == '"' {
+				i++
+			} else if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'':
+			inQuote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseYAMLValue(text string) (any, error) {
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated flow sequence")
+		}
+		inner := strings.TrimSpace(text[1 : len(text)-1])
+		seq := []any{}
+		if inner == "" {
+			return seq, nil
+		}
+		for _, item := range splitFlow(inner) {
+			v, err := parseYAMLScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	}
+	if strings.HasPrefix(text, "{") {
+		return nil, fmt.Errorf("flow mappings are not supported")
+	}
+	if strings.HasPrefix(text, "|") || strings.HasPrefix(text, ">") {
+		return nil, fmt.Errorf("block scalars are not supported")
+	}
+	return parseYAMLScalar(text)
+}
+
+// クォートを考慮してカンマで分割する
+func splitFlow(text string) []string {
+	var parts []string
+	inQuote := byte(0)
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case inQuote != 0:
+			if c == '\\' && inQuote == '"' {
+				i++
+			} else if c == inQuote {
+				inQuote = 0
+			}
+		case c == '"' || c == '\'':
+			inQuote = c
+		case c == ',':
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
+
+func parseYAMLScalar(text string) (any, error) {
+	switch {
+	case strings.HasPrefix(text, "\""):
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string %s", text)
+		}
+		return s, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("invalid quoted string %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return yamlPlain{text, true}, nil
+	case "false", "False", "FALSE":
+		return yamlPlain{text, false}, nil
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return yamlPlain{text, n}, nil
+	}
+	// inf・nan などは文字列として扱う
+	if strings.Trim(text, "0123456789+-.eE") == "" {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return yamlPlain{text, f}, nil
+		}
+	}
+	return text, nil
+}
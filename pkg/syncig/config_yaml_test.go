@@ -0,0 +1,117 @@
+package syncig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]any
+	}{
+		{"scalars", "a: 1\nb: -2.5\nc: true\nd: null\ne: ~\nf: text\ng: 007\n",
+			map[string]any{"a": int64(1), "b": -2.5, "c": true, "d": nil, "e": nil, "f": "text", "g": int64(7)}},
+		{"inf and nan are strings", "a: inf\nb: nan\nc: 1e3\n",
+			map[string]any{"a": "inf", "b": "nan", "c": 1000.0}},
+		{"double quoted", `a: "007"` + "\n" + `b: "x # y"` + "\n" + `c: "tab\there"` + "\n",
+			map[string]any{"a": "007", "b": "x # y", "c": "tab\there"}},
+		{"single quoted", "a: 'it''s'\nb: 'true'\n",
+			map[string]any{"a": "it's", "b": "true"}},
+		{"comments", "# header\na: 1 # trailing\nb: x#y\n",
+			map[string]any{"a": int64(1), "b": "x#y"}},
+		{"quoted key", `"a b": 1` + "\n",
+			map[string]any{"a b": int64(1)}},
+		{"block sequence", "a:\n  - x\n  - 2\nb:\n- y\n",
+			map[string]any{"a": []any{"x", int64(2)}, "b": []any{"y"}}},
+		{"flow sequence", "a: [x, \"y, z\", 3]\nb: []\n",
+			map[string]any{"a": []any{"x", "y, z", int64(3)}, "b": []any{}}},
+		{"nested mapping", "a:\n  b:\n    c: 1\n  d: 2\n",
+			map[string]any{"a": map[string]any{"b": map[string]any{"c": int64(1)}, "d": int64(2)}}},
+		{"sequence of mappings", "jobs:\n  - name: a\n    n: 1\n  - name: b\n",
+			map[string]any{"jobs": []any{map[string]any{"name": "a", "n": int64(1)}, map[string]any{"name": "b"}}}},
+		{"document marker and crlf", "---\r\na: 1\r\n",
+			map[string]any{"a": int64(1)}},
+		{"empty", "", map[string]any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.in), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"tab indentation", "a:\n\tb: 1\n"},
+		{"duplicate key", "a: 1\na: 2\n"},
+		{"bad indentation", "a: 1\n  b: 2\n"},
+		{"no colon", "a\n"},
+		{"flow mapping", "a: {b: 1}\n"},
+		{"block scalar", "a: |\n  x\n"},
+		{"unterminated flow sequence", "a: [1, 2\n"},
+		{"unterminated quote", "a: 'x\n"},
+		{"top level sequence", "- a\n- b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := parseYAML([]byte(tt.in), nil); err == nil {
+				t.Errorf("got %#v, want error", got)
+			}
+		})
+	}
+}
+
+// クォートしていない数値・真偽値は、文字列の項目には書いたとおりに、それ以外の項目には数値・真偽値として渡す
+func TestParseYAMLTarget(t *testing.T) {
+	in := "NAME: 007\nCONCURRENCY: 4\nAPPEND: true\nEXCLUDED_EXT: [1.50, x]\nHTTP_HEADERS:\n  X-Id: 0012\nJOBS:\n  - NAME: true\n"
+	got, err := parseYAML([]byte(in), reflect.TypeOf(Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"NAME":         "007",
+		"CONCURRENCY":  int64(4),
+		"APPEND":       true,
+		"EXCLUDED_EXT": []any{"1.50", "x"},
+		"HTTP_HEADERS": map[string]any{"X-Id": "0012"},
+		"JOBS":         []any{map[string]any{"NAME": "true"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestLoadConfigYAMLNumericName(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	data := "NAME: 007\nSRC_DIR: src\nDIST_DIR: \"dist\"\nCONCURRENCY: 2\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NAME != "007" {
+		t.Errorf("NAME = %q, want %q", cfg.NAME, "007")
+	}
+	if cfg.CONCURRENCY != 2 {
+		t.Errorf("CONCURRENCY = %d, want 2", cfg.CONCURRENCY)
+	}
+	if want := filepath.Join(dir, "dist"); cfg.DIST_DIR != want {
+		t.Errorf("DIST_DIR = %q, want %q", cfg.DIST_DIR, want)
+	}
+}
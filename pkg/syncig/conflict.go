@@ -0,0 +1,50 @@
+package syncig
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// 同期先に既にファイルがある場合の扱い（ON_CONFLICT）
+const (
+	// 置き換える（既定）
+	conflictOverwrite = "overwrite"
+	// コピーせずに残す
+	conflictSkip = "skip"
+	// 同期元の更新日時が同期先より新しい場合のみ置き換える
+	conflictNewerOnly = "newer-only"
+	// コピーせずに失敗とする
+	conflictError = "error"
+)
+
+// ON_CONFLICT に従い、同期先の既存のファイルを置き換えるか判定する。
+// 置き換えない場合は理由を返す。APPEND の追記は置き換えではないため対象外
+func (s *syncer) conflict(distFile string, info fs.FileInfo, rec fileRecord) (skip string, err error) {
+	if s.onConflict == "" || s.onConflict == conflictOverwrite {
+		return "", nil
+	}
+	if s.appendOnly {
+		if offset, err := appendOffset(distFile, rec, info); err == nil && offset > 0 {
+			return "", nil
+		}
+	}
+	dst, err := s.statDist(distFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	switch s.onConflict {
+	case conflictSkip:
+		return "exists", nil
+	case conflictNewerOnly:
+		if !info.ModTime().After(dst.ModTime()) {
+			return "not newer", nil
+		}
+	case conflictError:
+		return "", fmt.Errorf("%s already exists (ON_CONFLICT %q)", distFile, conflictError)
+	}
+	return "", nil
+}
@@ -0,0 +1,101 @@
+package syncig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CREDENTIALS: パスワードやトークンなどの認証情報を、設定ファイルに書かずに環境変数・ファイル・OS のキーチェーンから読む。
+// 各同期先が環境変数から読む認証情報（WEBDAV_PASSWORD など）ごとに取得元を指定し、指定がなければ従来どおり環境変数を使う
+
+// CREDENTIALS の取得元の形式
+const (
+	credentialEnv      = "env:"
+	credentialFile     = "file:"
+	credentialKeychain = "keychain:"
+)
+
+// 読み込んだ認証情報。キーチェーンの確認のダイアログなどが同期先を開くたびに出ないよう、取得元ごとに使い回す
+var credentialCache sync.Map
+
+// CREDENTIALS の取得元の形式を確認する
+func validateCredentials(creds map[string]string) error {
+	for name, ref := range creds {
+		if name == "" || strings.ContainsAny(name, "=$ ") {
+			return fmt.Errorf("CREDENTIALS: invalid name %q", name)
+		}
+		kind, arg, _ := strings.Cut(ref, ":")
+		switch kind + ":" {
+		case credentialEnv, credentialFile, credentialKeychain:
+			if arg == "" {
+				return fmt.Errorf("CREDENTIALS %s: %q is empty", name, ref)
+			}
+		default:
+			return fmt.Errorf("CREDENTIALS %s: %q must start with %q, %q or %q", name, ref, credentialEnv, credentialFile, credentialKeychain)
+		}
+	}
+	return nil
+}
+
+// 認証情報 name の値。CREDENTIALS に取得元があればそこから、なければ環境変数 name から読む。
+// どちらにもない場合は空文字列を返す
+func credential(job Job, name string) (string, error) {
+	ref, ok := job.CREDENTIALS[name]
+	if !ok {
+		return os.Getenv(name), nil
+	}
+	if v, ok := credentialCache.Load(ref); ok {
+		return v.(string), nil
+	}
+	kind, arg, _ := strings.Cut(ref, ":")
+	var v string
+	switch kind + ":" {
+	case credentialEnv:
+		v = os.Getenv(arg)
+		if v == "" {
+			return "", fmt.Errorf("credential %s: environment variable %s is not set", name, arg)
+		}
+	case credentialFile:
+		// パスは設定の読み込み時に展開し、設定ファイルのあるディレクトリを基準に解決している
+		b, err := os.ReadFile(arg)
+		if err != nil {
+			return "", fmt.Errorf("credential %s: %w", name, err)
+		}
+		if v = strings.TrimRight(string(b), "\r\n"); v == "" {
+			return "", fmt.Errorf("credential %s: %s is empty", name, arg)
+		}
+	case credentialKeychain:
+		// keychain:<サービス>/<アカウント>。アカウントを省略した場合は name
+		service, account, _ := strings.Cut(arg, "/")
+		if account == "" {
+			account = name
+		}
+		var err error
+		if v, err = readKeychain(service, account); err != nil {
+			return "", fmt.Errorf("credential %s: keychain %s/%s: %w", name, service, account, err)
+		}
+	default:
+		return "", fmt.Errorf("credential %s: unknown source %q", name, ref)
+	}
+	credentialCache.Store(ref, v)
+	return v, nil
+}
+
+// キーチェーンに認証情報がない
+var errNoKeychainItem = errors.New("not found")
+
+// 値の $VAR・${VAR} を認証情報に展開する（HTTP_HEADERS）。CREDENTIALS にない名前は環境変数を使う
+func expandCredentials(job Job, s string) (string, error) {
+	var err error
+	v := os.Expand(s, func(name string) string {
+		v, e := credential(job, name)
+		if e != nil && err == nil {
+			err = e
+		}
+		return v
+	})
+	return v, err
+}
@@ -0,0 +1,178 @@
+package syncig
+
+import (
+	"testing"
+	"time"
+)
+
+// 一致する値を並べたビット集合
+func cronBits(vs ...int) uint64 {
+	var b uint64
+	for _, v := range vs {
+		b |= 1 << v
+	}
+	return b
+}
+
+func cronSpan(lo, hi, step int) uint64 {
+	var b uint64
+	for v := lo; v <= hi; v += step {
+		b |= 1 << v
+	}
+	return b
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		names    []string
+		want     uint64
+	}{
+		{"*", 0, 59, nil, cronSpan(0, 59, 1)},
+		{"0", 0, 59, nil, cronBits(0)},
+		{"1,5,59", 0, 59, nil, cronBits(1, 5, 59)},
+		{"8-18", 0, 23, nil, cronSpan(8, 18, 1)},
+		{"*/10", 0, 59, nil, cronBits(0, 10, 20, 30, 40, 50)},
+		{"*/5", 1, 12, nil, cronBits(1, 6, 11)},
+		{"10-30/7", 0, 59, nil, cronBits(10, 17, 24)},
+		{"5/15", 0, 59, nil, cronBits(5, 20, 35, 50)},
+		{"1-3,20-22", 1, 31, nil, cronBits(1, 2, 3, 20, 21, 22)},
+		{"MON-FRI", 0, 7, cronDays, cronSpan(1, 5, 1)},
+		{"sun,Sat", 0, 7, cronDays, cronBits(0, 6)},
+		{"JAN,jun-AUG", 1, 12, cronMonths, cronBits(1, 6, 7, 8)},
+		{"DEC", 1, 12, cronMonths, cronBits(12)},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.min, tt.max, tt.names)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tt.field, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCronField(%q) = %b, want %b", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"18-8 * * * *",
+		"1, * * * *",
+		"a * * * *",
+		"* * * FOO *",
+		"* * * * FRI-MON",
+		"@reboot",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	c, err := parseCron("*/10 8-18 * * MON-FRI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := cronSchedule{
+		minute: cronBits(0, 10, 20, 30, 40, 50),
+		hour:   cronSpan(8, 18, 1),
+		dom:    cronSpan(1, 31, 1),
+		month:  cronSpan(1, 12, 1),
+		dow:    cronSpan(1, 5, 1),
+		domAny: true,
+	}
+	if *c != want {
+		t.Errorf("parseCron = %+v, want %+v", *c, want)
+	}
+	// 7 は日曜日
+	if c, err := parseCron("0 0 * * 7"); err != nil || c.dow&1 == 0 {
+		t.Errorf("parseCron(weekday 7) = %+v, %v; want Sunday", c, err)
+	}
+	if c, err := parseCron(" @Daily "); err != nil || c.minute != 1 || c.hour != 1 {
+		t.Errorf("parseCron(@daily) = %+v, %v", c, err)
+	}
+}
+
+func TestCronMatchDay(t *testing.T) {
+	// 2024-03-01 は金曜日、2024-03-13 は水曜日、2024-03-15 は金曜日
+	fri1 := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	wed13 := time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC)
+	fri15 := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want [3]bool // fri1, wed13, fri15
+	}{
+		{"0 0 * * *", [3]bool{true, true, true}},
+		// 日のみ・曜日のみの指定はそれぞれに一致する日
+		{"0 0 13 * *", [3]bool{false, true, false}},
+		{"0 0 * * FRI", [3]bool{true, false, true}},
+		// 両方を指定した場合はどちらかに一致すればよい（cron と同じ）
+		{"0 0 13 * FRI", [3]bool{true, true, true}},
+		{"0 0 1 * WED", [3]bool{true, true, false}},
+		// "*/" で始まる指定は * と同じく制限なしとして扱う
+		{"0 0 */2 * FRI", [3]bool{true, false, true}},
+		{"0 0 13 * */1", [3]bool{false, true, false}},
+		// 範囲の曜日は制限ありとして扱う
+		{"0 0 2 * 0-6", [3]bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		for i, day := range []time.Time{fri1, wed13, fri15} {
+			if got := c.matchDay(day); got != tt.want[i] {
+				t.Errorf("%q: matchDay(%s) = %v, want %v", tt.expr, day.Format("Mon Jan 2"), got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		expr, from, want string
+	}{
+		// 2024-03-01 は金曜日
+		{"*/10 8-18 * * MON-FRI", "2024-03-01 08:05:30", "2024-03-01 08:10:00"},
+		{"*/10 8-18 * * MON-FRI", "2024-03-01 08:10:00", "2024-03-01 08:20:00"},
+		{"*/10 8-18 * * MON-FRI", "2024-03-01 18:50:00", "2024-03-04 08:00:00"},
+		{"*/10 8-18 * * MON-FRI", "2024-03-02 12:00:00", "2024-03-04 08:00:00"},
+		{"0 0 1 1 *", "2024-06-15 00:00:00", "2025-01-01 00:00:00"},
+		{"30 2 31 * *", "2024-04-01 00:00:00", "2024-05-31 02:30:00"},
+		{"0 12 29 2 *", "2024-03-01 00:00:00", "2028-02-29 12:00:00"},
+		{"0 0 13 * FRI", "2024-03-02 00:00:00", "2024-03-08 00:00:00"},
+		{"59 23 * * *", "2024-12-31 23:59:00", "2025-01-01 23:59:00"},
+		// 一致する日がない
+		{"0 0 30 2 *", "2024-01-01 00:00:00", "0001-01-01 00:00:00"},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got, want := c.next(at(tt.from)), at(tt.want); !got.Equal(want) {
+			t.Errorf("%q: next(%s) = %s, want %s", tt.expr, tt.from, got, want)
+		}
+	}
+}
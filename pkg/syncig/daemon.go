@@ -0,0 +1,116 @@
+package syncig
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// sync -daemon の -interval の既定値
+const defaultDaemonInterval = 5 * time.Minute
+
+// 複数のホストが同じ時刻に同期を始めないよう、間隔に最大でこの割合のランダムな時間を加える
+const daemonJitterRatio = 0.1
+
+// 同期を繰り返し実行する。SCHEDULE を指定したジョブはその時刻に、それ以外のジョブは
+// 前回の終了から interval（とランダムな時間）が経過してから実行する。
+// 設定ファイルは毎回読み込み直し、失敗した場合もエラーを表示して続ける。
+// 待機中に reload が通知されると、すぐに読み込み直して実行する時刻を求め直す
+// ctx が終了すると実行中の同期を止めて終了する
+func runDaemon(ctx context.Context, interval time.Duration, load func() ([]Job, error), opts RunOptions, reload <-chan struct{}) error {
+	if interval <= 0 {
+		return fmt.Errorf("-interval must be positive")
+	}
+	// ジョブごとの次に実行する時刻
+	next := map[string]time.Time{}
+	started := time.Now()
+	reloaded := false
+	startWatchdog()
+	sdNotify("READY=1\nSTATUS=Waiting for the first run")
+	sleep := func(d time.Duration) {
+		select {
+		case <-time.After(d):
+		case <-reload:
+			reloaded = true
+		case <-ctx.Done():
+		}
+	}
+	for ctx.Err() == nil {
+		jobs, err := load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sync error: %v\n", err)
+			sleep(interval)
+			continue
+		}
+		if reloaded {
+			fmt.Println("Reloaded config.")
+			sdNotify("STATUS=Reloaded config")
+			reloaded = false
+		}
+		now := time.Now()
+		var due []Job
+		var wake time.Time
+		for _, job := range jobs {
+			key := daemonKey(job)
+			at, ok := next[key]
+			if !ok {
+				// SCHEDULE のジョブは起動直後には実行せず、次に一致する時刻を待つ
+				at = started
+				if job.SCHEDULE != "" {
+					at = nextScheduled(job, started)
+				}
+				next[key] = at
+			}
+			if at.IsZero() {
+				continue
+			}
+			if !at.After(now) {
+				due = append(due, job)
+			} else if wake.IsZero() || at.Before(wake) {
+				wake = at
+			}
+		}
+		if len(due) == 0 {
+			if wake.IsZero() {
+				wake = now.Add(interval)
+			}
+			sleep(time.Until(wake))
+			continue
+		}
+		fmt.Printf("Run started: %s\n", now.Format(time.DateTime))
+		sdNotify(fmt.Sprintf("STATUS=Syncing %d jobs (started %s)", len(due), now.Format(time.DateTime)))
+		result := "ok"
+		if err := runJobs(ctx, due, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "sync error: %v\n", err)
+			result = err.Error()
+		}
+		finished := time.Now()
+		for _, job := range due {
+			// 同期が長引いて過ぎた時刻の分はまとめて 1 回とし、終了後の時刻から求める
+			if job.SCHEDULE != "" {
+				next[daemonKey(job)] = nextScheduled(job, finished)
+			} else {
+				next[daemonKey(job)] = finished.Add(interval + rand.N(time.Duration(float64(interval)*daemonJitterRatio)+1))
+			}
+		}
+		fmt.Printf("Run finished: %s (took %s)\n", finished.Format(time.DateTime), finished.Sub(now).Round(time.Millisecond))
+		sdNotify(fmt.Sprintf("STATUS=Last run finished %s: %s", finished.Format(time.DateTime), result))
+	}
+	return nil
+}
+
+// 設定ファイルを読み込み直しても同じジョブを識別できるキー
+func daemonKey(job Job) string {
+	return job.NAME + "\x00" + job.SRC_DIR + "\x00" + job.DIST_DIR + "\x00" + job.SCHEDULE
+}
+
+// t より後で SCHEDULE に一致する時刻。SCHEDULE は validateJob で検証済み
+func nextScheduled(job Job, t time.Time) time.Time {
+	c, err := parseCron(job.SCHEDULE)
+	if err != nil {
+		return time.Time{}
+	}
+	return c.next(t)
+}
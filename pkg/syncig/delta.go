@@ -0,0 +1,294 @@
+package syncig
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DELTA_MIN_SIZE: 同期先の前回の版と一致するブロックをサーバー側でコピーし、変更された部分だけを送る。
+// rsync と同じく、前回送った内容のブロックごとの弱いチェックサム（rolling checksum）と強いハッシュ値を
+// 同期状態に記録しておき、新しい内容を 1 バイトずつずらしながら照合する。同期先を読み直す必要はないが、
+// 同期先のファイルが前回コピーした内容のままであることが前提になる
+
+// ブロックの大きさの下限と、1 ファイルのブロック数の上限（同期状態に記録する大きさを抑える）
+const (
+	minDeltaBlock  = 256 << 10
+	maxDeltaBlocks = 16384
+)
+
+// 1 ブロックの署名。弱いチェックサム 4 バイトと SHA-256 の先頭 16 バイト
+const (
+	deltaStrongLen = 16
+	deltaSigLen    = 4 + deltaStrongLen
+)
+
+// サーバー側でコピーできない同期先・ファイル。通常のアップロードに切り替える
+var errNoDelta = errors.New("server-side copy is not supported")
+
+// 新しい内容の off から n バイト。src は前回の版での位置で、-1 は同期元から送る部分
+type deltaOp struct {
+	off, n, src int64
+}
+
+// 同期先の既存のファイルの範囲をサーバー側でコピーして新しい内容を組み立てられる Destination
+type deltaStore interface {
+	// ops の順に、前回の版の範囲のコピーと literal(off, n) から読んだ内容で name を置き換え、送ったバイト数を返す。
+	// 対応していない場合は errNoDelta を返す
+	putDelta(ctx context.Context, name string, ops []deltaOp, literal func(off, n int64) io.Reader) (int64, error)
+}
+
+// ファイルの大きさに応じたブロックの大きさ（64KiB 単位）
+func deltaBlockSize(size int64) int64 {
+	b := (size + maxDeltaBlocks - 1) / maxDeltaBlocks
+	return max((b+64<<10-1)&^(64<<10-1), minDeltaBlock)
+}
+
+// rsync の弱いチェックサム。1 バイトずらした値を先頭から計算し直さずに求められる
+type rollsum struct {
+	a, b, n uint32
+}
+
+func (r *rollsum) init(p []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(p))
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-i) * uint32(c)
+	}
+}
+
+// 先頭の out を除き、末尾に in を加える
+func (r *rollsum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rollsum) sum() uint32 {
+	return r.b<<16 | r.a&0xffff
+}
+
+func appendBlockSig(sigs, p []byte) []byte {
+	var r rollsum
+	r.init(p)
+	strong := sha256.Sum256(p)
+	sigs = binary.BigEndian.AppendUint32(sigs, r.sum())
+	return append(sigs, strong[:deltaStrongLen]...)
+}
+
+// 書き込まれた内容をブロックに区切って署名を計算する
+type deltaSigner struct {
+	block []byte
+	sigs  []byte
+}
+
+func newDeltaSigner(blockSize int64) *deltaSigner {
+	return &deltaSigner{block: make([]byte, 0, blockSize)}
+}
+
+func (s *deltaSigner) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := min(len(p), cap(s.block)-len(s.block))
+		s.block = append(s.block, p[:m]...)
+		p = p[m:]
+		if len(s.block) == cap(s.block) {
+			s.sigs = appendBlockSig(s.sigs, s.block)
+			s.block = s.block[:0]
+		}
+	}
+	return n, nil
+}
+
+// 末尾の短いブロックを含めたすべての署名
+func (s *deltaSigner) sum() []byte {
+	if len(s.block) > 0 {
+		s.sigs = appendBlockSig(s.sigs, s.block)
+		s.block = s.block[:0]
+	}
+	return s.sigs
+}
+
+// r（大きさ size）を前回の版の記録 rec の署名と照合し、前回の版から取れる範囲と送る範囲を順に返す
+func computeDelta(ctx context.Context, r io.Reader, size int64, rec fileRecord) ([]deltaOp, error) {
+	bs := rec.BlockSize
+	nblocks := int64(len(rec.Blocks) / deltaSigLen)
+	if bs <= 0 || nblocks == 0 || (nblocks-1)*bs >= rec.Size || rec.Size > nblocks*bs {
+		return nil, errors.New("invalid block signatures")
+	}
+	sig := func(i int64) []byte { return rec.Blocks[i*deltaSigLen : (i+1)*deltaSigLen] }
+	tailLen := rec.Size - (nblocks-1)*bs
+	full := nblocks
+	if tailLen < bs {
+		full--
+	}
+	index := make(map[uint32][]int64, full)
+	for i := int64(0); i < full; i++ {
+		w := binary.BigEndian.Uint32(sig(i))
+		index[w] = append(index[w], i)
+	}
+	var ops []deltaOp
+	emit := func(off, n, src int64) {
+		if n == 0 {
+			return
+		}
+		if k := len(ops) - 1; k >= 0 {
+			last := &ops[k]
+			if (src < 0 && last.src < 0) || (src >= 0 && last.src >= 0 && last.src+last.n == src) {
+				last.n += n
+				return
+			}
+		}
+		ops = append(ops, deltaOp{off: off, n: n, src: src})
+	}
+	br := bufio.NewReaderSize(r, int(2*bs))
+	var (
+		pos, lit int64
+		rs       rollsum
+		valid    bool
+	)
+	for pos < size {
+		if pos&(1<<20-1) == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			touchActivity()
+		}
+		win, err := br.Peek(int(min(bs, size-pos)))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if int64(len(win)) < min(bs, size-pos) {
+			return nil, fmt.Errorf("file shrank while reading")
+		}
+		// 最後の短いブロックは前回の版の最後のブロックとのみ照合する
+		if int64(len(win)) < bs {
+			if int64(len(win)) == tailLen {
+				if strong := sha256.Sum256(win); bytes.Equal(strong[:deltaStrongLen], sig(nblocks - 1)[4:]) {
+					emit(lit, pos-lit, -1)
+					emit(pos, tailLen, (nblocks-1)*bs)
+					pos += tailLen
+					lit = pos
+				}
+			}
+			break
+		}
+		if !valid {
+			rs.init(win)
+			valid = true
+		}
+		if cands, ok := index[rs.sum()]; ok {
+			strong := sha256.Sum256(win)
+			matched := int64(-1)
+			for _, i := range cands {
+				if bytes.Equal(strong[:deltaStrongLen], sig(i)[4:]) {
+					matched = i
+					break
+				}
+			}
+			if matched >= 0 {
+				emit(lit, pos-lit, -1)
+				emit(pos, bs, matched*bs)
+				br.Discard(int(bs))
+				pos += bs
+				lit = pos
+				valid = false
+				continue
+			}
+		}
+		// 一致しなければ 1 バイトずらす。最後のブロックまで来た場合は残りをすべて送る
+		next, err := br.Peek(int(bs) + 1)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if int64(len(next)) <= bs {
+			break
+		}
+		rs.roll(next[0], next[bs])
+		br.Discard(1)
+		pos++
+	}
+	emit(lit, size-lit, -1)
+	return ops, nil
+}
+
+// 前回の版から取れるバイト数
+func deltaReused(ops []deltaOp) int64 {
+	var n int64
+	for _, op := range ops {
+		if op.src >= 0 {
+			n += op.n
+		}
+	}
+	return n
+}
+
+// DELTA_MIN_SIZE 以上のファイルをリモートの同期先にコピーする。前回の版の署名が記録されていて、
+// 同期先のファイルが記録と同じ大きさであれば一致するブロックをサーバー側でコピーする。
+// それ以外は通常どおりアップロードし、いずれの場合も次回のために新しい内容の署名を返す
+func (s *syncer) copyDelta(ctx context.Context, srcFile, distFile string, f *os.File, info os.FileInfo, rec fileRecord) copyResult {
+	var r copyResult
+	name := remoteName(distFile)
+	bs := deltaBlockSize(info.Size())
+	ds, ok := s.remote.(deltaStore)
+	if ok && rec.BlockSize > 0 && rec.Blocks != nil {
+		if dinfo, err := s.remote.Stat(ctx, name); err != nil || dinfo.Size() != rec.Size {
+			ok = false
+		}
+	} else {
+		ok = false
+	}
+	if ok {
+		// 署名を照合しながら新しい内容のハッシュ値と署名を計算する
+		h := newHash(s.hashAlgo)
+		signer := newDeltaSigner(bs)
+		ops, err := computeDelta(ctx, io.TeeReader(contextReader{ctx, f}, io.MultiWriter(h, signer)), info.Size(), rec)
+		if err == nil {
+			_, err = io.Copy(io.Discard, io.TeeReader(contextReader{ctx, f}, io.MultiWriter(h, signer)))
+		}
+		if err != nil {
+			r.err = err
+			return r
+		}
+		if deltaReused(ops) > 0 {
+			literal := func(off, n int64) io.Reader {
+				return s.wrapReader(contextReader{ctx, io.NewSectionReader(f, off, n)})
+			}
+			sent, err := ds.putDelta(ctx, name, ops, literal)
+			if err == nil {
+				s.progress.addBytes(info.Size() - sent)
+				// 照合した後に同期元が変更された場合は、記録するハッシュ値と送った内容が一致しない
+				// 署名と一致しない同期先を次回の照合に使わないよう削除する
+				if cur, serr := f.Stat(); serr != nil || cur.Size() != info.Size() || !cur.ModTime().Equal(info.ModTime()) {
+					s.remote.Remove(ctx, name)
+					r.err = fmt.Errorf("%s changed while copying", srcFile)
+					return r
+				}
+				r.sum, r.blockSize, r.blocks = hex.EncodeToString(h.Sum(nil)), bs, signer.sum()
+				r.reused = info.Size() - sent
+				return r
+			}
+			if !errors.Is(err, errNoDelta) {
+				r.err = err
+				return r
+			}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			r.err = err
+			return r
+		}
+	}
+	h := newHash(s.hashAlgo)
+	signer := newDeltaSigner(bs)
+	if r.err = s.remote.Put(ctx, name, io.TeeReader(s.wrapReader(contextReader{ctx, f}), io.MultiWriter(h, signer)), info.Size()); r.err != nil {
+		return r
+	}
+	r.sum, r.blockSize, r.blocks = hex.EncodeToString(h.Sum(nil)), bs, signer.sum()
+	return r
+}
@@ -0,0 +1,107 @@
+package syncig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// FAILOVER_DIST_DIR: 実行の開始時に DIST_DIR に接続できない場合（NAS の保守中など）、代わりに書き込む同期先。
+// DIST_DIR にコピー済みのファイルは DIST_DIR の同期状態から判定して書き込まない。
+// FAILOVER_DIST_DIR に書き込んだファイルは DIST_DIR の同期状態に記録しないため、
+// DIST_DIR に接続できるようになった後の同期で同期元から DIST_DIR にコピーされる
+
+// FAILOVER_DIST_DIR に使えない設定を確認する
+func validateFailover(job Job) error {
+	if job.STATE_DIR == "" || isRemoteURL(job.STATE_DIR) {
+		// DIST_DIR に接続できない間も DIST_DIR の同期状態を読む必要がある
+		return errors.New("FAILOVER_DIST_DIR requires a local STATE_DIR")
+	}
+	if len(job.DIST_DIRS) > 0 {
+		return errors.New("FAILOVER_DIST_DIR cannot be used with DIST_DIRS")
+	}
+	switch job.MODE {
+	case modeMove:
+		// DIST_DIR に後からコピーするファイルが同期元に残っている必要がある
+		return errors.New("MODE \"move\" cannot be used with FAILOVER_DIST_DIR")
+	case modeBidirectional:
+		return errors.New("MODE \"bidirectional\" cannot be used with FAILOVER_DIST_DIR")
+	}
+	// HTTP の同期先は読めないため、接続できるかを確かめられず、同期状態も置けない
+	if isHTTPURL(job.DIST_DIR) || isHTTPURL(job.FAILOVER_DIST_DIR) {
+		return errors.New("FAILOVER_DIST_DIR cannot be used with an http:// or https:// destination")
+	}
+	if job.FAILOVER_DIST_DIR == job.DIST_DIR {
+		return errors.New("FAILOVER_DIST_DIR must differ from DIST_DIR")
+	}
+	return nil
+}
+
+// FAILOVER_DIST_DIR に書き込むジョブ。同期状態は FAILOVER_DIST_DIR に置く
+func (j Job) failover() Job {
+	f := j
+	f.DIST_DIR, f.FAILOVER_DIST_DIR, f.STATE_DIR = j.FAILOVER_DIST_DIR, "", ""
+	f.primary = j.DIST_DIR
+	return f
+}
+
+// DIST_DIR に接続できるか確かめる。ローカルの場合は既にあるディレクトリでなければならない
+// （マウントされていない NAS のマウントポイントに書き込まないよう、作成はしない）
+func probeDist(ctx context.Context, job Job) error {
+	if !isRemoteURL(job.DIST_DIR) {
+		info, err := os.Stat(job.DIST_DIR)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", job.DIST_DIR)
+		}
+		return nil
+	}
+	r, root, err := openRemote(job.DIST_DIR, job)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// まだ何もない同期先は接続できている
+	if _, err := r.ReadDir(ctx, root); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// FAILOVER_DIST_DIR のあるジョブの実行。DIST_DIR に接続できなければ FAILOVER_DIST_DIR に書き込む
+func runFailover(ctx context.Context, job Job, opts RunOptions) error {
+	err := probeDist(ctx, job)
+	if err == nil {
+		s, err := newSyncer(ctx, job, opts)
+		if err != nil {
+			return err
+		}
+		defer s.close()
+		return s.run()
+	}
+	fmt.Fprintf(os.Stderr, "DIST_DIR %s is unreachable (%v); writing to FAILOVER_DIST_DIR %s\n", job.DIST_DIR, err, job.FAILOVER_DIST_DIR)
+	baseline, err := openJobState(job, opts.ForceState)
+	if err != nil {
+		return err
+	}
+	defer baseline.close()
+	s, err := newSyncer(ctx, job.failover(), opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	s.baseline = baseline
+	return s.run()
+}
+
+// DIST_DIR の同期状態 base で name がコピー済みか
+func (s *syncer) copiedToPrimary(base *manifest, name string, info fs.FileInfo) bool {
+	if rec, ok := base.Files[name]; ok {
+		return rec.DeletedAt.IsZero()
+	}
+	return !s.isNew(base, name, info)
+}
@@ -0,0 +1,113 @@
+package syncig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DIST_DIRS: 1 つのジョブで複数の同期先（ローカルのミラーと S3 など）に同じファイルをコピーする。
+// 同期先ごとのジョブに分けて順に実行し、同期状態と失敗は同期先ごとに扱う。
+// ある同期先が失敗しても他の同期先のコピーは続け、失敗した同期先には次回の同期でコピーする
+
+// DIST_DIRS のジョブを同期先ごとのジョブに分ける。分けたジョブは DIST_DIR に各同期先を、
+// DIST_DIRS に元の一覧を持つ
+func expandDestinations(jobs []Job) ([]Job, error) {
+	var out []Job
+	for _, job := range jobs {
+		if len(job.DIST_DIRS) == 0 {
+			out = append(out, job)
+			continue
+		}
+		if job.DIST_DIR != "" {
+			name := job.NAME
+			if name == "" {
+				name = "(default)"
+			}
+			return nil, fmt.Errorf("job %s: DIST_DIR and DIST_DIRS cannot both be set", name)
+		}
+		for _, dist := range job.DIST_DIRS {
+			j := job
+			j.DIST_DIR = dist
+			j.stateSub = destStateDir(dist)
+			out = append(out, j)
+		}
+	}
+	return out, nil
+}
+
+// 同期先ごとの同期状態を置く STATE_DIR の下のディレクトリ名。DIST_DIRS の順序を変えても
+// 同じ同期状態を使うよう、同期先のパス・URL から決める
+func destStateDir(dist string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, dist), "_.")
+}
+
+// DIST_DIRS に使えない設定を確認する
+func validateDestinations(job Job) error {
+	switch job.MODE {
+	case modeMove:
+		// 最初の同期先にコピーした時点で同期元から消え、他の同期先にコピーできなくなる
+		return errors.New("MODE \"move\" cannot be used with DIST_DIRS")
+	case modeBidirectional:
+		return errors.New("MODE \"bidirectional\" cannot be used with DIST_DIRS")
+	}
+	seen := map[string]string{}
+	for _, dist := range job.DIST_DIRS {
+		if dist == "" {
+			return errors.New("DIST_DIRS has an empty entry")
+		}
+		key := destStateDir(dist)
+		if prev, ok := seen[key]; ok {
+			if prev == dist {
+				return fmt.Errorf("DIST_DIRS has %q twice", dist)
+			}
+			return fmt.Errorf("DIST_DIRS %q and %q would share the same state directory", prev, dist)
+		}
+		seen[key] = dist
+	}
+	return nil
+}
+
+// DIST_DIRS・FAILOVER_DIST_DIR を含めたジョブの同期先のいずれかが fn を満たす
+func (j Job) anyDist(fn func(dist string) bool) bool {
+	dists := j.DIST_DIRS
+	if len(dists) == 0 {
+		dists = []string{j.DIST_DIR}
+	}
+	for _, d := range append(dists, j.FAILOVER_DIST_DIR, j.primary) {
+		if d == "" {
+			continue
+		}
+		if fn(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// DIST_DIRS・FAILOVER_DIST_DIR を含めたジョブの同期先のいずれかが prefixes のいずれかで始まる
+func (j Job) distHasPrefix(prefixes ...string) bool {
+	return j.anyDist(func(dist string) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(dist, p) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ジョブの見出しを表示する。DIST_DIRS の同期先ごとのジョブは同期先も表示する
+func printJobHeader(job Job) {
+	if job.NAME != "" {
+		fmt.Printf("Job: %s\n", job.NAME)
+	}
+	if len(job.DIST_DIRS) > 0 {
+		fmt.Printf("Destination: %s\n", job.DIST_DIR)
+	}
+}
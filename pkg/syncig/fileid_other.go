@@ -0,0 +1,17 @@
+//go:build !windows
+
+package syncig
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// デバイス番号と inode 番号からファイルの識別子を返す。取得できない場合は空文字列
+func fileID(path string, info fs.FileInfo) (string, error) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", st.Dev, st.Ino), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package syncig
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// ボリュームのシリアル番号とファイルインデックスからファイルの識別子を返す
+func fileID(path string, info fs.FileInfo) (string, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	// 書き込み中のファイルも開けるよう、すべての共有を許可する
+	h, err := syscall.CreateFile(p, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(h)
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &d); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", d.VolumeSerialNumber, uint64(d.FileIndexHigh)<<32|uint64(d.FileIndexLow)), nil
+}
@@ -0,0 +1,233 @@
+package syncig
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ジョブの設定から組み立てたファイル・ディレクトリの絞り込み条件
+type fileFilter struct {
+	includedExt  []string
+	excludedExt  []string
+	includeGlobs []string
+	excludeGlobs []string
+	includeRegex []*regexp.Regexp
+	excludeRegex []*regexp.Regexp
+	excludedDirs []string
+	maxDepth     int
+	skipHidden   bool
+	minSize      ByteSize
+	maxSize      ByteSize
+	minAge       time.Duration
+	modAfter     time.Time
+	// サブディレクトリを並列に処理する場合、.syncigignore の読み込みと判定が並行するため
+	ignoreMu    sync.RWMutex
+	ignore      ignoreSet
+	excludeFrom ignoreSet
+}
+
+// パターンはここで一度だけ検証・コンパイルする
+func newFileFilter(job Job) (*fileFilter, error) {
+	globs := append(append(append([]string{}, job.INCLUDE_GLOBS...), job.EXCLUDE_GLOBS...), job.EXCLUDED_DIRS...)
+	for _, g := range globs {
+		if err := checkGlob(g); err != nil {
+			return nil, err
+		}
+	}
+	includeRegex, err := compileRegexps(job.INCLUDE_REGEX)
+	if err != nil {
+		return nil, err
+	}
+	excludeRegex, err := compileRegexps(job.EXCLUDE_REGEX)
+	if err != nil {
+		return nil, err
+	}
+	var excludeFrom ignoreSet
+	if job.EXCLUDE_FROM != "" {
+		if excludeFrom, err = loadExcludeFrom(job.EXCLUDE_FROM); err != nil {
+			return nil, fmt.Errorf("EXCLUDE_FROM: %w", err)
+		}
+	}
+	return &fileFilter{
+		includedExt:  job.INCLUDED_EXT,
+		excludedExt:  job.EXCLUDED_EXT,
+		includeGlobs: job.INCLUDE_GLOBS,
+		excludeGlobs: job.EXCLUDE_GLOBS,
+		includeRegex: includeRegex,
+		excludeRegex: excludeRegex,
+		excludedDirs: job.EXCLUDED_DIRS,
+		maxDepth:     job.MAX_DEPTH,
+		skipHidden:   job.SKIP_HIDDEN,
+		minSize:      job.MIN_SIZE,
+		maxSize:      job.MAX_SIZE,
+		minAge:       time.Duration(job.MIN_AGE),
+		modAfter:     job.MODIFIED_AFTER.Time,
+		excludeFrom:  excludeFrom,
+	}, nil
+}
+
+func compileRegexps(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchAnyRegexp(res []*regexp.Regexp, name string) bool {
+	for _, re := range res {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ディレクトリ配下をまとめて走査対象外にするか判定する。rel は SRC_DIR からの / 区切りの相対パス
+func (f *fileFilter) skipDir(rel string, d fs.DirEntry) bool {
+	if f.skipHidden && isHidden(rel, d) {
+		return true
+	}
+	if f.maxDepth > 0 && strings.Count(rel, "/")+1 > f.maxDepth {
+		return true
+	}
+	for _, p := range f.excludedDirs {
+		// / を含まないパターンはディレクトリ名と照合する
+		if !strings.Contains(p, "/") {
+			if ok, _ := path.Match(p, path.Base(rel)); ok {
+				return true
+			}
+		} else if matchGlob(p, rel) {
+			return true
+		}
+	}
+	return matchAnyGlob(f.excludeGlobs, rel) || f.ignored(rel, true) || f.excludeFrom.match(rel, true)
+}
+
+// dir（SRC_DIR からの相対パス rel）にある .syncigignore のルールを追加する
+func (f *fileFilter) loadIgnoreFile(dir, rel string) error {
+	f.ignoreMu.Lock()
+	defer f.ignoreMu.Unlock()
+	return f.ignore.load(dir, rel)
+}
+
+func (f *fileFilter) ignored(rel string, isDir bool) bool {
+	f.ignoreMu.RLock()
+	defer f.ignoreMu.RUnlock()
+	return f.ignore.match(rel, isDir)
+}
+
+// ファイルをコピー対象外にするか判定する。rel は SRC_DIR からの / 区切りの相対パス
+func (f *fileFilter) skipFile(rel string, info fs.FileInfo) bool {
+	if isIgnoreFile(rel) || f.ignored(rel, false) || f.excludeFrom.match(rel, false) {
+		return true
+	}
+	if f.skipHidden && (strings.HasPrefix(path.Base(rel), ".") || hasHiddenAttr(info)) {
+		return true
+	}
+	ext := path.Ext(rel)
+	// INCLUDED_EXT を指定した場合はそれ以外の拡張子をすべて除外する
+	if len(f.includedExt) > 0 && !hasExt(ext, f.includedExt) {
+		return true
+	}
+	if hasExt(ext, f.excludedExt) {
+		return true
+	}
+	// ファイルサイズ0判定
+	if info.Size() == 0 {
+		return true
+	}
+	if info.Size() < int64(f.minSize) || (f.maxSize > 0 && info.Size() > int64(f.maxSize)) {
+		return true
+	}
+	if !f.modAfter.IsZero() && !info.ModTime().After(f.modAfter) {
+		return true
+	}
+	if len(f.includeGlobs) > 0 && !matchAnyGlob(f.includeGlobs, rel) {
+		return true
+	}
+	if matchAnyGlob(f.excludeGlobs, rel) {
+		return true
+	}
+	name := path.Base(rel)
+	if len(f.includeRegex) > 0 && !matchAnyRegexp(f.includeRegex, name) {
+		return true
+	}
+	return matchAnyRegexp(f.excludeRegex, name)
+}
+
+func isHidden(rel string, d fs.DirEntry) bool {
+	if strings.HasPrefix(path.Base(rel), ".") {
+		return true
+	}
+	info, err := d.Info()
+	return err == nil && hasHiddenAttr(info)
+}
+
+// MIN_AGE を満たし、書き込みが終わっているとみなせるか判定する
+func (f *fileFilter) settled(info fs.FileInfo, now time.Time) bool {
+	return f.minAge <= 0 || now.Sub(info.ModTime()) >= f.minAge
+}
+
+func checkGlob(pattern string) error {
+	for _, seg := range strings.Split(pattern, "/") {
+		if seg == "**" {
+			continue
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchAnyGlob(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if matchGlob(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// doublestar 形式のパターンと / 区切りのパスを照合する。
+// ** は 0 個以上のディレクトリに一致し、それ以外のセグメントは path.Match で照合する
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for len(pat) > 0 && pat[0] == "**" {
+				pat = pat[1:]
+			}
+			if len(pat) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
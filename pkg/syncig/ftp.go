@@ -0,0 +1,796 @@
+package syncig
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FTP・FTPS のサーバーに書き込む。ftp:// は暗号化なし、ftpes:// は AUTH TLS で暗号化する明示的 FTPS、
+// ftps:// は接続時から TLS を使う暗黙的 FTPS（既定のポートは 990）。データ接続はパッシブモードで開く
+
+// 応答・データの送受信を待つ時間
+const ftpTimeout = 60 * time.Second
+
+// 1 つの同期先に同時に開く接続の数。接続数を制限しているサーバーが多いため少なめにする
+const ftpConnections = 4
+
+// これより長く使っていない接続は、サーバーに切断されていないか NOOP で確かめてから使う
+const ftpIdleCheck = 15 * time.Second
+
+// これ以下のファイルはメモリに読み込んでから送り、接続が切れた場合などに接続し直して送り直す
+const ftpBufferSize = 16 << 20
+
+// 接続し直して送り直す回数
+const ftpRetries = 3
+
+const (
+	ftpPlain = iota
+	ftpExplicitTLS
+	ftpImplicitTLS
+)
+
+// ftp://user@host:port/path の同期先
+type ftpStore struct {
+	// エラーに付ける ftp://host:port
+	label    string
+	addr     string
+	user     string
+	password string
+	security int
+	tls      *tls.Config
+	// PROXY（nil の場合は直接接続する）
+	proxy *url.URL
+	// 同時に使う接続の数を制限する
+	sem  chan struct{}
+	mu   sync.Mutex
+	idle []*ftpConn
+	// ログインしたディレクトリ。/~/ で始まる URL のパスはここからの相対パスになる
+	home string
+	// 作成済み、または既にあることを確認したディレクトリ
+	dirs sync.Map
+}
+
+func openFTPStore(u *url.URL, job Job) (*ftpStore, error) {
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("%s: passwords in the URL are not supported; set FTP_PASSWORD", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: host is empty", u.Redacted())
+	}
+	password, err := credential(job, "FTP_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := jobProxy(job)
+	if err != nil {
+		return nil, err
+	}
+	s := &ftpStore{user: "anonymous", password: password, proxy: proxy, sem: make(chan struct{}, ftpConnections)}
+	if u.User != nil && u.User.Username() != "" {
+		s.user = u.User.Username()
+	}
+	port := "21"
+	switch u.Scheme {
+	case "ftpes":
+		s.security = ftpExplicitTLS
+	case "ftps":
+		s.security, port = ftpImplicitTLS, "990"
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+	s.label = u.Scheme + "://" + s.addr
+	if s.security != ftpPlain {
+		// データ接続で制御接続の TLS セッションを再開することを求めるサーバー（vsftpd など）があるため、セッションを保存する
+		s.tls = &tls.Config{ServerName: u.Hostname(), ClientSessionCache: tls.NewLRUClientSessionCache(8)}
+	}
+	// 接続とログインができるかを最初に確かめる
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	s.release(c, nil)
+	return s, nil
+}
+
+// 制御接続
+type ftpConn struct {
+	s    *ftpStore
+	nc   net.Conn
+	text *textproto.Conn
+	// FEAT で確認した拡張
+	mlst bool
+	epsv bool
+	used time.Time
+}
+
+// 失敗した応答。4xx は一時的なエラーとして送り直す
+type ftpStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *ftpStatusError) Error() string {
+	return fmt.Sprintf("%d %s", e.code, e.msg)
+}
+
+// 550 はファイルがない場合と権限がない場合の両方で返るが、どちらか区別できないためファイルがないとみなす
+func (e *ftpStatusError) Is(target error) bool {
+	return target == fs.ErrNotExist && e.code == 550
+}
+
+func (e *ftpStatusError) temporary() bool {
+	return e.code >= 400 && e.code < 500
+}
+
+// 接続し直せば成功する可能性があるエラー。421 はサーバーが接続を閉じることを表す
+func ftpConnError(err error) bool {
+	var se *ftpStatusError
+	if errors.As(err, &se) {
+		return se.code == 421
+	}
+	var pe *fs.PathError
+	return err != nil && !errors.As(err, &pe)
+}
+
+func (s *ftpStore) pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var se *ftpStatusError
+	if errors.As(err, &se) {
+		return &fs.PathError{Op: op, Path: s.label + s.abs(name), Err: err}
+	}
+	return fmt.Errorf("%s %s: %w", op, s.label+s.abs(name), err)
+}
+
+// リモートでのパスを、ログインしたディレクトリを基準にした絶対パスにする
+func (s *ftpStore) abs(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	return path.Join(s.home, name)
+}
+
+func (s *ftpStore) dialTCP(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ftpTimeout)
+	defer cancel()
+	return dialTCP(ctx, s.proxy, addr)
+}
+
+func (s *ftpStore) dial() (*ftpConn, error) {
+	nc, err := s.dialTCP(s.addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.security == ftpImplicitTLS {
+		nc = tls.Client(nc, s.tls)
+	}
+	c := &ftpConn{s: s, nc: nc, text: textproto.NewConn(nc)}
+	if err := c.login(); err != nil {
+		c.nc.Close()
+		return nil, fmt.Errorf("%s: %w", s.label, err)
+	}
+	c.used = time.Now()
+	return c, nil
+}
+
+func (c *ftpConn) login() error {
+	c.nc.SetDeadline(time.Now().Add(ftpTimeout))
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		return ftpReplyError(err)
+	}
+	if c.s.security == ftpExplicitTLS {
+		if _, _, err := c.cmd(2, "AUTH TLS"); err != nil {
+			return err
+		}
+		c.nc = tls.Client(c.nc, c.s.tls)
+		c.text = textproto.NewConn(c.nc)
+	}
+	code, _, err := c.cmd(0, "USER %s", c.s.user)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, _, err := c.cmd(2, "PASS %s", c.s.password); err != nil {
+			return err
+		}
+	}
+	if c.s.security != ftpPlain {
+		// データ接続も暗号化する
+		if _, _, err := c.cmd(2, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, _, err := c.cmd(2, "PROT P"); err != nil {
+			return err
+		}
+	}
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return err
+	}
+	// FEAT に対応していないサーバーでは拡張を使わない
+	if _, msg, err := c.cmd(2, "FEAT"); err == nil {
+		for _, line := range strings.Split(msg, "\n") {
+			feat, _, _ := strings.Cut(strings.ToUpper(strings.TrimSpace(line)), " ")
+			switch feat {
+			case "MLST":
+				c.mlst = true
+			case "EPSV":
+				c.epsv = true
+			case "UTF8":
+				c.cmd(2, "OPTS UTF8 ON")
+			}
+		}
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if c.s.home == "" {
+		_, msg, err := c.cmd(2, "PWD")
+		if err != nil {
+			return err
+		}
+		// 257 "/home/user" is the current directory
+		home := "/"
+		if i, j := strings.Index(msg, `"`), strings.LastIndex(msg, `"`); i >= 0 && j > i {
+			home = strings.ReplaceAll(msg[i+1:j], `""`, `"`)
+		}
+		c.s.home = home
+	}
+	return nil
+}
+
+// textproto の応答のエラーを ftpStatusError にする
+func ftpReplyError(err error) error {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return &ftpStatusError{code: te.Code, msg: te.Msg}
+	}
+	return err
+}
+
+// コマンドを送って応答を読む。expect は期待する応答の 1 桁目（0 は 2xx と 3xx のどちらも受け付ける）
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	c.nc.SetDeadline(time.Now().Add(ftpTimeout))
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.readReply(expect)
+}
+
+func (c *ftpConn) readReply(expect int) (int, string, error) {
+	c.nc.SetDeadline(time.Now().Add(ftpTimeout))
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil {
+		return code, msg, ftpReplyError(err)
+	}
+	if code/100 == expect || expect == 0 && (code/100 == 2 || code/100 == 3) {
+		return code, msg, nil
+	}
+	return code, msg, &ftpStatusError{code: code, msg: msg}
+}
+
+// パッシブモードでデータ接続を開き、転送のコマンドを送る。PASV が返すアドレスは NAT の内側の
+// アドレスのことがあるため使わず、制御接続と同じホストのポートに接続する
+func (c *ftpConn) openData(format string, args ...any) (*ftpDataConn, error) {
+	port := ""
+	if c.epsv {
+		// 229 Entering Extended Passive Mode (|||6446|)
+		if _, msg, err := c.cmd(2, "EPSV"); err == nil {
+			if i, j := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)"); i >= 0 && j > i+4 {
+				port = msg[i+4 : j]
+			}
+		} else if ftpConnError(err) {
+			return nil, err
+		}
+	}
+	if port == "" {
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		_, msg, err := c.cmd(2, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		i, j := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if i < 0 || j < i {
+			return nil, fmt.Errorf("unexpected PASV reply %q", msg)
+		}
+		f := strings.Split(msg[i+1:j], ",")
+		if len(f) != 6 {
+			return nil, fmt.Errorf("unexpected PASV reply %q", msg)
+		}
+		p1, err1 := strconv.Atoi(strings.TrimSpace(f[4]))
+		p2, err2 := strconv.Atoi(strings.TrimSpace(f[5]))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("unexpected PASV reply %q", msg)
+		}
+		port = strconv.Itoa(p1<<8 | p2)
+	}
+	// プロキシを経由する場合、制御接続の相手のアドレスはプロキシのものになるため、URL のホストに接続する
+	host, _, _ := net.SplitHostPort(c.nc.RemoteAddr().String())
+	if c.s.proxy != nil {
+		host, _, _ = net.SplitHostPort(c.s.addr)
+	}
+	nc, err := c.s.dialTCP(net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if c.s.security != ftpPlain {
+		tc := tls.Client(nc, c.s.tls)
+		tc.SetDeadline(time.Now().Add(ftpTimeout))
+		if err := tc.Handshake(); err != nil {
+			tc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	return &ftpDataConn{nc}, nil
+}
+
+// 読み書きのたびに期限を延ばすデータ接続。止まったままのサーバーを待ち続けないようにする
+type ftpDataConn struct {
+	net.Conn
+}
+
+func (d *ftpDataConn) Read(p []byte) (int, error) {
+	d.SetDeadline(time.Now().Add(ftpTimeout))
+	return d.Conn.Read(p)
+}
+
+func (d *ftpDataConn) Write(p []byte) (int, error) {
+	d.SetDeadline(time.Now().Add(ftpTimeout))
+	return d.Conn.Write(p)
+}
+
+// 送信を終えたことを伝え、サーバーが閉じるまで待つ。受信していないデータ（TLS 1.3 のセッションチケットなど）を
+// 残したまま閉じると RST が送られ、サーバーが読み込む前のデータが失われることがある
+func (d *ftpDataConn) closeWrite() error {
+	nc := d.Conn
+	if tc, ok := nc.(*tls.Conn); ok {
+		if err := tc.CloseWrite(); err != nil {
+			return err
+		}
+		nc = tc.NetConn()
+	}
+	// プロキシ経由の接続も含め、TCP の接続は送信側だけを閉じられる
+	if tc, ok := nc.(interface{ CloseWrite() error }); ok {
+		if err := tc.CloseWrite(); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(io.Discard, d)
+	return err
+}
+
+// 使っていない接続か新しい接続を返す。使い終わったら release を呼ぶ
+func (s *ftpStore) get() (*ftpConn, error) {
+	s.sem <- struct{}{}
+	for {
+		s.mu.Lock()
+		var c *ftpConn
+		if n := len(s.idle); n > 0 {
+			c, s.idle = s.idle[n-1], s.idle[:n-1]
+		}
+		s.mu.Unlock()
+		if c == nil {
+			break
+		}
+		// アイドルのタイムアウトでサーバーが閉じた接続は使わない
+		if time.Since(c.used) < ftpIdleCheck {
+			return c, nil
+		}
+		if _, _, err := c.cmd(2, "NOOP"); err == nil {
+			return c, nil
+		}
+		c.nc.Close()
+	}
+	c, err := s.dial()
+	if err != nil {
+		<-s.sem
+		return nil, err
+	}
+	return c, nil
+}
+
+// 接続を返す。接続が使えなくなるエラーの場合は閉じる
+func (s *ftpStore) release(c *ftpConn, err error) {
+	if ftpConnError(err) {
+		c.nc.Close()
+	} else {
+		c.used = time.Now()
+		s.mu.Lock()
+		s.idle = append(s.idle, c)
+		s.mu.Unlock()
+	}
+	<-s.sem
+}
+
+// 接続を借りて fn を実行する。接続が切れた場合や一時的なエラーの場合は、接続し直して fn をやり直す
+func (s *ftpStore) run(ctx context.Context, fn func(c *ftpConn) error) error {
+	for attempt := 0; ; attempt++ {
+		c, err := s.get()
+		if err == nil {
+			err = fn(c)
+			s.release(c, err)
+			if err == nil {
+				return nil
+			}
+		}
+		if !retryTemporary(ctx, err, attempt, ftpRetries) {
+			return err
+		}
+	}
+}
+
+// dir とその親のディレクトリを作る。既にある場合の MKD は 550 が返るため、失敗は無視して書き込みの失敗で知らせる
+func (s *ftpStore) mkdirAll(ctx context.Context, dir string) error {
+	dir = s.abs(dir)
+	if dir == "/" {
+		return nil
+	}
+	if _, ok := s.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	err := s.run(ctx, func(c *ftpConn) error {
+		_, _, err := c.cmd(2, "MKD %s", dir)
+		var se *ftpStatusError
+		if errors.As(err, &se) && se.code == 550 {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return s.pathError("mkdir", dir, err)
+	}
+	s.dirs.Store(dir, true)
+	return nil
+}
+
+// STOR で name に書き込む
+func (c *ftpConn) stor(name string, r io.Reader) error {
+	d, err := c.openData("STOR %s", name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d, activityReader{r})
+	if err == nil {
+		err = d.closeWrite()
+	}
+	d.Close()
+	if err != nil {
+		// 送信が途中で終わった場合、制御接続の状態が分からないため接続ごと捨てる
+		return err
+	}
+	_, _, err = c.readReply(2)
+	return err
+}
+
+// 既にあるファイルを置き換えられないサーバー（IIS など）では、削除してから名前を変更する
+func (c *ftpConn) rename(from, to string) error {
+	if _, _, err := c.cmd(3, "RNFR %s", from); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(2, "RNTO %s", to)
+	var se *ftpStatusError
+	if errors.As(err, &se) && (se.code == 550 || se.code == 553) {
+		if _, _, err := c.cmd(2, "DELE %s", to); err != nil {
+			return err
+		}
+		if _, _, err := c.cmd(3, "RNFR %s", from); err != nil {
+			return err
+		}
+		_, _, err = c.cmd(2, "RNTO %s", to)
+	}
+	return err
+}
+
+// 同じディレクトリの <名前>.partial に書き込んでから名前を変更する
+func (s *ftpStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if err := s.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	name = s.abs(name)
+	tmp := name + partialExt
+	first, err := readPart(r, size, ftpBufferSize)
+	if err != nil {
+		return err
+	}
+	upload := func(c *ftpConn) error {
+		if err := c.stor(tmp, bytes.NewReader(first)); err != nil {
+			return err
+		}
+		return c.rename(tmp, name)
+	}
+	if len(first) <= ftpBufferSize {
+		err = s.run(ctx, upload)
+	} else {
+		// 大きいファイルは同期元から読みながら送るため、送り直さない
+		var c *ftpConn
+		if c, err = s.get(); err == nil {
+			if err = c.stor(tmp, io.MultiReader(bytes.NewReader(first), r)); err == nil {
+				err = c.rename(tmp, name)
+			}
+			s.release(c, err)
+		}
+	}
+	if err != nil {
+		// 中断した場合も一時ファイルは削除する
+		s.Remove(context.Background(), tmp)
+		return s.pathError("put", name, err)
+	}
+	return nil
+}
+
+// FTP には既にある場合に失敗する書き込みがないため、ないことを確かめてから書き込む。
+// 確かめてから書き込むまでの間に他のマシンが作った場合は上書きする
+func (s *ftpStore) Create(ctx context.Context, name string, data []byte) error {
+	if err := s.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	if _, err := s.Stat(ctx, name); err == nil {
+		return &fs.PathError{Op: "create", Path: s.label + s.abs(name), Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	name = s.abs(name)
+	return s.pathError("create", name, s.run(ctx, func(c *ftpConn) error {
+		return c.stor(name, bytes.NewReader(data))
+	}))
+}
+
+// RETR で読み込む。読み終えるまで接続を借りたままにする
+func (s *ftpStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name = s.abs(name)
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	d, err := c.openData("RETR %s", name)
+	if err != nil {
+		s.release(c, err)
+		return nil, s.pathError("open", name, err)
+	}
+	return &ftpReader{s: s, c: c, d: d, name: name}, nil
+}
+
+type ftpReader struct {
+	s    *ftpStore
+	c    *ftpConn
+	d    *ftpDataConn
+	name string
+	eof  bool
+	done bool
+}
+
+func (r *ftpReader) Read(p []byte) (int, error) {
+	n, err := r.d.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// 最後まで読んだ場合は転送の完了の応答を読んで接続を返す。途中で閉じた場合は接続ごと捨てる
+func (r *ftpReader) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	r.d.Close()
+	var err error
+	if r.eof {
+		_, _, err = r.c.readReply(2)
+	} else {
+		err = io.ErrClosedPipe
+	}
+	r.s.release(r.c, err)
+	if r.eof {
+		return r.s.pathError("open", r.name, err)
+	}
+	return nil
+}
+
+// MLST に対応していれば MLST で、対応していなければ SIZE と MDTM で調べる。
+// SIZE が失敗した場合は CWD できればディレクトリとみなす
+func (s *ftpStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	name = s.abs(name)
+	var info *remoteFileInfo
+	err := s.run(ctx, func(c *ftpConn) error {
+		if c.mlst {
+			_, msg, err := c.cmd(2, "MLST %s", name)
+			if err != nil {
+				return err
+			}
+			for _, line := range strings.Split(msg, "\n") {
+				if strings.HasPrefix(line, " ") {
+					info = parseMLSx(strings.TrimPrefix(line, " "))
+				}
+			}
+			if info == nil {
+				return fmt.Errorf("unexpected MLST reply %q", msg)
+			}
+			info.name = path.Base(name)
+			return nil
+		}
+		_, msg, err := c.cmd(2, "SIZE %s", name)
+		if err != nil {
+			if _, _, cerr := c.cmd(2, "CWD %s", name); cerr == nil {
+				info = &remoteFileInfo{name: path.Base(name), dir: true}
+				return nil
+			}
+			return err
+		}
+		info = &remoteFileInfo{name: path.Base(name)}
+		info.size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+		if _, msg, err := c.cmd(2, "MDTM %s", name); err == nil {
+			info.mtime, _ = time.Parse("20060102150405", strings.TrimSpace(msg))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.pathError("stat", name, err)
+	}
+	if info == nil {
+		return nil, &fs.PathError{Op: "stat", Path: s.label + name, Err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+// MLST・MLSD の 1 行（type=file;size=12;modify=20260102030405; name）。ファイルとディレクトリ以外は nil を返す
+func parseMLSx(line string) *remoteFileInfo {
+	facts, name, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil
+	}
+	info := &remoteFileInfo{name: name}
+	for _, f := range strings.Split(facts, ";") {
+		k, v, _ := strings.Cut(f, "=")
+		switch strings.ToLower(k) {
+		case "type":
+			switch strings.ToLower(v) {
+			case "file":
+			case "dir":
+				info.dir = true
+			default:
+				return nil
+			}
+		case "size":
+			info.size, _ = strconv.ParseInt(v, 10, 64)
+		case "modify":
+			// 秒の小数部が付く場合がある
+			v, _, _ = strings.Cut(v, ".")
+			info.mtime, _ = time.Parse("20060102150405", v)
+		}
+	}
+	return info
+}
+
+func (s *ftpStore) Remove(ctx context.Context, name string) error {
+	name = s.abs(name)
+	return s.pathError("remove", name, s.run(ctx, func(c *ftpConn) error {
+		_, _, err := c.cmd(2, "DELE %s", name)
+		return err
+	}))
+}
+
+// MLSD に対応していれば MLSD で、対応していなければ LIST の出力を解釈して一覧にする
+func (s *ftpStore) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	dir = s.abs(dir)
+	var infos []fs.FileInfo
+	err := s.run(ctx, func(c *ftpConn) error {
+		infos = nil
+		cmd := "LIST %s"
+		if c.mlst {
+			cmd = "MLSD %s"
+		}
+		d, err := c.openData(cmd, dir)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(d)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		if _, _, err := c.readReply(2); err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimRight(line, "\r")
+			var info *remoteFileInfo
+			if c.mlst {
+				info = parseMLSx(line)
+			} else {
+				info = parseLIST(line)
+			}
+			if info != nil && info.name != "." && info.name != ".." {
+				infos = append(infos, info)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.pathError("readdir", dir, err)
+	}
+	return infos, nil
+}
+
+// LIST の 1 行。Unix の ls -l 形式と Windows（IIS）の形式に対応する。
+// 日時はサーバーのローカル時刻で、秒と年（ls -l の半年以内のファイル）が分からないため目安にとどまる
+func parseLIST(line string) *remoteFileInfo {
+	f := strings.Fields(line)
+	// 10-15-26  08:52AM  <DIR>  name、10-15-26  08:52AM  1234 name
+	if len(f) >= 4 && len(f[0]) == 8 && f[0][2] == '-' {
+		mtime, _ := time.ParseInLocation("01-02-06 03:04PM", f[0]+" "+f[1], time.Local)
+		info := &remoteFileInfo{name: ftpListName(line, 3), mtime: mtime}
+		if f[2] == "<DIR>" {
+			info.dir = true
+		} else {
+			info.size, _ = strconv.ParseInt(f[2], 10, 64)
+		}
+		return info
+	}
+	// -rw-r--r--   1 owner group   1234 Oct 15 08:52 name
+	if len(f) < 9 || (f[0][0] != '-' && f[0][0] != 'd') {
+		return nil
+	}
+	info := &remoteFileInfo{name: ftpListName(line, 8), dir: f[0][0] == 'd'}
+	info.size, _ = strconv.ParseInt(f[4], 10, 64)
+	if strings.Contains(f[7], ":") {
+		now := time.Now()
+		info.mtime, _ = time.ParseInLocation("Jan 2 15:04 2006", strings.Join(f[5:8], " ")+" "+strconv.Itoa(now.Year()), time.Local)
+		if info.mtime.After(now.AddDate(0, 0, 1)) {
+			info.mtime = info.mtime.AddDate(-1, 0, 0)
+		}
+	} else {
+		info.mtime, _ = time.ParseInLocation("Jan 2 2006", strings.Join(f[5:8], " "), time.Local)
+	}
+	return info
+}
+
+// LIST の行の n 個目以降の欄。名前に含まれる空白を残す
+func ftpListName(line string, n int) string {
+	for i := 0; i < n; i++ {
+		line = strings.TrimLeft(line, " ")
+		j := strings.IndexByte(line, ' ')
+		if j < 0 {
+			return ""
+		}
+		line = line[j:]
+	}
+	return strings.TrimLeft(line, " ")
+}
+
+func (s *ftpStore) Close() error {
+	s.mu.Lock()
+	idle := s.idle
+	s.idle = nil
+	s.mu.Unlock()
+	for _, c := range idle {
+		c.cmd(2, "QUIT")
+		c.nc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,523 @@
+package syncig
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Google Cloud Storage に JSON API で書き込む。認証はアプリケーションのデフォルト認証情報（ADC）に従う
+
+// 再開可能なアップロードの 1 回に送る大きさ（256KiB の倍数）。これ以下のファイルは 1 回の要求でアップロードする
+const gcsChunkSize = 16 << 20
+
+// 読み書きに必要な OAuth のスコープ
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// GOOGLE_APPLICATION_CREDENTIALS・gcloud auth application-default login のファイル・
+// GCE などのメタデータサーバーの順に認証情報を探す
+func findGoogleCredentials(client *http.Client) (*tokenSource, error) {
+	file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" {
+		if p := gcloudADCFile(); p != "" {
+			if _, err := os.Stat(p); err == nil {
+				file = p
+			}
+		}
+	}
+	if file != "" {
+		return googleCredentialsFromFile(client, file)
+	}
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	return &tokenSource{label: "google", fetch: func(ctx context.Context) (string, int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", 0, fmt.Errorf("no credentials file and no metadata server (%v); set GOOGLE_APPLICATION_CREDENTIALS", err)
+		}
+		return decodeTokenResponse(resp)
+	}}, nil
+}
+
+// gcloud auth application-default login が作るファイル
+func gcloudADCFile() string {
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, "gcloud", "application_default_credentials.json")
+		}
+		return ""
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// サービスアカウントの鍵（service_account）と gcloud のユーザー認証（authorized_user）のファイル
+func googleCredentialsFromFile(client *http.Client, file string) (*tokenSource, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("google credentials: %w", err)
+	}
+	var c struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("google credentials %s: %w", file, err)
+	}
+	if c.TokenURI == "" {
+		c.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	switch c.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(c.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("google credentials %s: private_key is not PEM", file)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("google credentials %s: %w", file, err)
+		}
+		key, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("google credentials %s: private_key is not an RSA key", file)
+		}
+		return &tokenSource{label: "google", fetch: func(ctx context.Context) (string, int, error) {
+			assertion, err := signJWT(key, c.ClientEmail, c.TokenURI)
+			if err != nil {
+				return "", 0, err
+			}
+			return postTokenForm(ctx, client, c.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}}, nil
+	case "authorized_user":
+		return &tokenSource{label: "google", fetch: func(ctx context.Context) (string, int, error) {
+			return postTokenForm(ctx, client, c.TokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {c.ClientID},
+				"client_secret": {c.ClientSecret},
+				"refresh_token": {c.RefreshToken},
+			})
+		}}, nil
+	}
+	return nil, fmt.Errorf("google credentials %s: unsupported type %q", file, c.Type)
+}
+
+// サービスアカウントでアクセストークンを要求するための JWT を RS256 で署名する
+func signJWT(key *rsa.PrivateKey, email, aud string) (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   email,
+		"scope": gcsScope,
+		"aud":   aud,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signing := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signing + "." + enc.EncodeToString(sig), nil
+}
+
+func postTokenForm(ctx context.Context, client *http.Client, tokenURI string, form url.Values) (string, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	return decodeTokenResponse(resp)
+}
+
+// gs://bucket/prefix の同期先
+type gcsStore struct {
+	client *http.Client
+	// STORAGE_EMULATOR_HOST を指定した場合はエミュレーターに接続し、認証しない
+	tokens *tokenSource
+	base   string
+	bucket string
+}
+
+func openGCSStore(u *url.URL, job Job) (*gcsStore, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: bucket is empty", u.Redacted())
+	}
+	client, err := newHTTPClient(job)
+	if err != nil {
+		return nil, err
+	}
+	s := &gcsStore{client: client, bucket: u.Host, base: "https://storage.googleapis.com"}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		s.base = strings.TrimRight(host, "/")
+		return s, nil
+	}
+	tokens, err := findGoogleCredentials(s.client)
+	if err != nil {
+		return nil, err
+	}
+	s.tokens = tokens
+	return s, nil
+}
+
+// リモートでのパスをオブジェクト名にする。オブジェクト名は / で始めない
+func (s *gcsStore) object(name string) string {
+	name = path.Clean(name)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+// オブジェクトのメタデータの URL
+func (s *gcsStore) objectURL(obj string) string {
+	return s.base + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(obj)
+}
+
+// 失敗した応答をエラーに変換して本文を閉じる
+func (s *gcsStore) responseError(op, obj string, resp *http.Response) error {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	msg := resp.Status
+	if json.Unmarshal(b, &e) == nil && e.Error.Message != "" {
+		msg += ": " + e.Error.Message
+	}
+	return &fs.PathError{Op: op, Path: "gs://" + s.bucket + "/" + obj, Err: &httpStatusError{code: resp.StatusCode, msg: msg}}
+}
+
+func (s *gcsStore) do(ctx context.Context, method, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestBody(req, body)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.tokens != nil {
+		token, err := s.tokens.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return s.client.Do(req)
+}
+
+func (s *gcsStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	obj := s.object(name)
+	first, err := readPart(r, size, gcsChunkSize)
+	if err != nil {
+		return err
+	}
+	if len(first) <= gcsChunkSize {
+		return s.putSimple(ctx, obj, first, "")
+	}
+	return s.putResumable(ctx, obj, first[:gcsChunkSize], io.MultiReader(bytes.NewReader(first[gcsChunkSize:]), r))
+}
+
+// 1 回の要求でアップロードする。オブジェクトはアップロードが完了してから作られる。
+// cond は ifGenerationMatch などの条件のクエリ（&ifGenerationMatch=0 など）
+func (s *gcsStore) putSimple(ctx context.Context, obj string, data []byte, cond string) error {
+	u := s.base + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?uploadType=media&name=" + url.QueryEscape(obj) + cond
+	var err error
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		resp, err = s.do(ctx, http.MethodPost, u, http.Header{"Content-Type": {"application/octet-stream"}}, data)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				resp.Body.Close()
+				return nil
+			}
+			err = s.responseError("put", obj, resp)
+		}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return err
+		}
+	}
+}
+
+// 再開可能なアップロード。gcsChunkSize ごとに送り、通信が途切れた場合は
+// サーバーが受け取った位置を問い合わせて続きから送る。中断した場合はセッションを取り消す
+func (s *gcsStore) putResumable(ctx context.Context, obj string, first []byte, rest io.Reader) error {
+	u := s.base + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?uploadType=resumable&name=" + url.QueryEscape(obj)
+	resp, err := s.do(ctx, http.MethodPost, u, http.Header{"Content-Type": {"application/json"}}, []byte("{}"))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError("put", obj, resp)
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("gs://%s/%s: no upload session in response", s.bucket, obj)
+	}
+	cur, next := first, make([]byte, gcsChunkSize)
+	var offset int64
+	err = func() error {
+		for {
+			// 次のチャンクがなければ現在のチャンクが最後で、全体の大きさが決まる
+			n, rerr := io.ReadFull(rest, next)
+			if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+				return rerr
+			}
+			total := int64(-1)
+			if n == 0 {
+				total = offset + int64(len(cur))
+			}
+			if err := s.putChunk(ctx, obj, session, cur, offset, total); err != nil {
+				return err
+			}
+			if n == 0 {
+				return nil
+			}
+			offset += int64(len(cur))
+			// 送り終えたバッファを次の読み込みに使う
+			cur, next = next[:n], cur
+		}
+	}()
+	if err != nil {
+		if resp, derr := s.do(context.Background(), http.MethodDelete, session, nil, nil); derr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+// 1 チャンクを送る。total は最後のチャンクの場合のみ全体の大きさで、それ以外は -1
+func (s *gcsStore) putChunk(ctx context.Context, obj, session string, data []byte, offset, total int64) error {
+	for attempt := 0; ; attempt++ {
+		size := "*"
+		if total >= 0 {
+			size = strconv.FormatInt(total, 10)
+		}
+		rng := "bytes */" + size
+		if len(data) > 0 {
+			rng = fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(data))-1, size)
+		}
+		resp, err := s.do(ctx, http.MethodPut, session, http.Header{"Content-Range": {rng}}, data)
+		if err == nil {
+			switch {
+			case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+				resp.Body.Close()
+				return nil
+			case resp.StatusCode == http.StatusPermanentRedirect && total < 0:
+				resp.Body.Close()
+				return nil
+			}
+			err = s.responseError("put", obj, resp)
+		}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return err
+		}
+		// 途中まで受け取られている場合は残りのみ送る
+		persisted, qerr := s.queryResumable(ctx, session)
+		if qerr != nil {
+			continue
+		}
+		if persisted < 0 {
+			return nil
+		}
+		if persisted > offset && persisted <= offset+int64(len(data)) {
+			data = data[persisted-offset:]
+			offset = persisted
+		}
+	}
+}
+
+// サーバーが受け取ったバイト数を問い合わせる。アップロードが完了している場合は -1 を返す
+func (s *gcsStore) queryResumable(ctx context.Context, session string) (int64, error) {
+	resp, err := s.do(ctx, http.MethodPut, session, http.Header{"Content-Range": {"bytes */*"}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return -1, nil
+	case http.StatusPermanentRedirect:
+		// Range: bytes=0-N。ヘッダーがなければまだ何も受け取っていない
+		rng := resp.Header.Get("Range")
+		if rng == "" {
+			return 0, nil
+		}
+		_, end, ok := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+		n, err := strconv.ParseInt(end, 10, 64)
+		if !ok || err != nil {
+			return 0, fmt.Errorf("invalid Range %q", rng)
+		}
+		return n + 1, nil
+	}
+	return 0, errors.New(resp.Status)
+}
+
+// ifGenerationMatch=0 の条件で作る。既にある場合は 412 が返る
+func (s *gcsStore) Create(ctx context.Context, name string, data []byte) error {
+	obj := s.object(name)
+	err := s.putSimple(ctx, obj, data, "&ifGenerationMatch=0")
+	var se *httpStatusError
+	if errors.As(err, &se) && se.code == http.StatusPreconditionFailed {
+		return &fs.PathError{Op: "create", Path: "gs://" + s.bucket + "/" + obj, Err: fs.ErrExist}
+	}
+	return err
+}
+
+func (s *gcsStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	obj := s.object(name)
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(obj)+"?alt=media", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("open", obj, resp)
+	}
+	return resp.Body, nil
+}
+
+// オブジェクトのメタデータ。size は文字列で返る
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+func (o gcsObject) info(name string) *remoteFileInfo {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return &remoteFileInfo{name: name, size: size, mtime: o.Updated}
+}
+
+func (s *gcsStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	obj := s.object(name)
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(obj), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("stat", obj, resp)
+	}
+	defer resp.Body.Close()
+	var o gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return nil, fmt.Errorf("gs://%s/%s: %w", s.bucket, obj, err)
+	}
+	return o.info(path.Base(obj)), nil
+}
+
+func (s *gcsStore) Remove(ctx context.Context, name string) error {
+	obj := s.object(name)
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(obj), nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s.responseError("remove", obj, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// 区切り文字を / として、dir の直下のオブジェクトと接頭辞（ディレクトリ）を一覧にする
+func (s *gcsStore) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	prefix := s.object(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var infos []fs.FileInfo
+	token := ""
+	for {
+		q := url.Values{"prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, s.base+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+q.Encode(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s.responseError("readdir", prefix, resp)
+		}
+		var result struct {
+			Items         []gcsObject `json:"items"`
+			Prefixes      []string    `json:"prefixes"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("gs://%s/%s: %w", s.bucket, prefix, err)
+		}
+		for _, o := range result.Items {
+			infos = append(infos, o.info(strings.TrimPrefix(o.Name, prefix)))
+		}
+		for _, p := range result.Prefixes {
+			infos = append(infos, &remoteFileInfo{name: strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"), dir: true})
+		}
+		if result.NextPageToken == "" {
+			return infos, nil
+		}
+		token = result.NextPageToken
+	}
+}
+
+func (s *gcsStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
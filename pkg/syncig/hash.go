@@ -0,0 +1,50 @@
+package syncig
+
+import (
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+)
+
+// ハッシュ値の計算方式（HASH_ALGO）
+const (
+	hashSHA256 = "sha256"
+	hashSHA512 = "sha512"
+	hashSHA3   = "sha3-256"
+	hashXXH64  = "xxh64"
+	hashBLAKE3 = "blake3"
+)
+
+// 方式ごとの hash.Hash。いずれも APPEND のため計算途中の状態を保存できる
+var hashAlgos = map[string]func() hash.Hash{
+	hashSHA256: sha256.New,
+	hashSHA512: sha512.New,
+	hashSHA3:   func() hash.Hash { return sha3.New256() },
+	hashXXH64:  func() hash.Hash { return newXXH64() },
+	hashBLAKE3: newBLAKE3,
+}
+
+// HASH_ALGO の既定値。既存の同期状態と互換性を保つため SHA-256 とする
+const defaultHashAlgo = hashSHA256
+
+func newHash(algo string) hash.Hash {
+	return hashAlgos[algo]()
+}
+
+// ファイルの内容のハッシュ値を返す
+func hashFile(path, algo string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash(algo)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
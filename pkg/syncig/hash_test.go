@@ -0,0 +1,91 @@
+package syncig
+
+import (
+	"encoding"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// BLAKE3 の公式のテストベクタの入力。i 番目のバイトは i % 251
+func blake3TestInput(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestHashReferenceVectors(t *testing.T) {
+	tests := []struct {
+		algo  string
+		input []byte
+		want  string
+	}{
+		{hashXXH64, nil, "ef46db3751d8e999"},
+		{hashXXH64, []byte("a"), "d24ec4f1a98c6e5b"},
+		{hashXXH64, []byte("abc"), "44bc2cf5ad770999"},
+		{hashXXH64, []byte("Nobody inspects the spammish repetition"), "fbcea83c8a378bf1"},
+		{hashBLAKE3, nil, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{hashBLAKE3, []byte("abc"), "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{hashBLAKE3, blake3TestInput(1), "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{hashBLAKE3, blake3TestInput(1023), "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{hashBLAKE3, blake3TestInput(1024), "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{hashBLAKE3, blake3TestInput(1025), "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{hashBLAKE3, blake3TestInput(2048), "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{hashBLAKE3, blake3TestInput(3073), "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3"},
+		{hashBLAKE3, blake3TestInput(5120), "9cadc15fed8b5d854562b26a9536d9707cadeda9b143978f319ab34230535833"},
+		{hashBLAKE3, blake3TestInput(102400), "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+	}
+	for _, tt := range tests {
+		h := newHash(tt.algo)
+		h.Write(tt.input)
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+			t.Errorf("%s(%d bytes) = %s, want %s", tt.algo, len(tt.input), got, tt.want)
+		}
+	}
+}
+
+// APPEND と同じく、途中の状態を保存・復元して書き足しても一度に計算した場合と同じになる
+func TestHashResumeState(t *testing.T) {
+	input := blake3TestInput(70000)
+	for algo := range hashAlgos {
+		h := newHash(algo)
+		h.Write(input)
+		want := h.Sum(nil)
+		for _, split := range []int{0, 1, 31, 32, 64, 1023, 1024, 1025, 4096, 33333, len(input)} {
+			h := newHash(algo)
+			h.Write(input[:split])
+			state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				t.Fatalf("%s: %v", algo, err)
+			}
+			r := newHash(algo)
+			if err := r.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+				t.Fatalf("%s: split %d: %v", algo, split, err)
+			}
+			// 少しずつ書き込み、ブロックの境界をまたぐ場合も確かめる
+			for p := input[split:]; len(p) > 0; {
+				n := min(len(p), 1+len(p)%97)
+				r.Write(p[:n])
+				p = p[n:]
+			}
+			if got := r.Sum(nil); string(got) != string(want) {
+				t.Errorf("%s: split %d: %x, want %x", algo, split, got, want)
+			}
+		}
+	}
+}
+
+func TestHashInvalidState(t *testing.T) {
+	for _, algo := range []string{hashXXH64, hashBLAKE3} {
+		h := newHash(algo)
+		h.Write([]byte(strings.Repeat("x", 2000)))
+		state, _ := h.(encoding.BinaryMarshaler).MarshalBinary()
+		for _, b := range [][]byte{nil, state[:len(state)-1], append(state, 0)} {
+			if err := newHash(algo).(encoding.BinaryUnmarshaler).UnmarshalBinary(b); err == nil {
+				t.Errorf("%s: UnmarshalBinary(%d bytes) succeeded", algo, len(b))
+			}
+		}
+	}
+}
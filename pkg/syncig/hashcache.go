@@ -0,0 +1,35 @@
+package syncig
+
+import (
+	"io/fs"
+	"time"
+)
+
+// 同期元のファイルについて計算したハッシュ値。サイズと更新日時が変わらない間は再計算しない
+type cachedHash struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	HashAlgo string    `json:"hash_algo,omitempty"`
+	Sum      string    `json:"sum"`
+}
+
+// 同期元のファイルのハッシュ値を返す。サイズと更新日時が記録またはキャッシュと同じなら
+// 保存されているハッシュ値を使い、計算した場合は m のキャッシュに加える（added が true）
+func (s *syncer) sourceHash(m *manifest, name, path string, info fs.FileInfo) (sum string, added bool, err error) {
+	if rec, ok := m.Files[name]; ok && rec.DeletedAt.IsZero() && rec.Size == info.Size() && rec.ModTime.Equal(info.ModTime()) {
+		if sum := rec.digest(s.hashAlgo); sum != "" {
+			return sum, false, nil
+		}
+	}
+	if c, ok := m.HashCache[name]; ok && c.Size == info.Size() && c.ModTime.Equal(info.ModTime()) && c.HashAlgo == recordedAlgo(s.hashAlgo) {
+		return c.Sum, false, nil
+	}
+	if sum, err = s.hashSource(path); err != nil {
+		return "", false, err
+	}
+	if m.HashCache == nil {
+		m.HashCache = map[string]cachedHash{}
+	}
+	m.HashCache[name] = cachedHash{Size: info.Size(), ModTime: info.ModTime(), HashAlgo: recordedAlgo(s.hashAlgo), Sum: sum}
+	return sum, true, nil
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package syncig
+
+import "io/fs"
+
+// Windows 以外には隠し属性がないため、ドットファイルの判定のみを行う
+func hasHiddenAttr(info fs.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package syncig
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// 隠し属性が付いているか判定する
+func hasHiddenAttr(info fs.FileInfo) bool {
+	if attr, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return attr.FileAttributes&syscall.FILE_ATTRIBUTE_HIDDEN != 0
+	}
+	return false
+}
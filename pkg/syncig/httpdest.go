@@ -0,0 +1,285 @@
+package syncig
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// http:// ・https:// の同期先。取り込み用の API などに、ファイルごとに URL のテンプレートへ PUT・POST する。
+// 2xx の応答を成功とみなす。書き込みのみで、同期先のファイルの有無や内容は確認できない
+
+// これ以下のファイルはメモリに読み込んでから送り、一時的なエラーの場合に送り直す
+const httpBufferSize = 16 << 20
+
+// 同期先を読む操作のエラー。同期先を読む設定は validateHTTPDist で拒否している
+var errHTTPWriteOnly = errors.New("http destination is write-only")
+
+// URL のテンプレートに使えるプレースホルダー
+var httpPlaceholders = []string{"{path}", "{name}", "{dir}"}
+
+func isHTTPURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// DIST_DIR が http:// ・https:// の場合に使えない設定を確認する
+func validateHTTPDist(job Job) error {
+	if job.STATE_DIR == "" {
+		return errors.New("an http:// or https:// DIST_DIR requires a local STATE_DIR")
+	}
+	if job.VERIFY_AFTER_COPY {
+		return errors.New("VERIFY_AFTER_COPY cannot be used with an http:// or https:// DIST_DIR")
+	}
+	if job.ON_CONFLICT != "" && job.ON_CONFLICT != conflictOverwrite {
+		return fmt.Errorf("ON_CONFLICT %q cannot be used with an http:// or https:// DIST_DIR", job.ON_CONFLICT)
+	}
+	switch job.HTTP_METHOD {
+	case "", http.MethodPut, http.MethodPost:
+	default:
+		return fmt.Errorf("HTTP_METHOD must be %q or %q", http.MethodPut, http.MethodPost)
+	}
+	for k := range job.HTTP_HEADERS {
+		if k == "" || strings.ContainsAny(k, " :\r\n") {
+			return fmt.Errorf("HTTP_HEADERS: invalid header name %q", k)
+		}
+	}
+	return nil
+}
+
+type httpStore struct {
+	client *http.Client
+	// ユーザー名を除いた URL のテンプレート
+	template string
+	method   string
+	header   http.Header
+	form     string
+	user     string
+	password string
+	bearer   string
+}
+
+// raw は DIST_DIR。URL のパスとクエリの {path}（同期元からの相対パス）・{name}（ファイル名）・{dir}（ディレクトリ）を
+// ファイルごとに置き換える。プレースホルダーがなく HTTP_METHOD が PUT の場合は、URL のパスの後に /{path} を続ける
+func openHTTPStore(raw string, job Job) (*httpStore, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("%s: passwords in the URL are not supported; set HTTP_PASSWORD", u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: host is empty", u.Redacted())
+	}
+	// ユーザー名を除く。url.URL.String() は {} をエスケープするため、元の文字列から取り除く
+	rest := strings.TrimPrefix(raw, u.Scheme+"://")
+	authority := rest
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority = rest[:i]
+	}
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		rest = rest[at+1:]
+	}
+	rest, _, _ = strings.Cut(rest, "#")
+	client, err := newHTTPClient(job)
+	if err != nil {
+		return nil, err
+	}
+	s := &httpStore{
+		client:   client,
+		template: u.Scheme + "://" + rest,
+		method:   job.HTTP_METHOD,
+		header:   http.Header{},
+		form:     job.HTTP_FORM_FIELD,
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+	}
+	if s.method == "" {
+		s.method = http.MethodPut
+	}
+	if s.password, err = credential(job, "HTTP_PASSWORD"); err != nil {
+		return nil, err
+	}
+	if s.bearer, err = credential(job, "HTTP_BEARER_TOKEN"); err != nil {
+		return nil, err
+	}
+	for k, v := range job.HTTP_HEADERS {
+		if v, err = expandCredentials(job, v); err != nil {
+			return nil, err
+		}
+		s.header.Set(k, v)
+	}
+	placeholder := false
+	for _, p := range httpPlaceholders {
+		placeholder = placeholder || strings.Contains(s.template, p)
+	}
+	if !placeholder && s.method == http.MethodPut {
+		p, q, hasQuery := strings.Cut(s.template, "?")
+		s.template = strings.TrimSuffix(p, "/") + "/{path}"
+		if hasQuery {
+			s.template += "?" + q
+		}
+	}
+	return s, nil
+}
+
+// name（同期元からの相対パス）を送る URL
+func (s *httpStore) url(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	dir, file := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	p, q, hasQuery := strings.Cut(s.template, "?")
+	p = strings.NewReplacer(
+		"{path}", (&url.URL{Path: name}).EscapedPath(),
+		"{name}", url.PathEscape(file),
+		"{dir}", (&url.URL{Path: dir}).EscapedPath(),
+	).Replace(p)
+	if !hasQuery {
+		return p
+	}
+	q = strings.NewReplacer(
+		"{path}", url.QueryEscape(name),
+		"{name}", url.QueryEscape(file),
+		"{dir}", url.QueryEscape(dir),
+	).Replace(q)
+	return p + "?" + q
+}
+
+// HTTP_FORM_FIELD の multipart/form-data で name の内容を書き込む
+func (s *httpStore) writeForm(mw *multipart.Writer, name string, r io.Reader) error {
+	part, err := mw.CreateFormFile(s.form, name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// 1 回の要求で name を送る。body が nil の場合は r を読みながら送る
+func (s *httpStore) send(ctx context.Context, name, contentType string, body []byte, r io.Reader, size int64) error {
+	rawURL := s.url(name)
+	req, err := http.NewRequestWithContext(ctx, s.method, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		setRequestBody(req, body)
+	} else {
+		req.Body, req.ContentLength = io.NopCloser(r), size
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	// multipart の境界はこちらで決めるため、Content-Type は HTTP_HEADERS より優先する
+	if s.form != "" || req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearer)
+	} else if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	msg := resp.Status
+	if m := strings.TrimSpace(string(b)); m != "" {
+		msg += ": " + m
+	}
+	return &fs.PathError{Op: strings.ToLower(s.method), Path: redactURL(rawURL), Err: &httpStatusError{code: resp.StatusCode, msg: msg}}
+}
+
+// エラーに表示する URL。クエリにトークンを含む API があるため、クエリは表示しない
+func redactURL(rawURL string) string {
+	p, _, _ := strings.Cut(rawURL, "?")
+	return p
+}
+
+// 16MiB までのファイルはメモリに読み込んで、一時的なエラーの場合に送り直す。
+// それより大きいファイルは同期元から読みながら 1 回の要求で送る
+func (s *httpStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	first, err := readPart(r, size, httpBufferSize)
+	if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	file := path.Base(name)
+	if len(first) <= httpBufferSize {
+		body := first
+		if s.form != "" {
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+			if err := s.writeForm(mw, file, bytes.NewReader(first)); err != nil {
+				return err
+			}
+			body, contentType = buf.Bytes(), mw.FormDataContentType()
+		}
+		for attempt := 0; ; attempt++ {
+			err := s.send(ctx, name, contentType, body, nil, 0)
+			if err == nil || !retryTemporary(ctx, err, attempt, remoteRetries) {
+				return err
+			}
+		}
+	}
+	src := activityReader{io.MultiReader(bytes.NewReader(first), r)}
+	if s.form == "" {
+		if size < int64(len(first)) {
+			size = -1
+		}
+		return s.send(ctx, name, contentType, nil, src, size)
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(s.writeForm(mw, file, src))
+	}()
+	return s.send(ctx, name, mw.FormDataContentType(), nil, pr, -1)
+}
+
+func (s *httpStore) Create(ctx context.Context, name string, data []byte) error {
+	return &fs.PathError{Op: "create", Path: name, Err: errHTTPWriteOnly}
+}
+
+func (s *httpStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errHTTPWriteOnly}
+}
+
+func (s *httpStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: errHTTPWriteOnly}
+}
+
+func (s *httpStore) Remove(ctx context.Context, name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: errHTTPWriteOnly}
+}
+
+func (s *httpStore) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: dir, Err: errHTTPWriteOnly}
+}
+
+func (s *httpStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,146 @@
+package syncig
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 同期元に置かれた除外指定ファイルの名前
+const ignoreFileName = ".syncigignore"
+
+// .syncigignore の 1 行分のルール
+type ignoreRule struct {
+	base    string // ルールを定義したファイルのあるディレクトリ（SRC_DIR からの相対パス、ルートは ""）
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// gitignore と同じ規則で照合する。後に定義されたルールほど優先される
+type ignoreSet struct {
+	rules []ignoreRule
+}
+
+// dir にある .syncigignore を読み込む。rel は dir の SRC_DIR からの相対パス
+func (s *ignoreSet) load(dir, rel string) error {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if rule, ok := parseIgnoreLine(sc.Text(), rel); ok {
+			s.rules = append(s.rules, rule)
+		}
+	}
+	return sc.Err()
+}
+
+func parseIgnoreLine(line, base string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, "\r")
+	// 末尾の空白は \ でエスケープされていなければ無視する
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// スラッシュを含まないパターンは任意の階層の名前に一致する
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	rule.pattern = strings.TrimPrefix(line, "/")
+	if rule.pattern == "" || checkGlob(rule.pattern) != nil {
+		return ignoreRule{}, false
+	}
+	return rule, true
+}
+
+// rel（SRC_DIR からの / 区切りの相対パス）が除外対象か判定する
+func (s *ignoreSet) match(rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range s.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		sub := rel
+		if r.base != "" {
+			if !strings.HasPrefix(rel, r.base+"/") {
+				continue
+			}
+			sub = strings.TrimPrefix(rel, r.base+"/")
+		}
+		if matchGlob(r.pattern, sub) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// .syncigignore 自体はコピーしない
+func isIgnoreFile(rel string) bool {
+	return path.Base(rel) == ignoreFileName
+}
+
+// rsync の --exclude-from 形式のファイルを読み込む。
+// "- " / "+ " の接頭辞に対応し、rsync と同じく先に書かれたルールを優先する
+func loadExcludeFrom(file string) (ignoreSet, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return ignoreSet{}, err
+	}
+	var rules []ignoreRule
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		rule := ignoreRule{}
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			rule.negate = true
+			line = line[2:]
+		case strings.HasPrefix(line, "- "):
+			line = line[2:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// 先頭が / のパターンは SRC_DIR 基準、それ以外はパスの末尾と照合する
+		if strings.HasPrefix(line, "/") {
+			line = line[1:]
+		} else {
+			line = "**/" + line
+		}
+		if err := checkGlob(line); err != nil || line == "" {
+			return ignoreSet{}, fmt.Errorf("%s:%d: invalid pattern", file, i+1)
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	// ignoreSet は後のルールを優先するため逆順にする
+	for i, j := 0, len(rules)-1; i < j; i, j = i+1, j-1 {
+		rules[i], rules[j] = rules[j], rules[i]
+	}
+	return ignoreSet{rules: rules}, nil
+}
@@ -0,0 +1,147 @@
+package syncig
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// syncig init: 対話形式で設定ファイルを作成する
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("o", "config.json", "作成する設定ファイルのパス（拡張子で形式を決定）")
+	fs.Parse(args)
+
+	in := bufio.NewReader(os.Stdin)
+	if _, err := os.Stat(*output); err == nil {
+		ok, err := promptYesNo(in, fmt.Sprintf("%s already exists. Overwrite?", *output))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("aborted")
+		}
+	}
+
+	var job Job
+	for {
+		src, err := prompt(in, "Source directory (SRC_DIR)", "", true)
+		if err != nil {
+			return err
+		}
+		if err := checkSourceDir(src); err != nil {
+			fmt.Printf("  %v\n", err)
+			continue
+		}
+		job.SRC_DIR = src
+		break
+	}
+	for {
+		dist, err := prompt(in, "Destination directory (DIST_DIR)", "", true)
+		if err != nil {
+			return err
+		}
+		job.DIST_DIR = dist
+		if err := validateJob(job); err != nil {
+			fmt.Printf("  %v\n", err)
+			continue
+		}
+		break
+	}
+	exts, err := prompt(in, "Excluded extensions, comma separated (EXCLUDED_EXT)", "", false)
+	if err != nil {
+		return err
+	}
+	for _, e := range strings.Split(exts, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			job.EXCLUDED_EXT = append(job.EXCLUDED_EXT, e)
+		}
+	}
+
+	b, err := formatConfig(job, filepath.Ext(*output))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, b, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", *output)
+	return nil
+}
+
+// 標準入力から 1 行読み込む。required の場合は空入力を受け付けない
+func prompt(in *bufio.Reader, label, def string, required bool) (string, error) {
+	for {
+		if def != "" {
+			fmt.Printf("%s [%s]: ", label, def)
+		} else {
+			fmt.Printf("%s: ", label)
+		}
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = def
+		}
+		if line != "" || !required {
+			return line, nil
+		}
+	}
+}
+
+func promptYesNo(in *bufio.Reader, label string) (bool, error) {
+	ans, err := prompt(in, label+" (y/N)", "n", false)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(ans, "y") || strings.EqualFold(ans, "yes"), nil
+}
+
+// 拡張子に応じた形式で設定ファイルの内容を生成する
+func formatConfig(job Job, ext string) ([]byte, error) {
+	exts := job.EXCLUDED_EXT
+	if exts == nil {
+		exts = []string{}
+	}
+	var b strings.Builder
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		fmt.Fprintf(&b, "SRC_DIR: %s\n", strconv.Quote(job.SRC_DIR))
+		fmt.Fprintf(&b, "DIST_DIR: %s\n", strconv.Quote(job.DIST_DIR))
+		fmt.Fprintf(&b, "EXCLUDED_EXT: [%s]\n", quoteList(exts))
+	case ".toml":
+		fmt.Fprintf(&b, "SRC_DIR = %s\n", strconv.Quote(job.SRC_DIR))
+		fmt.Fprintf(&b, "DIST_DIR = %s\n", strconv.Quote(job.DIST_DIR))
+		fmt.Fprintf(&b, "EXCLUDED_EXT = [%s]\n", quoteList(exts))
+	default:
+		out, err := json.MarshalIndent(struct {
+			SRC_DIR      string   `json:"SRC_DIR"`
+			DIST_DIR     string   `json:"DIST_DIR"`
+			EXCLUDED_EXT []string `json:"EXCLUDED_EXT"`
+		}{job.SRC_DIR, job.DIST_DIR, exts}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(out, '\n'), nil
+	}
+	return []byte(b.String()), nil
+}
+
+func quoteList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, s := range items {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package syncig
+
+// Windows 以外では他のプロセスが開いていても排他されないため、判定しない
+func fileInUse(path string) bool {
+	return false
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package syncig
+
+import (
+	"errors"
+	"syscall"
+)
+
+// syscall パッケージに定義がないため直接指定する
+const errorSharingViolation syscall.Errno = 32
+
+// 他のプロセスが開いているか判定する。共有を許可せずに開けない場合は使用中とみなす
+func fileInUse(path string) bool {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return errors.Is(err, errorSharingViolation)
+	}
+	syscall.CloseHandle(h)
+	return false
+}
@@ -0,0 +1,112 @@
+package syncig
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 同期状態と同じ場所に追記するジャーナルの名前
+const journalFileName = "syncig_journal.jsonl"
+
+// ジャーナルに記録する判定の種類
+const (
+	journalRunStart = "run_start"
+	journalRunEnd   = "run_end"
+	journalCopied   = "copied"
+	journalSkipped  = "skipped"
+	journalFailed   = "failed"
+	journalDeleted  = "deleted"
+	journalRenamed  = "renamed"
+	// 破損した同期先ファイルを QUARANTINE_DIR に退避した
+	journalQuarantined = "quarantined"
+	// MODE が move で同期元のファイルを削除した
+	journalSourceRemoved = "source_removed"
+	// MODE が move で同期元のファイルを ARCHIVE_DIR に移した
+	journalSourceArchived = "source_archived"
+)
+
+// ジャーナルの 1 行分
+type journalEntry struct {
+	Run    string    `json:"run"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Path   string    `json:"path,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+	// SHA256 を計算した方式（HASH_ALGO が sha256 以外の場合のみ）
+	HashAlgo string `json:"hash_algo,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// 実行ごとに一意の ID を付けて、コピーの判定を JSON Lines で追記する
+type journal struct {
+	mu    sync.Mutex
+	runID string
+	f     *os.File
+}
+
+func openJournal(root string) (*journal, error) {
+	if err := ensureDir(root); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(root, journalFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newRunID()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	j := &journal{runID: id, f: f}
+	return j, j.write(journalEntry{Action: journalRunStart})
+}
+
+// ランダムな UUID (version 4) を生成する
+func newRunID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func (j *journal) write(e journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e.Run = j.runID
+	e.Time = time.Now()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = j.f.Write(append(b, '\n'))
+	return err
+}
+
+// 実行の終了を記録して閉じる
+func (j *journal) close(runErr error) error {
+	if j == nil {
+		return nil
+	}
+	e := journalEntry{Action: journalRunEnd}
+	if runErr != nil {
+		e.Error = runErr.Error()
+	}
+	werr := j.write(e)
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	return werr
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package syncig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// OS のキーチェーンの認証情報。macOS はキーチェーンの汎用パスワード（security コマンド）、
+// それ以外は Secret Service（GNOME Keyring・KWallet など、libsecret の secret-tool コマンド）から読む
+func readKeychain(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if !errors.As(err, &ee) {
+			return "", err
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", cmd.Args[0], msg)
+		}
+		return "", errNoKeychainItem
+	}
+	// secret-tool は見つからない場合も終了コード 1 で何も出力しない
+	v := strings.TrimRight(string(out), "\r\n")
+	if v == "" {
+		return "", errNoKeychainItem
+	}
+	return v, nil
+}
@@ -0,0 +1,68 @@
+//go:build windows
+
+package syncig
+
+import (
+	"errors"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+// 資格情報マネージャーの API。syscall パッケージに定義がないため直接呼び出す
+var (
+	modadvapi32   = syscall.NewLazyDLL("advapi32.dll")
+	procCredReadW = modadvapi32.NewProc("CredReadW")
+	procCredFree  = modadvapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric = 1
+	errorNotFound   = syscall.Errno(1168)
+)
+
+// CREDENTIALW
+type winCredential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// 資格情報マネージャーの汎用資格情報（cmdkey /generic:<サービス>/<アカウント> で登録したもの）のパスワード
+func readKeychain(service, account string) (string, error) {
+	target, err := syscall.UTF16PtrFromString(service + "/" + account)
+	if err != nil {
+		return "", err
+	}
+	var cred *winCredential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if errors.Is(err, errorNotFound) {
+			return "", errNoKeychainItem
+		}
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	// cmdkey は UTF-16 で保存する。ASCII の UTF-16（上位バイトがすべて 0）でなければ UTF-8 とみなす
+	if len(blob)%2 == 0 {
+		u := make([]uint16, 0, len(blob)/2)
+		for i := 0; i < len(blob); i += 2 {
+			if blob[i+1] != 0 {
+				return string(blob), nil
+			}
+			u = append(u, uint16(blob[i])|uint16(blob[i+1])<<8)
+		}
+		return string(utf16.Decode(u)), nil
+	}
+	return string(blob), nil
+}
@@ -0,0 +1,182 @@
+package syncig
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// リモートの同期先のルートに置く、他のマシンと同時に実行されないようにするためのロックファイル
+const lockFileName = "syncig.lock"
+
+// 他のプロセスが同じ同期先で実行中
+var errLocked = errors.New("locked by another process")
+
+// 同じマシンの syncig 同士で排他するロックファイルのパス。同期先を公開する場合に見えないよう DIST_DIR の中には置かず、
+// STATE_DIR（ローカルの場合）または一時ディレクトリに DIST_DIR ごとの名前で置く。
+// 他のマシンとの排他はリモートに置くロック（acquireRemoteLock）で行う
+func (j Job) lockPath() string {
+	key := j.DIST_DIR
+	if !isRemoteURL(key) {
+		if abs, err := filepath.Abs(key); err == nil {
+			key = abs
+		}
+	}
+	sum := sha256.Sum256([]byte(key))
+	name := "syncig-" + hex.EncodeToString(sum[:8]) + ".lock"
+	if j.STATE_DIR != "" && !isRemoteURL(j.STATE_DIR) {
+		return filepath.Join(j.STATE_DIR, name)
+	}
+	return filepath.Join(os.TempDir(), name)
+}
+
+// 同期先 target のロックを path に取得する。他の syncig が実行中の場合は待たずに失敗する。
+// 取得したロックはプロセスが終了すると OS が解放するため、強制終了しても残らない
+func acquireLock(path, target string) (*os.File, error) {
+	if err := ensureDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	f, err := openLockFile(path)
+	if err == nil {
+		if err = lockFile(f); err != nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errLocked) {
+			// 実行中のプロセスが書き込んだ PID を表示する
+			if b, rerr := os.ReadFile(path); rerr == nil {
+				if pid, perr := strconv.Atoi(strings.TrimSpace(string(b))); perr == nil {
+					return nil, fmt.Errorf("another syncig (pid %d) is running against %s: %w", pid, target, err)
+				}
+			}
+			return nil, fmt.Errorf("another syncig is running against %s: %w", target, err)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
+
+// ロックを解放する。ファイルは次回の実行で再利用するため削除しない
+func releaseLockFile(f *os.File) {
+	if f == nil {
+		return
+	}
+	unlockFile(f)
+	f.Close()
+}
+
+// ジョブの実行中に保持するロック。DIST_DIR がリモートの場合はリモートにもロックを置く
+type jobLock struct {
+	f      *os.File
+	remote *remoteLock
+}
+
+// ジョブのロックを取得する。同じマシンの syncig はローカルのロックファイルで、
+// 他のマシンの syncig はリモートの同期先に置くロックで排他する（書き込みのみの HTTP の同期先を除く）
+func acquireJobLock(job Job) (*jobLock, error) {
+	f, err := acquireLock(job.lockPath(), job.DIST_DIR)
+	if err != nil {
+		return nil, err
+	}
+	l := &jobLock{f: f}
+	if isRemoteURL(job.DIST_DIR) && !isHTTPURL(job.DIST_DIR) {
+		if l.remote, err = acquireRemoteLock(job); err != nil {
+			releaseLockFile(f)
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func releaseLock(l *jobLock) {
+	if l == nil {
+		return
+	}
+	if l.remote != nil {
+		l.remote.release()
+	}
+	releaseLockFile(l.f)
+}
+
+// リモートの同期先のルートに置くロック。取得した syncig のホスト名・PID・開始日時を書き込む
+type remoteLock struct {
+	r    Destination
+	name string
+}
+
+type remoteLockInfo struct {
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+// リモートの同期先にロックを作る。既にある場合、同じホストのものは異常終了した実行が残したものとして置き換え
+// （同じホストの syncig はローカルのロックで排他しているため）、他のホストのものは実行中とみなして失敗する。
+// OS が解放するローカルのロックと違い、他のホストで異常終了した場合は手動で削除する必要がある
+func acquireRemoteLock(job Job) (*remoteLock, error) {
+	job.S3_STORAGE_CLASS = ""
+	r, root, err := openRemote(job.DIST_DIR, job)
+	if err != nil {
+		return nil, err
+	}
+	l := &remoteLock{r: r, name: path.Join(root, lockFileName)}
+	host, _ := os.Hostname()
+	b, err := json.Marshal(remoteLockInfo{Host: host, PID: os.Getpid(), Started: time.Now()})
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	ctx := context.Background()
+	err = r.Create(ctx, l.name, b)
+	if errors.Is(err, fs.ErrExist) {
+		var held remoteLockInfo
+		lockURL := strings.TrimRight(job.DIST_DIR, "/") + "/" + lockFileName
+		switch herr := l.read(ctx, &held); {
+		case herr == nil && held.Host == host:
+			err = r.Put(ctx, l.name, bytes.NewReader(b), int64(len(b)))
+		case herr == nil:
+			err = fmt.Errorf("another syncig (host %s, pid %d, started %s) is running against %s: %w; if it is no longer running, delete %s",
+				held.Host, held.PID, held.Started.Local().Format(time.RFC3339), job.DIST_DIR, errLocked, lockURL)
+		default:
+			err = fmt.Errorf("another syncig is running against %s: %w; if it is no longer running, delete %s", job.DIST_DIR, errLocked, lockURL)
+		}
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *remoteLock) read(ctx context.Context, info *remoteLockInfo) error {
+	rc, err := l.r.Open(ctx, l.name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(info)
+}
+
+// ロックを削除する。削除できなかった場合は次回に同じホストで実行すると置き換わる。
+// 中断した実行でも削除するため、実行の context は使わない
+func (l *remoteLock) release() {
+	if err := l.r.Remove(context.Background(), l.name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "unlock %s: %v\n", l.name, err)
+	}
+	l.r.Close()
+}
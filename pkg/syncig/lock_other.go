@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package syncig
+
+import "os"
+
+// ファイルのロックに対応していない環境では、ロックファイルを排他的に作成できたかで判定する。
+// 強制終了した場合はロックファイルが残るため、手動で削除する
+func openLockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, errLocked
+	}
+	return f, err
+}
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) {
+	os.Remove(f.Name())
+}
@@ -0,0 +1,29 @@
+package syncig
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+)
+
+// コピー処理のカウンタ。-pprof を指定した場合に /debug/vars で公開する
+var (
+	metricFilesCopied  = expvar.NewInt("syncig_files_copied")
+	metricBytesCopied  = expvar.NewInt("syncig_bytes_copied")
+	metricCopyErrors   = expvar.NewInt("syncig_copy_errors")
+	metricActiveCopies = expvar.NewInt("syncig_active_copies")
+	metricDirsScanned  = expvar.NewInt("syncig_dirs_scanned")
+)
+
+// net/http/pprof と expvar のエンドポイントを addr で公開する
+func startDebugServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("pprof: %w", err)
+	}
+	fmt.Printf("Debug server: http://%s/debug/pprof/ (counters: /debug/vars)\n", ln.Addr())
+	go http.Serve(ln, nil)
+	return nil
+}
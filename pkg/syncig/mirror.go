@@ -0,0 +1,168 @@
+package syncig
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 同期の方式（MODE）
+const (
+	// 同期元から消えたファイルも同期先に残す（既定）
+	modeCopy = "copy"
+	// 同期先を同期元と同じ内容に保つ。同期元にないファイルは同期先から削除する
+	modeMirror = "mirror"
+	// コピーを検証した後に同期元のファイルを削除する
+	modeMove = "move"
+	// SRC_DIR と DIST_DIR の両方の変更を互いに反映する
+	modeBidirectional = "bidirectional"
+)
+
+// 同期先にある syncig 自身のファイルか判定する。base は対応する同期元のファイル名（なければ空）
+func (s *syncer) ownFile(name string) (base string, own bool) {
+	switch {
+	case name == manifestFileName || name == legacyStateFileName || name == kvStateFileName || name == journalFileName || name == lockFileName:
+		return "", true
+	case name == "MANIFEST."+s.hashAlgo:
+		return "", true
+	// writeFileAtomic の一時ファイル
+	case strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp"):
+		return "", true
+	case strings.HasSuffix(name, partialExt+resumeExt):
+		return strings.TrimSuffix(name, partialExt+resumeExt), true
+	case strings.HasSuffix(name, partialExt):
+		return strings.TrimSuffix(name, partialExt), true
+	case strings.HasSuffix(name, tombstoneExt):
+		return strings.TrimSuffix(name, tombstoneExt), true
+	case s.keepVersions > 0 && versionSuffix.MatchString(name):
+		return versionSuffix.ReplaceAllString(name, ""), true
+	case s.checksums == checksumSidecar && strings.HasSuffix(name, "."+s.hashAlgo):
+		return strings.TrimSuffix(name, "."+s.hashAlgo), true
+	}
+	return "", false
+}
+
+// 同期先にあって同期元にも同期状態にもないファイルを求める（MODE が mirror）。
+// フィルタで対象外になるファイルは削除しない
+func (s *syncer) findExtraneous(distDir, rel string, sc *dirScan, present map[string]bool) error {
+	entries, err := os.ReadDir(distDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || present[name] {
+			continue
+		}
+		if _, recorded := sc.state.Files[name]; recorded {
+			continue
+		}
+		// 同期元から消えたファイルの .partial などは削除し、同期状態などは残す
+		if base, own := s.ownFile(name); own {
+			if base == "" || present[base] {
+				continue
+			}
+		} else {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if s.filter.skipFile(filepath.ToSlash(filepath.Join(rel, name)), info) {
+				continue
+			}
+		}
+		sc.extraneous = append(sc.extraneous, name)
+	}
+	sort.Slice(sc.extraneous, func(i, j int) bool { return s.less(sc.extraneous[i], sc.extraneous[j]) })
+	return nil
+}
+
+func (s *syncer) removeExtraneous(distDir, rel string, names []string) error {
+	for _, f := range names {
+		distFile := filepath.Join(distDir, f)
+		kept := ""
+		// 同期元から消えたファイルの .partial などはゴミ箱に移さない（以前の版は移す）
+		if _, own := s.ownFile(f); own && !versionSuffix.MatchString(f) {
+			if err := os.Remove(distFile); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else {
+			dst, err := s.removeDist(rel, f)
+			if err != nil {
+				return err
+			}
+			kept = dst
+		}
+		s.observer.OnFileDone(s.removedEvent(distFile, kept, false))
+		if err := s.journal.write(journalEntry{Action: journalDeleted, Path: filepath.ToSlash(filepath.Join(rel, f)), Reason: modeMirror}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 同期元から消えたディレクトリを同期先から削除し、配下の同期状態も消去する（MIRROR_DIRS）。
+// 同期元にあってフィルタで除外しているディレクトリは削除しない
+func (s *syncer) removeGoneDirs() error {
+	var gone []string
+	err := filepath.WalkDir(s.distRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == s.distRoot {
+			return nil
+		}
+		// ゴミ箱と、同期先の中に置いた STATE_DIR・QUARANTINE_DIR・BACKUP_DIR は対象外
+		if path == filepath.Join(s.distRoot, trashDirName) {
+			return fs.SkipDir
+		}
+		for _, dir := range []string{s.stateDir, s.quarantineDir, s.backupDir} {
+			if dir != "" && path == filepath.Clean(dir) {
+				return fs.SkipDir
+			}
+		}
+		rel, _ := filepath.Rel(s.distRoot, path)
+		if _, err := os.Lstat(filepath.Join(s.srcRoot, rel)); os.IsNotExist(err) {
+			gone = append(gone, rel)
+			return fs.SkipDir
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil || len(gone) == 0 {
+		return err
+	}
+	states, err := s.state.list()
+	if err != nil {
+		return err
+	}
+	for _, rel := range gone {
+		distDir := filepath.Join(s.distRoot, rel)
+		if s.opts.DryRun || s.opts.DeleteDryRun {
+			s.observer.OnFileDone(FileEvent{Dist: distDir, Action: FileDeleted, Dir: true, DryRun: true})
+			continue
+		}
+		kept, err := s.removeDistDir(rel)
+		if err != nil {
+			return err
+		}
+		for _, st := range states {
+			if st == rel || strings.HasPrefix(st, rel+string(filepath.Separator)) {
+				if err := s.state.remove(st); err != nil {
+					return err
+				}
+			}
+		}
+		s.observer.OnFileDone(s.removedEvent(distDir, kept, true))
+		if err := s.journal.write(journalEntry{Action: journalDeleted, Path: filepath.ToSlash(rel) + "/", Reason: modeMirror}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
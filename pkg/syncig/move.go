@@ -0,0 +1,97 @@
+package syncig
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MODE が move の場合、コピーを検証して記録した同期元のファイルを削除する（ARCHIVE_DIR が
+// 指定されている場合は移す）。直前にサイズか更新日時が変わっていれば書き込み中とみなして残す
+func (s *syncer) removeSource(srcFile, rel string, info fs.FileInfo) error {
+	cur, err := s.statSource(srcFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cur.Size() != info.Size() || !cur.ModTime().Equal(info.ModTime()) {
+		fmt.Fprintf(os.Stderr, "warning: %s changed after copy; not removing it\n", srcFile)
+		return nil
+	}
+	action := journalSourceRemoved
+	if s.archiveDir != "" {
+		if err := s.archiveSource(srcFile, rel); err != nil {
+			return err
+		}
+		action = journalSourceArchived
+	} else if s.source != nil {
+		d, ok := s.source.(Destination)
+		if !ok {
+			return fmt.Errorf("%s: SRC_DIR does not support removing files", srcFile)
+		}
+		if err := d.Remove(s.ctx, remoteName(srcFile)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(srcFile); err != nil {
+		return err
+	}
+	s.movedMu.Lock()
+	s.movedDirs[filepath.Dir(srcFile)] = true
+	s.movedMu.Unlock()
+	return s.journal.write(journalEntry{Action: action, Path: filepath.ToSlash(filepath.Join(rel, filepath.Base(srcFile))), Size: info.Size()})
+}
+
+// 同期元のファイルを ARCHIVE_DIR の同じ相対パスに移す。同じ名前のファイルが既にある場合は
+// 上書きせず、名前の後ろに実行日時を付ける
+func (s *syncer) archiveSource(srcFile, rel string) error {
+	dst := filepath.Join(s.archiveDir, rel, filepath.Base(srcFile))
+	if _, err := os.Lstat(dst); err == nil {
+		dst += "." + s.runStamp
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return s.moveFile(srcFile, dst)
+}
+
+// コピー済みとして記録されているのに残っている同期元のファイル（前回の削除の失敗など）。
+// 記録とサイズ・更新日時が同じものに限る
+func (s *syncer) leftovers(sc *dirScan) []string {
+	var names []string
+	for _, f := range sc.files {
+		rec, ok := sc.state.Files[f]
+		if !ok || !rec.DeletedAt.IsZero() || contains(sc.toCopy, f) || contains(sc.deferred, f) {
+			continue
+		}
+		if rec.Size == sc.infos[f].Size() && rec.ModTime.Equal(sc.infos[f].ModTime()) {
+			names = append(names, f)
+		}
+	}
+	return names
+}
+
+// REMOVE_EMPTY_DIRS: ファイルを削除して空になった同期元のディレクトリを、
+// 空になった親ディレクトリも含めて削除する（SRC_DIR 自体は残す）
+func (s *syncer) pruneSourceDirs() {
+	dirs := make([]string, 0, len(s.movedDirs))
+	for dir := range s.movedDirs {
+		dirs = append(dirs, dir)
+	}
+	// 深いディレクトリから削除する
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		for dir != s.srcRoot && strings.HasPrefix(dir, s.srcRoot+string(filepath.Separator)) {
+			// 空でなければ失敗するため、そこで止める
+			if os.Remove(dir) != nil {
+				break
+			}
+			s.observer.OnFileDone(FileEvent{Src: dir, Action: FileSourceRemoved, Dir: true})
+			dir = filepath.Dir(dir)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package syncig
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// 同期の経過を受け取る。Syncer.Observer に指定すると、コマンドが標準出力に表示する内容の代わりにこれが呼ばれる。
+// ディレクトリ・ファイルは並列に処理するため、各メソッドは複数の goroutine から呼ばれる。
+// OnFileDone・OnError は同じディレクトリの中では同期状態に記録する順に呼ばれる
+type Observer interface {
+	// コピーを始める。src・dist は同期元・同期先のパス
+	OnFileStart(src, dist string, size int64)
+	// ファイルをコピー・削除などした。DryRun・DeleteDryRun の場合は予定を渡す
+	OnFileDone(ev FileEvent)
+	// コピーに失敗した。err はそのまま Run のエラーになる（DryRun の場合はコピーできない理由）
+	OnError(src, dist string, err error)
+	// ディレクトリ直下のファイルの処理を終えた。rel は SRC_DIR からの相対パス
+	OnDirDone(rel string)
+}
+
+// FileEvent.Action の値
+const (
+	FileCopied   = "copied"
+	FileUpdated  = "updated"
+	FileAppended = "appended"
+	// 同期元から削除した（MOVE）
+	FileMoved   = "moved"
+	FileSkipped = "skipped"
+	// DETECT_RENAMES で同期先の名前を変更した。Src は変更前の同期先のパス
+	FileRenamed = "renamed"
+	// 同期元で削除されたファイル・MIRROR の余分なファイルを同期先から削除した
+	FileDeleted    = "deleted"
+	FileTrashed    = "trashed"
+	FileBackedUp   = "backed-up"
+	FileTombstoned = "tombstoned"
+	// ON_DELETE が record の場合。同期先は変更せず削除を記録した
+	FileDeletionRecorded = "deletion-recorded"
+	FilePruned           = "pruned"
+	FileQuarantined      = "quarantined"
+	// REMOVE_SOURCE などで同期元から削除した。Dist は空
+	FileSourceRemoved = "source-removed"
+	// 双方向同期の衝突
+	FileConflict = "conflict"
+)
+
+// OnFileDone で渡すファイルの処理結果
+type FileEvent struct {
+	Src, Dist string
+	Action    string
+	// 書き込んだバイト数。追記の場合は追記した分
+	Bytes int64
+	// DELTA_MIN_SIZE で同期先の既存の内容を使い、送らずに済んだバイト数
+	Reused int64
+	// 退避先のパス（TRASH・BACKUP_DIR・QUARANTINE_DIR）
+	Kept string
+	// Action が skipped・conflict・quarantined の場合の理由
+	Reason string
+	// 削除・退避したのがディレクトリ（MIRROR_DIRS・REMOVE_EMPTY_DIRS・TRASH の保持期間）
+	Dir bool
+	// 実行せず予定のみ（DryRun・DeleteDryRun）
+	DryRun bool
+}
+
+// Observer を指定しない場合に使う、コマンドの表示
+type printObserver struct {
+	s *syncer
+	// DryRun: ディレクトリごとのコピー予定の合計
+	mu    sync.Mutex
+	plans map[string]*dirPlan
+}
+
+type dirPlan struct {
+	files int
+	bytes int64
+}
+
+// 動作ごとの表示
+var (
+	doneLabels = map[string]string{
+		FileCopied:        "Copied",
+		FileUpdated:       "Updated",
+		FileAppended:      "Appended",
+		FileMoved:         "Moved",
+		FileSkipped:       "Skipped",
+		FileRenamed:       "Renamed",
+		FileDeleted:       "Deleted",
+		FileTrashed:       "Trashed",
+		FileBackedUp:      "Backed up",
+		FileTombstoned:    "Tombstoned",
+		FilePruned:        "Pruned",
+		FileQuarantined:   "Quarantined",
+		FileSourceRemoved: "Removed source",
+		FileConflict:      "Conflict",
+	}
+	dryRunVerbs = map[string]string{
+		FileCopied:           "copy",
+		FileUpdated:          "update",
+		FileMoved:            "move",
+		FileSkipped:          "skip",
+		FileRenamed:          "rename",
+		FileDeleted:          "delete",
+		FileTombstoned:       "tombstone",
+		FileDeletionRecorded: "record deletion",
+		FilePruned:           "prune",
+		FileQuarantined:      "quarantine",
+		FileSourceRemoved:    "remove source",
+		FileConflict:         "keep both",
+	}
+)
+
+func newPrintObserver(s *syncer) *printObserver {
+	return &printObserver{s: s, plans: map[string]*dirPlan{}}
+}
+
+// 進捗バーにコピー中のファイルを表示する
+func (p *printObserver) OnFileStart(src, dist string, size int64) {
+	p.s.progress.fileStart(dist)
+}
+
+func (p *printObserver) OnFileDone(ev FileEvent) {
+	if ev.DryRun {
+		p.printDryRun(ev)
+		return
+	}
+	label := doneLabels[ev.Action]
+	if ev.Dir {
+		label += " directory"
+	}
+	switch ev.Action {
+	case FileSkipped:
+		p.s.printf("%s: %s (%s)\n", label, ev.Dist, ev.Reason)
+	case FileAppended:
+		p.s.printf("%s: %s -> %s (%d bytes)\n", label, ev.Src, ev.Dist, ev.Bytes)
+	case FileCopied, FileUpdated, FileMoved, FileRenamed:
+		if ev.Reused > 0 {
+			p.s.printf("Delta: %s (sent %s, reused %s)\n", ev.Dist, ByteSize(ev.Bytes), ByteSize(ev.Reused))
+		}
+		p.s.printf("%s: %s -> %s\n", label, ev.Src, ev.Dist)
+	case FileSourceRemoved:
+		if ev.Dir {
+			label = "Removed directory"
+		}
+		p.s.printf("%s: %s\n", label, ev.Src)
+	case FileConflict:
+		if ev.Reason != "" {
+			p.s.printf("%s: %s (%s)\n", label, p.relDist(ev.Dist), ev.Reason)
+			return
+		}
+		p.s.printf("%s: %s\n", label, p.relDist(ev.Dist))
+	default:
+		if ev.Kept != "" {
+			p.s.printf("%s: %s -> %s\n", label, ev.Dist, ev.Kept)
+			return
+		}
+		p.s.printf("%s: %s\n", label, ev.Dist)
+	}
+}
+
+// DryRun・DeleteDryRun の予定を表示し、コピーの予定はディレクトリごとに合計する
+func (p *printObserver) printDryRun(ev FileEvent) {
+	verb := dryRunVerbs[ev.Action]
+	if ev.Dir {
+		verb += " directory"
+	}
+	switch ev.Action {
+	case FileCopied, FileUpdated, FileMoved:
+		p.s.printf("Would %s: %s -> %s (%d bytes)\n", verb, ev.Src, ev.Dist, ev.Bytes)
+		p.plan(ev.Dist, ev.Bytes, 1)
+	case FileSkipped:
+		p.s.printf("Would %s: %s (%s)\n", verb, ev.Dist, ev.Reason)
+		p.plan(ev.Dist, 0, 0)
+	case FileRenamed:
+		p.s.printf("Would %s: %s -> %s\n", verb, ev.Src, ev.Dist)
+	case FileSourceRemoved:
+		p.s.printf("Would %s: %s\n", verb, ev.Src)
+	case FileConflict:
+		p.s.printf("Would %s: %s\n", verb, p.relDist(ev.Dist))
+	default:
+		p.s.printf("Would %s: %s\n", verb, ev.Dist)
+	}
+}
+
+// コピーの失敗は Run のエラーとしても返るが、並列にコピーした他のファイルの失敗もここで表示する
+func (p *printObserver) OnError(src, dist string, err error) {
+	if p.s.opts.DryRun {
+		p.s.printf("Would fail: %v\n", err)
+		p.plan(dist, 0, 0)
+		return
+	}
+	p.s.printf("Failed: %s -> %s (%v)\n", src, dist, err)
+}
+
+// DryRun の場合はディレクトリのコピーの予定の合計を表示する
+func (p *printObserver) OnDirDone(rel string) {
+	if !p.s.opts.DryRun {
+		return
+	}
+	distDir := filepath.Join(p.s.distRoot, rel)
+	p.mu.Lock()
+	plan, ok := p.plans[distDir]
+	delete(p.plans, distDir)
+	p.mu.Unlock()
+	if ok {
+		p.s.printf("Plan: %s: %d files, %d bytes\n", rel, plan.files, plan.bytes)
+	}
+}
+
+func (p *printObserver) plan(dist string, bytes int64, files int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	plan := p.plans[filepath.Dir(dist)]
+	if plan == nil {
+		plan = &dirPlan{}
+		p.plans[filepath.Dir(dist)] = plan
+	}
+	plan.files += files
+	plan.bytes += bytes
+}
+
+// 衝突は双方向同期の両方向で同じ名前になるよう、同期先からの相対パスで表示する
+func (p *printObserver) relDist(dist string) string {
+	rel, err := filepath.Rel(p.s.distRoot, dist)
+	if err != nil {
+		return dist
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Observer を指定しない場合の出力先。進捗バーを表示している場合は行が混ざらないようにする
+func (s *syncer) printf(format string, args ...any) {
+	if s.opts.observer != nil {
+		return
+	}
+	if s.progress != nil {
+		s.progress.printf(format, args...)
+		return
+	}
+	fmt.Printf(format, args...)
+}
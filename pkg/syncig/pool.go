@@ -0,0 +1,66 @@
+package syncig
+
+import "sync"
+
+// 0 から n-1 までの各インデックスについて work を workers 個の goroutine で並列に実行し、
+// 結果を apply にインデックス順で渡す。apply がエラーを返した場合は残りの作業を打ち切り、
+// 実行中の work の完了を待ってからそのエラーを返す。apply は呼び出し元の goroutine で実行される
+func runOrdered[T any](n, workers int, work func(i int) T, apply func(i int, r T) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct {
+		i int
+		r T
+	}
+	jobs := make(chan int)
+	out := make(chan result, workers)
+	stop := make(chan struct{})
+	go func() {
+		defer close(jobs)
+		for i := 0; i < n; i++ {
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				out <- result{i, work(i)}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	// 先に終わった結果は順番が来るまで保持する
+	done := map[int]T{}
+	next := 0
+	var err error
+	for res := range out {
+		if err != nil {
+			continue
+		}
+		done[res.i] = res.r
+		for {
+			r, ok := done[next]
+			if !ok {
+				break
+			}
+			delete(done, next)
+			if err = apply(next, r); err != nil {
+				close(stop)
+				break
+			}
+			next++
+		}
+	}
+	return err
+}
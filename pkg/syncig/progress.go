@@ -0,0 +1,185 @@
+package syncig
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 進捗を表示する間隔
+const (
+	progressBarInterval  = 500 * time.Millisecond
+	progressLineInterval = 10 * time.Second
+)
+
+// コピーの進捗。合計はサブディレクトリを走査するたびに増える
+type progress struct {
+	filesTotal, filesDone atomic.Int64
+	bytesTotal, bytesDone atomic.Int64
+	// 最後にコピーを始めたファイル
+	current atomic.Pointer[string]
+	start   time.Time
+	// 標準出力が端末の場合は進捗バーを 1 行で書き換える
+	tty bool
+	out io.Writer
+	// 進捗バーとファイルごとの出力が混ざらないようにする
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startProgress() *progress {
+	p := &progress{
+		start: time.Now(),
+		tty:   isTerminal(os.Stdout),
+		out:   os.Stdout,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	interval := progressLineInterval
+	if p.tty {
+		interval = progressBarInterval
+	}
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.draw()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// コピーするファイルを合計に加える
+func (p *progress) plan(files int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.filesTotal.Add(int64(files))
+	p.bytesTotal.Add(bytes)
+}
+
+// コピーを始めたファイルを進捗バーに表示する
+func (p *progress) fileStart(name string) {
+	if p == nil {
+		return
+	}
+	p.current.Store(&name)
+}
+
+// 1 ファイルのコピーが終わった（失敗した場合も含む）
+func (p *progress) fileDone() {
+	if p == nil {
+		return
+	}
+	p.filesDone.Add(1)
+}
+
+// コピーしたバイト数を数える Reader を返す
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &p.bytesDone}
+}
+
+// ZERO_COPY など Reader を通さずにコピーしたバイト数を加える
+func (p *progress) addBytes(n int64) {
+	if p == nil {
+		return
+	}
+	p.bytesDone.Add(n)
+}
+
+// 進捗バーを消してから 1 行出力し、進捗バーを描き直す
+func (p *progress) printf(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+	fmt.Fprintf(p.out, format, args...)
+	if p.tty {
+		fmt.Fprint(p.out, p.status())
+	}
+}
+
+func (p *progress) draw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		fmt.Fprint(p.out, "\r\033[K"+p.status())
+		return
+	}
+	fmt.Fprintf(p.out, "Progress: %s\n", p.status())
+}
+
+// 進捗を止め、最後の状態を表示する
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+	fmt.Fprintf(p.out, "Progress: %s\n", p.status())
+}
+
+func (p *progress) status() string {
+	files, filesTotal := p.filesDone.Load(), p.filesTotal.Load()
+	bytes, bytesTotal := p.bytesDone.Load(), p.bytesTotal.Load()
+	elapsed := time.Since(p.start)
+	rate := float64(bytes) / elapsed.Seconds()
+	eta := "-"
+	if rate > 0 && bytesTotal > bytes {
+		eta = time.Duration(float64(bytesTotal-bytes) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	text := fmt.Sprintf("%d/%d files, %s/%s, %s/s, ETA %s", files, filesTotal, ByteSize(bytes), ByteSize(bytesTotal), ByteSize(int64(rate)), eta)
+	if !p.tty {
+		return text
+	}
+	const width = 20
+	filled := width
+	if bytesTotal > 0 {
+		filled = int(int64(width) * bytes / bytesTotal)
+	}
+	if filled > width {
+		filled = width
+	}
+	bar := "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "] " + text
+	if name := p.current.Load(); name != nil && files < filesTotal {
+		bar += " " + filepath.Base(*name)
+	}
+	return bar
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,262 @@
+package syncig
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// PROXY: ジョブの接続に使うプロキシ（socks5://host:port・http://host:port）。指定しない場合、
+// HTTP の同期先（S3・GCS・Azure・WebDAV・syncig://・http(s)://）は環境変数 HTTPS_PROXY・HTTP_PROXY・NO_PROXY に従い、
+// FTP と SFTP は直接接続する。指定した場合はジョブのすべての接続（SFTP は ssh の ProxyCommand）に使う
+
+// ssh の ProxyCommand に渡すプロキシの URL（パスワードを含むため、コマンドラインではなく環境変数で渡す）
+const proxyEnv = "SYNCIG_PROXY_URL"
+
+// プロキシへの接続と、プロキシから接続先への接続のタイムアウト
+const proxyTimeout = 30 * time.Second
+
+// PROXY の形式を確認する
+func validateProxy(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("PROXY %q: %v", raw, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return fmt.Errorf("PROXY %q must be a socks5://, http:// or https:// URL", raw)
+	}
+	if u.Host == "" || u.Port() == "" {
+		return fmt.Errorf("PROXY %q must include the host and port", raw)
+	}
+	if _, ok := u.User.Password(); ok {
+		return fmt.Errorf("PROXY %q: passwords in the URL are not supported; set PROXY_PASSWORD", u.Redacted())
+	}
+	return nil
+}
+
+// ジョブのプロキシ。PROXY がなければ nil。URL にユーザー名があれば PROXY_PASSWORD のパスワードを付ける
+func jobProxy(job Job) (*url.URL, error) {
+	if job.PROXY == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(job.PROXY)
+	if err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		password, err := credential(job, "PROXY_PASSWORD")
+		if err != nil {
+			return nil, err
+		}
+		u.User = url.UserPassword(u.User.Username(), password)
+	}
+	return u, nil
+}
+
+// HTTP の同期先のクライアント。PROXY がなければ環境変数のプロキシに従う既定のトランスポートを使う。
+// マネージド ID などのメタデータサーバー（リンクローカル）とループバックにはプロキシを使わない
+func newHTTPClient(job Job) (*http.Client, error) {
+	p, err := jobProxy(job)
+	if err != nil || p == nil {
+		return &http.Client{}, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		host := req.URL.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			return nil, nil
+		}
+		return p, nil
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// addr（host:port）に TCP で接続する。proxy が nil でなければプロキシを経由する
+func dialTCP(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: proxyTimeout}
+	if proxy == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	conn, err := d.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, proxy, addr)
+	default:
+		conn, err = httpConnect(conn, proxy, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// SOCKS5（RFC 1928）の CONNECT。ユーザー名がある場合はユーザー名とパスワードで認証する（RFC 1929）
+func socks5Connect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	methods := []byte{0x00}
+	if proxy.User != nil {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != methods[0] {
+		return errors.New("socks5: no acceptable authentication method")
+	}
+	if proxy.User != nil {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("socks5: user name or password too long")
+		}
+		b := append([]byte{1, byte(len(user))}, user...)
+		b = append(append(b, byte(len(password))), password...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+	// 名前の解決はプロキシに任せる（社内の DNS しか引けない拠点がある）
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 1), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 4), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("socks5: connect to %s failed (reply %d)", addr, head[1])
+	}
+	// 応答のアドレスとポートは使わない
+	var n int
+	switch head[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// HTTP プロキシの CONNECT。FTP のサーバーは接続するとすぐに応答を送るため、応答のヘッダーの後に読み込んだ分も返す接続にする
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.SetBasicAuth(proxy.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// syncig proxy-connect HOST PORT: SFTP の ssh の ProxyCommand として、SYNCIG_PROXY_URL のプロキシ経由で接続し、
+// 標準入出力と中継する
+func runProxyConnect(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: syncig proxy-connect HOST PORT")
+	}
+	proxy, err := url.Parse(os.Getenv(proxyEnv))
+	if err != nil || proxy.Host == "" {
+		return fmt.Errorf("%s is not set", proxyEnv)
+	}
+	conn, err := dialTCP(context.Background(), proxy, net.JoinHostPort(args[0], args[1]))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
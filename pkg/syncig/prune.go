@@ -0,0 +1,223 @@
+package syncig
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// syncig prune: RETENTION_DAYS を過ぎたコピー済みのファイルを同期先から削除し、
+// MAX_DIST_SIZE を超えている場合は古いファイルから削除する。
+// 同期元にないディレクトリも含め、同期状態に記録されているすべてのディレクトリが対象
+func runPrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	var jf jobFlags
+	jf.register(fs)
+	days := fs.Int("days", 0, "RETENTION_DAYS を上書き")
+	dryRun := fs.Bool("dry-run", false, "削除せずに対象のみ表示")
+	fs.Parse(args)
+	jobs, err := jf.jobs(fs)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		printJobHeader(job)
+		if *days != 0 {
+			job.RETENTION_DAYS = *days
+		}
+		if job.RETENTION_DAYS <= 0 && job.MAX_DIST_SIZE <= 0 {
+			return fmt.Errorf("prune requires RETENTION_DAYS, -days or MAX_DIST_SIZE")
+		}
+		if isRemoteURL(job.DIST_DIR) {
+			return fmt.Errorf("prune cannot be used with a remote DIST_DIR")
+		}
+		s, err := newSyncer(context.Background(), job, RunOptions{DryRun: *dryRun, ForceState: jf.force})
+		if err != nil {
+			return err
+		}
+		n, err := s.pruneAll()
+		if err == nil {
+			var evicted int
+			evicted, err = s.evict()
+			n += evicted
+		}
+		if jerr := s.journal.close(err); err == nil {
+			err = jerr
+		}
+		s.close()
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			fmt.Printf("Would prune %d files\n", n)
+		} else {
+			fmt.Printf("Pruned %d files\n", n)
+		}
+	}
+	return nil
+}
+
+// 同期状態に記録されているすべてのディレクトリで期限を過ぎたファイルを削除し、削除した数を返す
+func (s *syncer) pruneAll() (int, error) {
+	dirs, err := s.state.list()
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(dirs)
+	total := 0
+	for _, rel := range dirs {
+		m, err := s.state.load(rel)
+		if err != nil {
+			return total, err
+		}
+		names := s.expired(m, nil)
+		if len(names) == 0 {
+			continue
+		}
+		total += len(names)
+		if err := s.pruneDir(rel, m, names, "retention"); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// 1 ディレクトリ分のファイルを削除して同期状態を保存する。-dry-run・-delete-dry-run の場合は表示のみ
+func (s *syncer) pruneDir(rel string, m *manifest, names []string, reason string) error {
+	distDir := filepath.Join(s.distRoot, rel)
+	if s.opts.DryRun || s.opts.DeleteDryRun {
+		for _, f := range names {
+			s.observer.OnFileDone(FileEvent{Dist: filepath.Join(distDir, f), Action: FilePruned, DryRun: true})
+		}
+		return nil
+	}
+	err := s.pruneFiles(distDir, rel, m, names, reason)
+	m.UpdatedAt = time.Now()
+	if serr := s.state.save(rel, m); err == nil {
+		err = serr
+	}
+	if err == nil {
+		err = s.writeChecksumManifest(distDir, m)
+	}
+	return err
+}
+
+// 同期先に残っているコピー済みのファイル。ON_DELETE の delete で削除したものは含めない
+func (s *syncer) retained(rec fileRecord) bool {
+	return rec.PrunedAt.IsZero() && (rec.DeletedAt.IsZero() || s.onDelete != deleteRemove)
+}
+
+// 同期先に残っているコピー済みのファイルの合計が MAX_DIST_SIZE を超えている場合、
+// コピーした日時の古いものから削除し、削除した数を返す
+func (s *syncer) evict() (int, error) {
+	if s.maxDistSize <= 0 {
+		return 0, nil
+	}
+	dirs, err := s.state.list()
+	if err != nil {
+		return 0, err
+	}
+	type candidate struct {
+		rel, name string
+		rec       fileRecord
+	}
+	var (
+		candidates []candidate
+		total      int64
+	)
+	states := map[string]*manifest{}
+	for _, rel := range dirs {
+		m, err := s.state.load(rel)
+		if err != nil {
+			return 0, err
+		}
+		states[rel] = m
+		for name, rec := range m.Files {
+			if s.retained(rec) {
+				candidates = append(candidates, candidate{rel, name, rec})
+				total += rec.Size
+			}
+		}
+	}
+	if total <= s.maxDistSize {
+		return 0, nil
+	}
+	// 旧形式から移行した記録はコピーした日時がないため最も古いものとして扱う
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if !a.rec.CopiedAt.Equal(b.rec.CopiedAt) {
+			return a.rec.CopiedAt.Before(b.rec.CopiedAt)
+		}
+		if a.rel != b.rel {
+			return a.rel < b.rel
+		}
+		return s.less(a.name, b.name)
+	})
+	evicted := map[string][]string{}
+	n := 0
+	for _, c := range candidates {
+		if total <= s.maxDistSize {
+			break
+		}
+		evicted[c.rel] = append(evicted[c.rel], c.name)
+		total -= c.rec.Size
+		n++
+	}
+	rels := make([]string, 0, len(evicted))
+	for rel := range evicted {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	for _, rel := range rels {
+		names := evicted[rel]
+		sort.Slice(names, func(i, j int) bool { return s.less(names[i], names[j]) })
+		if err := s.pruneDir(rel, states[rel], names, "size"); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// コピーしてから RETENTION_DAYS を過ぎたファイル。skip（これからコピーし直すファイル）と、
+// コピーした日時が記録されていない旧形式から移行した記録は除く
+func (s *syncer) expired(state *manifest, skip []string) []string {
+	if s.retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-s.retention)
+	var names []string
+	for name, rec := range state.Files {
+		if rec.PrunedAt.IsZero() && !rec.CopiedAt.IsZero() && rec.CopiedAt.Before(cutoff) && !contains(skip, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return s.less(names[i], names[j]) })
+	return names
+}
+
+// 同期先からファイルを削除し、同期状態に削除した日時を記録する。reason はジャーナルに記録する理由。
+// 記録は残すため、同期元に残っていても再コピーしない
+func (s *syncer) pruneFiles(distDir, rel string, state *manifest, names []string, reason string) error {
+	now := time.Now()
+	for _, f := range names {
+		distFile := filepath.Join(distDir, f)
+		if err := os.Remove(distFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := s.removeSidecar(distFile); err != nil {
+			return err
+		}
+		rec := state.Files[f]
+		rec.PrunedAt = now
+		state.Files[f] = rec
+		s.observer.OnFileDone(FileEvent{Dist: distFile, Action: FilePruned})
+		if err := s.journal.write(journalEntry{Action: journalDeleted, Path: filepath.ToSlash(filepath.Join(rel, f)), Size: rec.Size, Reason: reason}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
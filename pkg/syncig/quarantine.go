@@ -0,0 +1,38 @@
+package syncig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// 破損した同期先ファイルを QUARANTINE_DIR に退避する。退避先は実行ごとのディレクトリの下に
+// 同期先と同じ相対パスで置き、上書きで破損の証拠が失われないようにする
+func (s *syncer) quarantine(rel, name, reason string) error {
+	distFile := filepath.Join(s.distRoot, rel, name)
+	dst := filepath.Join(s.quarantineDir, s.runStamp, rel, name)
+	if err := s.moveFile(distFile, dst); err != nil {
+		return err
+	}
+	s.observer.OnFileDone(FileEvent{Dist: distFile, Action: FileQuarantined, Kept: dst, Reason: reason})
+	return s.journal.write(journalEntry{Action: journalQuarantined, Path: filepath.ToSlash(filepath.Join(rel, name)), Reason: reason})
+}
+
+// ファイルを移動する。別のファイルシステムには rename できないため、コピーしてから削除する
+func (s *syncer) moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	buf := s.buffers.get()
+	// 移動の途中で止めると両側に不完全なファイルが残るため、終了の指示では中断しない
+	_, err := copyFile(context.Background(), src, dst, s.hashAlgo, *buf, nil)
+	s.buffers.put(buf)
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,54 @@
+package syncig
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// 設定ファイルの変更を確認する間隔
+const configPollInterval = 5 * time.Second
+
+// SIGHUP を受け取ったときと設定ファイルが変更されたときに通知する（sync -daemon / watch）。
+// Windows では SIGHUP がないため、設定ファイルの変更のみ
+func reloadSignals(path string) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		last := configStamp(path)
+		t := time.NewTicker(configPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-sig:
+			case <-t.C:
+				cur := configStamp(path)
+				if cur == last {
+					continue
+				}
+				last = cur
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch
+}
+
+// 設定ファイルの変更を検出するための更新日時とサイズ。ファイルがなければゼロ値
+type configStampValue struct {
+	mtime int64
+	size  int64
+}
+
+func configStamp(path string) configStampValue {
+	info, err := os.Stat(path)
+	if err != nil {
+		return configStampValue{}
+	}
+	return configStampValue{info.ModTime().UnixNano(), info.Size()}
+}
@@ -0,0 +1,499 @@
+package syncig
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DIST_DIR に指定できる URL の形式（sftp://user@host/path など）
+var remoteURLPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+// ローカルのディレクトリではなく URL で指定されているか
+func isRemoteURL(path string) bool {
+	return remoteURLPattern.MatchString(path)
+}
+
+// リモートの同期元。name はリモートでのパス（区切りは /）
+type Source interface {
+	// ctx は要求の中断に使う。読み込み中の中断は呼び出し側で contextReader を使う
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// ファイルがない場合は fs.ErrNotExist を返す
+	Stat(ctx context.Context, name string) (fs.FileInfo, error)
+	// dir 直下のファイルとディレクトリ。dir がない場合は fs.ErrNotExist を返す
+	ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error)
+	Close() error
+}
+
+// リモートの同期先。同期元として読み込む操作に加え、書き込みと削除ができる
+type Destination interface {
+	Source
+	// name の内容を r で置き換える。書き込み途中の内容が見えないよう、SFTP・WebDAV・FTP は一時ファイルに書いてから置き換え、
+	// S3・GCS・Azure はアップロードが完了してからオブジェクトを作る。親ディレクトリがなければ作る。
+	// size は r の大きさの見込み（分からなければ -1）で、1 回の要求で送るか分割するかの判断に使う
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// name がなければ data の内容で作る。既にある場合は fs.ErrExist を返す（リモートのロックに使う）
+	Create(ctx context.Context, name string, data []byte) error
+	Remove(ctx context.Context, name string) error
+}
+
+// URL のスキームごとのリモートの同期先・同期元。組み込みの形式は init でまとめて登録する。
+// 社内のストレージなどの形式は、このパッケージを import するプログラムで Destination を実装し、
+// init で RegisterBackend を呼べば DIST_DIR・SRC_DIR に指定できる（設定の確認・ロック・同期状態の扱いは組み込みの形式と同じ）
+type Backend struct {
+	// raw（u はそれを解析したもの）を開き、URL が指すリモートでのパスを返す
+	Open func(raw string, u *url.URL, job Job) (Destination, string, error)
+	// SRC_DIR にも指定できるか
+	AsSource bool
+	// DIST_DIR に指定した場合の形式ごとの設定の確認（nil の場合は共通の確認のみ）
+	ValidateDist func(job Job) error
+}
+
+var remoteBackends = map[string]Backend{}
+
+// schemes の URL を b で開くよう登録する。同じスキームを 2 回登録した場合は panic する
+func RegisterBackend(b Backend, schemes ...string) {
+	for _, s := range schemes {
+		if _, ok := remoteBackends[s]; ok {
+			panic("RegisterBackend: duplicate URL scheme " + s)
+		}
+		remoteBackends[s] = b
+	}
+}
+
+// 組み込みのリモートの形式
+func init() {
+	RegisterBackend(Backend{AsSource: true, Open: func(_ string, u *url.URL, job Job) (Destination, string, error) {
+		r, err := openSFTPStore(u, job)
+		return r, remotePath(u), err
+	}}, "sftp")
+	RegisterBackend(Backend{AsSource: true, ValidateDist: validateS3Dist, Open: func(_ string, u *url.URL, job Job) (Destination, string, error) {
+		r, err := openS3Store(u, job)
+		return r, remotePath(u), err
+	}}, "s3")
+	RegisterBackend(Backend{AsSource: true, Open: func(_ string, u *url.URL, job Job) (Destination, string, error) {
+		r, err := openGCSStore(u, job)
+		return r, remotePath(u), err
+	}}, "gs")
+	RegisterBackend(Backend{AsSource: true, Open: func(_ string, u *url.URL, job Job) (Destination, string, error) {
+		r, err := openAzureStore(u, job)
+		return r, remotePath(u), err
+	}}, "azblob")
+	RegisterBackend(Backend{AsSource: true, Open: func(_ string, u *url.URL, job Job) (Destination, string, error) {
+		r, err := openWebDAVStore(u, job)
+		return r, remotePath(u), err
+	}}, "dav", "davs")
+	RegisterBackend(Backend{AsSource: true, Open: func(_ string, u *url.URL, job Job) (Destination, string, error) {
+		r, err := openFTPStore(u, job)
+		return r, remotePath(u), err
+	}}, "ftp", "ftps", "ftpes")
+	RegisterBackend(Backend{AsSource: true, Open: func(_ string, u *url.URL, job Job) (Destination, string, error) {
+		r, err := openAgentStore(u, job)
+		return r, remotePath(u), err
+	}}, "syncig")
+	// URL はテンプレートのため、同期元からの相対パスをそのまま渡す
+	RegisterBackend(Backend{ValidateDist: validateHTTPDist, Open: func(raw string, _ *url.URL, job Job) (Destination, string, error) {
+		r, err := openHTTPStore(raw, job)
+		return r, ".", err
+	}}, "http", "https")
+}
+
+// DIST_DIR が URL の場合に使えない設定を確認する。同期先のファイルの移動・削除や、
+// ローカルのファイルシステムでのみ行える書き込みには対応していない
+func validateRemoteDist(job Job) error {
+	u, err := url.Parse(job.DIST_DIR)
+	if err != nil {
+		return fmt.Errorf("DIST_DIR %q: %v", job.DIST_DIR, err)
+	}
+	b, ok := remoteBackends[u.Scheme]
+	if !ok {
+		return fmt.Errorf("DIST_DIR %q: unsupported URL scheme %q", job.DIST_DIR, u.Scheme)
+	}
+	if job.MODE == modeMirror || job.MODE == modeBidirectional {
+		return fmt.Errorf("MODE %q cannot be used with a remote DIST_DIR", job.MODE)
+	}
+	for _, o := range []struct {
+		key string
+		set bool
+	}{
+		{"ON_DELETE \"tombstone\" or \"delete\"", job.ON_DELETE == deleteTombstone || job.ON_DELETE == deleteRemove},
+		{"DETECT_RENAMES", job.DETECT_RENAMES},
+		{"APPEND", job.APPEND},
+		{"KEEP_VERSIONS", job.KEEP_VERSIONS > 0},
+		{"BACKUP_DIR", job.BACKUP_DIR != ""},
+		{"QUARANTINE_DIR", job.QUARANTINE_DIR != ""},
+		{"CHECKSUM_FILES", job.CHECKSUM_FILES != ""},
+		{"RETENTION_DAYS", job.RETENTION_DAYS > 0},
+		{"MAX_DIST_SIZE", job.MAX_DIST_SIZE > 0},
+		{"RESUME_THRESHOLD", job.RESUME_THRESHOLD > 0},
+		{"ZERO_COPY", job.ZERO_COPY},
+		{"DURABLE", job.DURABLE},
+	} {
+		if o.set {
+			return fmt.Errorf("%s cannot be used with a remote DIST_DIR", o.key)
+		}
+	}
+	// ジャーナルと kv・sqlite 形式の同期状態はローカルのファイルにしか書けない
+	if job.STATE_DIR == "" && (job.JOURNAL || job.STATE_BACKEND == stateBackendKV || job.STATE_BACKEND == stateBackendSQLite) {
+		return errors.New("JOURNAL and STATE_BACKEND \"kv\" or \"sqlite\" require a local STATE_DIR when DIST_DIR is remote")
+	}
+	if isRemoteURL(job.STATE_DIR) {
+		return fmt.Errorf("STATE_DIR %q must be a local directory", job.STATE_DIR)
+	}
+	if b.ValidateDist != nil {
+		if err := b.ValidateDist(job); err != nil {
+			return err
+		}
+	}
+	if job.AZURE_ENDPOINT != "" {
+		if e, err := url.Parse(job.AZURE_ENDPOINT); err != nil || (e.Scheme != "http" && e.Scheme != "https") || e.Host == "" {
+			return fmt.Errorf("AZURE_ENDPOINT %q must be an http or https URL", job.AZURE_ENDPOINT)
+		}
+	}
+	return nil
+}
+
+// URL の形式に応じてリモートの同期先を開き、URL が指すリモートでのパスを返す
+func openRemote(raw string, job Job) (Destination, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	b, ok := remoteBackends[u.Scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported URL scheme %q in %s", u.Scheme, raw)
+	}
+	return b.Open(raw, u, job)
+}
+
+// URL のパス。/~/ で始まる場合はログインしたユーザーのホームディレクトリからの相対パスにする
+func remotePath(u *url.URL) string {
+	p := u.Path
+	if p == "/~" || strings.HasPrefix(p, "/~/") {
+		p = strings.TrimPrefix(strings.TrimPrefix(p, "/~"), "/")
+	}
+	if p == "" {
+		return "."
+	}
+	return path.Clean(p)
+}
+
+// 同期先のローカルのパスの形で組み立てたパスを、リモートでのパスに戻す
+func remoteName(distFile string) string {
+	return filepath.ToSlash(distFile)
+}
+
+// 同期先のファイルの情報。リモートの場合はリモートに問い合わせる
+func (s *syncer) statDist(distFile string) (fs.FileInfo, error) {
+	if s.remote != nil {
+		return s.remote.Stat(s.ctx, remoteName(distFile))
+	}
+	return os.Stat(distFile)
+}
+
+// 同期先のファイルのハッシュ値。リモートの場合は読み込んで計算する
+func (s *syncer) hashDist(distFile string) (string, error) {
+	if s.remote == nil {
+		return s.hashFile(distFile)
+	}
+	s.fileRate.wait(1)
+	rc, err := s.remote.Open(s.ctx, remoteName(distFile))
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := newHash(s.hashAlgo)
+	if _, err := io.Copy(h, contextReader{s.ctx, rc}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// リモートの同期先にコピーする。一時ファイルへの書き込みと置き換えは Destination が行う。
+// rec はコピー前の記録で、DELTA_MIN_SIZE で前回の版の署名を使う
+func (s *syncer) copyRemote(ctx context.Context, srcFile, distFile string, rec fileRecord) copyResult {
+	var r copyResult
+	f, err := os.Open(srcFile)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if s.deltaMin > 0 && info.Size() >= s.deltaMin {
+		if r = s.copyDelta(ctx, srcFile, distFile, f, info, rec); r.err != nil {
+			return r
+		}
+	} else {
+		h := newHash(s.hashAlgo)
+		if r.err = s.remote.Put(ctx, remoteName(distFile), io.TeeReader(s.wrapReader(contextReader{ctx, f}), h), info.Size()); r.err != nil {
+			return r
+		}
+		r.sum = hex.EncodeToString(h.Sum(nil))
+	}
+	// 置き換えた後に読み直すため、一致しなければ同期先から削除する
+	if s.verify {
+		if r.err = s.verifyCopy(distFile, r.sum); r.err != nil {
+			s.remote.Remove(ctx, remoteName(distFile))
+		}
+	}
+	return r
+}
+
+// オブジェクトストレージなど、属性をまとめて返さない同期先のファイルの情報
+type remoteFileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (i *remoteFileInfo) Name() string       { return i.name }
+func (i *remoteFileInfo) Size() int64        { return i.size }
+func (i *remoteFileInfo) ModTime() time.Time { return i.mtime }
+func (i *remoteFileInfo) IsDir() bool        { return i.dir }
+func (i *remoteFileInfo) Sys() any           { return nil }
+
+func (i *remoteFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// リモートの同期先に置く同期状態。ローカルの json と同じく各ディレクトリに syncig_manifest.json を置く。
+// 中断した実行でもそれまでの同期状態を保存するため、実行の context は使わない
+type remoteStateStore struct {
+	r    Destination
+	root string
+}
+
+func openRemoteStateStore(job Job, raw string) (stateStore, error) {
+	// 同期状態は実行のたびに読み込むため、GLACIER などのすぐに読めないストレージクラスにはしない
+	job.S3_STORAGE_CLASS = ""
+	r, root, err := openRemote(raw, job)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteStateStore{r: r, root: root}, nil
+}
+
+func (s *remoteStateStore) name(rel string) string {
+	return path.Join(s.root, filepath.ToSlash(rel), manifestFileName)
+}
+
+func (s *remoteStateStore) load(rel string) (*manifest, error) {
+	rc, err := s.r.Open(context.Background(), s.name(rel))
+	if errors.Is(err, fs.ErrNotExist) {
+		return newManifest(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	m := &manifest{}
+	if err := json.NewDecoder(rc).Decode(m); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.name(rel), err)
+	}
+	if err := upgradeManifest(m); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.name(rel), err)
+	}
+	return m, nil
+}
+
+func (s *remoteStateStore) save(rel string, m *manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.r.Put(context.Background(), s.name(rel), bytes.NewReader(b), int64(len(b)))
+}
+
+func (s *remoteStateStore) remove(rel string) error {
+	err := s.r.Remove(context.Background(), s.name(rel))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *remoteStateStore) list() ([]string, error) {
+	var dirs []string
+	var walk func(dir, rel string) error
+	walk = func(dir, rel string) error {
+		entries, err := s.r.ReadDir(context.Background(), dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			switch {
+			case e.IsDir():
+				if err := walk(path.Join(dir, e.Name()), filepath.Join(rel, e.Name())); err != nil {
+					return err
+				}
+			case e.Name() == manifestFileName:
+				dirs = append(dirs, rel)
+			}
+		}
+		return nil
+	}
+	err := walk(s.root, ".")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return dirs, err
+}
+
+func (s *remoteStateStore) close() error {
+	return s.r.Close()
+}
+
+// 1 回の要求で送るか分割するかを決めるため、r から limit+1 バイトまで読み込む。
+// size が分かっていれば、読み込む前にその大きさの領域を確保する
+func readPart(r io.Reader, size, limit int64) ([]byte, error) {
+	if size < 0 || size > limit {
+		size = limit
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size+1))
+	_, err := buf.ReadFrom(io.LimitReader(r, limit+1))
+	return buf.Bytes(), err
+}
+
+// HTTP の同期先（S3・GCS・Azure・WebDAV・HTTP・syncig serve）で一時的なエラーを送り直す回数
+const remoteRetries = 5
+
+// 失敗した HTTP の応答のステータス。408・429・5xx は一時的なエラーとして送り直す
+type httpStatusError struct {
+	code int
+	msg  string
+	// 本文のエラーコード。S3 のみ設定する（"NoSuchKey"・"SlowDown" など）
+	errCode string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.msg
+}
+
+// S3 はエラーコードのない 404・403 と NoSuchKey のみ、ファイルがない・権限がないとみなす（NoSuchBucket などは設定の誤り）
+func (e *httpStatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.code == http.StatusNotFound && (e.errCode == "" || e.errCode == "NoSuchKey")
+	case fs.ErrPermission:
+		return (e.code == http.StatusForbidden || e.code == http.StatusUnauthorized) && e.errCode == ""
+	case fs.ErrExist:
+		return e.code == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// S3 は接続が遅い場合の RequestTimeout（400）と、条件付きの書き込みの競合も送り直す
+func (e *httpStatusError) temporary() bool {
+	return e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests || e.code >= 500 ||
+		e.errCode == "RequestTimeout" || e.errCode == "ConditionalRequestConflict"
+}
+
+// 送り直すかを判定できるエラー。httpStatusError と ftpStatusError が実装する
+type temporaryError interface {
+	temporary() bool
+}
+
+// attempt 回目（0 から数える）の要求が err で失敗した場合に、送り直すなら待ってから true を返す。
+// temporaryError でないエラー（接続の切断など）は一時的なエラーとみなす。retries は送り直す回数の上限
+func retryTemporary(ctx context.Context, err error, attempt, retries int) bool {
+	if ctx.Err() != nil || attempt >= retries {
+		return false
+	}
+	var te temporaryError
+	if errors.As(err, &te) && !te.temporary() {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Duration(1<<attempt) * time.Second):
+		return true
+	}
+}
+
+// 要求の本文を body にする。大きなパートを送る間もウォッチドッグに進行中と伝わるよう、送信で読み込むたびに touchActivity する
+func setRequestBody(req *http.Request, body []byte) {
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body, req.GetBody = nil, nil
+		return
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(activityReader{bytes.NewReader(body)}), nil
+	}
+	req.Body, _ = req.GetBody()
+}
+
+// アクセストークンを取得して有効期限まで使い回す
+type tokenSource struct {
+	// エラーに付ける認証情報の種類（"google" など）
+	label   string
+	fetch   func(ctx context.Context) (token string, expiresIn int, err error)
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (t *tokenSource) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// 期限の直前に使ったトークンが要求の途中で切れないよう、余裕を持って取り直す
+	if t.token != "" && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+	token, expiresIn, err := t.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%s credentials: %w", t.label, err)
+	}
+	t.token, t.expires = token, time.Now().Add(time.Duration(expiresIn)*time.Second)
+	return t.token, nil
+}
+
+// OAuth のトークンエンドポイントの応答からアクセストークンと有効期間（秒）を取り出す
+func decodeTokenResponse(resp *http.Response) (string, int, error) {
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token request: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		// Azure のマネージド ID は文字列で返す
+		ExpiresIn json.RawMessage `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return "", 0, fmt.Errorf("token request: %w", err)
+	}
+	if t.AccessToken == "" {
+		return "", 0, errors.New("token request: no access_token in response")
+	}
+	expiresIn, _ := strconv.Atoi(strings.Trim(string(t.ExpiresIn), `"`))
+	return t.AccessToken, expiresIn, nil
+}
@@ -0,0 +1,102 @@
+package syncig
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 同期元で名前が変更されたファイル
+type rename struct {
+	from, to string
+}
+
+// 記録のない同期元のファイルのうち、同期元からなくなったコピー済みファイルと
+// 識別子（inode 番号など）が同じものを名前の変更とみなす。コピー予定の新しいファイルは toCopy から取り除く
+func (s *syncer) detectRenames(path string, sc *dirScan, present map[string]bool) error {
+	missing := map[string]string{}
+	for name, rec := range sc.state.Files {
+		if rec.FileID != "" && rec.DeletedAt.IsZero() && rec.PrunedAt.IsZero() && !present[name] {
+			missing[rec.FileID] = name
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	var toCopy []string
+	for _, f := range sc.toCopy {
+		if contains(sc.changed, f) {
+			toCopy = append(toCopy, f)
+			continue
+		}
+		id, err := fileID(filepath.Join(path, f), sc.infos[f])
+		if err != nil {
+			return err
+		}
+		from, ok := missing[id]
+		if !ok || sc.state.Files[from].Size != sc.infos[f].Size() {
+			toCopy = append(toCopy, f)
+			continue
+		}
+		sc.renamed = append(sc.renamed, rename{from: from, to: f})
+		delete(missing, id)
+	}
+	sc.toCopy = toCopy
+	// TRACKING の境界値より前の名前・更新日時になったファイルはコピー予定にならないため、別に探す。
+	// 見つけなければ元の名前が削除として扱われ、同期先からなくなる
+	names := make([]string, 0, len(sc.unrecorded))
+	for f := range sc.unrecorded {
+		names = append(names, f)
+	}
+	sort.Slice(names, func(i, j int) bool { return s.less(names[i], names[j]) })
+	for _, f := range names {
+		if len(missing) == 0 {
+			break
+		}
+		info := sc.unrecorded[f]
+		id, err := fileID(filepath.Join(path, f), info)
+		if err != nil {
+			return err
+		}
+		from, ok := missing[id]
+		if !ok || sc.state.Files[from].Size != info.Size() {
+			continue
+		}
+		sc.infos[f] = info
+		sc.renamed = append(sc.renamed, rename{from: from, to: f})
+		delete(missing, id)
+	}
+	return nil
+}
+
+// 名前の変更を同期先に反映し、同期状態の記録を移す
+func (s *syncer) applyRenames(distDir, rel string, state *manifest, renamed []rename, sc *dirScan) error {
+	for _, r := range renamed {
+		from, to := filepath.Join(distDir, r.from), filepath.Join(distDir, r.to)
+		rec := state.Files[r.from]
+		// 同期先で削除されている場合は記録のみ移す
+		err := os.Rename(from, to)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := s.removeSidecar(from); err != nil {
+			return err
+		}
+		if err == nil {
+			if err := s.writeSidecar(to, rec.digest(s.hashAlgo)); err != nil {
+				return err
+			}
+		}
+		delete(state.Files, r.from)
+		delete(state.HashCache, r.from)
+		state.record(r.to, sc.infos[r.to], rec.SHA256, rec.HashAlgo, s.less)
+		moved := state.Files[r.to]
+		moved.FileID, moved.HashState, moved.CopiedAt = rec.FileID, rec.HashState, rec.CopiedAt
+		state.Files[r.to] = moved
+		if err := s.journal.write(journalEntry{Action: journalRenamed, Path: filepath.ToSlash(filepath.Join(rel, r.to)), Size: rec.Size, Reason: "renamed from " + r.from}); err != nil {
+			return err
+		}
+		s.observer.OnFileDone(FileEvent{Src: from, Dist: to, Action: FileRenamed})
+	}
+	return nil
+}
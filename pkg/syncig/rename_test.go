@@ -0,0 +1,91 @@
+package syncig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TRACKING の境界値より前の名前に変更したファイルも名前の変更として同期先に反映する。
+// 以前は新しいファイルとしてもコピーされず、元の名前が削除として扱われて同期先からなくなっていた
+func TestDetectRenamesBelowMark(t *testing.T) {
+	tests := []struct {
+		tracking, onDelete string
+		from, to           string
+	}{
+		{trackNatural, deleteTombstone, "f3.txt", "f3b.txt"},
+		{trackNatural, deleteRemove, "f3.txt", "f3b.txt"},
+		{trackName, deleteTombstone, "f3.txt", "f10.txt"},
+		{trackName, deleteRemove, "f3.txt", "f10.txt"},
+		{trackMtime, deleteTombstone, "f3.txt", "f10.txt"},
+		// 境界値より後ろの名前への変更（toCopy から検出する従来の経路）
+		{trackName, deleteTombstone, "f3.txt", "f4.txt"},
+		{trackManifest, deleteTombstone, "f3.txt", "f10.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tracking+"/"+tt.onDelete+"/"+tt.to, func(t *testing.T) {
+			root := t.TempDir()
+			src, dist := filepath.Join(root, "src"), filepath.Join(root, "dist")
+			dir := filepath.Join(src, "a")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			// 更新日時も名前の順にする（TRACKING が mtime の境界値は f30.txt の更新日時）
+			mtime := time.Now().Add(-time.Hour)
+			for i, name := range []string{"f1.txt", "f2.txt", "f3.txt", "f30.txt"} {
+				p := filepath.Join(dir, name)
+				if err := os.WriteFile(p, []byte("content of "+name), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(p, mtime, mtime.Add(time.Duration(i)*time.Minute)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			job := Job{SRC_DIR: src, DIST_DIR: dist, TRACKING: tt.tracking, ON_DELETE: tt.onDelete, DETECT_RENAMES: true}
+			if err := validateJob(job); err != nil {
+				t.Fatal(err)
+			}
+			run := func() {
+				t.Helper()
+				if err := runJob(context.Background(), job, RunOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			run()
+			if err := os.Rename(filepath.Join(dir, tt.from), filepath.Join(dir, tt.to)); err != nil {
+				t.Fatal(err)
+			}
+			run()
+
+			b, err := os.ReadFile(filepath.Join(dist, "a", tt.to))
+			if err != nil {
+				t.Fatalf("renamed file is missing from the destination: %v", err)
+			}
+			if string(b) != "content of "+tt.from {
+				t.Errorf("%s = %q", tt.to, b)
+			}
+			for _, gone := range []string{tt.from, tt.from + tombstoneExt} {
+				if _, err := os.Stat(filepath.Join(dist, "a", gone)); !os.IsNotExist(err) {
+					t.Errorf("%s is left in the destination (err %v)", gone, err)
+				}
+			}
+			store, err := openStateStore("", dist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.close()
+			state, err := store.load("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := state.Files[tt.from]; ok {
+				t.Errorf("state still has %s", tt.from)
+			}
+			if rec, ok := state.Files[tt.to]; !ok || !rec.DeletedAt.IsZero() {
+				t.Errorf("state for %s = %+v, %v", tt.to, rec, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package syncig
+
+import (
+	"context"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// .partial の横に置く、コピーを再開するための進捗ファイルの拡張子
+const resumeExt = ".resume"
+
+// RESUME_CHUNK_SIZE の既定値
+const defaultResumeChunkSize = 64 << 20
+
+// コピーを再開するための進捗。.partial の先頭 Offset バイトがコピー済みで、
+// HashState はその部分のハッシュ値の計算途中の状態
+type resumeState struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	HashAlgo  string    `json:"hash_algo"`
+	Offset    int64     `json:"offset"`
+	HashState []byte    `json:"hash_state"`
+}
+
+// RESUME_THRESHOLD 以上のファイルは中断したコピーを再開できるようにする
+func (s *syncer) resumable(info fs.FileInfo) bool {
+	return s.resumeThreshold > 0 && info.Size() >= s.resumeThreshold
+}
+
+// 前回中断したコピーの進捗を読み込む。同期元が変わっている場合や .partial が短い場合は 0 から始める
+func (s *syncer) loadResume(tmpFile string, info fs.FileInfo) resumeState {
+	fresh := resumeState{Size: info.Size(), ModTime: info.ModTime(), HashAlgo: s.hashAlgo}
+	b, err := os.ReadFile(tmpFile + resumeExt)
+	if err != nil {
+		return fresh
+	}
+	var rs resumeState
+	if json.Unmarshal(b, &rs) != nil || rs.Size != info.Size() || !rs.ModTime.Equal(info.ModTime()) || rs.HashAlgo != s.hashAlgo {
+		return fresh
+	}
+	if tmp, err := os.Stat(tmpFile); err != nil || tmp.Size() < rs.Offset {
+		return fresh
+	}
+	return rs
+}
+
+// RESUME_CHUNK_SIZE ごとに .partial を fsync して進捗を保存しながらコピーし、
+// ファイル全体のハッシュ値と計算途中の状態を返す。失敗した場合も .partial と進捗は残す
+func (s *syncer) resumeCopy(ctx context.Context, srcFile, tmpFile string, info fs.FileInfo, buf []byte) (string, []byte, error) {
+	rs := s.loadResume(tmpFile, info)
+	h := newHash(s.hashAlgo)
+	if rs.Offset > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(rs.HashState); err != nil {
+			rs.Offset = 0
+			h.Reset()
+		}
+	}
+	srcF, err := os.Open(srcFile)
+	if err != nil {
+		return "", nil, err
+	}
+	defer srcF.Close()
+	dstF, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return "", nil, err
+	}
+	defer dstF.Close()
+	// 進捗を保存した後に書き込まれた部分は捨てる
+	if err := dstF.Truncate(rs.Offset); err != nil {
+		return "", nil, err
+	}
+	if rs.Offset > 0 {
+		s.printf("Resuming: %s from %d bytes\n", srcFile, rs.Offset)
+		s.progress.addBytes(rs.Offset)
+	}
+	if _, err := srcF.Seek(rs.Offset, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	if _, err := dstF.Seek(rs.Offset, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	r := s.wrapReader(contextReader{ctx, srcF})
+	w := io.MultiWriter(dstF, h)
+	for {
+		n, err := io.CopyBuffer(w, io.LimitReader(r, s.resumeChunkSize), buf)
+		if err != nil {
+			return "", nil, err
+		}
+		if n == 0 {
+			break
+		}
+		rs.Offset += n
+		// 進捗より先に内容を永続化しないと、再開したときに欠けた部分が残る
+		if err := dstF.Sync(); err != nil {
+			return "", nil, err
+		}
+		if rs.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+			return "", nil, err
+		}
+		b, err := json.Marshal(rs)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := writeFileAtomic(tmpFile+resumeExt, b, 0644); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := dstF.Close(); err != nil {
+		return "", nil, err
+	}
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), state, nil
+}
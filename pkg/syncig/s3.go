@@ -0,0 +1,854 @@
+package syncig
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Amazon S3（と S3 互換のストレージ）に書き込む。SDK は使わず、REST API を署名バージョン 4 で呼び出す
+
+// S3_PART_SIZE の既定値と範囲。S3 の 1 パートは 5MiB 以上 5GiB 以下で、1 オブジェクトは 10000 パート・5TiB まで
+const (
+	defaultS3PartSize = 16 << 20
+	minS3PartSize     = 5 << 20
+	maxS3PartSize     = 5 << 30
+	maxS3Parts        = 10000
+	maxS3ObjectSize   = 5 << 40
+)
+
+// S3_STORAGE_CLASS に指定できる値
+var s3StorageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER":             true,
+	"GLACIER_IR":          true,
+	"DEEP_ARCHIVE":        true,
+}
+
+// 認証情報。環境変数（CREDENTIALS）か共有認証情報ファイル（~/.aws/credentials）から読み込む
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func loadAWSCredentials(job Job) (awsCredentials, error) {
+	var c awsCredentials
+	for _, v := range []struct {
+		name string
+		dst  *string
+	}{
+		{"AWS_ACCESS_KEY_ID", &c.accessKey},
+		{"AWS_SECRET_ACCESS_KEY", &c.secretKey},
+		{"AWS_SESSION_TOKEN", &c.sessionToken},
+	} {
+		var err error
+		if *v.dst, err = credential(job, v.name); err != nil {
+			return awsCredentials{}, err
+		}
+	}
+	if c.accessKey != "" && c.secretKey != "" {
+		return c, nil
+	}
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, errors.New("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or create %s", file)
+	}
+	defer f.Close()
+	c = awsCredentials{}
+	section := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			c.accessKey = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			c.secretKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			c.sessionToken = strings.TrimSpace(v)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return awsCredentials{}, fmt.Errorf("%s: %w", file, err)
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials for profile %q in %s", profile, file)
+	}
+	return c, nil
+}
+
+// S3_ROLE_ARN のロールの一時的な認証情報。元の認証情報で STS の AssumeRole を呼び出して取得し、期限の前に取り直す
+type awsRole struct {
+	client     *http.Client
+	base       awsCredentials
+	arn        string
+	externalID string
+	// STS のエンドポイントと署名に使うリージョン
+	endpoint string
+	region   string
+
+	mu      sync.Mutex
+	creds   awsCredentials
+	expires time.Time
+}
+
+// 引き受けたロールの有効期間
+const awsRoleDuration = time.Hour
+
+// CloudTrail で実行元が分かるよう、セッション名にホスト名を含める（使える文字は英数字と =,.@_-、64 文字まで）
+func awsRoleSessionName() string {
+	host, _ := os.Hostname()
+	name := []byte("syncig-" + host)
+	for i, c := range name {
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("=,.@_-", c) >= 0) {
+			name[i] = '-'
+		}
+	}
+	return string(name[:min(len(name), 64)])
+}
+
+func (r *awsRole) get(ctx context.Context) (awsCredentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 大きなパートの送信中に切れないよう、余裕を持って取り直す
+	if r.creds.accessKey != "" && time.Until(r.expires) > 5*time.Minute {
+		return r.creds, nil
+	}
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {r.arn},
+		"RoleSessionName": {awsRoleSessionName()},
+		"DurationSeconds": {strconv.Itoa(int(awsRoleDuration / time.Second))},
+	}
+	if r.externalID != "" {
+		form.Set("ExternalId", r.externalID)
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint+"/", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	setRequestBody(req, body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	sum := sha256.Sum256(body)
+	signAWS(req, r.base, r.region, "sts", "/", "", hex.EncodeToString(sum[:]), time.Now().UTC())
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assume role %s: %w", r.arn, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assume role %s: %w", r.arn, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error s3Error `xml:"Error"`
+		}
+		msg := resp.Status
+		if xml.Unmarshal(b, &e) == nil && e.Error.Code != "" {
+			msg = e.Error.Code + ": " + e.Error.Message
+		}
+		return awsCredentials{}, fmt.Errorf("assume role %s: %s", r.arn, msg)
+	}
+	var out struct {
+		AccessKeyID     string    `xml:"AssumeRoleResult>Credentials>AccessKeyId"`
+		SecretAccessKey string    `xml:"AssumeRoleResult>Credentials>SecretAccessKey"`
+		SessionToken    string    `xml:"AssumeRoleResult>Credentials>SessionToken"`
+		Expiration      time.Time `xml:"AssumeRoleResult>Credentials>Expiration"`
+	}
+	if err := xml.Unmarshal(b, &out); err != nil || out.AccessKeyID == "" {
+		return awsCredentials{}, fmt.Errorf("assume role %s: invalid response", r.arn)
+	}
+	r.creds = awsCredentials{accessKey: out.AccessKeyID, secretKey: out.SecretAccessKey, sessionToken: out.SessionToken}
+	r.expires = out.Expiration
+	return r.creds, nil
+}
+
+// s3://bucket/prefix の同期先
+type s3Store struct {
+	client *http.Client
+	creds  awsCredentials
+	// S3_ROLE_ARN を指定した場合は creds の代わりにロールの認証情報で署名する
+	role   *awsRole
+	region string
+	bucket string
+	// バケットを含むベースの URL。S3_ENDPOINT を指定した場合とバケット名に . を含む場合はパス形式にする
+	base         string
+	pathStyle    bool
+	storageClass string
+	partSize     int64
+}
+
+// DIST_DIR が s3:// の場合の設定を確認する
+func validateS3Dist(job Job) error {
+	if job.S3_STORAGE_CLASS != "" && !s3StorageClasses[job.S3_STORAGE_CLASS] {
+		return fmt.Errorf("unknown S3_STORAGE_CLASS %q", job.S3_STORAGE_CLASS)
+	}
+	if job.S3_PART_SIZE != 0 && (job.S3_PART_SIZE < minS3PartSize || job.S3_PART_SIZE > maxS3PartSize) {
+		return errors.New("S3_PART_SIZE must be between 5MiB and 5GiB")
+	}
+	if job.S3_ENDPOINT != "" {
+		if e, err := url.Parse(job.S3_ENDPOINT); err != nil || (e.Scheme != "http" && e.Scheme != "https") || e.Host == "" {
+			return fmt.Errorf("S3_ENDPOINT %q must be an http or https URL", job.S3_ENDPOINT)
+		}
+	}
+	return nil
+}
+
+func openS3Store(u *url.URL, job Job) (*s3Store, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: bucket is empty", u.Redacted())
+	}
+	creds, err := loadAWSCredentials(job)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHTTPClient(job)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Store{
+		client:       client,
+		creds:        creds,
+		region:       job.S3_REGION,
+		bucket:       u.Host,
+		storageClass: job.S3_STORAGE_CLASS,
+		partSize:     int64(job.S3_PART_SIZE),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.partSize == 0 {
+		s.partSize = defaultS3PartSize
+	}
+	switch {
+	case job.S3_ENDPOINT != "":
+		s.base, s.pathStyle = strings.TrimRight(job.S3_ENDPOINT, "/")+"/"+s.bucket, true
+	case strings.Contains(s.bucket, "."):
+		s.base, s.pathStyle = "https://s3."+s.region+".amazonaws.com/"+s.bucket, true
+	default:
+		s.base = "https://" + s.bucket + ".s3." + s.region + ".amazonaws.com"
+	}
+	if job.S3_ROLE_ARN != "" {
+		// S3 互換のストレージ（MinIO など）は同じエンドポイントで STS の API を提供する
+		endpoint := "https://sts." + s.region + ".amazonaws.com"
+		if job.S3_ENDPOINT != "" {
+			endpoint = strings.TrimRight(job.S3_ENDPOINT, "/")
+		}
+		s.role = &awsRole{client: s.client, base: creds, arn: job.S3_ROLE_ARN, externalID: job.S3_EXTERNAL_ID, endpoint: endpoint, region: s.region}
+	}
+	return s, nil
+}
+
+// リモートでのパスをオブジェクトのキーにする。キーは / で始めない
+func (s *s3Store) key(name string) string {
+	name = path.Clean(name)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+// URI のエンコード。S3 の署名ではキーの / はエンコードせず、クエリの値は / もエンコードする
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// 署名した要求を送る。body は署名のために内容のハッシュ値を計算するため、メモリ上に置いたものを渡す
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	escaped := "/" + s3Escape(key, false)
+	rawURL := s.base + escaped
+	if s.pathStyle {
+		escaped = "/" + s3Escape(s.bucket, false) + escaped
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	if canonicalQuery != "" {
+		rawURL += "?" + canonicalQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestBody(req, body)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	creds := s.creds
+	if s.role != nil {
+		if creds, err = s.role.get(ctx); err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256(body)
+	signAWS(req, creds, s.region, "s3", escaped, canonicalQuery, hex.EncodeToString(sum[:]), time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// 署名バージョン 4 の Authorization ヘッダーを付ける。service は "s3"・"sts"、escapedPath はエンコード済みのパス
+func signAWS(req *http.Request, creds awsCredentials, region, service, escapedPath, canonicalQuery, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, escapedPath, canonicalQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// S3 のエラー応答
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// 失敗した応答をエラーに変換して本文を閉じる。オブジェクトがない場合は fs.ErrNotExist として扱える
+func (s *s3Store) responseError(op, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+	var e s3Error
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(b, &e)
+	return &fs.PathError{Op: op, Path: "s3://" + s.bucket + "/" + key, Err: s3StatusError(resp.StatusCode, resp.Status, e)}
+}
+
+// HEAD の応答など本文のない場合は status をメッセージにする
+func s3StatusError(code int, status string, e s3Error) *httpStatusError {
+	if e.Code == "" {
+		return &httpStatusError{code: code, msg: status}
+	}
+	return &httpStatusError{code: code, msg: e.Code + ": " + e.Message, errCode: e.Code}
+}
+
+// 要求を送り、200 が返るまで一時的なエラーを送り直す。返した応答の本文は呼び出し側で閉じる
+func (s *s3Store) send(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.do(ctx, method, key, query, header, body)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				return resp, nil
+			}
+			err = s.responseError("put", key, resp)
+		}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return nil, err
+		}
+	}
+}
+
+// 1 パートに収まるファイルは 1 回の PUT でアップロードする。size から 10000 パートに収まらない場合は
+// パートを大きくし、5TiB を超えるファイルはアップロードする前にエラーにする
+func (s *s3Store) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	key := s.key(name)
+	if size > maxS3ObjectSize {
+		return &fs.PathError{Op: "put", Path: "s3://" + s.bucket + "/" + key, Err: errors.New("file is larger than the S3 object size limit of 5TiB")}
+	}
+	partSize := s.partSize
+	if size > partSize*maxS3Parts {
+		// 1MiB 単位に切り上げる
+		partSize = ((size+maxS3Parts-1)/maxS3Parts + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	first, err := readPart(r, size, partSize)
+	if err != nil {
+		return err
+	}
+	if int64(len(first)) <= partSize {
+		return s.putObject(ctx, key, first)
+	}
+	return s.putMultipart(ctx, key, partSize, first[:partSize], io.MultiReader(bytes.NewReader(first[partSize:]), r))
+}
+
+// アップロードするオブジェクトのヘッダー
+func (s *s3Store) objectHeader() http.Header {
+	h := http.Header{}
+	if s.storageClass != "" {
+		h.Set("x-amz-storage-class", s.storageClass)
+	}
+	return h
+}
+
+func (s *s3Store) putObject(ctx context.Context, key string, data []byte) error {
+	resp, err := s.send(ctx, http.MethodPut, key, nil, s.objectHeader(), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// If-None-Match: * の条件付き PUT で作る。既にある場合は 412 が返る
+func (s *s3Store) Create(ctx context.Context, name string, data []byte) error {
+	key := s.key(name)
+	h := s.objectHeader()
+	h.Set("If-None-Match", "*")
+	resp, err := s.send(ctx, http.MethodPut, key, nil, h, data)
+	var se *httpStatusError
+	if errors.As(err, &se) && se.code == http.StatusPreconditionFailed {
+		return &fs.PathError{Op: "create", Path: "s3://" + s.bucket + "/" + key, Err: fs.ErrExist}
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// マルチパートアップロード。オブジェクトはすべてのパートを送って完了するまで作られず、
+// 失敗した場合は途中のパートを破棄する。各パートと完了の要求は一時的なエラーであれば送り直す
+func (s *s3Store) putMultipart(ctx context.Context, key string, partSize int64, first []byte, rest io.Reader) error {
+	uploadID, err := s.initiateMultipart(ctx, key)
+	if err != nil {
+		return err
+	}
+	var parts []s3CompletePart
+	err = func() error {
+		buf := first
+		next := make([]byte, partSize)
+		for n := 1; ; n++ {
+			// 読み込み中に大きくなったファイルなど、見込みより多くのパートが必要になった場合
+			if n > maxS3Parts {
+				return &fs.PathError{Op: "put", Path: "s3://" + s.bucket + "/" + key, Err: errors.New("file needs more than 10000 parts; increase S3_PART_SIZE")}
+			}
+			q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+			resp, err := s.send(ctx, http.MethodPut, key, q, nil, buf)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			parts = append(parts, s3CompletePart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+			m, err := io.ReadFull(rest, next)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			buf = next[:m]
+		}
+	}()
+	if err == nil {
+		err = s.completeMultipart(ctx, key, uploadID, parts)
+	}
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+	}
+	return err
+}
+
+func (s *s3Store) initiateMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := s.send(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, s.objectHeader(), nil)
+	if err != nil {
+		return "", err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("s3 %s: %w", key, err)
+	}
+	return initiated.UploadID, nil
+}
+
+// 中断した場合も途中のパートが課金され続けないよう破棄する
+func (s *s3Store) abortMultipart(key, uploadID string) {
+	if resp, err := s.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// マルチパートアップロードの 1 パート。src は UploadPartCopy でコピーする前回の版での位置で、-1 はアップロードする
+type s3DeltaPart struct {
+	off, n, src int64
+}
+
+// 差分をパートに分ける。最後以外のパートは 5MiB 以上である必要があるため、5MiB に満たない一致する範囲や、
+// 送る部分の前後の 5MiB に満たない部分は同期元から送る。10000 パートに収まらない場合は errNoDelta を返す
+func (s *s3Store) deltaParts(ops []deltaOp) ([]s3DeltaPart, error) {
+	var (
+		parts    []s3DeltaPart
+		lit, end int64 = -1, 0
+	)
+	// n を 5GiB と partSize 以下に分ける。残りが 5MiB に満たない場合は直前のパートに含める
+	split := func(off, n, src, size int64) {
+		for n > 0 {
+			c := min(n, size)
+			if rest := n - c; rest > 0 && rest < minS3PartSize {
+				c = n
+				if c > maxS3PartSize {
+					c = n / 2
+				}
+			}
+			parts = append(parts, s3DeltaPart{off: off, n: c, src: src})
+			off += c
+			n -= c
+			if src >= 0 {
+				src += c
+			}
+		}
+	}
+	flush := func() {
+		if lit >= 0 {
+			split(lit, end-lit, -1, s.partSize)
+			lit = -1
+		}
+	}
+	for _, op := range ops {
+		off, n, src := op.off, op.n, op.src
+		if src >= 0 && lit >= 0 && end-lit < minS3PartSize {
+			take := min(minS3PartSize-(end-lit), n)
+			end += take
+			off, n, src = off+take, n-take, src+take
+		}
+		if src >= 0 && n >= minS3PartSize {
+			flush()
+			split(off, n, src, maxS3PartSize)
+			continue
+		}
+		if n > 0 {
+			if lit < 0 {
+				lit = off
+			}
+			end = off + n
+		}
+	}
+	flush()
+	if len(parts) > maxS3Parts {
+		return nil, errNoDelta
+	}
+	return parts, nil
+}
+
+// 前回の版の範囲を UploadPartCopy でコピーし、変わった部分をアップロードする。置き換える前の
+// オブジェクトはマルチパートアップロードが完了するまで残るため、同じキーからコピーできる
+func (s *s3Store) putDelta(ctx context.Context, name string, ops []deltaOp, literal func(off, n int64) io.Reader) (int64, error) {
+	key := s.key(name)
+	plan, err := s.deltaParts(ops)
+	if err != nil {
+		return 0, err
+	}
+	uploadID, err := s.initiateMultipart(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	parts := make([]s3CompletePart, 0, len(plan))
+	var sent int64
+	err = func() error {
+		for i, p := range plan {
+			q := url.Values{"partNumber": {strconv.Itoa(i + 1)}, "uploadId": {uploadID}}
+			var etag string
+			if p.src >= 0 {
+				if etag, err = s.copyPart(ctx, key, q, p.src, p.n); err != nil {
+					return err
+				}
+			} else {
+				buf, err := io.ReadAll(literal(p.off, p.n))
+				if err != nil {
+					return err
+				}
+				resp, err := s.send(ctx, http.MethodPut, key, q, nil, buf)
+				if err != nil {
+					return err
+				}
+				resp.Body.Close()
+				etag = resp.Header.Get("ETag")
+				sent += p.n
+			}
+			parts = append(parts, s3CompletePart{PartNumber: i + 1, ETag: etag})
+		}
+		return nil
+	}()
+	if err == nil {
+		err = s.completeMultipart(ctx, key, uploadID, parts)
+	}
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+	}
+	return sent, err
+}
+
+// UploadPartCopy。CompleteMultipartUpload と同じく、200 でもエラーを返すことがある
+func (s *s3Store) copyPart(ctx context.Context, key string, q url.Values, off, n int64) (string, error) {
+	h := http.Header{}
+	h.Set("x-amz-copy-source", "/"+s3Escape(s.bucket, false)+"/"+s3Escape(key, false))
+	h.Set("x-amz-copy-source-range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	for attempt := 0; ; attempt++ {
+		resp, err := s.send(ctx, http.MethodPut, key, q, h, nil)
+		if err != nil {
+			return "", err
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		var result struct {
+			XMLName xml.Name
+			ETag    string `xml:"ETag"`
+			s3Error
+		}
+		if err := xml.Unmarshal(b, &result); err != nil {
+			return "", fmt.Errorf("s3 %s: %w", key, err)
+		}
+		if result.XMLName.Local != "Error" {
+			return result.ETag, nil
+		}
+		code := http.StatusBadRequest
+		if result.Code == "InternalError" || result.Code == "SlowDown" || result.Code == "ServiceUnavailable" {
+			code = http.StatusInternalServerError
+		}
+		err = &fs.PathError{Op: "put", Path: "s3://" + s.bucket + "/" + key, Err: s3StatusError(code, "", result.s3Error)}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return "", err
+		}
+	}
+}
+
+func (s *s3Store) completeMultipart(ctx context.Context, key, uploadID string, parts []s3CompletePart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletePart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := s.send(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+		if err != nil {
+			return err
+		}
+		// 完了の処理中に失敗した場合も 200 でエラーを返すことがある。InternalError などは送り直す
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		var e struct {
+			XMLName xml.Name
+			s3Error
+		}
+		if xml.Unmarshal(b, &e) != nil || e.XMLName.Local != "Error" {
+			return nil
+		}
+		code := http.StatusBadRequest
+		if e.Code == "InternalError" || e.Code == "SlowDown" || e.Code == "ServiceUnavailable" {
+			code = http.StatusInternalServerError
+		}
+		err = &fs.PathError{Op: "put", Path: "s3://" + s.bucket + "/" + key, Err: s3StatusError(code, "", e.s3Error)}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return err
+		}
+	}
+}
+
+func (s *s3Store) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	key := s.key(name)
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("open", key, resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	key := s.key(name)
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("stat", key, resp)
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &remoteFileInfo{name: path.Base(key), size: resp.ContentLength, mtime: mtime}, nil
+}
+
+func (s *s3Store) Remove(ctx context.Context, name string) error {
+	key := s.key(name)
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s.responseError("remove", key, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// 区切り文字を / として、dir の直下のオブジェクトと共通の接頭辞（ディレクトリ）を一覧にする
+func (s *s3Store) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	prefix := s.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var infos []fs.FileInfo
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s.responseError("readdir", prefix, resp)
+		}
+		var result struct {
+			IsTruncated bool `xml:"IsTruncated"`
+			Contents    []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+		for _, c := range result.Contents {
+			infos = append(infos, &remoteFileInfo{name: strings.TrimPrefix(c.Key, prefix), size: c.Size, mtime: c.LastModified})
+		}
+		for _, p := range result.CommonPrefixes {
+			infos = append(infos, &remoteFileInfo{name: strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"), dir: true})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Store) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,900 @@
+package syncig
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SFTP（プロトコルのバージョン 3）で同期先に書き込む。SSH の実装は標準ライブラリにないため、
+// ssh コマンドで sftp サブシステムを起動して標準入出力でやり取りする。
+// 認証は ssh の設定（~/.ssh/config・鍵・エージェント）に任せ、パスワードの入力は求めない
+
+// パケットの種類
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpExtended = 200
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+// SSH_FXP_STATUS のエラーコード
+const (
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+	sftpPermDenied = 3
+)
+
+// 対応しているプロトコルのバージョン
+const sftpProtoVersion = 3
+
+// SSH_FXP_OPEN のフラグ
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+	sftpFlagExcl  = 0x20
+)
+
+// ファイル属性に含まれる項目
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+// 1 回の SSH_FXP_READ / SSH_FXP_WRITE で送る大きさと、応答を待たずに送る数。
+// OpenSSH の sftp-server は 1 回の読み込みを 256KiB までに制限している
+const (
+	sftpChunkSize = 32 << 10
+	sftpInflight  = 64
+)
+
+// copy-data の 1 回の要求でコピーする大きさ
+const sftpCopyChunk = 256 << 20
+
+// 接続先が応答しない場合に待ち続けないようにする
+const sftpConnectTimeout = 30 * time.Second
+
+// 受信したパケット。data は種類と要求 ID を除いた部分
+type sftpPacket struct {
+	typ  byte
+	data []byte
+}
+
+// ssh コマンド 1 つ分の SFTP セッション。要求は並行して送ってよく、応答は要求 ID で振り分ける
+type sftpClient struct {
+	cmd *exec.Cmd
+	w   io.WriteCloser
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan sftpPacket
+	// 受信が止まった理由（ssh の終了など）
+	err error
+	// posix-rename@openssh.com に対応している（既存のファイルを置き換えられる）
+	posixRename bool
+	// copy-data に対応している（OpenSSH 9.0 以降。DELTA_MIN_SIZE でサーバー側でコピーする）
+	copyData bool
+
+	// 同じ接続先を開いている sftpStore の数（sftpClients で管理する）
+	key  string
+	refs int
+}
+
+// 同期先と同期状態を同じ接続先に置く場合に ssh を 1 つで済ませる
+var (
+	sftpClientsMu sync.Mutex
+	sftpClients   = map[string]*sftpClient{}
+)
+
+// ssh の引数。SSH_COMMAND が指定されている場合はその後ろに接続先を続ける。
+// compress の場合は ssh の圧縮（zlib）を有効にする。OpenSSH では圧縮の程度は選べない。
+// proxyCommand は PROXY を指定した場合の ProxyCommand（SSH_COMMAND で -o ProxyCommand を指定した場合はそちらが優先される）
+func sftpArgs(u *url.URL, sshCommand string, compress bool, proxyCommand string) []string {
+	args := strings.Fields(sshCommand)
+	if len(args) == 0 {
+		args = []string{"ssh"}
+	}
+	// パスワードなどの入力を待たずに失敗させる
+	args = append(args, "-o", "BatchMode=yes", "-o", fmt.Sprintf("ConnectTimeout=%d", int(sftpConnectTimeout.Seconds())))
+	if compress {
+		args = append(args, "-o", "Compression=yes")
+	}
+	if proxyCommand != "" {
+		args = append(args, "-o", "ProxyCommand="+proxyCommand)
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	if u.User != nil && u.User.Username() != "" {
+		args = append(args, "-l", u.User.Username())
+	}
+	return append(args, "-s", u.Hostname(), "sftp")
+}
+
+// 接続先ごとに共有する SFTP セッションを開く。使い終わったら releaseSFTP を呼ぶ
+func acquireSFTP(u *url.URL, job Job) (*sftpClient, error) {
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("%s: passwords in the URL are not supported; use an SSH key or agent", u.Redacted())
+	}
+	// - で始まるホスト名は ssh のオプションとして解釈される
+	if u.Hostname() == "" || strings.HasPrefix(u.Hostname(), "-") {
+		return nil, fmt.Errorf("%s: invalid host", u.Redacted())
+	}
+	// PROXY は ssh が ProxyCommand として起動する syncig proxy-connect が中継する。
+	// プロキシのパスワードをコマンドラインに含めないよう、URL は環境変数で渡す
+	var proxyCommand string
+	var env []string
+	proxy, err := jobProxy(job)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		proxyCommand = `"` + strings.ReplaceAll(exe, "%", "%%") + `" proxy-connect %h %p`
+		env = append(os.Environ(), proxyEnv+"="+proxy.String())
+	}
+	args := sftpArgs(u, job.SSH_COMMAND, job.COMPRESSION_LEVEL > 0, proxyCommand)
+	key := strings.Join(append(args, env...), "\x00")
+	sftpClientsMu.Lock()
+	defer sftpClientsMu.Unlock()
+	if c, ok := sftpClients[key]; ok {
+		c.refs++
+		return c, nil
+	}
+	c, err := dialSFTP(args, env)
+	if err != nil {
+		return nil, fmt.Errorf("sftp %s: %w", u.Redacted(), err)
+	}
+	c.key, c.refs = key, 1
+	sftpClients[key] = c
+	return c, nil
+}
+
+func releaseSFTP(c *sftpClient) error {
+	sftpClientsMu.Lock()
+	c.refs--
+	if c.refs > 0 {
+		sftpClientsMu.Unlock()
+		return nil
+	}
+	delete(sftpClients, c.key)
+	sftpClientsMu.Unlock()
+	return c.close()
+}
+
+// env が nil の場合は syncig の環境変数をそのまま渡す
+func dialSFTP(args, env []string) (*sftpClient, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	// 接続・認証の失敗は ssh が標準エラーに表示する
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &sftpClient{cmd: cmd, w: w, pending: map[uint32]chan sftpPacket{}}
+	br := bufio.NewReaderSize(r, 64<<10)
+	// SSH_FXP_INIT には要求 ID がない
+	var b sftpBuf
+	b.u32(sftpProtoVersion)
+	if err := c.writePacket(sftpInit, b); err != nil {
+		c.close()
+		return nil, err
+	}
+	typ, data, err := readSFTPPacket(br)
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("ssh exited before starting the sftp subsystem: %w", err)
+	}
+	if typ != sftpVersion {
+		c.close()
+		return nil, fmt.Errorf("unexpected packet %d instead of version", typ)
+	}
+	p := sftpParser{b: data}
+	if v := p.u32(); v != sftpProtoVersion {
+		c.close()
+		return nil, fmt.Errorf("server speaks SFTP version %d, not %d", v, sftpProtoVersion)
+	}
+	for len(p.b) > 0 && p.err == nil {
+		name, _ := p.str(), p.str()
+		switch name {
+		case "posix-rename@openssh.com":
+			c.posixRename = true
+		case "copy-data":
+			c.copyData = true
+		}
+	}
+	go c.receive(br)
+	return c, nil
+}
+
+// 応答を受信して要求 ID ごとに振り分ける。ssh が終了すると待っている要求をすべて失敗させる
+func (c *sftpClient) receive(r io.Reader) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err == nil && len(data) < 4 {
+			err = fmt.Errorf("short packet %d", typ)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("connection closed")
+			}
+			c.mu.Lock()
+			c.err = fmt.Errorf("sftp: %w", err)
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+		id := binary.BigEndian.Uint32(data)
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- sftpPacket{typ: typ, data: data[4:]}
+		}
+	}
+}
+
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > 1<<20 {
+		return 0, nil, fmt.Errorf("invalid packet length %d", n)
+	}
+	data := make([]byte, n-1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], data, nil
+}
+
+func (c *sftpClient) writePacket(typ byte, payload []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(payload)+1))
+	hdr[4] = typ
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.w.Write(append(hdr[:], payload...)); err != nil {
+		return fmt.Errorf("sftp: %w", err)
+	}
+	return nil
+}
+
+// 要求を送り、応答を受け取るチャネルを返す。payload は要求 ID より後の部分
+func (c *sftpClient) send(typ byte, payload sftpBuf) (<-chan sftpPacket, error) {
+	ch := make(chan sftpPacket, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+	var b sftpBuf
+	b.u32(id)
+	if err := c.writePacket(typ, append(b, payload...)); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// 応答を待つ。ssh が終了した場合は終了の理由を返す
+func (c *sftpClient) wait(ch <-chan sftpPacket) (sftpPacket, error) {
+	p, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return p, c.err
+	}
+	return p, nil
+}
+
+func (c *sftpClient) call(typ byte, payload sftpBuf) (sftpPacket, error) {
+	ch, err := c.send(typ, payload)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	return c.wait(ch)
+}
+
+// SSH_FXP_STATUS の応答をエラーに変換する。OK は nil
+func sftpStatusError(op, name string, p sftpPacket) error {
+	if p.typ != sftpStatus {
+		return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("unexpected sftp packet %d", p.typ)}
+	}
+	sp := sftpParser{b: p.data}
+	code, msg := sp.u32(), sp.str()
+	var err error
+	switch code {
+	case sftpOK:
+		return nil
+	case sftpEOF:
+		err = io.EOF
+	case sftpNoSuchFile:
+		err = fs.ErrNotExist
+	case sftpPermDenied:
+		err = fs.ErrPermission
+	default:
+		if msg == "" {
+			msg = fmt.Sprintf("sftp status %d", code)
+		}
+		err = errors.New(msg)
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// 応答が状態のみの要求
+func (c *sftpClient) callStatus(op string, typ byte, name string, payload sftpBuf) error {
+	p, err := c.call(typ, payload)
+	if err != nil {
+		return err
+	}
+	return sftpStatusError(op, name, p)
+}
+
+func (c *sftpClient) stat(name string) (fs.FileInfo, error) {
+	var b sftpBuf
+	b.str(name)
+	p, err := c.call(sftpStat, b)
+	if err != nil {
+		return nil, err
+	}
+	if p.typ != sftpAttrs {
+		return nil, sftpStatusError("stat", name, p)
+	}
+	sp := sftpParser{b: p.data}
+	info := sp.attrs(path.Base(name))
+	return info, sp.err
+}
+
+func (c *sftpClient) openHandle(op, name string, flags uint32) (string, error) {
+	var b sftpBuf
+	b.str(name)
+	b.u32(flags)
+	// 新しく作るファイルの権限はサーバーの umask に任せる
+	b.u32(0)
+	p, err := c.call(sftpOpen, b)
+	if err != nil {
+		return "", err
+	}
+	if p.typ != sftpHandle {
+		return "", sftpStatusError(op, name, p)
+	}
+	sp := sftpParser{b: p.data}
+	return sp.str(), sp.err
+}
+
+func (c *sftpClient) closeHandle(name, handle string) error {
+	var b sftpBuf
+	b.str(handle)
+	return c.callStatus("close", sftpClose, name, b)
+}
+
+func (c *sftpClient) readDir(dir string) ([]fs.FileInfo, error) {
+	var b sftpBuf
+	b.str(dir)
+	p, err := c.call(sftpOpendir, b)
+	if err != nil {
+		return nil, err
+	}
+	if p.typ != sftpHandle {
+		return nil, sftpStatusError("readdir", dir, p)
+	}
+	sp := sftpParser{b: p.data}
+	handle := sp.str()
+	defer c.closeHandle(dir, handle)
+	var infos []fs.FileInfo
+	for {
+		var b sftpBuf
+		b.str(handle)
+		p, err := c.call(sftpReaddir, b)
+		if err != nil {
+			return nil, err
+		}
+		if p.typ != sftpName {
+			if err := sftpStatusError("readdir", dir, p); !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			return infos, nil
+		}
+		sp := sftpParser{b: p.data}
+		for n := sp.u32(); n > 0 && sp.err == nil; n-- {
+			name := sp.str()
+			sp.str() // ls -l 形式の表示
+			info := sp.attrs(name)
+			if name != "." && name != ".." {
+				infos = append(infos, info)
+			}
+		}
+		if sp.err != nil {
+			return nil, sp.err
+		}
+	}
+}
+
+func (c *sftpClient) remove(name string) error {
+	var b sftpBuf
+	b.str(name)
+	return c.callStatus("remove", sftpRemove, name, b)
+}
+
+// 親ディレクトリも含めて作る。既にある場合は何もしない
+func (c *sftpClient) mkdirAll(dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	if info, err := c.stat(dir); err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := c.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	var b sftpBuf
+	b.str(dir)
+	b.u32(0)
+	err := c.callStatus("mkdir", sftpMkdir, dir, b)
+	// 並行して作られた場合
+	if err != nil {
+		if info, serr := c.stat(dir); serr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// 既存のファイルを置き換える。posix-rename に対応していないサーバーでは置き換え先を削除してから名前を変える
+func (c *sftpClient) rename(from, to string) error {
+	var b sftpBuf
+	if c.posixRename {
+		b.str("posix-rename@openssh.com")
+		b.str(from)
+		b.str(to)
+		return c.callStatus("rename", sftpExtended, to, b)
+	}
+	b.str(from)
+	b.str(to)
+	err := c.callStatus("rename", sftpRename, to, b)
+	if err != nil {
+		if _, serr := c.stat(to); serr == nil {
+			if rerr := c.remove(to); rerr != nil {
+				return err
+			}
+			err = c.callStatus("rename", sftpRename, to, b)
+		}
+	}
+	return err
+}
+
+// r の内容を name に書き込む
+func (c *sftpClient) upload(ctx context.Context, name string, r io.Reader, flags uint32) error {
+	handle, err := c.openHandle("create", name, flags)
+	if err != nil {
+		return err
+	}
+	err = c.writeFrom(ctx, name, handle, r, 0)
+	if cerr := c.closeHandle(name, handle); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// r の内容を開いたファイルの offset から書き込む。応答を待たずに sftpInflight 個まで書き込み要求を送る
+func (c *sftpClient) writeFrom(ctx context.Context, name, handle string, r io.Reader, offset uint64) error {
+	var (
+		err      error
+		inflight []<-chan sftpPacket
+		buf      = make([]byte, sftpChunkSize)
+	)
+	waitOne := func() error {
+		p, err := c.wait(inflight[0])
+		inflight = inflight[1:]
+		if err != nil {
+			return err
+		}
+		return sftpStatusError("write", name, p)
+	}
+	for err == nil {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if n > 0 {
+			var b sftpBuf
+			b.str(handle)
+			b.u64(offset)
+			b.bytes(buf[:n])
+			ch, serr := c.send(sftpWrite, b)
+			if serr != nil {
+				err = serr
+				break
+			}
+			inflight = append(inflight, ch)
+			offset += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			break
+		}
+		if err == nil && len(inflight) >= sftpInflight {
+			err = waitOne()
+		}
+	}
+	for len(inflight) > 0 {
+		if werr := waitOne(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// copy-data 拡張で、開いたファイルの範囲を別のファイルにサーバー内でコピーする
+func (c *sftpClient) copyRange(name, from string, fromOffset, n uint64, to string, toOffset uint64) error {
+	var b sftpBuf
+	b.str("copy-data")
+	b.str(from)
+	b.u64(fromOffset)
+	b.u64(n)
+	b.str(to)
+	b.u64(toOffset)
+	return c.callStatus("copy-data", sftpExtended, name, b)
+}
+
+func (c *sftpClient) close() error {
+	c.w.Close()
+	done := make(chan error, 1)
+	go func() { done <- c.cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.cmd.Process.Kill()
+		<-done
+	}
+	return nil
+}
+
+// 先頭から順に読み込む
+type sftpReader struct {
+	c      *sftpClient
+	name   string
+	handle string
+	offset uint64
+	buf    []byte
+	err    error
+}
+
+func (r *sftpReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var b sftpBuf
+		b.str(r.handle)
+		b.u64(r.offset)
+		b.u32(sftpChunkSize)
+		pkt, err := r.c.call(sftpRead, b)
+		if err != nil {
+			r.err = err
+			continue
+		}
+		if pkt.typ != sftpData {
+			if r.err = sftpStatusError("read", r.name, pkt); errors.Is(r.err, io.EOF) {
+				r.err = io.EOF
+			}
+			continue
+		}
+		sp := sftpParser{b: pkt.data}
+		r.buf = []byte(sp.str())
+		if sp.err != nil {
+			r.err = sp.err
+		}
+		r.offset += uint64(len(r.buf))
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *sftpReader) Close() error {
+	return r.c.closeHandle(r.name, r.handle)
+}
+
+// sftp://user@host:port/path の同期先
+type sftpStore struct {
+	c *sftpClient
+}
+
+func openSFTPStore(u *url.URL, job Job) (*sftpStore, error) {
+	c, err := acquireSFTP(u, job)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpStore{c: c}, nil
+}
+
+func (s *sftpStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if err := s.c.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	tmp := name + partialExt
+	if err := s.c.upload(ctx, tmp, r, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc); err != nil {
+		s.c.remove(tmp)
+		return err
+	}
+	if err := s.c.rename(tmp, name); err != nil {
+		s.c.remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// SSH_FXF_EXCL で作る。SFTP v3 には既にあることを表すステータスがないため、失敗した場合は stat で確かめる
+func (s *sftpStore) Create(ctx context.Context, name string, data []byte) error {
+	if err := s.c.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	err := s.c.upload(ctx, name, bytes.NewReader(data), sftpFlagWrite|sftpFlagCreat|sftpFlagExcl)
+	if err != nil {
+		if _, serr := s.c.stat(name); serr == nil {
+			return &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+		}
+	}
+	return err
+}
+
+// 前回の版を開いたまま .partial に範囲をコピーし、変わった部分を書き込んでから置き換える
+func (s *sftpStore) putDelta(ctx context.Context, name string, ops []deltaOp, literal func(off, n int64) io.Reader) (int64, error) {
+	if !s.c.copyData {
+		return 0, errNoDelta
+	}
+	old, err := s.c.openHandle("open", name, sftpFlagRead)
+	if err != nil {
+		return 0, err
+	}
+	defer s.c.closeHandle(name, old)
+	tmp := name + partialExt
+	handle, err := s.c.openHandle("create", tmp, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return 0, err
+	}
+	var sent int64
+	for _, op := range ops {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if op.src < 0 {
+			err = s.c.writeFrom(ctx, tmp, handle, literal(op.off, op.n), uint64(op.off))
+			sent += op.n
+		} else {
+			// 中断できるよう、1 回のコピーは sftpCopyChunk までにする
+			for done := int64(0); done < op.n && err == nil; done += sftpCopyChunk {
+				if err = ctx.Err(); err == nil {
+					n := min(op.n-done, sftpCopyChunk)
+					err = s.c.copyRange(name, old, uint64(op.src+done), uint64(n), handle, uint64(op.off+done))
+					touchActivity()
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if cerr := s.c.closeHandle(tmp, handle); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.c.rename(tmp, name)
+	}
+	if err != nil {
+		s.c.remove(tmp)
+	}
+	return sent, err
+}
+
+// SFTP の要求は 1 本の接続で順に送るため、送った要求は中断できない。要求を送る前に中断を確かめる
+func (s *sftpStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	handle, err := s.c.openHandle("open", name, sftpFlagRead)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpReader{c: s.c, name: name, handle: handle}, nil
+}
+
+func (s *sftpStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.c.stat(name)
+}
+
+func (s *sftpStore) Remove(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.c.remove(name)
+}
+
+func (s *sftpStore) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.c.readDir(dir)
+}
+
+func (s *sftpStore) Close() error {
+	return releaseSFTP(s.c)
+}
+
+// 送信するパケットの組み立て
+type sftpBuf []byte
+
+func (b *sftpBuf) u32(v uint32) {
+	*b = binary.BigEndian.AppendUint32(*b, v)
+}
+
+func (b *sftpBuf) u64(v uint64) {
+	*b = binary.BigEndian.AppendUint64(*b, v)
+}
+
+func (b *sftpBuf) str(s string) {
+	b.u32(uint32(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *sftpBuf) bytes(p []byte) {
+	b.u32(uint32(len(p)))
+	*b = append(*b, p...)
+}
+
+// 受信したパケットの読み取り。足りない場合は err を設定してゼロ値を返す
+type sftpParser struct {
+	b   []byte
+	err error
+}
+
+func (p *sftpParser) u32() uint32 {
+	if len(p.b) < 4 {
+		p.err = errors.New("sftp: truncated packet")
+		p.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+
+func (p *sftpParser) u64() uint64 {
+	return uint64(p.u32())<<32 | uint64(p.u32())
+}
+
+func (p *sftpParser) str() string {
+	n := p.u32()
+	if uint32(len(p.b)) < n {
+		p.err = errors.New("sftp: truncated packet")
+		p.b = nil
+		return ""
+	}
+	s := string(p.b[:n])
+	p.b = p.b[n:]
+	return s
+}
+
+// ファイル属性を読み取る。使わない項目も順に読み飛ばす
+func (p *sftpParser) attrs(name string) *sftpFileInfo {
+	info := &sftpFileInfo{name: name}
+	flags := p.u32()
+	if flags&sftpAttrSize != 0 {
+		info.size = int64(p.u64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		p.u32()
+		p.u32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		info.mode = p.u32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		p.u32()
+		info.mtime = time.Unix(int64(p.u32()), 0)
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := p.u32(); n > 0 && p.err == nil; n-- {
+			p.str()
+			p.str()
+		}
+	}
+	return info
+}
+
+type sftpFileInfo struct {
+	name  string
+	size  int64
+	mode  uint32
+	mtime time.Time
+}
+
+func (i *sftpFileInfo) Name() string       { return i.name }
+func (i *sftpFileInfo) Size() int64        { return i.size }
+func (i *sftpFileInfo) ModTime() time.Time { return i.mtime }
+func (i *sftpFileInfo) IsDir() bool        { return i.Mode().IsDir() }
+func (i *sftpFileInfo) Sys() any           { return nil }
+
+// POSIX の st_mode の種類を fs.FileMode に変換する
+func (i *sftpFileInfo) Mode() fs.FileMode {
+	m := fs.FileMode(i.mode & 0777)
+	switch i.mode & 0170000 {
+	case 0040000:
+		m |= fs.ModeDir
+	case 0120000:
+		m |= fs.ModeSymlink
+	case 0100000:
+	default:
+		if i.mode != 0 {
+			m |= fs.ModeIrregular
+		}
+	}
+	return m
+}
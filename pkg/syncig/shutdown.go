@@ -0,0 +1,54 @@
+package syncig
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGINT / SIGTERM を受け取ると終了する context。新しいディレクトリ・ファイルの処理を始めず、
+// コピー中のファイルは中断して .partial を削除し（RESUME_THRESHOLD 以上のものは再開できるよう残す）、
+// それまでにコピーしたファイルの同期状態を保存してから終了する。2 回目のシグナルではすぐに終了する
+func shutdownContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case got := <-sig:
+			fmt.Fprintf(os.Stderr, "Received %v: stopping after saving state (send again to exit immediately)\n", got)
+			sdNotify("STOPPING=1")
+			cancel(fmt.Errorf("stopped by signal: %v", got))
+		case <-done:
+			return
+		}
+		select {
+		case <-sig:
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sig)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// ctx が終了すると次の読み込みで中断する Reader
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, context.Cause(c.ctx)
+	}
+	touchActivity()
+	return c.r.Read(p)
+}
@@ -0,0 +1,58 @@
+package syncig
+
+import "strings"
+
+// ファイル名の並び順（SORT_ORDER）
+const (
+	sortByName    = "name"
+	sortByNatural = "natural"
+)
+
+// SORT_ORDER に応じた比較関数を返す
+func nameLess(order string) func(a, b string) bool {
+	if order == sortByNatural {
+		return naturalLess
+	}
+	return func(a, b string) bool { return a < b }
+}
+
+// 数字の並びを数値として比較する自然順。file9.dat < file10.dat となる
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		ca, cb := a[0], b[0]
+		if isDigit(ca) && isDigit(cb) {
+			na, ra := splitDigits(a)
+			nb, rb := splitDigits(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			// 数値が同じ場合は先頭の 0 が多い方を後ろにする
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			a, b = ra, rb
+			continue
+		}
+		if ca != cb {
+			return ca < cb
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -0,0 +1,163 @@
+package syncig
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SRC_DIR が URL の場合（プル）。リモートの同期元から新しいファイルをローカルの同期先にダウンロードする。
+// 同期元はリモートの一覧で走査し、境界値・同期状態による判定はローカルの同期元と同じ
+
+// SRC_DIR が URL の場合に使えない設定を確認する。同期元のファイルの識別子や追記・再開など、
+// ローカルのファイルシステムでのみ行える読み込みには対応していない
+func validateRemoteSource(job Job) error {
+	u, err := url.Parse(job.SRC_DIR)
+	if err != nil {
+		return fmt.Errorf("SRC_DIR %q: %v", job.SRC_DIR, err)
+	}
+	if b, ok := remoteBackends[u.Scheme]; !ok || !b.AsSource {
+		return fmt.Errorf("SRC_DIR %q: unsupported URL scheme %q", job.SRC_DIR, u.Scheme)
+	}
+	if isRemoteURL(job.DIST_DIR) {
+		return errors.New("SRC_DIR and DIST_DIR cannot both be remote")
+	}
+	if job.MODE == modeBidirectional || job.MIRROR_DIRS {
+		return fmt.Errorf("MODE %q and MIRROR_DIRS cannot be used with a remote SRC_DIR", modeBidirectional)
+	}
+	for _, o := range []struct {
+		key string
+		set bool
+	}{
+		{"DETECT_RENAMES", job.DETECT_RENAMES},
+		{"APPEND", job.APPEND},
+		{"RESUME_THRESHOLD", job.RESUME_THRESHOLD > 0},
+		{"ZERO_COPY", job.ZERO_COPY},
+		{"STABLE_INTERVAL", job.STABLE_INTERVAL > 0},
+		{"ARCHIVE_DIR", job.ARCHIVE_DIR != ""},
+		{"REMOVE_EMPTY_DIRS", job.REMOVE_EMPTY_DIRS},
+	} {
+		if o.set {
+			return fmt.Errorf("%s cannot be used with a remote SRC_DIR", o.key)
+		}
+	}
+	return nil
+}
+
+// リモートの同期元を開いてルートがディレクトリであることを確認し、リモートでのパスを返す
+func openRemoteSource(ctx context.Context, job Job) (Source, string, error) {
+	r, root, err := openRemote(job.SRC_DIR, job)
+	if err != nil {
+		return nil, "", err
+	}
+	// オブジェクトストレージではルートの接頭辞を stat できないため、一覧が取れることで確かめる
+	if _, err := r.ReadDir(ctx, root); err != nil {
+		r.Close()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", fmt.Errorf("SRC_DIR %q does not exist", job.SRC_DIR)
+		}
+		return nil, "", fmt.Errorf("SRC_DIR %q: %w", job.SRC_DIR, err)
+	}
+	return r, root, nil
+}
+
+// リモートの同期元を名前順に走査し、対象のサブディレクトリごとに fn を呼び出す（walk のリモート版）
+func (s *syncer) walkRemote(dir, rel string, fn func(path, rel string) error) error {
+	entries, err := s.source.ReadDir(s.ctx, remoteName(dir))
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := s.ctx.Err(); err != nil {
+			return context.Cause(s.ctx)
+		}
+		touchActivity()
+		p, r := filepath.Join(dir, e.Name()), filepath.Join(rel, e.Name())
+		if s.filter.skipDir(filepath.ToSlash(r), fs.FileInfoToDirEntry(e)) {
+			continue
+		}
+		if err := fn(p, r); err != nil {
+			return err
+		}
+		if err := s.walkRemote(p, r, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// リモートの同期元のディレクトリ直下のファイル（listDir の読み込み部分のリモート版）。
+// 他の syncig が書き込む同期先から取り込む場合に備え、その同期状態と書き込み中の .partial は除く
+func (s *syncer) readSourceDir(dir string) ([]fs.FileInfo, error) {
+	entries, err := s.source.ReadDir(s.ctx, remoteName(dir))
+	if err != nil {
+		return nil, err
+	}
+	files := entries[:0]
+	for _, e := range entries {
+		if !e.IsDir() && e.Name() != manifestFileName && !strings.HasSuffix(e.Name(), partialExt) {
+			files = append(files, e)
+		}
+	}
+	return files, nil
+}
+
+// 同期元のファイルの情報。リモートの場合はリモートに問い合わせる
+func (s *syncer) statSource(srcFile string) (fs.FileInfo, error) {
+	if s.source != nil {
+		return s.source.Stat(s.ctx, remoteName(srcFile))
+	}
+	return os.Stat(srcFile)
+}
+
+// 同期元のファイルのハッシュ値。リモートの場合は読み込んで計算する
+func (s *syncer) hashSource(srcFile string) (string, error) {
+	if s.source == nil {
+		return s.hashFile(srcFile)
+	}
+	s.fileRate.wait(1)
+	rc, err := s.source.Open(s.ctx, remoteName(srcFile))
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := newHash(s.hashAlgo)
+	if _, err := io.Copy(h, contextReader{s.ctx, activityReader{rc}}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// リモートの同期元のファイルを distFile（同期先の .partial）にダウンロードし、ハッシュ値を返す
+func (s *syncer) download(ctx context.Context, srcFile, distFile string, buf []byte) (string, error) {
+	rc, err := s.source.Open(ctx, remoteName(srcFile))
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	f, err := os.OpenFile(distFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash(s.hashAlgo)
+	if _, err := io.CopyBuffer(io.MultiWriter(f, h), s.wrapReader(contextReader{ctx, activityReader{rc}}), buf); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
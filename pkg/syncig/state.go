@@ -0,0 +1,309 @@
+package syncig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 同期先の各ディレクトリに置く同期状態ファイルの名前
+const manifestFileName = "syncig_manifest.json"
+
+// 同期状態の保存先。rel は SRC_DIR / DIST_DIR からのサブディレクトリの相対パス。
+// 保存先のルートは STATE_DIR（未指定の場合は DIST_DIR）
+type stateStore interface {
+	load(rel string) (*manifest, error)
+	save(rel string, m *manifest) error
+	// 同期状態を削除する
+	remove(rel string) error
+	// 同期状態が記録されているサブディレクトリの一覧を返す
+	list() ([]string, error)
+	close() error
+}
+
+// STATE_BACKEND に指定できる値
+const (
+	stateBackendJSON   = "json"
+	stateBackendKV     = "kv"
+	stateBackendSQLite = "sqlite"
+)
+
+// STATE_BACKEND に応じた同期状態の保存先を開く
+func openStateStore(backend, root string) (stateStore, error) {
+	switch backend {
+	case "", stateBackendJSON:
+		return &jsonStateStore{root: root}, nil
+	case stateBackendKV:
+		return openKVStateStore(root)
+	case stateBackendSQLite:
+		return openSQLiteStateStore(root)
+	}
+	return nil, fmt.Errorf("unknown STATE_BACKEND %q", backend)
+}
+
+// 実行 1 回分の履歴
+type runRecord struct {
+	id, job           string
+	started, finished time.Time
+	filesCopied       int64
+	bytesCopied       int64
+	filesFailed       int64
+	err               error
+}
+
+// 実行の履歴も残す同期状態の保存先（STATE_BACKEND "sqlite"）
+type runRecorder interface {
+	recordRun(r runRecord) error
+}
+
+// store が実行の履歴を残せる場合は r を記録する
+func recordRun(store stateStore, r runRecord) error {
+	if s, ok := store.(*signedStateStore); ok {
+		store = s.stateStore
+	}
+	if rr, ok := store.(runRecorder); ok {
+		return rr.recordRun(r)
+	}
+	return nil
+}
+
+// 各サブディレクトリに対応する位置に syncig_manifest.json を置く
+type jsonStateStore struct {
+	root string
+}
+
+func (s *jsonStateStore) load(rel string) (*manifest, error) {
+	return readManifest(filepath.Join(s.root, rel))
+}
+
+func (s *jsonStateStore) save(rel string, m *manifest) error {
+	dir := filepath.Join(s.root, rel)
+	if err := ensureDir(dir); err != nil {
+		return err
+	}
+	return writeManifest(dir, m)
+}
+
+func (s *jsonStateStore) remove(rel string) error {
+	err := os.Remove(filepath.Join(s.root, rel, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *jsonStateStore) list() ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == s.root {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != manifestFileName {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, rel)
+		return nil
+	})
+	return dirs, err
+}
+
+func (s *jsonStateStore) close() error {
+	return nil
+}
+
+// 同期状態の形式のバージョン。
+// 0: last_copied.txt に名前が最大のファイルのみを記録していた旧形式
+// 1: コピーしたファイルをすべて記録する形式
+const stateVersion = 1
+
+// 旧形式の同期状態ファイルの名前
+const legacyStateFileName = "last_copied.txt"
+
+// ディレクトリ単位の同期状態。コピーしたファイルをすべて記録する
+type manifest struct {
+	Version int `json:"version"`
+	// コピー済みのファイルのうち名前が最大のもの
+	LastCopied string `json:"last_copied"`
+	// コピー済みのファイルのうち最新の更新日時
+	LastModTime time.Time `json:"last_mtime"`
+	// 最後に同期状態を更新した日時
+	UpdatedAt time.Time             `json:"updated_at"`
+	Files     map[string]fileRecord `json:"files"`
+	// 記録と内容が異なる同期元のファイルについて計算したハッシュ値（DETECT・verify -source）
+	HashCache map[string]cachedHash `json:"hash_cache,omitempty"`
+	// STATE_KEY_FILE の鍵による HMAC-SHA256 の署名
+	Signature string `json:"signature,omitempty"`
+
+	// 旧形式から移行した場合の境界値。この名前以下のファイルはコピー済みとして記録する
+	legacyMark string
+	// 署名が一致しないが -force で読み込んだ。次の同期で署名し直す
+	unverified bool
+}
+
+// コピーしたファイル 1 件分の記録
+type fileRecord struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	SHA256   string    `json:"sha256"`
+	CopiedAt time.Time `json:"copied_at"`
+	// SHA256 を計算した方式（HASH_ALGO、空は sha256）。SHA256 の名前は互換性のため変えない
+	HashAlgo string `json:"hash_algo,omitempty"`
+	// ハッシュ値の計算途中の状態（APPEND で追記分のハッシュ値を続けて計算するため）
+	HashState []byte `json:"hash_state,omitempty"`
+	// 同期元のファイルの識別子（DETECT_RENAMES で名前の変更を検出するため）
+	FileID string `json:"file_id,omitempty"`
+	// DELTA_MIN_SIZE: 同期先に送った内容のブロックの大きさと、ブロックごとの署名
+	BlockSize int64  `json:"block_size,omitempty"`
+	Blocks    []byte `json:"blocks,omitempty"`
+	// 同期元で削除されたことを検出した日時（ON_DELETE）
+	DeletedAt time.Time `json:"deleted_at,omitzero"`
+	// RETENTION_DAYS を過ぎて同期先から削除した日時
+	PrunedAt time.Time `json:"pruned_at,omitzero"`
+}
+
+func newManifest() *manifest {
+	return &manifest{Version: stateVersion, Files: map[string]fileRecord{}}
+}
+
+// まだ何も記録されていないか
+func (m *manifest) empty() bool {
+	return len(m.Files) == 0 && m.LastCopied == ""
+}
+
+// Files と HashCache を別の map にした複製
+func (m *manifest) clone() *manifest {
+	c := *m
+	c.Files = make(map[string]fileRecord, len(m.Files))
+	for k, v := range m.Files {
+		c.Files[k] = v
+	}
+	if m.HashCache != nil {
+		c.HashCache = make(map[string]cachedHash, len(m.HashCache))
+		for k, v := range m.HashCache {
+			c.HashCache[k] = v
+		}
+	}
+	return &c
+}
+
+// 読み込んだ同期状態を現在の形式に合わせる
+func upgradeManifest(m *manifest) error {
+	if m.Version > stateVersion {
+		return fmt.Errorf("state version %d is newer than supported version %d; upgrade syncig", m.Version, stateVersion)
+	}
+	if m.Files == nil {
+		m.Files = map[string]fileRecord{}
+	}
+	// version を持たない初期の manifest は形式が同じなのでそのまま引き継ぐ
+	m.Version = stateVersion
+	return nil
+}
+
+// 同期先のディレクトリにある旧形式の last_copied.txt を読み込む。なければ nil を返す
+func readLegacyState(distDir string) (*manifest, error) {
+	b, err := os.ReadFile(filepath.Join(distDir, legacyStateFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := newManifest()
+	m.legacyMark = strings.TrimSpace(string(b))
+	m.LastCopied = m.legacyMark
+	return m, nil
+}
+
+// 旧形式の境界値以下のファイルをコピー済みとして記録する。files はディレクトリ内のファイル情報
+func (m *manifest) importLegacy(files map[string]fs.FileInfo) {
+	for name, info := range files {
+		if name <= m.legacyMark {
+			if _, ok := m.Files[name]; !ok {
+				m.Files[name] = fileRecord{Size: info.Size(), ModTime: info.ModTime()}
+			}
+			if info.ModTime().After(m.LastModTime) {
+				m.LastModTime = info.ModTime()
+			}
+		}
+	}
+}
+
+func removeLegacyState(distDir string) error {
+	err := os.Remove(filepath.Join(distDir, legacyStateFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// 同期状態を読み込む。ファイルがなければ空の状態を返す
+func readManifest(dir string) (*manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return newManifest(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if err := upgradeManifest(m); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, manifestFileName), err)
+	}
+	return m, nil
+}
+
+func writeManifest(dir string, m *manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, manifestFileName), b, 0644)
+}
+
+// コピーしたファイルを記録する。sum は algo で計算したハッシュ値、less は SORT_ORDER に応じたファイル名の比較関数
+func (m *manifest) record(name string, info os.FileInfo, sum, algo string, less func(a, b string) bool) {
+	m.Files[name] = fileRecord{
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		SHA256:   sum,
+		HashAlgo: recordedAlgo(algo),
+		CopiedAt: time.Now(),
+	}
+	delete(m.HashCache, name)
+	if m.LastCopied == "" || less(m.LastCopied, name) {
+		m.LastCopied = name
+	}
+	if info.ModTime().After(m.LastModTime) {
+		m.LastModTime = info.ModTime()
+	}
+}
+
+// algo で計算したハッシュ値。記録がないか、別の方式で計算されている場合は空を返す
+func (r fileRecord) digest(algo string) string {
+	if r.HashAlgo != recordedAlgo(algo) {
+		return ""
+	}
+	return r.SHA256
+}
+
+// 同期状態に記録する方式の名前。既存の記録と同じになるよう sha256 は空にする
+func recordedAlgo(algo string) string {
+	if algo == hashSHA256 {
+		return ""
+	}
+	return algo
+}
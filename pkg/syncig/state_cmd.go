@@ -0,0 +1,164 @@
+package syncig
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// syncig state <subcommand>
+func runState(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: syncig state reset [flags] [dir...]")
+	}
+	switch args[0] {
+	case "reset":
+		return runStateReset(args[1:])
+	}
+	return fmt.Errorf("unknown state subcommand: %s", args[0])
+}
+
+// syncig state reset: 同期状態を消去または巻き戻す。
+// dir（SRC_DIR / DIST_DIR からの相対パス）を指定した場合はそのディレクトリと配下のみが対象
+func runStateReset(args []string) error {
+	fs := flag.NewFlagSet("state reset", flag.ExitOnError)
+	var jf jobFlags
+	jf.register(fs)
+	all := fs.Bool("all", false, "dir を指定せずにすべての同期状態を対象にする")
+	to := fs.String("to", "", "この名前より後ろのファイルの記録のみを消去する")
+	since := fs.String("since", "", "この日時以降にコピーしたファイルの記録のみを消去する")
+	dryRun := fs.Bool("dry-run", false, "消去せずに対象のみ表示")
+	dirs := parseInterspersed(fs, args)
+	if len(dirs) == 0 && !*all {
+		return errors.New("specify directories to reset, or -all to reset everything")
+	}
+	var sinceTime time.Time
+	if *since != "" {
+		var ts Timestamp
+		if err := ts.UnmarshalText([]byte(*since)); err != nil {
+			return err
+		}
+		sinceTime = ts.Time
+	}
+	// 条件に一致するファイルの記録を消去する。条件がなければディレクトリの同期状態ごと消去する
+	partial := *to != "" || !sinceTime.IsZero()
+
+	jobs, err := jf.jobs(fs)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		printJobHeader(job)
+		var lock *jobLock
+		if !*dryRun {
+			if lock, err = acquireJobLock(job); err != nil {
+				return err
+			}
+		}
+		store, err := openJobState(job, jf.force)
+		if err != nil {
+			releaseLock(lock)
+			return err
+		}
+		err = resetState(store, dirs, partial, resetFilter(*to, sinceTime, nameLess(job.sortOrder())), nameLess(job.sortOrder()), *dryRun)
+		if cerr := store.close(); err == nil {
+			err = cerr
+		}
+		releaseLock(lock)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 消去するファイルの記録の条件。to より後ろの名前かつ since 以降にコピーしたもの
+func resetFilter(to string, since time.Time, less func(a, b string) bool) func(string, fileRecord) bool {
+	return func(name string, rec fileRecord) bool {
+		if to != "" && !less(to, name) {
+			return false
+		}
+		if !since.IsZero() && rec.CopiedAt.Before(since) {
+			return false
+		}
+		return true
+	}
+}
+
+func resetState(store stateStore, dirs []string, partial bool, drop func(string, fileRecord) bool, less func(a, b string) bool, dryRun bool) error {
+	recorded, err := store.list()
+	if err != nil {
+		return err
+	}
+	sort.Strings(recorded)
+	for _, rel := range recorded {
+		if len(dirs) > 0 && !underAny(rel, dirs) {
+			continue
+		}
+		if !partial {
+			if dryRun {
+				fmt.Printf("Would reset: %s\n", rel)
+				continue
+			}
+			if err := store.remove(rel); err != nil {
+				return err
+			}
+			fmt.Printf("Reset: %s\n", rel)
+			continue
+		}
+		m, err := store.load(rel)
+		if err != nil {
+			return err
+		}
+		var dropped []string
+		for name, rec := range m.Files {
+			if drop(name, rec) {
+				dropped = append(dropped, name)
+			}
+		}
+		if len(dropped) == 0 {
+			continue
+		}
+		sort.Strings(dropped)
+		for _, name := range dropped {
+			if dryRun {
+				fmt.Printf("Would forget: %s\n", filepath.Join(rel, name))
+			} else {
+				delete(m.Files, name)
+			}
+		}
+		if dryRun {
+			continue
+		}
+		m.LastCopied, m.LastModTime = "", time.Time{}
+		for name, rec := range m.Files {
+			if m.LastCopied == "" || less(m.LastCopied, name) {
+				m.LastCopied = name
+			}
+			if rec.ModTime.After(m.LastModTime) {
+				m.LastModTime = rec.ModTime
+			}
+		}
+		if err := store.save(rel, m); err != nil {
+			return err
+		}
+		fmt.Printf("Reset: %s (%d files)\n", rel, len(dropped))
+	}
+	return nil
+}
+
+// rel が dirs のいずれかのディレクトリそのものか配下にあるか判定する
+func underAny(rel string, dirs []string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, d := range dirs {
+		d = strings.Trim(filepath.ToSlash(filepath.Clean(d)), "/")
+		if d == "." || rel == d || strings.HasPrefix(rel, d+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package syncig
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// STATE_BACKEND "kv" で STATE_DIR（未指定の場合は DIST_DIR）直下に作成する状態ファイルの名前
+const kvStateFileName = "syncig_state.db"
+
+// サブディレクトリの相対パス（区切りは /）をキー、同期状態の JSON を値とするバケット
+var kvDirsBucket = []byte("dirs")
+
+// 他のプロセス（実行中の syncig など）が状態ファイルを開いている場合に待つ時間
+const kvOpenTimeout = 30 * time.Second
+
+// 同期先ごとに 1 ファイルの bbolt のキーバリューストア。
+// 保存はディレクトリごとに 1 トランザクションで、コミットのたびに fsync する。
+// 途中でクラッシュした場合や最新のメタページが壊れた場合は、直前にコミットした内容で開く
+type kvStateStore struct {
+	path string
+	db   *bolt.DB
+}
+
+func openKVStateStore(root string) (*kvStateStore, error) {
+	if err := ensureDir(root); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(root, kvStateFileName)
+	err := checkKVFile(path)
+	var db *bolt.DB
+	if err == nil {
+		db, err = bolt.Open(path, 0644, &bolt.Options{Timeout: kvOpenTimeout})
+	}
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s: another process has the state open", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w (restore it from a backup, or remove it and run with -full-scan)", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(kvDirsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &kvStateStore{path: path, db: db}, nil
+}
+
+// bbolt のメタページの位置と内容。メタページはファイルの先頭の 2 ページで、コミットごとに交互に書く
+const (
+	kvMagic       = 0xED0CDAED
+	kvMetaOffset  = 16 // ページヘッダの後
+	kvMetaSumSize = 56 // チェックサムの対象（magic から txid まで）
+)
+
+// bbolt は状態ファイルをメモリにマップして読むため、ファイルが途中で切り詰められていると
+// 読み込んだ時点でプロセスが異常終了する（SIGBUS）。開く前に、最新のコミットのページがファイル内にあるか確かめる
+func checkKVFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// メタページのチェックサムが合わないなど、判定できない場合は bbolt に任せる
+	head := make([]byte, 128<<10)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+	var latestTx, need uint64
+	found := false
+	for _, pageSize := range []int{0, 4096, 8192, 16384, 32768, 65536} {
+		for _, page := range []int{0, 1} {
+			pgid, txid, size, ok := readKVMeta(head, page*pageSize)
+			if !ok || (page == 1 && int(size) != pageSize) {
+				continue
+			}
+			if !found || txid > latestTx {
+				found, latestTx, need = true, txid, pgid*uint64(size)
+			}
+		}
+	}
+	if found && need > uint64(info.Size()) {
+		return fmt.Errorf("file is truncated (%d bytes; the last commit needs %d)", info.Size(), need)
+	}
+	return nil
+}
+
+// off から始まるメタページを読む。pgid は使用中のページ数、size はページの大きさ
+func readKVMeta(b []byte, off int) (pgid, txid uint64, size uint32, ok bool) {
+	m := off + kvMetaOffset
+	if m+kvMetaSumSize+8 > len(b) || binary.LittleEndian.Uint32(b[m:]) != kvMagic {
+		return 0, 0, 0, false
+	}
+	h := fnv.New64a()
+	h.Write(b[m : m+kvMetaSumSize])
+	if h.Sum64() != binary.LittleEndian.Uint64(b[m+kvMetaSumSize:]) {
+		return 0, 0, 0, false
+	}
+	return binary.LittleEndian.Uint64(b[m+40:]), binary.LittleEndian.Uint64(b[m+48:]), binary.LittleEndian.Uint32(b[m+8:]), true
+}
+
+func (s *kvStateStore) load(rel string) (*manifest, error) {
+	m := newManifest()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kvDirsBucket).Get([]byte(filepath.ToSlash(rel)))
+		if b == nil {
+			return nil
+		}
+		// b はトランザクションの間のみ有効なため、ここでデコードする
+		return json.Unmarshal(b, m)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", s.path, rel, err)
+	}
+	if err := upgradeManifest(m); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return m, nil
+}
+
+func (s *kvStateStore) save(rel string, m *manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvDirsBucket).Put([]byte(filepath.ToSlash(rel)), b)
+	})
+}
+
+func (s *kvStateStore) remove(rel string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvDirsBucket).Delete([]byte(filepath.ToSlash(rel)))
+	})
+}
+
+func (s *kvStateStore) list() ([]string, error) {
+	var dirs []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvDirsBucket).ForEach(func(k, _ []byte) error {
+			dirs = append(dirs, filepath.FromSlash(string(k)))
+			return nil
+		})
+	})
+	return dirs, err
+}
+
+func (s *kvStateStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,167 @@
+package syncig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 3 回コミットした状態ファイルを作る。最後のコミットの LastCopied は "c"、その前は "b"
+func writeKVState(t *testing.T, root string) []byte {
+	t.Helper()
+	s, err := openKVStateStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, last := range []string{"a", "b", "c"} {
+		m := newManifest()
+		m.LastCopied = last
+		m.Files[last] = fileRecord{Size: int64(len(last))}
+		if err := s.save("d", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(root, kvStateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 最新のメタページ（txid が大きい方）の位置
+func latestKVMeta(t *testing.T, b []byte) int {
+	t.Helper()
+	_, tx0, size, ok0 := readKVMeta(b, 0)
+	if !ok0 {
+		t.Fatal("meta page 0 is invalid")
+	}
+	_, tx1, _, ok1 := readKVMeta(b, int(size))
+	if ok1 && tx1 > tx0 {
+		return int(size)
+	}
+	return 0
+}
+
+func TestKVStateStoreRecovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, b []byte) []byte
+		want    string
+		// 開けない場合のエラーに含まれる文字列
+		wantErr string
+	}{
+		{"intact", func(t *testing.T, b []byte) []byte { return b }, "c", ""},
+		{"trailing garbage", func(t *testing.T, b []byte) []byte { return append(b, "torn write"...) }, "c", ""},
+		{"latest meta torn", func(t *testing.T, b []byte) []byte {
+			// 最後のコミットのメタページの書き込みが途中で止まった場合は、その前のコミットで開く
+			b[latestKVMeta(t, b)+kvMetaOffset+48] ^= 0xff
+			return b
+		}, "b", ""},
+		{"older meta corrupt", func(t *testing.T, b []byte) []byte {
+			latest := latestKVMeta(t, b)
+			_, _, size, _ := readKVMeta(b, 0)
+			older := int(size) - latest
+			b[older+kvMetaOffset+48] ^= 0xff
+			return b
+		}, "c", ""},
+		{"both metas corrupt", func(t *testing.T, b []byte) []byte {
+			_, _, size, _ := readKVMeta(b, 0)
+			b[kvMetaOffset+48] ^= 0xff
+			b[int(size)+kvMetaOffset+48] ^= 0xff
+			return b
+		}, "", "checksum"},
+		{"truncated below the last commit", func(t *testing.T, b []byte) []byte {
+			_, _, size, _ := readKVMeta(b, 0)
+			return b[:3*size]
+		}, "", "truncated"},
+		{"truncated inside the meta pages", func(t *testing.T, b []byte) []byte { return b[:100] }, "", "truncated"},
+		{"truncated to nothing but a partial header", func(t *testing.T, b []byte) []byte { return b[:10] }, "", "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			b := tt.corrupt(t, writeKVState(t, root))
+			if err := os.WriteFile(filepath.Join(root, kvStateFileName), b, 0644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := openKVStateStore(root)
+			if tt.wantErr != "" {
+				if err == nil {
+					s.close()
+					t.Fatalf("opened a corrupt state file, want error containing %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "-full-scan") {
+					t.Fatalf("error %q, want %q with a recovery hint", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+			m, err := s.load("d")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.LastCopied != tt.want {
+				t.Errorf("LastCopied = %q, want %q", m.LastCopied, tt.want)
+			}
+			if _, ok := m.Files[tt.want]; !ok || len(m.Files) != 1 {
+				t.Errorf("Files = %v, want only %q", m.Files, tt.want)
+			}
+			// 復旧した状態ファイルに続けて保存できる
+			m.LastCopied = "d"
+			if err := s.save("d", m); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestKVStateStore(t *testing.T) {
+	root := t.TempDir()
+	s, err := openKVStateStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest()
+	if err := s.save(filepath.Join("x", "y"), m); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save("z", newManifest()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openKVStateStore(root); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	got, err := s.load(filepath.Join("x", "y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameManifest(t, got, m)
+	dirs, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join("x", "y"), "z"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("list = %q, want %q", dirs, want)
+	}
+	if err := s.remove("z"); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, _ = s.list(); len(dirs) != 1 {
+		t.Errorf("list after remove = %q", dirs)
+	}
+	if got, _ = s.load("missing"); !got.empty() {
+		t.Errorf("missing dir has state %+v", got)
+	}
+}
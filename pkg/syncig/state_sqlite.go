@@ -0,0 +1,280 @@
+package syncig
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// STATE_BACKEND "sqlite" で STATE_DIR（未指定の場合は DIST_DIR）直下に作成するデータベースの名前
+const sqliteStateFileName = "syncig_state.sqlite"
+
+// 同期状態の表。dirs はサブディレクトリごと、files はファイルごとの記録、runs は実行の履歴
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS dirs (
+	rel         TEXT PRIMARY KEY,
+	version     INTEGER NOT NULL,
+	last_copied TEXT NOT NULL,
+	last_mtime  TEXT,
+	updated_at  TEXT,
+	hash_cache  TEXT,
+	signature   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS files (
+	dir        TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	size       INTEGER NOT NULL,
+	mtime      TEXT,
+	sha256     TEXT NOT NULL,
+	hash_algo  TEXT NOT NULL,
+	copied_at  TEXT,
+	hash_state BLOB,
+	file_id    TEXT NOT NULL,
+	block_size INTEGER NOT NULL,
+	blocks     BLOB,
+	deleted_at TEXT,
+	pruned_at  TEXT,
+	PRIMARY KEY (dir, name)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS runs (
+	id           TEXT PRIMARY KEY,
+	job          TEXT NOT NULL,
+	started_at   TEXT NOT NULL,
+	finished_at  TEXT NOT NULL,
+	files_copied INTEGER NOT NULL,
+	bytes_copied INTEGER NOT NULL,
+	files_failed INTEGER NOT NULL,
+	error        TEXT
+);
+`
+
+// 同期先ごとに 1 つの SQLite データベースに同期状態と実行の履歴を置く。
+// 保存はディレクトリごとに 1 トランザクションで、前回の保存から変わったファイルの行のみ書き込む
+type sqliteStateStore struct {
+	db *sql.DB
+	mu sync.Mutex
+	// データベースにある内容。変わった行を判定するため、読み込み・保存した同期状態の複製を持つ
+	saved map[string]*manifest
+}
+
+func openSQLiteStateStore(root string) (*sqliteStateStore, error) {
+	if err := ensureDir(root); err != nil {
+		return nil, err
+	}
+	// 停電などで途中の書き込みが失われないよう、コミットごとに fsync する
+	dsn := "file:" + filepath.ToSlash(filepath.Join(root, sqliteStateFileName)) +
+		"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// 書き込みは 1 つの接続で順に行う
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", filepath.Join(root, sqliteStateFileName), err)
+	}
+	return &sqliteStateStore{db: db, saved: map[string]*manifest{}}, nil
+}
+
+func (s *sqliteStateStore) load(rel string) (*manifest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := filepath.ToSlash(rel)
+	m := newManifest()
+	var lastMTime, updatedAt, hashCache sql.NullString
+	err := s.db.QueryRow(`SELECT version, last_copied, last_mtime, updated_at, hash_cache, signature FROM dirs WHERE rel = ?`, key).
+		Scan(&m.Version, &m.LastCopied, &lastMTime, &updatedAt, &hashCache, &m.Signature)
+	if err == sql.ErrNoRows {
+		delete(s.saved, key)
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.LastModTime, err = parseSQLiteTime(lastMTime); err != nil {
+		return nil, err
+	}
+	if m.UpdatedAt, err = parseSQLiteTime(updatedAt); err != nil {
+		return nil, err
+	}
+	if hashCache.Valid {
+		if err := json.Unmarshal([]byte(hashCache.String), &m.HashCache); err != nil {
+			return nil, fmt.Errorf("state %s: hash_cache: %w", key, err)
+		}
+	}
+	rows, err := s.db.Query(`SELECT name, size, mtime, sha256, hash_algo, copied_at, hash_state, file_id, block_size, blocks, deleted_at, pruned_at FROM files WHERE dir = ?`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name                                 string
+			r                                    fileRecord
+			mtime, copiedAt, deletedAt, prunedAt sql.NullString
+		)
+		if err := rows.Scan(&name, &r.Size, &mtime, &r.SHA256, &r.HashAlgo, &copiedAt, &r.HashState, &r.FileID, &r.BlockSize, &r.Blocks, &deletedAt, &prunedAt); err != nil {
+			return nil, err
+		}
+		for _, t := range []struct {
+			dst *time.Time
+			src sql.NullString
+		}{{&r.ModTime, mtime}, {&r.CopiedAt, copiedAt}, {&r.DeletedAt, deletedAt}, {&r.PrunedAt, prunedAt}} {
+			if *t.dst, err = parseSQLiteTime(t.src); err != nil {
+				return nil, err
+			}
+		}
+		m.Files[name] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := upgradeManifest(m); err != nil {
+		return nil, fmt.Errorf("state %s: %w", key, err)
+	}
+	s.saved[key] = m.clone()
+	return m, nil
+}
+
+func (s *sqliteStateStore) save(rel string, m *manifest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := filepath.ToSlash(rel)
+	var hashCache any
+	if len(m.HashCache) > 0 {
+		b, err := json.Marshal(m.HashCache)
+		if err != nil {
+			return err
+		}
+		hashCache = string(b)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO dirs (rel, version, last_copied, last_mtime, updated_at, hash_cache, signature) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key, m.Version, m.LastCopied, formatSQLiteTime(m.LastModTime), formatSQLiteTime(m.UpdatedAt), hashCache, m.Signature); err != nil {
+		return err
+	}
+	prev, known := s.saved[key]
+	if !known {
+		// 読み込んでいないディレクトリは記録をすべて書き直す
+		if _, err := tx.Exec(`DELETE FROM files WHERE dir = ?`, key); err != nil {
+			return err
+		}
+		prev = newManifest()
+	}
+	ins, err := tx.Prepare(`INSERT OR REPLACE INTO files (dir, name, size, mtime, sha256, hash_algo, copied_at, hash_state, file_id, block_size, blocks, deleted_at, pruned_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	for name, r := range m.Files {
+		if old, ok := prev.Files[name]; ok && sameFileRecord(old, r) {
+			continue
+		}
+		if _, err := ins.Exec(key, name, r.Size, formatSQLiteTime(r.ModTime), r.SHA256, r.HashAlgo, formatSQLiteTime(r.CopiedAt),
+			r.HashState, r.FileID, r.BlockSize, r.Blocks, formatSQLiteTime(r.DeletedAt), formatSQLiteTime(r.PrunedAt)); err != nil {
+			return err
+		}
+	}
+	for name := range prev.Files {
+		if _, ok := m.Files[name]; ok {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM files WHERE dir = ? AND name = ?`, key, name); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// 保存した後に呼び出し側で変更されても影響しないよう複製を持つ
+	s.saved[key] = m.clone()
+	return nil
+}
+
+func (s *sqliteStateStore) remove(rel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := filepath.ToSlash(rel)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM files WHERE dir = ?`, key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM dirs WHERE rel = ?`, key); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	delete(s.saved, key)
+	return nil
+}
+
+func (s *sqliteStateStore) list() ([]string, error) {
+	rows, err := s.db.Query(`SELECT rel FROM dirs ORDER BY rel`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dirs []string
+	for rows.Next() {
+		var rel string
+		if err := rows.Scan(&rel); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, filepath.FromSlash(rel))
+	}
+	return dirs, rows.Err()
+}
+
+func (s *sqliteStateStore) close() error {
+	return s.db.Close()
+}
+
+// 実行の履歴を runs に追加する
+func (s *sqliteStateStore) recordRun(r runRecord) error {
+	var runErr any
+	if r.err != nil {
+		runErr = r.err.Error()
+	}
+	_, err := s.db.Exec(`INSERT INTO runs (id, job, started_at, finished_at, files_copied, bytes_copied, files_failed, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.id, r.job, formatSQLiteTime(r.started), formatSQLiteTime(r.finished), r.filesCopied, r.bytesCopied, r.filesFailed, runErr)
+	return err
+}
+
+// 日時は JSON の同期状態と同じ RFC 3339 の文字列で持つ。ゼロ値は NULL にする
+func formatSQLiteTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseSQLiteTime(s sql.NullString) (time.Time, error) {
+	if !s.Valid {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s.String)
+}
+
+// 保存する内容が同じ記録か。日時は保存する文字列で比べる
+func sameFileRecord(a, b fileRecord) bool {
+	return a.Size == b.Size && a.SHA256 == b.SHA256 && a.HashAlgo == b.HashAlgo && a.FileID == b.FileID && a.BlockSize == b.BlockSize &&
+		bytes.Equal(a.HashState, b.HashState) && bytes.Equal(a.Blocks, b.Blocks) &&
+		formatSQLiteTime(a.ModTime) == formatSQLiteTime(b.ModTime) && formatSQLiteTime(a.CopiedAt) == formatSQLiteTime(b.CopiedAt) &&
+		formatSQLiteTime(a.DeletedAt) == formatSQLiteTime(b.DeletedAt) && formatSQLiteTime(a.PrunedAt) == formatSQLiteTime(b.PrunedAt)
+}
@@ -0,0 +1,161 @@
+package syncig
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testManifest() *manifest {
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.FixedZone("JST", 9*3600))
+	m := newManifest()
+	m.LastCopied = "b.dat"
+	m.LastModTime = t0
+	m.UpdatedAt = t0.Add(time.Minute)
+	m.Files["a.dat"] = fileRecord{Size: 10, ModTime: t0, SHA256: "aa", CopiedAt: t0.Add(time.Second)}
+	m.Files["b.dat"] = fileRecord{Size: 20, ModTime: t0, SHA256: "bb", HashAlgo: hashXXH64, HashState: []byte{1, 2}, FileID: "7:42",
+		BlockSize: 4096, Blocks: []byte{3, 4, 5}, CopiedAt: t0, DeletedAt: t0.Add(time.Hour)}
+	m.HashCache = map[string]cachedHash{"c.dat": {Size: 5, ModTime: t0, Sum: "cc"}}
+	return m
+}
+
+// 同期状態は JSON の形式と同じ内容で読み戻せる（STATE_KEY_FILE の署名は JSON で計算する）
+func assertSameManifest(t *testing.T, got, want *manifest) {
+	t.Helper()
+	g, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(g) != string(w) {
+		t.Errorf("got  %s\nwant %s", g, w)
+	}
+}
+
+func TestSQLiteStateStore(t *testing.T) {
+	root := t.TempDir()
+	s, err := openSQLiteStateStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest()
+	if err := s.save(filepath.Join("x", "y"), m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.load(filepath.Join("x", "y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameManifest(t, got, m)
+
+	// 変わった記録・削除した記録のみ書き込む
+	rec := got.Files["a.dat"]
+	rec.Size = 11
+	got.Files["a.dat"] = rec
+	delete(got.Files, "b.dat")
+	got.Files["d.dat"] = fileRecord{Size: 1, ModTime: m.LastModTime}
+	got.Signature = "sig"
+	if err := s.save(filepath.Join("x", "y"), got); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save("z", newManifest()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openSQLiteStateStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	again, err := s.load(filepath.Join("x", "y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameManifest(t, again, got)
+	dirs, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join("x", "y"), "z"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("list = %q, want %q", dirs, want)
+	}
+	if err := s.remove(filepath.Join("x", "y")); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := s.load(filepath.Join("x", "y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !empty.empty() {
+		t.Errorf("removed state still has %d files", len(empty.Files))
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT count(*) FROM files`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d file rows left after remove", n)
+	}
+}
+
+// 読み込まずに保存したディレクトリは、前回の記録を残さず書き直す
+func TestSQLiteStateStoreSaveWithoutLoad(t *testing.T) {
+	root := t.TempDir()
+	s, err := openSQLiteStateStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save("d", testManifest()); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	s, err = openSQLiteStateStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	m := newManifest()
+	m.Files["only.dat"] = fileRecord{Size: 1}
+	if err := s.save("d", m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.load("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameManifest(t, got, m)
+}
+
+func TestSQLiteStateStoreRuns(t *testing.T) {
+	s, err := openSQLiteStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	start := time.Now()
+	// 署名する場合も実行の履歴を残す
+	signed := &signedStateStore{stateStore: s, key: []byte("k")}
+	for i, runErr := range []error{nil, errors.New("disk full")} {
+		r := runRecord{id: string(rune('a' + i)), job: "j", started: start, finished: start.Add(time.Second), filesCopied: 3, bytesCopied: 30, filesFailed: int64(i), err: runErr}
+		if err := recordRun(signed, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var copied, failed int64
+	var lastErr string
+	if err := s.db.QueryRow(`SELECT sum(files_copied), sum(files_failed), max(error) FROM runs`).Scan(&copied, &failed, &lastErr); err != nil {
+		t.Fatal(err)
+	}
+	if copied != 6 || failed != 1 || lastErr != "disk full" {
+		t.Errorf("runs: copied %d, failed %d, error %q", copied, failed, lastErr)
+	}
+}
@@ -0,0 +1,103 @@
+package syncig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errStateSignature = errors.New("signature mismatch; the state may have been tampered with (use -force to trust it)")
+
+// STATE_KEY_FILE が指定されている場合、同期状態を HMAC-SHA256 で署名して保存し、
+// 読み込み時に署名を確認する。force の場合は一致しなくても警告して読み込み、次の保存で署名し直す
+type signedStateStore struct {
+	stateStore
+	key   []byte
+	force bool
+}
+
+// ジョブの同期状態を開く。force は署名が一致しない同期状態も読み込む（-force）
+func openJobState(job Job, force bool) (stateStore, error) {
+	var store stateStore
+	var err error
+	if root := job.stateRoot(); isRemoteURL(root) {
+		store, err = openRemoteStateStore(job, root)
+	} else {
+		store, err = openStateStore(job.STATE_BACKEND, root)
+	}
+	if err != nil || job.STATE_KEY_FILE == "" {
+		return store, err
+	}
+	key, err := readStateKey(job.STATE_KEY_FILE)
+	if err != nil {
+		store.close()
+		return nil, err
+	}
+	return &signedStateStore{stateStore: store, key: key, force: force}, nil
+}
+
+func readStateKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("STATE_KEY_FILE: %w", err)
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return nil, fmt.Errorf("STATE_KEY_FILE %s is empty", path)
+	}
+	return []byte(key), nil
+}
+
+// サブディレクトリの相対パスも署名に含め、別のディレクトリの同期状態と入れ替えられないようにする
+func signManifest(key []byte, rel string, m *manifest) (string, error) {
+	c := *m
+	c.Signature = ""
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(filepath.ToSlash(rel)))
+	mac.Write([]byte{0})
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s *signedStateStore) load(rel string) (*manifest, error) {
+	m, err := s.stateStore.load(rel)
+	if err != nil {
+		return nil, err
+	}
+	// 同期状態がまだない
+	if m.Signature == "" && m.empty() && len(m.HashCache) == 0 {
+		return m, nil
+	}
+	want, err := signManifest(s.key, rel, m)
+	if err != nil {
+		return nil, err
+	}
+	if hmac.Equal([]byte(m.Signature), []byte(want)) {
+		return m, nil
+	}
+	if !s.force {
+		return nil, fmt.Errorf("state %q: %w", rel, errStateSignature)
+	}
+	fmt.Fprintf(os.Stderr, "warning: state %q: signature mismatch; trusting it because of -force\n", rel)
+	m.unverified = true
+	return m, nil
+}
+
+func (s *signedStateStore) save(rel string, m *manifest) error {
+	sig, err := signManifest(s.key, rel, m)
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return s.stateStore.save(rel, m)
+}
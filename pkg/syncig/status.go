@@ -0,0 +1,102 @@
+package syncig
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// syncig status: サブディレクトリごとの同期状態と未コピーのファイル数を表示する（読み取りのみ）
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	var jf jobFlags
+	jf.register(fs)
+	fs.Parse(args)
+	jobs, err := jf.jobs(fs)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		printJobHeader(job)
+		if err := printStatus(job, jf.force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dirStatus struct {
+	lastCopied string
+	updatedAt  time.Time
+	files      int
+	backlog    int
+}
+
+func printStatus(job Job, force bool) error {
+	s, err := newSyncer(context.Background(), job, RunOptions{DryRun: true, ForceState: force})
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	rows := map[string]*dirStatus{}
+	err = s.walk(func(path, rel string) error {
+		sc, err := s.scanDir(path, rel)
+		if err != nil {
+			return err
+		}
+		if sc.state == nil {
+			return nil
+		}
+		rows[rel] = &dirStatus{
+			lastCopied: sc.state.LastCopied,
+			updatedAt:  sc.state.UpdatedAt,
+			files:      len(sc.state.Files),
+			backlog:    len(sc.toCopy),
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// 同期元から消えたディレクトリの同期状態も表示する
+	recorded, err := s.state.list()
+	if err != nil {
+		return err
+	}
+	for _, rel := range recorded {
+		if _, ok := rows[rel]; ok {
+			continue
+		}
+		m, err := s.state.load(rel)
+		if err != nil {
+			return err
+		}
+		rows[rel] = &dirStatus{lastCopied: m.LastCopied, updatedAt: m.UpdatedAt, files: len(m.Files)}
+	}
+
+	dirs := make([]string, 0, len(rows))
+	for rel := range rows {
+		dirs = append(dirs, rel)
+	}
+	sort.Strings(dirs)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DIR\tLAST COPIED\tUPDATED\tFILES\tBACKLOG")
+	for _, rel := range dirs {
+		r := rows[rel]
+		updated := "-"
+		if !r.updatedAt.IsZero() {
+			updated = r.updatedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		last := r.lastCopied
+		if last == "" {
+			last = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", rel, last, updated, r.files, r.backlog)
+	}
+	return w.Flush()
+}
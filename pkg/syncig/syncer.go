@@ -0,0 +1,1440 @@
+package syncig
+
+import (
+	"context"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 指定拡張子がリストに含まれるか判定（大文字小文字は区別しない）
+func hasExt(ext string, exts []string) bool {
+	ext = strings.ToLower(ext)
+	for _, e := range exts {
+		if strings.ToLower(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func ensureDir(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ファイルを buf を使ってコピーし、内容の algo のハッシュ値を返す。
+// wrap が nil でなければ同期元の Reader を包む（帯域制限や進捗の計測）。ctx が終了すると中断する
+func copyFile(ctx context.Context, srcFile, distFile, algo string, buf []byte, wrap func(io.Reader) io.Reader) (string, error) {
+	sum, _, err := appendFile(ctx, srcFile, distFile, algo, 0, nil, buf, wrap)
+	return sum, err
+}
+
+// 同期元の offset 以降を同期先に追記し、ファイル全体のハッシュ値と計算途中の状態を返す。
+// offset が 0 の場合はファイル全体をコピーする。hashState は前回返した計算途中の状態
+func appendFile(ctx context.Context, srcFile, distFile, algo string, offset int64, hashState, buf []byte, wrap func(io.Reader) io.Reader) (string, []byte, error) {
+	h := newHash(algo)
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(hashState); err != nil {
+			return "", nil, err
+		}
+		flag = os.O_WRONLY | os.O_APPEND
+	}
+	srcF, err := os.Open(srcFile)
+	if err != nil {
+		return "", nil, err
+	}
+	defer srcF.Close()
+	if _, err := srcF.Seek(offset, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	dstF, err := os.OpenFile(distFile, flag, 0644)
+	if err != nil {
+		return "", nil, err
+	}
+	defer dstF.Close()
+	// *os.File の WriterTo は独自のバッファを使うため、Reader のみを渡して buf を使わせる
+	var r io.Reader = contextReader{ctx, srcF}
+	if wrap != nil {
+		r = wrap(r)
+	}
+	if _, err := io.CopyBuffer(io.MultiWriter(dstF, h), r, buf); err != nil {
+		return "", nil, err
+	}
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), state, nil
+}
+
+// 実行時のオプション。コマンドラインのフラグ（-dry-run など）に相当する
+type RunOptions struct {
+	// コピー・削除をせずに同期内容のみ表示する
+	DryRun bool
+	// 新しいファイルの判定を無視し、同期先にない・内容が異なるファイルをすべてコピーする
+	FullScan bool
+	// コピーの進捗を定期的に表示する
+	Progress bool
+	// STATE_KEY_FILE の署名が一致しない同期状態も読み込む
+	ForceState bool
+	// コピーは行い、同期先からの削除は予定の表示のみにする
+	DeleteDryRun bool
+	// Syncer.Observer。nil の場合は標準出力に表示する
+	observer Observer
+}
+
+// 1 ジョブ分の同期処理
+type syncer struct {
+	srcRoot  string
+	distRoot string
+	filter   *fileFilter
+	state    stateStore
+	// DIST_DIR が URL の場合のみ。distRoot はリモートでのパスになる
+	remote Destination
+	// SRC_DIR が URL の場合のみ。srcRoot はリモートでのパスになる
+	source Source
+	// STATE_KEY_FILE で同期状態を署名している
+	signed bool
+	opts   RunOptions
+	// 終了すると新しいディレクトリ・ファイルの処理を始めず、コピー中のファイルも中断する（SIGINT / SIGTERM）
+	ctx context.Context
+	// 実行中に保持する同期状態の保存先のロック（-dry-run では nil）
+	lock *jobLock
+	// 同期状態を途中保存する間隔
+	checkpointFiles    int
+	checkpointInterval time.Duration
+	// JOURNAL が有効な場合のみ
+	journal *journal
+	detect  string
+	// SORT_ORDER に応じたファイル名の比較関数
+	less     func(a, b string) bool
+	tracking string
+	// サイズが増えたファイルは追記分のみコピーする
+	appendOnly bool
+	onDelete   string
+	onConflict string
+	// MODE が mirror。MIRROR_DIRS は同期元から消えたディレクトリも削除する
+	mirror     bool
+	mirrorDirs bool
+	// MODE が move。REMOVE_EMPTY_DIRS は空になった同期元のディレクトリも削除する
+	move            bool
+	removeEmptyDirs bool
+	// 同期元のファイルを削除する代わりに移すディレクトリ
+	archiveDir string
+	// 書き込み中とみなして次回に回したファイルのあるディレクトリ（watch で同期し直す）
+	deferredMu   sync.Mutex
+	deferredDirs []string
+	// 同期元のファイルを削除したディレクトリ
+	movedMu   sync.Mutex
+	movedDirs map[string]bool
+	// 同期先の中に置いた場合に削除しないよう控えておく
+	stateDir string
+	// MODE が bidirectional。peer は他方向の同期状態で、conflictSide はこの方向の同期元（"src" / "dist"）
+	bidirectional      bool
+	peer               stateStore
+	conflicts          *conflictList
+	conflictSide       string
+	conflictResolution string
+	// FAILOVER_DIST_DIR に書き込む場合の DIST_DIR の同期状態。DIST_DIR にコピー済みのファイルは書き込まない
+	baseline stateStore
+	// コピー前にサイズと更新日時が変わらないことを確認する間隔
+	stableInterval time.Duration
+	// STABLE_INTERVAL の比較に使う、実行中に 1 度だけ記録した同期元のファイルのサイズと更新日時
+	stableOnce     sync.Once
+	stableSnapshot map[string]fileStamp
+	stableErr      error
+	renames        bool
+	// 並列にコピーするファイル数
+	concurrency int
+	// 並列に処理するサブディレクトリ数
+	dirConcurrency int
+	buffers        *bufferPool
+	zeroCopy       bool
+	durable        bool
+	copyTimeout    time.Duration
+	// MAX_FILES_PER_RUN・MAX_BYTES_PER_RUN が指定されていない場合は nil
+	budget *runBudget
+	// RESUME_THRESHOLD（0 は再開しない）と進捗を保存する間隔
+	resumeThreshold int64
+	resumeChunkSize int64
+	// DELTA_MIN_SIZE（0 は差分を送らない）
+	deltaMin int64
+	verify   bool
+	checksums       string
+	// RETENTION_DAYS と MAX_DIST_SIZE（0 は削除しない）
+	retention   time.Duration
+	maxDistSize int64
+	// 上書きする前の版を残す数（0 は残さない）
+	keepVersions int
+	// HASH_ALGO（未指定の場合は sha256）
+	hashAlgo      string
+	quarantineDir string
+	// TRASH が有効な場合は削除するファイルを .syncig-trash に移し、TRASH_RETENTION_DAYS を過ぎたら削除する
+	trash          bool
+	trashRetention time.Duration
+	// BACKUP_DIR が指定されている場合は上書き・削除するファイルを移し、BACKUP_RETENTION_DAYS を過ぎたら削除する
+	backupDir       string
+	backupRetention time.Duration
+	// QUARANTINE_DIR・ゴミ箱・BACKUP_DIR の下に作る実行ごとのディレクトリ名
+	runStamp string
+	// BANDWIDTH_LIMIT が指定されていない場合は nil
+	limit *rateLimiter
+	// FILES_PER_SECOND・MAX_OPEN_FILES が指定されていない場合は nil
+	fileRate *rateLimiter
+	handles  *handleLimiter
+	// -progress が指定されていない場合は nil
+	progress *progress
+	// ADAPTIVE_CONCURRENCY が無効な場合は nil
+	adaptive *adaptiveLimiter
+	// コピーしたファイルの通知先
+	observer Observer
+	// 実行の履歴に残す開始日時とファイル数
+	started                               time.Time
+	filesCopied, bytesCopied, filesFailed atomic.Int64
+	jobName                               string
+}
+
+// 途中保存の既定の間隔
+const (
+	defaultCheckpointFiles    = 1000
+	defaultCheckpointInterval = 30 * time.Second
+)
+
+// 実行ごとのディレクトリ名の形式
+const runStampLayout = "20060102T150405"
+
+func newSyncer(ctx context.Context, job Job, opts RunOptions) (*syncer, error) {
+	srcDir := strings.TrimRight(job.SRC_DIR, string(os.PathSeparator))
+	distDir := strings.TrimRight(job.DIST_DIR, string(os.PathSeparator))
+	// HTTP の同期先は読めないため、同期先と比較できない
+	if opts.FullScan && isHTTPURL(job.DIST_DIR) {
+		return nil, errors.New("-full-scan cannot be used with an http:// or https:// DIST_DIR")
+	}
+	filter, err := newFileFilter(job)
+	if err != nil {
+		return nil, err
+	}
+	// リモートの同期元の .syncigignore は読み込まない
+	if !isRemoteURL(job.SRC_DIR) {
+		if err := filter.loadIgnoreFile(srcDir, ""); err != nil {
+			return nil, err
+		}
+	}
+	// 同時に実行された syncig が同じ同期先・同期状態に書き込まないようにする
+	var lock *jobLock
+	if !opts.DryRun {
+		if lock, err = acquireJobLock(job); err != nil {
+			return nil, err
+		}
+	}
+	var remote Destination
+	if isRemoteURL(job.DIST_DIR) {
+		if remote, distDir, err = openRemote(job.DIST_DIR, job); err != nil {
+			releaseLock(lock)
+			return nil, err
+		}
+	}
+	var source Source
+	if isRemoteURL(job.SRC_DIR) {
+		if source, srcDir, err = openRemoteSource(ctx, job); err != nil {
+			releaseLock(lock)
+			return nil, err
+		}
+	}
+	state, err := openJobState(job, opts.ForceState)
+	if err != nil {
+		if remote != nil {
+			remote.Close()
+		}
+		if source != nil {
+			source.Close()
+		}
+		releaseLock(lock)
+		return nil, err
+	}
+	s := &syncer{
+		lock:               lock,
+		srcRoot:            srcDir,
+		distRoot:           distDir,
+		remote:             remote,
+		source:             source,
+		filter:             filter,
+		state:              state,
+		signed:             job.STATE_KEY_FILE != "",
+		opts:               opts,
+		ctx:                ctx,
+		checkpointFiles:    job.CHECKPOINT_FILES,
+		checkpointInterval: time.Duration(job.CHECKPOINT_INTERVAL),
+		detect:             job.DETECT,
+		less:               nameLess(job.sortOrder()),
+		tracking:           job.TRACKING,
+		appendOnly:         job.APPEND,
+		onDelete:           job.ON_DELETE,
+		onConflict:         job.ON_CONFLICT,
+		mirror:             job.MODE == modeMirror,
+		mirrorDirs:         job.MODE == modeMirror && job.MIRROR_DIRS,
+		move:               job.MODE == modeMove,
+		removeEmptyDirs:    job.REMOVE_EMPTY_DIRS,
+		archiveDir:         job.ARCHIVE_DIR,
+		bidirectional:      job.MODE == modeBidirectional,
+		conflictResolution: job.CONFLICT_RESOLUTION,
+		movedDirs:          map[string]bool{},
+		stateDir:           job.STATE_DIR,
+		stableInterval:     time.Duration(job.STABLE_INTERVAL),
+		renames:            job.DETECT_RENAMES,
+		concurrency:        job.CONCURRENCY,
+		dirConcurrency:     job.DIR_CONCURRENCY,
+		zeroCopy:           job.ZERO_COPY,
+		durable:            job.DURABLE,
+		copyTimeout:        time.Duration(job.COPY_TIMEOUT),
+		budget:             newRunBudget(job),
+		resumeThreshold:    int64(job.RESUME_THRESHOLD),
+		resumeChunkSize:    int64(job.RESUME_CHUNK_SIZE),
+		deltaMin:           int64(job.DELTA_MIN_SIZE),
+		verify:             job.VERIFY_AFTER_COPY,
+		checksums:          job.CHECKSUM_FILES,
+		keepVersions:       job.KEEP_VERSIONS,
+		retention:          time.Duration(job.RETENTION_DAYS) * 24 * time.Hour,
+		maxDistSize:        int64(job.MAX_DIST_SIZE),
+		hashAlgo:           job.HASH_ALGO,
+		quarantineDir:      job.QUARANTINE_DIR,
+		trash:              job.TRASH,
+		trashRetention:     time.Duration(job.TRASH_RETENTION_DAYS) * 24 * time.Hour,
+		backupDir:          job.BACKUP_DIR,
+		backupRetention:    time.Duration(job.BACKUP_RETENTION_DAYS) * 24 * time.Hour,
+		runStamp:           time.Now().Format(runStampLayout),
+		limit:              newRateLimiter(int64(job.BANDWIDTH_LIMIT)),
+		fileRate:           newRateLimiter(int64(job.FILES_PER_SECOND)),
+		handles:            newHandleLimiter(job.MAX_OPEN_FILES),
+	}
+	bufSize := int(job.COPY_BUFFER_SIZE)
+	if bufSize == 0 {
+		bufSize = defaultCopyBufferSize
+	}
+	s.buffers = newBufferPool(bufSize)
+	if s.concurrency == 0 {
+		s.concurrency = 1
+	}
+	if s.resumeChunkSize == 0 {
+		s.resumeChunkSize = defaultResumeChunkSize
+	}
+	// mirror では同期元から消えたコピー済みのファイルも削除する
+	if s.mirror {
+		s.onDelete = deleteRemove
+	}
+	// move では同期元を削除する前に必ずコピーを検証する
+	if s.move {
+		s.verify = true
+	}
+	// 双方向同期では他方でコピー済みのファイルの変更も反映する
+	if s.bidirectional && s.detect == "" {
+		s.detect = detectMtime
+	}
+	if s.hashAlgo == "" {
+		s.hashAlgo = defaultHashAlgo
+	}
+	if s.checkpointFiles == 0 {
+		s.checkpointFiles = defaultCheckpointFiles
+	}
+	if s.checkpointInterval == 0 {
+		s.checkpointInterval = defaultCheckpointInterval
+	}
+	// 自動調整の上限はジョブ全体で同時にコピーするファイル数
+	s.adaptive = newAdaptiveLimiter(job.ADAPTIVE_CONCURRENCY, job.MIN_CONCURRENCY, s.concurrency*max(s.dirConcurrency, 1))
+	if opts.Progress && !opts.DryRun {
+		s.progress = startProgress()
+	}
+	s.observer = opts.observer
+	if s.observer == nil {
+		s.observer = newPrintObserver(s)
+	}
+	s.started, s.jobName = time.Now(), job.NAME
+	if job.JOURNAL && !opts.DryRun {
+		if s.journal, err = openJournal(job.stateRoot()); err != nil {
+			state.close()
+			if remote != nil {
+				remote.Close()
+			}
+			if source != nil {
+				source.Close()
+			}
+			releaseLock(lock)
+			return nil, err
+		}
+		s.printf("Run: %s\n", s.journal.runID)
+	}
+	activeRuns.Add(1)
+	touchActivity()
+	return s, nil
+}
+
+func (s *syncer) close() error {
+	activeRuns.Add(-1)
+	defer releaseLock(s.lock)
+	if s.remote != nil {
+		defer s.remote.Close()
+	}
+	if s.source != nil {
+		defer s.source.Close()
+	}
+	return s.state.close()
+}
+
+func (s *syncer) run() error {
+	return s.finish(s.walkParallel(s.syncDir))
+}
+
+// ディレクトリごとの同期の後に、ジョブ全体に対する処理を行ってジャーナルを閉じる
+func (s *syncer) finish(err error) error {
+	if err == nil && s.mirrorDirs {
+		err = s.removeGoneDirs()
+	}
+	if s.removeEmptyDirs && !s.opts.DryRun {
+		s.pruneSourceDirs()
+	}
+	if err == nil {
+		_, err = s.evict()
+	}
+	if err == nil {
+		err = s.pruneKept()
+	}
+	s.progress.finish()
+	if !s.opts.DryRun {
+		if herr := s.recordRun(err); err == nil {
+			err = herr
+		}
+	}
+	if jerr := s.journal.close(err); err == nil {
+		err = jerr
+	}
+	return err
+}
+
+// 実行の履歴を同期状態に残す。JOURNAL が有効な場合はジャーナルと同じ ID にする
+func (s *syncer) recordRun(runErr error) error {
+	r := runRecord{
+		job:         s.jobName,
+		started:     s.started,
+		finished:    time.Now(),
+		filesCopied: s.filesCopied.Load(),
+		bytesCopied: s.bytesCopied.Load(),
+		filesFailed: s.filesFailed.Load(),
+		err:         runErr,
+	}
+	if s.journal != nil {
+		r.id = s.journal.runID
+	} else {
+		var err error
+		if r.id, err = newRunID(); err != nil {
+			return err
+		}
+	}
+	return recordRun(s.state, r)
+}
+
+// 対象のサブディレクトリごとに fn を呼び出す。rel は SRC_DIR からの相対パス
+func (s *syncer) walk(fn func(path, rel string) error) error {
+	if s.source != nil {
+		return s.walkRemote(s.srcRoot, "", fn)
+	}
+	return filepath.WalkDir(s.srcRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == s.srcRoot {
+			return nil
+		}
+		if err := s.ctx.Err(); err != nil {
+			return context.Cause(s.ctx)
+		}
+		touchActivity()
+		rel, _ := filepath.Rel(s.srcRoot, path)
+		if s.filter.skipDir(filepath.ToSlash(rel), d) {
+			return fs.SkipDir
+		}
+		if err := s.filter.loadIgnoreFile(path, filepath.ToSlash(rel)); err != nil {
+			return err
+		}
+		return fn(path, rel)
+	})
+}
+
+// walk と同様だが、fn を最大 dirConcurrency 個のサブディレクトリで並列に実行する。
+// 同期状態はサブディレクトリごとに独立しているため、ディレクトリ内の処理順序は変わらない
+func (s *syncer) walkParallel(fn func(path, rel string) error) error {
+	if s.dirConcurrency <= 1 {
+		return s.walk(fn)
+	}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return first
+	}
+	sem := make(chan struct{}, s.dirConcurrency)
+	err := s.walk(func(path, rel string) error {
+		// 失敗したディレクトリがあれば以降のディレクトリは処理しない
+		if err := failed(); err != nil {
+			return err
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(path, rel); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	return err
+}
+
+// サブディレクトリ 1 つ分の走査結果
+type dirScan struct {
+	files    []string
+	infos    map[string]fs.FileInfo
+	state    *manifest
+	migrated bool
+	// コピーすべきファイル
+	toCopy []string
+	// 書き込み中とみなして次回に回したファイル
+	deferred []string
+	// toCopy のうち、コピー済みだが内容が変更されたファイル
+	changed []string
+	// toCopy のうち、同期先の内容が記録と異なるファイル（-full-scan）
+	corrupt []string
+	// 前回の実行以降に同期元で削除されたファイル（ON_DELETE）
+	deleted []string
+	// 同期元で名前が変更されたファイル（DETECT_RENAMES）
+	renamed []rename
+	// TRACKING の境界値より前にある記録のないファイル。名前の変更先になりうるため DETECT_RENAMES の場合のみ保持する
+	unrecorded map[string]fs.FileInfo
+	// 同期先にのみあるファイル（MODE が mirror）
+	extraneous []string
+	// コピーしてから RETENTION_DAYS を過ぎたファイル
+	expired []string
+	// コピー済みだが削除できずに残っている同期元のファイル（MODE が move）
+	leftover []string
+	// 両側で変更され、両方の内容を残すファイル（CONFLICT_RESOLUTION が rename-both）
+	conflicted []string
+	// コピーしなくても同期状態の保存が必要か
+	dirty bool
+}
+
+// 変更検出の方式（DETECT）
+const (
+	detectNone  = "none"
+	detectMtime = "mtime"
+	detectHash  = "hash"
+)
+
+// コピー済みのファイルが変更されたか判定する。
+// hash の場合、内容が同じでサイズ・更新日時のみ異なる記録は更新する
+func (s *syncer) changed(sc *dirScan, name, srcFile string) (bool, error) {
+	rec, info := sc.state.Files[name], sc.infos[name]
+	switch s.detect {
+	case detectMtime:
+		return rec.Size != info.Size() || !rec.ModTime.Equal(info.ModTime()), nil
+	case detectHash:
+		// サイズと更新日時が記録と同じなら記録したハッシュ値をそのまま使う
+		same := rec.Size == info.Size() && rec.ModTime.Equal(info.ModTime())
+		want := rec.digest(s.hashAlgo)
+		if want != "" && same {
+			return false, nil
+		}
+		// HASH_ALGO を変更する前の記録は、サイズか更新日時が変わっていれば変更されたとみなす
+		if want == "" && rec.SHA256 != "" && !same {
+			return true, nil
+		}
+		// 書き込み中で次回に回すファイルなどを毎回読み直さないよう、計算したハッシュ値は保存する
+		sum, added, err := s.sourceHash(sc.state, name, srcFile, info)
+		if err != nil {
+			return false, err
+		}
+		if added {
+			sc.dirty = true
+		}
+		// ハッシュ値のない記録（旧形式からの移行分）と HASH_ALGO を変更する前の記録は
+		// 現在の内容をコピー済みとみなし、現在の方式で記録し直す
+		if want == "" || want == sum {
+			rec.Size, rec.ModTime, rec.SHA256, rec.HashAlgo = info.Size(), info.ModTime(), sum, recordedAlgo(s.hashAlgo)
+			sc.state.Files[name] = rec
+			delete(sc.state.HashCache, name)
+			sc.dirty = true
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// サブディレクトリ内のファイルと同期状態を突き合わせ、コピーすべきファイルを求める
+func (s *syncer) scanDir(path, rel string) (*dirScan, error) {
+	distDir := filepath.Join(s.distRoot, rel)
+
+	metricDirsScanned.Add(1)
+	state, err := s.state.load(rel)
+	if err != nil {
+		return nil, err
+	}
+	// -force で読み込んだ署名の一致しない同期状態は保存して署名し直す
+	sc := &dirScan{infos: map[string]fs.FileInfo{}, state: state, dirty: state.unverified}
+	// 削除と名前の変更の検出には、フィルタで除外したものも含めた同期元のファイル名が必要
+	var present map[string]bool
+	if s.onDelete != "" || s.renames {
+		present = map[string]bool{}
+	}
+	if err := s.listDir(path, rel, sc, present); err != nil {
+		return nil, err
+	}
+	// 削除を検出する場合と RETENTION_DAYS では同期元が空になったディレクトリも同期状態と突き合わせる
+	if len(sc.files) == 0 && len(sc.unrecorded) == 0 && s.onDelete == "" && s.retention == 0 {
+		return sc, nil
+	}
+	if s.tracking == trackMtime {
+		// 更新日時順に処理し、書き込み中のファイル以降は次回に回す
+		sort.Slice(sc.files, func(i, j int) bool {
+			ti, tj := sc.infos[sc.files[i]].ModTime(), sc.infos[sc.files[j]].ModTime()
+			if !ti.Equal(tj) {
+				return ti.Before(tj)
+			}
+			return s.less(sc.files[i], sc.files[j])
+		})
+	} else {
+		sort.Slice(sc.files, func(i, j int) bool { return s.less(sc.files[i], sc.files[j]) })
+	}
+	// 同期状態がなければ旧形式の last_copied.txt から移行する
+	if sc.state.empty() && s.remote == nil {
+		legacy, err := readLegacyState(distDir)
+		if err != nil {
+			return nil, err
+		}
+		if legacy != nil {
+			// 署名できない旧形式の境界値は書き換えられていても検出できない
+			if s.signed && !s.opts.ForceState {
+				return nil, fmt.Errorf("%s is not signed; use -force to migrate it", filepath.Join(distDir, legacyStateFileName))
+			}
+			legacy.importLegacy(sc.infos)
+			sc.state, sc.migrated = legacy, true
+		}
+	}
+	var base *manifest
+	if s.baseline != nil {
+		if base, err = s.baseline.load(rel); err != nil {
+			return nil, err
+		}
+	}
+	// 新しいファイルをコピーする。
+	// 同期先で削除したファイルも記録に残るため再コピーされない
+	now := time.Now()
+	for _, f := range sc.files {
+		rec, done := sc.state.Files[f]
+		// 削除された後に再び作成されたファイルは新しいファイルとして扱う
+		if done && !rec.DeletedAt.IsZero() {
+			done = false
+		}
+		need := !done && (s.opts.FullScan || s.isNew(sc.state, f, sc.infos[f]))
+		if done {
+			if need, err = s.changed(sc, f, filepath.Join(path, f)); err != nil {
+				return nil, err
+			}
+		}
+		// RETENTION_DAYS で削除したファイルは同期先になくても再コピーしない
+		if !need && s.opts.FullScan && rec.PrunedAt.IsZero() {
+			var corrupt bool
+			if need, corrupt, err = s.distDiffers(filepath.Join(distDir, f), rec, sc.infos[f]); err != nil {
+				return nil, err
+			}
+			if corrupt {
+				sc.corrupt = append(sc.corrupt, f)
+			}
+		}
+		if !need || !done && base != nil && s.copiedToPrimary(base, f, sc.infos[f]) {
+			continue
+		}
+		if done {
+			sc.changed = append(sc.changed, f)
+		}
+		// 書き込み中のファイルは次回に回す
+		if !s.filter.settled(sc.infos[f], now) {
+			sc.deferred = append(sc.deferred, f)
+			if s.tracking != "" && s.tracking != trackManifest && !s.opts.FullScan {
+				// 境界値を越えて取りこぼさないよう、以降のファイルもすべて次回に回す
+				break
+			}
+			continue
+		}
+		sc.toCopy = append(sc.toCopy, f)
+	}
+	if s.stableInterval > 0 && len(sc.toCopy) > 0 {
+		if err := s.checkStable(path, sc); err != nil {
+			return nil, err
+		}
+	}
+	if s.peer != nil && len(sc.toCopy) > 0 {
+		if err := s.resolveConflicts(path, rel, sc); err != nil {
+			return nil, err
+		}
+	}
+	if s.renames {
+		if err := s.detectRenames(path, sc, present); err != nil {
+			return nil, err
+		}
+	}
+	if s.mirror {
+		if err := s.findExtraneous(distDir, rel, sc, present); err != nil {
+			return nil, err
+		}
+	}
+	if s.onDelete != "" {
+		for _, r := range sc.renamed {
+			present[r.from] = true
+		}
+		// フィルタの変更で対象外になっただけのファイルは削除とみなさない
+		for name, rec := range sc.state.Files {
+			if rec.DeletedAt.IsZero() && !present[name] {
+				sc.deleted = append(sc.deleted, name)
+			}
+		}
+		sort.Slice(sc.deleted, func(i, j int) bool { return s.less(sc.deleted[i], sc.deleted[j]) })
+	}
+	sc.expired = s.expired(sc.state, sc.toCopy)
+	if s.move {
+		sc.leftover = s.leftovers(sc)
+	}
+	return sc, nil
+}
+
+// 一度に読み込むディレクトリエントリ数
+const dirBatchSize = 1024
+
+// サブディレクトリ直下のファイルを一定数ずつ読み込み、対象のファイルを sc に加える。
+// 数百万のエントリがあるディレクトリでも一覧全体を保持しないよう、読み込むたびに絞り込む
+func (s *syncer) listDir(path, rel string, sc *dirScan, present map[string]bool) error {
+	// 境界値で判定する場合、記録のない境界値以前のファイルはコピーしないため保持しない
+	// （同期状態が空の場合は旧形式からの移行に全ファイルが必要）
+	prune := s.tracking != "" && s.tracking != trackManifest && !s.opts.FullScan && !sc.state.empty()
+	add := func(info fs.FileInfo) {
+		if s.filter.skipFile(filepath.ToSlash(filepath.Join(rel, info.Name())), info) {
+			return
+		}
+		if _, done := sc.state.Files[info.Name()]; prune && !done && !s.isNew(sc.state, info.Name(), info) {
+			if s.renames {
+				if sc.unrecorded == nil {
+					sc.unrecorded = map[string]fs.FileInfo{}
+				}
+				sc.unrecorded[info.Name()] = info
+			}
+			return
+		}
+		sc.files = append(sc.files, info.Name())
+		sc.infos[info.Name()] = info
+	}
+	// リモートの同期元は一覧をまとめて取得する
+	if s.source != nil {
+		infos, err := s.readSourceDir(path)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if present != nil {
+				present[info.Name()] = true
+			}
+			add(info)
+		}
+		return nil
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		entries, err := dir.ReadDir(dirBatchSize)
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			if present != nil {
+				present[entry.Name()] = true
+			}
+			// 双方向同期では他方向の処理で書き込んだ .partial なども同期元にあるため除く
+			if s.bidirectional {
+				if _, own := s.ownFile(entry.Name()); own {
+					continue
+				}
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			add(info)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 新しいファイルの判定方式（TRACKING）
+const (
+	// 同期状態に記録されていないファイル
+	trackManifest = "manifest"
+	// 名前が最大のコピー済みファイルより後ろのファイル（文字コード順）
+	trackName = "name"
+	// 名前が最大のコピー済みファイルより後ろのファイル（自然順）
+	trackNatural = "natural"
+	// 記録されている最新の更新日時以降に更新されたファイル
+	trackMtime = "mtime"
+)
+
+// 同期状態に記録されていないファイルを新しいファイルとしてコピーするか判定する
+func (s *syncer) isNew(state *manifest, name string, info fs.FileInfo) bool {
+	switch s.tracking {
+	case trackName, trackNatural:
+		return state.LastCopied == "" || s.less(state.LastCopied, name)
+	case trackMtime:
+		// 同じ更新日時のファイルは記録されていなければコピーする
+		return !info.ModTime().Before(state.LastModTime)
+	}
+	return true
+}
+
+// ファイルのサイズと更新日時
+type fileStamp struct {
+	size  int64
+	mtime time.Time
+}
+
+// 同期元のすべての対象ファイルのサイズと更新日時を記録し、STABLE_INTERVAL だけ待つ。
+// ディレクトリごとに待つとディレクトリの数だけ時間がかかるため、最初に呼ばれたときに 1 度だけ行う
+func (s *syncer) takeStableSnapshot() (map[string]fileStamp, error) {
+	s.stableOnce.Do(func() {
+		snap := map[string]fileStamp{}
+		s.stableErr = filepath.WalkDir(s.srcRoot, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := s.ctx.Err(); err != nil {
+				return context.Cause(s.ctx)
+			}
+			rel, _ := filepath.Rel(s.srcRoot, path)
+			if d.IsDir() {
+				if path != s.srcRoot && s.filter.skipDir(filepath.ToSlash(rel), d) {
+					return fs.SkipDir
+				}
+				touchActivity()
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !s.filter.skipFile(filepath.ToSlash(rel), info) {
+				snap[path] = fileStamp{size: info.Size(), mtime: info.ModTime()}
+			}
+			return nil
+		})
+		if s.stableErr != nil {
+			return
+		}
+		s.stableErr = s.sleepActive(s.stableInterval)
+		s.stableSnapshot = snap
+	})
+	return s.stableSnapshot, s.stableErr
+}
+
+// d だけ待つ。待っている間も systemd のウォッチドッグに進行中であることを伝え、終了の指示で中断する
+func (s *syncer) sleepActive(d time.Duration) error {
+	deadline := time.Now().Add(d)
+	for {
+		touchActivity()
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil
+		}
+		select {
+		case <-s.ctx.Done():
+			return context.Cause(s.ctx)
+		case <-time.After(min(left, 10*time.Second)):
+		}
+	}
+}
+
+// コピーするファイルのサイズと更新日時が STABLE_INTERVAL の間に変わらないか確認し、
+// 変わったファイルや他のプロセスが開いているファイルは次回に回す。
+// 記録した後に作られたファイルは確認できないため次回に回す
+func (s *syncer) checkStable(path string, sc *dirScan) error {
+	snap, err := s.takeStableSnapshot()
+	if err != nil {
+		return err
+	}
+	var stable []string
+	for i, f := range sc.toCopy {
+		info, err := os.Stat(filepath.Join(path, f))
+		if err != nil {
+			return err
+		}
+		before, ok := snap[filepath.Join(path, f)]
+		if ok && info.Size() == before.size && info.ModTime().Equal(before.mtime) && !fileInUse(filepath.Join(path, f)) {
+			stable = append(stable, f)
+			continue
+		}
+		if s.tracking != "" && s.tracking != trackManifest && !s.opts.FullScan {
+			// 境界値を越えて取りこぼさないよう、以降のファイルもすべて次回に回す
+			sc.deferred = append(sc.deferred, sc.toCopy[i:]...)
+			break
+		}
+		sc.deferred = append(sc.deferred, f)
+	}
+	sc.toCopy = stable
+	return nil
+}
+
+// 1 ファイル分のコピー結果
+type copyResult struct {
+	sum       string
+	hashState []byte
+	// 追記した場合はコピー済みのサイズ
+	offset int64
+	fileID string
+	// DELTA_MIN_SIZE: 送った内容のブロックの大きさと署名
+	blockSize int64
+	blocks    []byte
+	// DELTA_MIN_SIZE: 同期先の既存の内容を使い、送らなかったバイト数
+	reused int64
+	// ON_CONFLICT でコピーしなかった理由
+	skipped string
+	err     error
+}
+
+// COPY_TIMEOUT が指定されている場合は時間内に終わらないコピーを打ち切って失敗とする。
+// 応答しない NFS などで読み書きが止まった goroutine は待たずに残し、.partial を削除する。
+// 終了の指示で中断した場合は、中断の理由をエラーとして返す
+func (s *syncer) copyWithTimeout(srcFile, distFile string, info fs.FileInfo, rec fileRecord) copyResult {
+	if err := s.ctx.Err(); err != nil {
+		return copyResult{err: context.Cause(s.ctx)}
+	}
+	if err := s.budget.reserve(info); err != nil {
+		return copyResult{err: err}
+	}
+	if s.copyTimeout <= 0 {
+		r := s.copyOne(s.ctx, srcFile, distFile, info, rec)
+		if r.err != nil && s.ctx.Err() != nil {
+			r.err = context.Cause(s.ctx)
+		}
+		return r
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, s.copyTimeout)
+	defer cancel()
+	done := make(chan copyResult, 1)
+	go func() { done <- s.copyOne(ctx, srcFile, distFile, info, rec) }()
+	select {
+	case r := <-done:
+		if r.err != nil && s.ctx.Err() != nil {
+			r.err = context.Cause(s.ctx)
+		}
+		return r
+	case <-ctx.Done():
+		// 中断した場合は、次の読み込みで止まるコピーが .partial を片付けるのを待つ
+		if s.ctx.Err() != nil {
+			r := <-done
+			if r.err != nil {
+				r.err = context.Cause(s.ctx)
+			}
+			return r
+		}
+		if !s.resumable(info) {
+			os.Remove(distFile + partialExt)
+		}
+		return copyResult{err: fmt.Errorf("copy %s: timed out after %s", srcFile, s.copyTimeout)}
+	}
+}
+
+// 1 ファイルをコピーする。複数の goroutine から呼び出されるため同期状態には触れない。
+// rec はコピー前の記録（なければゼロ値）。ctx が終了していれば元の名前に置き換えない
+func (s *syncer) copyOne(ctx context.Context, srcFile, distFile string, info fs.FileInfo, rec fileRecord) copyResult {
+	var r copyResult
+	if r.skipped, r.err = s.conflict(distFile, info, rec); r.skipped != "" || r.err != nil {
+		return r
+	}
+	metricActiveCopies.Add(1)
+	defer metricActiveCopies.Add(-1)
+	s.fileRate.wait(1)
+	buf := s.buffers.get()
+	defer s.buffers.put(buf)
+	// 同期元と同期先の 2 つを開く
+	s.handles.acquire(2)
+	if s.remote != nil {
+		defer s.handles.release(2)
+		return s.copyRemote(ctx, srcFile, distFile, rec)
+	}
+	// 書き込み途中のファイルが後段のシステムに読まれないよう、一時ファイルに書いてから置き換える
+	tmpFile := distFile + partialExt
+	cloned := false
+	// RESUME_THRESHOLD 以上のファイルは中断しても .partial を残し、次回は続きからコピーする
+	resume := s.resumable(info)
+	switch {
+	case s.appendOnly:
+		// HASH_ALGO を変更する前の計算途中の状態は使えないため、ファイル全体をコピーし直す
+		if rec.digest(s.hashAlgo) == "" {
+			rec.HashState = nil
+		}
+		if r.offset, r.err = appendOffset(distFile, rec, info); r.err == nil {
+			switch {
+			case r.offset > 0:
+				// 追記は同期先のファイルに直接行う
+				resume = false
+				r.sum, r.hashState, r.err = appendFile(ctx, srcFile, distFile, s.hashAlgo, r.offset, rec.HashState, *buf, s.wrapReader)
+			case resume:
+				r.sum, r.hashState, r.err = s.resumeCopy(ctx, srcFile, tmpFile, info, *buf)
+			default:
+				r.sum, r.hashState, r.err = appendFile(ctx, srcFile, tmpFile, s.hashAlgo, 0, nil, *buf, s.wrapReader)
+			}
+		}
+	case resume:
+		r.sum, _, r.err = s.resumeCopy(ctx, srcFile, tmpFile, info, *buf)
+	case s.zeroCopy && s.limit == nil:
+		cloned, r.err = cloneFile(srcFile, tmpFile)
+	}
+	switch {
+	case r.err != nil || s.appendOnly || resume || cloned:
+	case s.source != nil:
+		r.sum, r.err = s.download(ctx, srcFile, tmpFile, *buf)
+	default:
+		r.sum, r.err = copyFile(ctx, srcFile, tmpFile, s.hashAlgo, *buf, s.wrapReader)
+	}
+	// 再開できるコピーが中断した場合は .partial と進捗を残す
+	interrupted := resume && r.err != nil
+	s.handles.release(2)
+	written := tmpFile
+	if r.offset > 0 {
+		written = distFile
+	}
+	if cloned {
+		s.progress.addBytes(info.Size())
+		// 同期元を読み直すため、ハッシュ値は変更の検出・検証・チェックサムファイルに必要な場合のみ計算する
+		if r.err == nil && (s.detect == detectHash || s.verify || s.checksums != "") {
+			r.sum, r.err = s.hashFile(srcFile)
+		}
+	}
+	// VERIFY_AFTER_COPY: 書き込んだ内容を読み直し、同期元のハッシュ値と比較する
+	if r.err == nil && s.verify {
+		r.err = s.verifyCopy(written, r.sum)
+	}
+	// DURABLE: 同期状態に記録する前に内容と rename の結果を永続化する
+	if r.err == nil && s.durable {
+		r.err = fsyncFile(written)
+	}
+	if r.offset == 0 {
+		if r.err == nil {
+			r.err = ctx.Err()
+		}
+		// KEEP_VERSIONS・BACKUP_DIR: 上書きする前の版を残す
+		if r.err == nil {
+			r.err = s.rotateVersions(distFile)
+		}
+		if r.err == nil {
+			r.err = s.backupReplaced(distFile)
+		}
+		if r.err == nil {
+			r.err = os.Rename(tmpFile, distFile)
+		}
+		if r.err == nil && s.durable {
+			r.err = fsyncDir(filepath.Dir(distFile))
+		}
+		if r.err != nil && !interrupted {
+			os.Remove(tmpFile)
+		}
+		if resume && !interrupted {
+			os.Remove(tmpFile + resumeExt)
+		}
+	}
+	if r.err == nil && s.renames {
+		r.fileID, r.err = fileID(srcFile, info)
+	}
+	return r
+}
+
+// 同期先に書き込んだファイルのハッシュ値が同期元と一致するか確認する
+func (s *syncer) verifyCopy(path, want string) error {
+	got, err := s.hashDist(path)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("verify %s: checksum mismatch (source %s, destination %s)", path, want, got)
+	}
+	return nil
+}
+
+// 同期元の Reader に帯域制限と進捗の計測を組み込む
+func (s *syncer) wrapReader(r io.Reader) io.Reader {
+	return s.progress.reader(limitReader(r, s.limit))
+}
+
+// FILES_PER_SECOND と MAX_OPEN_FILES に従ってファイルのハッシュ値を計算する
+func (s *syncer) hashFile(path string) (string, error) {
+	s.fileRate.wait(1)
+	s.handles.acquire(1)
+	defer s.handles.release(1)
+	touchActivity()
+	defer touchActivity()
+	return hashFile(path, s.hashAlgo)
+}
+
+// 同期先のファイルが存在しないか、コピー済みの内容と異なるか判定する（-full-scan）。
+// サイズを比較し、DETECT が hash の場合は記録されているハッシュ値とも比較する。
+// corrupt は同期先のファイルが存在し、内容が異なる場合
+func (s *syncer) distDiffers(distFile string, rec fileRecord, info fs.FileInfo) (differs, corrupt bool, err error) {
+	dst, err := s.statDist(distFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if dst.Size() != info.Size() {
+		return true, true, nil
+	}
+	if want := rec.digest(s.hashAlgo); s.detect == detectHash && want != "" {
+		sum, err := s.hashDist(distFile)
+		if err != nil {
+			return false, false, err
+		}
+		return sum != want, sum != want, nil
+	}
+	return false, false, nil
+}
+
+// 追記分のみコピーできる場合はコピー済みのサイズを返す（APPEND）。
+// 同期元が記録より大きく、同期先が記録と同じサイズのまま残っている場合のみ追記する
+func appendOffset(distFile string, rec fileRecord, info fs.FileInfo) (int64, error) {
+	if rec.Size == 0 || rec.Size >= info.Size() || rec.HashState == nil {
+		return 0, nil
+	}
+	dst, err := os.Stat(distFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if dst.Size() != rec.Size {
+		return 0, nil
+	}
+	return rec.Size, nil
+}
+
+// サブディレクトリ直下のファイルを同期する。rel は SRC_DIR からの相対パス
+func (s *syncer) syncDir(path, rel string) error {
+	distDir := filepath.Join(s.distRoot, rel)
+	sc, err := s.scanDir(path, rel)
+	if err != nil {
+		return err
+	}
+	if len(sc.deferred) > 0 {
+		s.deferredMu.Lock()
+		s.deferredDirs = append(s.deferredDirs, filepath.ToSlash(rel))
+		s.deferredMu.Unlock()
+	}
+	for _, f := range sc.deferred {
+		if err := s.journal.write(journalEntry{Action: journalSkipped, Path: filepath.ToSlash(filepath.Join(rel, f)), Size: sc.infos[f].Size(), Reason: "unsettled"}); err != nil {
+			return err
+		}
+	}
+	if len(sc.toCopy) == 0 && len(sc.deleted) == 0 && len(sc.extraneous) == 0 && len(sc.expired) == 0 && len(sc.leftover) == 0 && len(sc.conflicted) == 0 && len(sc.renamed) == 0 && !sc.migrated && !sc.dirty {
+		return nil
+	}
+	if s.opts.DryRun {
+		if sc.migrated {
+			s.printf("Would migrate: %s\n", filepath.Join(distDir, legacyStateFileName))
+		}
+		for _, r := range sc.renamed {
+			s.observer.OnFileDone(FileEvent{Src: filepath.Join(distDir, r.from), Dist: filepath.Join(distDir, r.to), Action: FileRenamed, DryRun: true})
+		}
+		for _, f := range sc.deleted {
+			s.observer.OnFileDone(FileEvent{Dist: filepath.Join(distDir, f), Action: deleteActions[s.onDelete], DryRun: true})
+		}
+		for _, f := range sc.extraneous {
+			s.observer.OnFileDone(FileEvent{Dist: filepath.Join(distDir, f), Action: FileDeleted, DryRun: true})
+		}
+		for _, f := range sc.expired {
+			s.observer.OnFileDone(FileEvent{Dist: filepath.Join(distDir, f), Action: FilePruned, DryRun: true})
+		}
+		for _, f := range sc.leftover {
+			s.observer.OnFileDone(FileEvent{Src: filepath.Join(path, f), Action: FileSourceRemoved, DryRun: true})
+		}
+		for _, f := range sc.conflicted {
+			s.observer.OnFileDone(FileEvent{Src: filepath.Join(path, f), Dist: filepath.Join(distDir, f), Action: FileConflict, DryRun: true})
+		}
+		if s.quarantineDir != "" {
+			for _, f := range sc.corrupt {
+				s.observer.OnFileDone(FileEvent{Dist: filepath.Join(distDir, f), Action: FileQuarantined, DryRun: true})
+			}
+		}
+		for _, f := range sc.toCopy {
+			srcFile, distFile := filepath.Join(path, f), filepath.Join(distDir, f)
+			if skip, err := s.conflict(distFile, sc.infos[f], sc.state.Files[f]); err != nil {
+				s.observer.OnError(srcFile, distFile, err)
+				continue
+			} else if skip != "" {
+				s.observer.OnFileDone(FileEvent{Src: srcFile, Dist: distFile, Action: FileSkipped, Reason: skip, DryRun: true})
+				continue
+			}
+			ev := FileEvent{Src: srcFile, Dist: distFile, Action: FileCopied, Bytes: sc.infos[f].Size(), DryRun: true}
+			if s.move {
+				ev.Action = FileMoved
+			} else if contains(sc.changed, f) {
+				ev.Action = FileUpdated
+			}
+			s.observer.OnFileDone(ev)
+		}
+		s.observer.OnDirDone(rel)
+		return nil
+	}
+	// コピー処理（リモートのディレクトリはファイルを書き込むときに作る）
+	if s.remote == nil {
+		if err := ensureDir(distDir); err != nil {
+			return err
+		}
+	}
+	state := sc.state
+	save := func() error {
+		state.UpdatedAt = time.Now()
+		return s.state.save(rel, state)
+	}
+	deleted, extraneous, expired := sc.deleted, sc.extraneous, sc.expired
+	// -delete-dry-run: 同期先から削除するファイルは表示のみにし、記録も変えない
+	if s.opts.DeleteDryRun {
+		if s.onDelete == deleteRemove {
+			for _, f := range deleted {
+				s.observer.OnFileDone(FileEvent{Dist: filepath.Join(distDir, f), Action: FileDeleted, DryRun: true})
+			}
+			deleted = nil
+		}
+		for _, f := range extraneous {
+			s.observer.OnFileDone(FileEvent{Dist: filepath.Join(distDir, f), Action: FileDeleted, DryRun: true})
+		}
+		extraneous = nil
+		for _, f := range expired {
+			s.observer.OnFileDone(FileEvent{Dist: filepath.Join(distDir, f), Action: FilePruned, DryRun: true})
+		}
+		expired = nil
+	}
+	err = s.applyRenames(distDir, rel, state, sc.renamed, sc)
+	if err == nil {
+		err = s.propagateDeletes(distDir, rel, state, deleted)
+	}
+	if err == nil {
+		err = s.removeExtraneous(distDir, rel, extraneous)
+	}
+	if err == nil {
+		err = s.pruneFiles(distDir, rel, state, expired, "retention")
+	}
+	for _, f := range sc.leftover {
+		if err != nil {
+			break
+		}
+		if err = s.removeSource(filepath.Join(path, f), rel, sc.infos[f]); err == nil {
+			s.observer.OnFileDone(FileEvent{Src: filepath.Join(path, f), Action: FileSourceRemoved})
+		}
+	}
+	if err == nil && s.quarantineDir != "" {
+		for _, f := range sc.corrupt {
+			if err = s.quarantine(rel, f, "size or checksum mismatch"); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		if serr := save(); serr != nil {
+			return fmt.Errorf("%w (saving state also failed: %v)", err, serr)
+		}
+		return err
+	}
+	// 大量のファイルをコピーする途中で停止しても、それまでの記録が失われないよう定期的に保存する
+	pending, lastSave := 0, time.Now()
+	// コピーは並列に行い、記録は TRACKING の境界値が飛ばないよう toCopy の順に行う。
+	// コピー中は同期状態を更新するため、コピー前の記録を控えておく
+	records := make([]fileRecord, len(sc.toCopy))
+	for i, f := range sc.toCopy {
+		records[i] = state.Files[f]
+	}
+	var planned int64
+	for _, f := range sc.toCopy {
+		planned += sc.infos[f].Size()
+	}
+	// 双方向同期で同期先に書き込んだファイル。他方向でコピーし返さないよう他方の同期状態に記録する
+	peerCopied := map[string]string{}
+	s.progress.plan(len(sc.toCopy), planned)
+	copyOne := func(i int) copyResult {
+		f := sc.toCopy[i]
+		s.adaptive.acquire()
+		s.observer.OnFileStart(filepath.Join(path, f), filepath.Join(distDir, f), sc.infos[f].Size())
+		start := time.Now()
+		r := s.copyWithTimeout(filepath.Join(path, f), filepath.Join(distDir, f), sc.infos[f], records[i])
+		s.adaptive.release(time.Since(start), sc.infos[f].Size(), r.err)
+		return r
+	}
+	err = runOrdered(len(sc.toCopy), s.concurrency, copyOne, func(i int, r copyResult) error {
+		f := sc.toCopy[i]
+		srcFile := filepath.Join(path, f)
+		distFile := filepath.Join(distDir, f)
+		relFile := filepath.ToSlash(filepath.Join(rel, f))
+		s.progress.fileDone()
+		// 上限に達してコピーしなかったファイルは失敗として記録しない
+		if errors.Is(r.err, errRunBudget) {
+			return r.err
+		}
+		if r.err != nil {
+			metricCopyErrors.Add(1)
+			s.filesFailed.Add(1)
+			s.observer.OnError(srcFile, distFile, r.err)
+			if jerr := s.journal.write(journalEntry{Action: journalFailed, Path: relFile, Size: sc.infos[f].Size(), Error: r.err.Error()}); jerr != nil {
+				return jerr
+			}
+			return r.err
+		}
+		if r.skipped != "" {
+			s.observer.OnFileDone(FileEvent{Src: srcFile, Dist: distFile, Action: FileSkipped, Reason: r.skipped})
+			return s.journal.write(journalEntry{Action: journalSkipped, Path: relFile, Size: sc.infos[f].Size(), Reason: r.skipped})
+		}
+		metricFilesCopied.Add(1)
+		metricBytesCopied.Add(sc.infos[f].Size() - r.offset)
+		s.filesCopied.Add(1)
+		s.bytesCopied.Add(sc.infos[f].Size() - r.offset)
+		state.record(f, sc.infos[f], r.sum, s.hashAlgo, s.less)
+		if err := s.writeSidecar(distFile, r.sum); err != nil {
+			return err
+		}
+		// 削除後に再び作成されたファイルは削除マーカーを取り除く
+		if s.onDelete == deleteTombstone {
+			if err := os.Remove(distFile + tombstoneExt); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if r.hashState != nil || r.fileID != "" || r.blocks != nil {
+			rec := state.Files[f]
+			rec.HashState, rec.FileID = r.hashState, r.fileID
+			rec.BlockSize, rec.Blocks = r.blockSize, r.blocks
+			state.Files[f] = rec
+		}
+		if err := s.journal.write(journalEntry{Action: journalCopied, Path: relFile, Size: sc.infos[f].Size(), SHA256: r.sum, HashAlgo: recordedAlgo(s.hashAlgo)}); err != nil {
+			return err
+		}
+		if s.peer != nil {
+			peerCopied[f] = r.sum
+		}
+		ev := FileEvent{Src: srcFile, Dist: distFile, Action: FileCopied, Bytes: sc.infos[f].Size() - r.offset - r.reused, Reused: r.reused}
+		if s.move {
+			if err := s.removeSource(srcFile, rel, sc.infos[f]); err != nil {
+				return err
+			}
+			ev.Action = FileMoved
+		} else if r.offset > 0 {
+			ev.Action = FileAppended
+		} else if contains(sc.changed, f) {
+			ev.Action = FileUpdated
+		}
+		s.observer.OnFileDone(ev)
+		pending++
+		if pending >= s.checkpointFiles || time.Since(lastSave) >= s.checkpointInterval {
+			if err := save(); err != nil {
+				return err
+			}
+			pending, lastSave = 0, time.Now()
+		}
+		return nil
+	})
+	if err == nil {
+		err = s.copyConflicts(path, rel, state, sc.conflicted, peerCopied)
+	}
+	if perr := s.updatePeer(rel, peerCopied); err == nil {
+		err = perr
+	}
+	if err != nil {
+		if pending > 0 || len(peerCopied) > 0 {
+			if serr := save(); serr != nil {
+				return fmt.Errorf("%w (saving state also failed: %v)", err, serr)
+			}
+		}
+		return err
+	}
+	if err := save(); err != nil {
+		return err
+	}
+	if err := s.writeChecksumManifest(distDir, state); err != nil {
+		return err
+	}
+	if sc.migrated {
+		s.printf("Migrated: %s\n", filepath.Join(distDir, legacyStateFileName))
+		if err := removeLegacyState(distDir); err != nil {
+			return err
+		}
+	}
+	s.observer.OnDirDone(rel)
+	return nil
+}
+
+func runJob(ctx context.Context, job Job, opts RunOptions) error {
+	ctx, cancel := jobContext(ctx, job)
+	defer cancel()
+	if job.MODE == modeBidirectional {
+		return budgetResult(runBidirectional(ctx, job, opts), opts)
+	}
+	if job.FAILOVER_DIST_DIR != "" {
+		return budgetResult(runFailover(ctx, job, opts), opts)
+	}
+	s, err := newSyncer(ctx, job, opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	return budgetResult(s.run(), opts)
+}
@@ -0,0 +1,67 @@
+// Package syncig は syncig コマンドの同期の処理を他のプログラムから使うためのパッケージ。
+// 設定ファイルの読み込み（LoadConfig）と、1 ジョブ分の同期の実行（New・Syncer.Run）を提供する。
+//
+//	cfg, err := syncig.LoadConfig("/etc/syncig/config.json")
+//	if err != nil {
+//		return err
+//	}
+//	for _, job := range cfg.Jobs() {
+//		if err := syncig.New(job).Run(ctx); err != nil {
+//			return err
+//		}
+//	}
+//
+// コピー・削除したファイルはコマンドと同じく標準出力に表示する。Syncer.Observer を指定すると代わりにそれに通知する。
+// 設定の項目・動作はコマンドと同じで、README に記載している。
+package syncig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// 1 ジョブ分の同期を実行する。コマンドの sync と同じく、同期状態のロックを取得して SRC_DIR から DIST_DIR へコピーする
+type Syncer struct {
+	// 実行時のオプション。未設定の場合はコマンドの sync をフラグなしで実行した場合と同じ
+	Options RunOptions
+	// 処理したファイルの通知先。nil の場合はコマンドと同じく標準出力に表示する。
+	// 指定した場合は標準出力には何も表示しない（Options.Progress の進捗を除く）
+	Observer Observer
+	job      Job
+}
+
+// job を実行する Syncer を返す。job は LoadConfig で読み込んだものか、Job を直接組み立てたもの。
+// 直接組み立てた場合、相対パスは作業ディレクトリを基準とし、SYNCIG_ で始まる環境変数の上書きは反映しない
+func New(job Job) *Syncer {
+	return &Syncer{job: job}
+}
+
+// 同期を実行する。ctx を取り消すとコピー中のファイルを中断し、同期状態を保存してから context.Cause(ctx) を返す。
+// DIST_DIRS を指定したジョブは同期先ごとに順に実行し、失敗した同期先のエラーをまとめて返す
+func (s *Syncer) Run(ctx context.Context) error {
+	jobs, err := expandDestinations([]Job{s.job})
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if err := validateJob(job); err != nil {
+			return err
+		}
+	}
+	opts := s.Options
+	opts.observer = s.Observer
+	var errs []error
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if err := runJob(ctx, job, opts); err != nil {
+			if len(job.DIST_DIRS) > 0 {
+				err = fmt.Errorf("%s: %w", job.DIST_DIR, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
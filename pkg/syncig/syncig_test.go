@@ -0,0 +1,359 @@
+package syncig_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperdb/syncig/pkg/syncig"
+)
+
+// パッケージの外から設定ファイルを読み込んで同期できる
+func TestSyncerRun(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "src", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "src", "a", "f.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 相対パスは設定ファイルのディレクトリが基準
+	config := filepath.Join(root, "syncig.json")
+	if err := os.WriteFile(config, []byte(`{"SRC_DIR": "src", "DIST_DIRS": ["dist1", "dist2"], "DETECT": "mtime"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := syncig.LoadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range cfg.Jobs() {
+		if err := syncig.New(job).Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dist := range []string{"dist1", "dist2"} {
+		b, err := os.ReadFile(filepath.Join(root, dist, "a", "f.txt"))
+		if err != nil || string(b) != "hello" {
+			t.Errorf("%s: %q, %v", dist, b, err)
+		}
+	}
+
+	// DryRun は同期先に書き込まない
+	s := syncig.New(syncig.Job{SRC_DIR: filepath.Join(root, "src"), DIST_DIR: filepath.Join(root, "dist3")})
+	s.Options.DryRun = true
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dist3", "a", "f.txt")); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote to DIST_DIR: %v", err)
+	}
+}
+
+func TestSyncerRunInvalidJob(t *testing.T) {
+	if err := syncig.New(syncig.Job{DIST_DIR: t.TempDir()}).Run(context.Background()); err == nil {
+		t.Error("Run without SRC_DIR succeeded")
+	}
+}
+
+// メモリ上のリモートの同期先
+type memStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	puts  int
+}
+
+type memInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memInfo) Name() string { return i.name }
+func (i memInfo) Size() int64  { return i.size }
+func (i memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() any           { return nil }
+
+func (m *memStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = b
+	m.puts++
+	return nil
+}
+
+func (m *memStore) Create(ctx context.Context, name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		return fs.ErrExist
+	}
+	m.files[name] = data
+	return nil
+}
+
+func (m *memStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.files[name]; ok {
+		return memInfo{path.Base(name), int64(len(b)), false}, nil
+	}
+	for f := range m.files {
+		if strings.HasPrefix(f, name+"/") {
+			return memInfo{path.Base(name), 0, true}, nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (m *memStore) Remove(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memStore) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := map[string]bool{}
+	var entries []fs.FileInfo
+	for f, b := range m.files {
+		rest, ok := strings.CutPrefix(f, dir+"/")
+		if !ok {
+			continue
+		}
+		name, _, sub := strings.Cut(rest, "/")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, memInfo{name, int64(len(b)), sub})
+	}
+	return entries, nil
+}
+
+func (m *memStore) Close() error { return nil }
+
+var memSchemes atomic.Int32
+
+// d を新しいスキームで登録し、そのスキームの DIST_DIR を返す（-count で繰り返しても重複しないようにする）
+func registerDest(d syncig.Destination) string {
+	scheme := fmt.Sprintf("memtest%d", memSchemes.Add(1))
+	syncig.RegisterBackend(syncig.Backend{Open: func(_ string, u *url.URL, _ syncig.Job) (syncig.Destination, string, error) {
+		return d, u.Host + u.Path, nil
+	}}, scheme)
+	return scheme + "://dist"
+}
+
+// パッケージの外で登録した形式を DIST_DIR に指定できる
+func TestRegisterBackend(t *testing.T) {
+	store := &memStore{files: map[string][]byte{}}
+	dist := registerDest(store)
+
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a", "f.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := syncig.Job{SRC_DIR: src, DIST_DIR: dist, STATE_DIR: t.TempDir()}
+	if err := syncig.New(job).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b := store.files["dist/a/f.txt"]; string(b) != "hello" {
+		t.Errorf("dist/a/f.txt = %q", b)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate scheme did not panic")
+		}
+	}()
+	syncig.RegisterBackend(syncig.Backend{}, strings.TrimSuffix(dist, "://dist"))
+}
+
+// 同期先への書き込みで ctx を取り消す
+type cancelStore struct {
+	*memStore
+	cancel context.CancelCauseFunc
+}
+
+func (c cancelStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	c.cancel(errStop)
+	return c.memStore.Put(ctx, name, r, size)
+}
+
+var errStop = errors.New("stop")
+
+// ctx を取り消すと残りのファイルをコピーせずに context.Cause(ctx) を返す
+func TestSyncerRunCancel(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 100 {
+		if err := os.WriteFile(filepath.Join(src, "a", fmt.Sprintf("f%03d.txt", i)), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	store := &memStore{files: map[string][]byte{}}
+	dist := registerDest(cancelStore{store, cancel})
+
+	job := syncig.Job{SRC_DIR: src, DIST_DIR: dist, STATE_DIR: t.TempDir()}
+	if err := syncig.New(job).Run(ctx); !errors.Is(err, errStop) {
+		t.Fatalf("Run = %v, want %v", err, errStop)
+	}
+	n := 0
+	for name := range store.files {
+		if strings.HasPrefix(name, "dist/a/") {
+			n++
+		}
+	}
+	if n == 100 {
+		t.Error("all files were copied after cancellation")
+	}
+
+	// 取り消し済みの ctx では何もコピーしない
+	puts := store.puts
+	if err := syncig.New(job).Run(ctx); !errors.Is(err, errStop) {
+		t.Fatalf("Run = %v, want %v", err, errStop)
+	}
+	if store.puts != puts {
+		t.Errorf("Run with a cancelled context wrote %d files", store.puts-puts)
+	}
+
+	// 次回はコピーしていない残りのファイルだけをコピーする
+	if err := syncig.New(job).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.puts-puts != 100-n {
+		t.Errorf("resumed run copied %d files, want %d", store.puts-puts, 100-n)
+	}
+}
+
+// 受け取った経過を記録する
+type recorder struct {
+	mu     sync.Mutex
+	starts []string
+	events []syncig.FileEvent
+	dirs   []string
+}
+
+func (r *recorder) OnFileStart(src, dist string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.starts = append(r.starts, src)
+}
+
+func (r *recorder) OnFileDone(ev syncig.FileEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *recorder) OnError(src, dist string, err error) {}
+
+func (r *recorder) OnDirDone(rel string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dirs = append(r.dirs, rel)
+}
+
+// Observer を指定するとコピー・削除を通知し、標準出力には何も表示しない
+func TestSyncerObserver(t *testing.T) {
+	root := t.TempDir()
+	src, dist := filepath.Join(root, "src"), filepath.Join(root, "dist")
+	if err := os.MkdirAll(filepath.Join(src, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"f1", "f2"} {
+		if err := os.WriteFile(filepath.Join(src, "a", f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := syncig.Job{SRC_DIR: src, DIST_DIR: dist, STATE_DIR: filepath.Join(root, "state"), MODE: "mirror"}
+	run := func(dryRun bool) *recorder {
+		t.Helper()
+		r := &recorder{}
+		s := syncig.New(job)
+		s.Observer = r
+		s.Options.DryRun = dryRun
+		stdout := os.Stdout
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stdout = pw
+		err = s.Run(context.Background())
+		os.Stdout = stdout
+		pw.Close()
+		out, _ := io.ReadAll(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) > 0 {
+			t.Errorf("Run with an Observer printed %q", out)
+		}
+		return r
+	}
+
+	r := run(false)
+	if len(r.starts) != 2 || len(r.events) != 2 || r.events[0].Action != syncig.FileCopied || r.events[0].Dist != filepath.Join(dist, "a", "f1") || r.events[0].Bytes != 2 {
+		t.Errorf("starts %v, events %+v", r.starts, r.events)
+	}
+	if len(r.dirs) != 1 || r.dirs[0] != "a" {
+		t.Errorf("dirs %v", r.dirs)
+	}
+
+	if err := os.Remove(filepath.Join(src, "a", "f1")); err != nil {
+		t.Fatal(err)
+	}
+	want := syncig.FileEvent{Dist: filepath.Join(dist, "a", "f1"), Action: syncig.FileDeleted}
+	r = run(true)
+	if len(r.events) != 1 || r.events[0] != (syncig.FileEvent{Dist: want.Dist, Action: want.Action, DryRun: true}) {
+		t.Errorf("dry run events %+v", r.events)
+	}
+	r = run(false)
+	if len(r.events) != 1 || r.events[0] != want {
+		t.Errorf("events %+v, want %+v", r.events, want)
+	}
+	if _, err := os.Stat(want.Dist); !os.IsNotExist(err) {
+		t.Errorf("%s was not deleted: %v", want.Dist, err)
+	}
+}
@@ -0,0 +1,73 @@
+package syncig
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// systemd の Type=notify で起動された場合に、sd_notify と同じ形式で状態を通知する。
+// NOTIFY_SOCKET が設定されていなければ何もしない
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	// 抽象名前空間のソケット
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// 同期の進み具合。コピー・ハッシュ値の計算で読み込むたび、ディレクトリを走査するたびに更新する
+var (
+	lastActivity atomic.Int64
+	activeRuns   atomic.Int32
+)
+
+func touchActivity() {
+	lastActivity.Store(time.Now().UnixNano())
+}
+
+// 読み込むたびに touchActivity する Reader。メモリ上のパートを HTTP で送る間など、
+// 同期元の読み込みが進まなくても送信が進んでいれば停止とみなさないようにする
+type activityReader struct {
+	r io.Reader
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	touchActivity()
+	return a.r.Read(p)
+}
+
+// WatchdogSec が設定されている場合、その半分の間隔で WATCHDOG=1 を送る。
+// 同期中は WatchdogSec の間に読み込みが進んでいない場合（応答しない NFS で止まっている場合など）は送らず、
+// systemd に停止とみなさせる
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	timeout := time.Duration(usec) * time.Microsecond
+	go func() {
+		t := time.NewTicker(timeout / 2)
+		defer t.Stop()
+		for range t.C {
+			if activeRuns.Load() == 0 || time.Since(time.Unix(0, lastActivity.Load())) < timeout {
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package syncig
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// トークンバケット方式の帯域制限。複数の goroutine で共有する
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// rate は 1 秒あたりのバイト数。0 以下の場合は nil（制限なし）を返す
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	// 1 回の読み込みで待ち時間が大きく偏らないよう、バケットの容量は 0.1 秒分とする
+	burst := float64(rate) / 10
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// 1 回の読み込みの上限
+func (l *rateLimiter) chunk() int {
+	if l.burst < 1 {
+		return 1
+	}
+	return int(l.burst)
+}
+
+// n バイト分のトークンを消費し、足りなければ補充されるまで待つ
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// 読み込み量を rateLimiter で制限する Reader
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+// l が nil の場合は r をそのまま返す
+func limitReader(r io.Reader, l *rateLimiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if c := lr.l.chunk(); len(p) > c {
+		p = p[:c]
+	}
+	n, err := lr.r.Read(p)
+	lr.l.wait(n)
+	return n, err
+}
+
+// 同時に開くファイル数の上限
+type handleLimiter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	avail int
+}
+
+// max が 0 以下の場合は nil（制限なし）を返す
+func newHandleLimiter(max int) *handleLimiter {
+	if max <= 0 {
+		return nil
+	}
+	l := &handleLimiter{avail: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// n 個をまとめて確保する。一部だけ確保して待つとデッドロックするため、揃うまで待つ
+func (l *handleLimiter) acquire(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	for l.avail < n {
+		l.cond.Wait()
+	}
+	l.avail -= n
+	l.mu.Unlock()
+}
+
+func (l *handleLimiter) release(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.avail += n
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
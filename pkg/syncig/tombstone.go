@@ -0,0 +1,73 @@
+package syncig
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+)
+
+// 同期元で削除されたファイルの扱い（ON_DELETE）
+const (
+	// 同期状態に削除を記録するのみ
+	deleteRecord = "record"
+	// 同期先に削除を示すマーカーファイルを書き込む
+	deleteTombstone = "tombstone"
+	// 同期先のコピーを削除する
+	deleteRemove = "delete"
+)
+
+// 削除マーカーファイルの拡張子
+const tombstoneExt = ".deleted"
+
+// ON_DELETE ごとの同期元で削除されたファイルの扱い（-dry-run で渡す FileEvent.Action）
+var deleteActions = map[string]string{
+	deleteRecord:    FileDeletionRecorded,
+	deleteTombstone: FileTombstoned,
+	deleteRemove:    FileDeleted,
+}
+
+// 削除マーカーファイルの内容
+type tombstone struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	HashAlgo  string    `json:"hash_algo,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// 同期元で削除されたファイルを ON_DELETE に従って同期先に反映し、同期状態に記録する
+func (s *syncer) propagateDeletes(distDir, rel string, state *manifest, deleted []string) error {
+	now := time.Now()
+	for _, f := range deleted {
+		rec := state.Files[f]
+		distFile := filepath.Join(distDir, f)
+		relFile := filepath.ToSlash(filepath.Join(rel, f))
+		switch s.onDelete {
+		case deleteTombstone:
+			b, err := json.MarshalIndent(tombstone{Path: relFile, Size: rec.Size, SHA256: rec.SHA256, HashAlgo: rec.HashAlgo, DeletedAt: now}, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := writeFileAtomic(distFile+tombstoneExt, append(b, '\n'), 0644); err != nil {
+				return err
+			}
+			s.observer.OnFileDone(FileEvent{Dist: distFile, Action: FileTombstoned})
+		case deleteRemove:
+			kept, err := s.removeDist(rel, f)
+			if err != nil {
+				return err
+			}
+			if err := s.removeSidecar(distFile); err != nil {
+				return err
+			}
+			s.observer.OnFileDone(s.removedEvent(distFile, kept, false))
+		}
+		rec.DeletedAt = now
+		state.Files[f] = rec
+		delete(state.HashCache, f)
+		if err := s.journal.write(journalEntry{Action: journalDeleted, Path: relFile, Size: rec.Size, Reason: s.onDelete}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
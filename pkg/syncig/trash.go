@@ -0,0 +1,124 @@
+package syncig
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TRASH が有効な場合に、同期先から削除するファイルを移すディレクトリ（DIST_DIR 直下）
+const trashDirName = ".syncig-trash"
+
+// 削除・上書きする同期先のファイルの移動先。BACKUP_DIR またはゴミ箱の実行ごとのディレクトリの下に
+// 同期先と同じ相対パスで置く。どちらも無効な場合は空
+func (s *syncer) keepPath(rel string) string {
+	switch {
+	case s.backupDir != "":
+		return filepath.Join(s.backupDir, s.runStamp, rel)
+	case s.trash:
+		return filepath.Join(s.distRoot, trashDirName, s.runStamp, rel)
+	}
+	return ""
+}
+
+// 同期先のファイルを削除する。BACKUP_DIR や TRASH が有効な場合は消去せずに移し、
+// 誤って同期元から削除したファイルを取り戻せるようにする。移した場合は移動先を返す
+func (s *syncer) removeDist(rel, name string) (string, error) {
+	distFile := filepath.Join(s.distRoot, rel, name)
+	dst := s.keepPath(filepath.Join(rel, name))
+	if dst == "" {
+		if err := os.Remove(distFile); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		return "", nil
+	}
+	if _, err := os.Lstat(distFile); os.IsNotExist(err) {
+		return "", nil
+	}
+	return dst, s.moveFile(distFile, dst)
+}
+
+// 同期先のディレクトリを配下ごと削除する。BACKUP_DIR や TRASH が有効な場合は removeDist と同様に移す
+func (s *syncer) removeDistDir(rel string) (string, error) {
+	distDir := filepath.Join(s.distRoot, rel)
+	dst := s.keepPath(rel)
+	if dst == "" {
+		return "", os.RemoveAll(distDir)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(distDir, dst); err == nil {
+		return dst, nil
+	}
+	// 別のファイルシステムにはファイルごとに移す
+	err := filepath.WalkDir(distDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		r, _ := filepath.Rel(distDir, path)
+		return s.moveFile(path, filepath.Join(dst, r))
+	})
+	if err != nil {
+		return "", err
+	}
+	return dst, os.RemoveAll(distDir)
+}
+
+// removeDist・removeDistDir で削除したファイル・ディレクトリの FileEvent。kept は退避先
+func (s *syncer) removedEvent(distPath, kept string, dir bool) FileEvent {
+	ev := FileEvent{Dist: distPath, Action: FileDeleted, Kept: kept, Dir: dir}
+	switch {
+	case kept == "":
+	case s.trash:
+		ev.Action = FileTrashed
+	default:
+		ev.Action = FileBackedUp
+	}
+	return ev
+}
+
+// 同期の終わりに、ゴミ箱と BACKUP_DIR のうち保持する日数を過ぎた実行のディレクトリを削除する
+func (s *syncer) pruneKept() error {
+	if s.trash {
+		if err := s.pruneRunDirs(filepath.Join(s.distRoot, trashDirName), s.trashRetention); err != nil {
+			return err
+		}
+	}
+	if s.backupDir != "" {
+		return s.pruneRunDirs(s.backupDir, s.backupRetention)
+	}
+	return nil
+}
+
+// root の下の実行ごとのディレクトリのうち retention を過ぎたものを削除する（0 は削除しない）
+func (s *syncer) pruneRunDirs(root string, retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	for _, entry := range entries {
+		t, err := time.ParseInLocation(runStampLayout, entry.Name(), time.Local)
+		if err != nil || !entry.IsDir() || !t.Before(cutoff) {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		if s.opts.DryRun {
+			s.observer.OnFileDone(FileEvent{Dist: dir, Action: FilePruned, Dir: true, DryRun: true})
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		s.observer.OnFileDone(FileEvent{Dist: dir, Action: FilePruned, Dir: true})
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package syncig
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// "10MB" のような単位付きの表記を受け付けるバイト数。
+// K/M/G/T（KiB などの表記も可）は 1024 倍、KB/MB/GB/TB は 1000 倍とする
+type ByteSize int64
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KIB": 1 << 10,
+	"KB":  1000,
+	"M":   1 << 20,
+	"MIB": 1 << 20,
+	"MB":  1000 * 1000,
+	"G":   1 << 30,
+	"GIB": 1 << 30,
+	"GB":  1000 * 1000 * 1000,
+	"T":   1 << 40,
+	"TIB": 1 << 40,
+	"TB":  1000 * 1000 * 1000 * 1000,
+}
+
+func parseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		i++
+	}
+	num, unit := s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+	mult, ok := byteUnits[unit]
+	if num == "" || !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(f * float64(mult)), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	v, err := parseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// 数値（バイト数）と文字列の両方を受け付ける
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid size %s", data)
+	}
+	return b.UnmarshalText([]byte(s))
+}
+
+func (b ByteSize) String() string {
+	v := float64(b)
+	for _, u := range []string{"B", "KiB", "MiB", "GiB"} {
+		if v < 1024 {
+			if u == "B" {
+				return fmt.Sprintf("%d%s", int64(b), u)
+			}
+			return fmt.Sprintf("%.1f%s", v, u)
+		}
+		v /= 1024
+	}
+	return fmt.Sprintf("%.1fTiB", v)
+}
+
+// "20MB/s" のような 1 秒あたりのバイト数。"/s" は省略できる
+type Bandwidth int64
+
+func (b *Bandwidth) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	v, err := parseByteSize(strings.TrimSuffix(strings.TrimSuffix(s, "/s"), "ps"))
+	if err != nil {
+		return fmt.Errorf("invalid bandwidth %q", s)
+	}
+	*b = Bandwidth(v)
+	return nil
+}
+
+func (b *Bandwidth) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = Bandwidth(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid bandwidth %s", data)
+	}
+	return b.UnmarshalText([]byte(s))
+}
+
+func (b Bandwidth) String() string {
+	return ByteSize(b).String() + "/s"
+}
+
+// "30s" や "5m" のような time.ParseDuration 形式の期間。数値の場合は秒として扱う
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		*d = Duration(n * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var n float64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*d = Duration(n * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// RFC 3339 形式または "2006-01-02 15:04:05"、"2006-01-02"（ローカル時刻）の日時
+type Timestamp struct {
+	time.Time
+}
+
+var timestampLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+func (t *Timestamp) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	for _, layout := range timestampLayouts {
+		if v, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			t.Time = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid timestamp %q", s)
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid timestamp %s", data)
+	}
+	return t.UnmarshalText([]byte(s))
+}
@@ -0,0 +1,260 @@
+package syncig
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 検証結果の種類
+const (
+	verifyOK       = "ok"
+	verifyMismatch = "mismatch"
+	verifyMissing  = "missing"
+	// 比較するハッシュ値がない（記録にハッシュ値がない、または -source で同期元がない）
+	verifySkipped = "skipped"
+)
+
+// 1 ファイル分の検証結果
+type verifyResult struct {
+	rel    string
+	dir    string
+	name   string
+	status string
+	want   string
+	got    string
+}
+
+// syncig verify: 同期先のファイルを記録したハッシュ値（-source の場合は現在の同期元）と照合する
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var jf jobFlags
+	jf.register(fs)
+	var opts verifyOptions
+	fs.BoolVar(&opts.source, "source", false, "記録したハッシュ値ではなく現在の同期元の内容と比較する")
+	fs.BoolVar(&opts.rehash, "rehash", false, "-source でサイズと更新日時が変わっていない同期元も読み直す")
+	ignoreMissing := fs.Bool("ignore-missing", false, "同期先で削除されたファイルを問題として扱わない")
+	verbose := fs.Bool("v", false, "一致したファイルも表示する")
+	repair := fs.Bool("repair", false, "一致しないファイルを QUARANTINE_DIR に退避して再コピーする")
+	fs.Parse(args)
+	jobs, err := jf.jobs(fs)
+	if err != nil {
+		return err
+	}
+	if *repair {
+		for _, job := range jobs {
+			if job.QUARANTINE_DIR == "" {
+				return fmt.Errorf("-repair requires QUARANTINE_DIR")
+			}
+		}
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	problems := 0
+	for _, job := range jobs {
+		printJobHeader(job)
+		if isHTTPURL(job.DIST_DIR) {
+			return fmt.Errorf("verify cannot be used with an http:// or https:// DIST_DIR")
+		}
+		s, err := newSyncer(ctx, job, RunOptions{DryRun: !*repair, ForceState: jf.force})
+		if err != nil {
+			return err
+		}
+		counts := map[string]int{}
+		var mismatched []verifyResult
+		err = s.verifyState(opts, func(r verifyResult) error {
+			counts[r.status]++
+			switch r.status {
+			case verifyMismatch:
+				problems++
+				fmt.Printf("MISMATCH: %s (expected %s, got %s)\n", r.rel, r.want, r.got)
+				mismatched = append(mismatched, r)
+			case verifyMissing:
+				if *ignoreMissing {
+					return nil
+				}
+				problems++
+				fmt.Printf("MISSING: %s\n", r.rel)
+			case verifySkipped:
+				if *verbose {
+					fmt.Printf("SKIPPED: %s\n", r.rel)
+				}
+			default:
+				if *verbose {
+					fmt.Printf("OK: %s\n", r.rel)
+				}
+			}
+			return nil
+		})
+		if err == nil && *repair {
+			for _, r := range mismatched {
+				if err = s.repair(r); err != nil {
+					break
+				}
+			}
+		}
+		if jerr := s.journal.close(err); err == nil {
+			err = jerr
+		}
+		s.close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Verified: %d ok, %d mismatched, %d missing, %d skipped\n",
+			counts[verifyOK], counts[verifyMismatch], counts[verifyMissing], counts[verifySkipped])
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d files failed verification", problems)
+	}
+	return nil
+}
+
+// 検証の方法
+type verifyOptions struct {
+	// 現在の同期元の内容と比較する
+	source bool
+	// 保存されている同期元のハッシュ値を使わない
+	rehash bool
+}
+
+// 同期状態に記録されているすべてのファイルを検証し、結果を fn に渡す。
+// 同期元で削除されたと記録されているファイルと、RETENTION_DAYS で削除したファイルは対象外
+func (s *syncer) verifyState(opts verifyOptions, fn func(verifyResult) error) error {
+	dirs, err := s.state.list()
+	if err != nil {
+		return err
+	}
+	sort.Strings(dirs)
+	for _, rel := range dirs {
+		m, err := s.state.load(rel)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(m.Files))
+		for name, rec := range m.Files {
+			if rec.DeletedAt.IsZero() && rec.PrunedAt.IsZero() {
+				names = append(names, name)
+			}
+		}
+		sort.Slice(names, func(i, j int) bool { return s.less(names[i], names[j]) })
+		cached := false
+		var stopped error
+		for _, name := range names {
+			if s.ctx.Err() != nil {
+				stopped = context.Cause(s.ctx)
+				break
+			}
+			r, added, err := s.verifyFile(m, rel, name, opts)
+			if err != nil {
+				return err
+			}
+			cached = cached || added
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		// 次回の verify -source で読み直さないよう、計算した同期元のハッシュ値を保存する（中断した場合も）
+		if cached {
+			if err := s.state.save(rel, m); err != nil {
+				return err
+			}
+		}
+		if stopped != nil {
+			return stopped
+		}
+	}
+	return nil
+}
+
+// added は同期元のハッシュ値を計算して m に加えた場合 true
+func (s *syncer) verifyFile(m *manifest, rel, name string, opts verifyOptions) (r verifyResult, added bool, err error) {
+	r = verifyResult{rel: filepath.ToSlash(filepath.Join(rel, name)), dir: rel, name: name, want: m.Files[name].digest(s.hashAlgo)}
+	distFile := filepath.Join(s.distRoot, rel, name)
+	if _, err := s.statDist(distFile); errors.Is(err, fs.ErrNotExist) {
+		r.status = verifyMissing
+		return r, false, nil
+	}
+	if opts.source {
+		srcFile := filepath.Join(s.srcRoot, rel, name)
+		info, err := s.statSource(srcFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			r.status = verifySkipped
+			return r, false, nil
+		}
+		if err != nil {
+			return r, false, err
+		}
+		if opts.rehash {
+			r.want, err = s.hashSource(srcFile)
+		} else {
+			r.want, added, err = s.sourceHash(m, name, srcFile, info)
+		}
+		if err != nil {
+			return r, false, err
+		}
+	}
+	if r.want == "" {
+		r.status = verifySkipped
+		return r, added, nil
+	}
+	if r.got, err = s.hashDist(distFile); err != nil {
+		return r, added, err
+	}
+	r.status = verifyOK
+	if r.got != r.want {
+		r.status = verifyMismatch
+	}
+	return r, added, nil
+}
+
+// 一致しなかった同期先ファイルを QUARANTINE_DIR に退避し、同期元から再コピーして記録し直す。
+// 同期元が削除されている場合は退避のみ行う
+func (s *syncer) repair(r verifyResult) error {
+	if err := s.quarantine(r.dir, r.name, "verify: checksum mismatch"); err != nil {
+		return err
+	}
+	srcFile := filepath.Join(s.srcRoot, r.dir, r.name)
+	info, err := s.statSource(srcFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Source missing, not recopied: %s\n", srcFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	distFile := filepath.Join(s.distRoot, r.dir, r.name)
+	c := s.copyWithTimeout(srcFile, distFile, info, fileRecord{})
+	if c.err != nil {
+		return c.err
+	}
+	m, err := s.state.load(r.dir)
+	if err != nil {
+		return err
+	}
+	m.record(r.name, info, c.sum, s.hashAlgo, s.less)
+	if c.hashState != nil || c.fileID != "" {
+		rec := m.Files[r.name]
+		rec.HashState, rec.FileID = c.hashState, c.fileID
+		m.Files[r.name] = rec
+	}
+	m.UpdatedAt = time.Now()
+	if err := s.state.save(r.dir, m); err != nil {
+		return err
+	}
+	if err := s.writeSidecar(distFile, c.sum); err != nil {
+		return err
+	}
+	if err := s.writeChecksumManifest(filepath.Join(s.distRoot, r.dir), m); err != nil {
+		return err
+	}
+	if err := s.journal.write(journalEntry{Action: journalCopied, Path: r.rel, Size: info.Size(), SHA256: c.sum, HashAlgo: recordedAlgo(s.hashAlgo)}); err != nil {
+		return err
+	}
+	fmt.Printf("Recopied: %s -> %s\n", srcFile, distFile)
+	return nil
+}
@@ -0,0 +1,36 @@
+package syncig
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// KEEP_VERSIONS で残した以前の版のファイル名（<ファイル名>.~1~ が最も新しい）
+var versionSuffix = regexp.MustCompile(`\.~[1-9][0-9]*~$`)
+
+func versionName(distFile string, n int) string {
+	return distFile + ".~" + strconv.Itoa(n) + "~"
+}
+
+// 同期先の既存のファイルを上書きする前に .~1~ に移し、それまでの版を 1 つずつずらす。
+// KEEP_VERSIONS を超えた最も古い版は削除する
+func (s *syncer) rotateVersions(distFile string) error {
+	if s.keepVersions <= 0 {
+		return nil
+	}
+	if _, err := os.Lstat(distFile); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(versionName(distFile, s.keepVersions)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := s.keepVersions - 1; n >= 1; n-- {
+		if err := os.Rename(versionName(distFile, n), versionName(distFile, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(distFile, versionName(distFile, 1))
+}
@@ -0,0 +1,313 @@
+package syncig
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WATCH_DEBOUNCE の既定値
+const defaultWatchDebounce = 2 * time.Second
+
+// 監視で見つかった変更のあったディレクトリ（SRC_DIR からの相対パス）。
+// 監視側の goroutine から追加し、同期側は notify を受けて同期できるものを取り出す
+type watchQueue struct {
+	mu sync.Mutex
+	// ディレクトリごとに最後の変更からこの時間が経過したら同期する
+	debounce time.Duration
+	// 変更がこの数に達したディレクトリは debounce を待たずに同期する（0 は制限なし）
+	maxBatch int
+	dirs     map[string]*pendingDir
+	// イベントの取りこぼしなどで、すべてのディレクトリを走査し直す
+	all    bool
+	allDue time.Time
+	notify chan struct{}
+}
+
+type pendingDir struct {
+	due    time.Time
+	events int
+}
+
+func newWatchQueue(debounce time.Duration, maxBatch int) *watchQueue {
+	return &watchQueue{debounce: debounce, maxBatch: maxBatch, dirs: map[string]*pendingDir{}, notify: make(chan struct{}, 1)}
+}
+
+// rel のディレクトリに変更があったことを記録する。all はすべてのディレクトリ
+func (q *watchQueue) add(rel string, all bool) {
+	q.mu.Lock()
+	due := time.Now().Add(q.debounce)
+	if all {
+		q.all, q.allDue = true, due
+	} else {
+		rel = filepath.ToSlash(rel)
+		p := q.dirs[rel]
+		if p == nil {
+			p = &pendingDir{}
+			q.dirs[rel] = p
+		}
+		p.due = due
+		p.events++
+	}
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 同期し直すディレクトリを delay の後に同期する。その間に変更があればそちらに従う
+func (q *watchQueue) requeue(rels []string, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, rel := range rels {
+		if q.dirs[rel] == nil {
+			q.dirs[rel] = &pendingDir{due: time.Now().Add(delay)}
+		}
+	}
+}
+
+// 同期できるディレクトリを取り出す。すべてのディレクトリを走査し直す場合は all が true
+func (q *watchQueue) take(now time.Time) (rels []string, all bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.all && !q.allDue.After(now) {
+		q.all = false
+		q.dirs = map[string]*pendingDir{}
+		return nil, true
+	}
+	for rel, p := range q.dirs {
+		if !p.due.After(now) || (q.maxBatch > 0 && p.events >= q.maxBatch) {
+			rels = append(rels, rel)
+			delete(q.dirs, rel)
+		}
+	}
+	sort.Strings(rels)
+	return rels, false
+}
+
+// 次に同期できるディレクトリが現れる時刻。待っているものがなければゼロ値
+func (q *watchQueue) wake() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next time.Time
+	if q.all {
+		next = q.allDue
+	}
+	for _, p := range q.dirs {
+		if next.IsZero() || p.due.Before(next) {
+			next = p.due
+		}
+	}
+	return next
+}
+
+// syncig watch: SRC_DIR の変更を監視し、変更のあったディレクトリのみを同期する
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	var jf jobFlags
+	jf.register(fs)
+	debounce := fs.Duration("debounce", 0, "ディレクトリごとに最後の変更からこの時間が経過してから同期する（WATCH_DEBOUNCE を上書き）")
+	maxBatch := fs.Int("max-batch", 0, "変更がこの数に達したディレクトリは debounce を待たずに同期する（WATCH_MAX_BATCH を上書き）")
+	fs.Parse(args)
+	load := func() ([]Job, error) {
+		jobs, err := jf.jobs(fs)
+		if err != nil {
+			return nil, err
+		}
+		for i, job := range jobs {
+			if job.MODE == modeBidirectional {
+				return nil, fmt.Errorf("watch does not support MODE %q", modeBidirectional)
+			}
+			if isRemoteURL(job.SRC_DIR) {
+				return nil, fmt.Errorf("watch does not support a remote SRC_DIR; use sync -daemon to poll it")
+			}
+			if *debounce > 0 {
+				jobs[i].WATCH_DEBOUNCE = Duration(*debounce)
+			}
+			if *maxBatch > 0 {
+				jobs[i].WATCH_MAX_BATCH = *maxBatch
+			}
+		}
+		return jobs, nil
+	}
+	jobs, err := load()
+	if err != nil {
+		return err
+	}
+	ctx, stopSignals := shutdownContext()
+	defer stopSignals()
+	reload := reloadSignals(jf.config)
+	startWatchdog()
+	for {
+		sdNotify(fmt.Sprintf("READY=1\nSTATUS=Watching %d jobs", len(jobs)))
+		stop := make(chan struct{})
+		errs := make(chan error, len(jobs))
+		for _, job := range jobs {
+			go func() {
+				errs <- watchJob(ctx, job, RunOptions{ForceState: jf.force}, stop)
+			}()
+		}
+		var all []error
+		running := len(jobs)
+	wait:
+		for running > 0 {
+			select {
+			case err := <-errs:
+				running--
+				if err != nil {
+					all = append(all, err)
+				}
+			case <-reload:
+				// 読み込めない設定は反映せず、これまでの設定で監視を続ける
+				next, err := load()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "reload error: %v\n", err)
+					continue
+				}
+				fmt.Println("Reloaded config.")
+				// 同期中のジョブはその同期を終えてから止める
+				close(stop)
+				for ; running > 0; running-- {
+					<-errs
+				}
+				jobs = next
+				break wait
+			}
+		}
+		if running == 0 && (len(all) > 0 || ctx.Err() != nil) {
+			return errors.Join(all...)
+		}
+	}
+}
+
+// 最初にすべてのディレクトリを同期し、以降は変更のあったディレクトリを同期する。
+// 同期の失敗は表示して監視を続け、stop が閉じられるか ctx が終了すると終了する
+func watchJob(ctx context.Context, job Job, opts RunOptions, stop <-chan struct{}) error {
+	debounce := time.Duration(job.WATCH_DEBOUNCE)
+	if debounce == 0 {
+		debounce = defaultWatchDebounce
+	}
+	q := newWatchQueue(debounce, job.WATCH_MAX_BATCH)
+	stopWatch, err := watchTree(job.SRC_DIR, q)
+	if err != nil {
+		return fmt.Errorf("watch %s: %w", job.SRC_DIR, err)
+	}
+	defer stopWatch()
+	label := job.SRC_DIR
+	if job.NAME != "" {
+		label = job.NAME
+	}
+	if len(job.DIST_DIRS) > 0 {
+		label += " -> " + job.DIST_DIR
+	}
+	fmt.Printf("Watching: %s\n", job.SRC_DIR)
+	// MIN_AGE などで次回に回したファイルは、変更がなくても後で同期し直す
+	retry := max(debounce, time.Duration(job.MIN_AGE))
+	if err := runJob(ctx, job, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "watch error: %s: %v\n", label, err)
+	}
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-q.notify:
+		case <-timer.C:
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		rels, all := q.take(time.Now())
+		if all || len(rels) > 0 {
+			var deferred []string
+			var err error
+			if all {
+				err = runJob(ctx, job, opts)
+			} else {
+				deferred, err = syncJobDirs(ctx, job, opts, rels)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "watch error: %s: %v\n", label, err)
+			}
+			q.requeue(deferred, retry)
+		}
+		if next := q.wake(); !next.IsZero() {
+			timer.Reset(time.Until(next))
+		} else {
+			timer.Stop()
+		}
+	}
+}
+
+// 指定したディレクトリのみを同期し、書き込み中とみなして次回に回したファイルのあるディレクトリを返す
+func syncJobDirs(ctx context.Context, job Job, opts RunOptions, rels []string) ([]string, error) {
+	ctx, cancel := jobContext(ctx, job)
+	defer cancel()
+	s, err := newSyncer(ctx, job, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	err = s.finish(s.syncRels(rels))
+	// 上限に達して止めた場合は、残りのディレクトリも後で同期し直す
+	if errors.Is(err, errRunBudget) {
+		return rels, budgetResult(err, opts)
+	}
+	return s.deferredDirs, err
+}
+
+// rels のディレクトリを同期する。walk と同様に除外するディレクトリの配下は同期せず、
+// 途中のディレクトリの .syncigignore も読み込む
+func (s *syncer) syncRels(rels []string) error {
+	loaded := map[string]bool{}
+	for _, rel := range rels {
+		if err := s.ctx.Err(); err != nil {
+			return context.Cause(s.ctx)
+		}
+		if rel == "" || rel == "." {
+			continue
+		}
+		skip := false
+		prefix := ""
+		for _, part := range strings.Split(rel, "/") {
+			prefix = path.Join(prefix, part)
+			dir := filepath.Join(s.srcRoot, filepath.FromSlash(prefix))
+			info, err := os.Lstat(dir)
+			// 同期する前に削除されたディレクトリ
+			if os.IsNotExist(err) {
+				skip = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() || s.filter.skipDir(prefix, fs.FileInfoToDirEntry(info)) {
+				skip = true
+				break
+			}
+			if !loaded[prefix] {
+				if err := s.filter.loadIgnoreFile(dir, prefix); err != nil {
+					return err
+				}
+				loaded[prefix] = true
+			}
+		}
+		if skip {
+			continue
+		}
+		if err := s.syncDir(filepath.Join(s.srcRoot, filepath.FromSlash(rel)), filepath.FromSlash(rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+//go:build linux
+
+package syncig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// 監視するイベント。書き込み中の変更は IN_MODIFY で debounce を延長する
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_ATTRIB
+
+// inotify はディレクトリ単位のため、SRC_DIR 配下のすべてのディレクトリを監視する
+type inotifyWatcher struct {
+	fd int
+	// 監視をやめるときに閉じる。非ブロッキングで開き、読み込みを中断できるようにする
+	f    *os.File
+	root string
+	// 監視記述子ごとのディレクトリ（SRC_DIR からの相対パス、"/" 区切り）
+	dirs map[int32]string
+}
+
+func watchTree(root string, q *watchQueue) (stop func(), err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{fd: fd, f: os.NewFile(uintptr(fd), "inotify"), root: root, dirs: map[int32]string{}}
+	if _, err := w.addTree(""); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.loop(q)
+	return func() { w.f.Close() }, nil
+}
+
+// rel 以下のディレクトリを監視に加え、加えたディレクトリを返す。
+// 監視に加える前に削除されたディレクトリは無視する
+func (w *inotifyWatcher) addTree(rel string) ([]string, error) {
+	var added []string
+	err := filepath.WalkDir(filepath.Join(w.root, filepath.FromSlash(rel)), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err == syscall.ENOENT {
+			return fs.SkipDir
+		}
+		if err == syscall.ENOSPC {
+			return fmt.Errorf("%s: %w (increase fs.inotify.max_user_watches)", p, err)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		r, _ := filepath.Rel(w.root, p)
+		r = filepath.ToSlash(r)
+		if r == "." {
+			r = ""
+		}
+		w.dirs[int32(wd)] = r
+		added = append(added, r)
+		return nil
+	})
+	return added, err
+}
+
+// rel 以下のディレクトリの監視をやめる
+func (w *inotifyWatcher) removeTree(rel string) {
+	for wd, dir := range w.dirs {
+		if dir == rel || strings.HasPrefix(dir, rel+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+func (w *inotifyWatcher) loop(q *watchQueue) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.f.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "watch error: %s: %v\n", w.root, err)
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			w.handle(q, ev, string(bytes.TrimRight(nameBytes, "\x00")))
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(q *watchQueue, ev *syscall.InotifyEvent, name string) {
+	// イベントを取りこぼしたため、すべてのディレクトリを同期し直す
+	if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		q.add("", true)
+		return
+	}
+	dir, ok := w.dirs[ev.Wd]
+	if !ok {
+		return
+	}
+	if ev.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, ev.Wd)
+		return
+	}
+	if ev.Mask&syscall.IN_ISDIR != 0 {
+		rel := path.Join(dir, name)
+		// SRC_DIR の外に移されたディレクトリは監視をやめる。SRC_DIR の中での移動は IN_MOVED_TO で監視し直す
+		if ev.Mask&syscall.IN_MOVED_FROM != 0 {
+			w.removeTree(rel)
+		}
+		// 起動後に作成・移動されてきたディレクトリ（日付ごとのディレクトリなど）は配下も含めて監視し、
+		// 監視を始める前に置かれたファイルも同期する
+		if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			added, err := w.addTree(rel)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "watch error: %v\n", err)
+			}
+			for _, r := range added {
+				q.add(r, false)
+			}
+		}
+		// 削除されたディレクトリは MIRROR_DIRS のために同期の後処理のみ行う
+		q.add(dir, false)
+		return
+	}
+	// SRC_DIR の直下のファイルは同期しない
+	if dir == "" {
+		return
+	}
+	q.add(dir, false)
+}
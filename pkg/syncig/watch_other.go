@@ -0,0 +1,25 @@
+//go:build !linux && !windows
+
+package syncig
+
+import "time"
+
+// ファイルシステムの通知に対応していない環境で、すべてのディレクトリを同期し直す間隔
+const watchPollInterval = 30 * time.Second
+
+func watchTree(root string, q *watchQueue) (stop func(), err error) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(watchPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				q.add("", true)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
@@ -0,0 +1,93 @@
+//go:build windows
+
+package syncig
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const watchNotifyFilter = syscall.FILE_NOTIFY_CHANGE_FILE_NAME | syscall.FILE_NOTIFY_CHANGE_DIR_NAME |
+	syscall.FILE_NOTIFY_CHANGE_SIZE | syscall.FILE_NOTIFY_CHANGE_LAST_WRITE | syscall.FILE_NOTIFY_CHANGE_ATTRIBUTES
+
+// ReadDirectoryChangesW で SRC_DIR の配下をまとめて監視する
+func watchTree(root string, q *watchQueue) (stop func(), err error) {
+	p, err := syscall.UTF16PtrFromString(root)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(p, syscall.FILE_LIST_DIRECTORY,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return nil, err
+	}
+	var stopped atomic.Bool
+	go func() {
+		defer syscall.CloseHandle(h)
+		buf := make([]byte, 64<<10)
+		for {
+			var n uint32
+			err := syscall.ReadDirectoryChanges(h, &buf[0], uint32(len(buf)), true, watchNotifyFilter, &n, nil, 0)
+			if stopped.Load() {
+				return
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "watch error: %s: %v\n", root, err)
+				return
+			}
+			// バッファに収まらずイベントを取りこぼしたため、すべてのディレクトリを同期し直す
+			if n == 0 {
+				q.add("", true)
+				continue
+			}
+			for off := uint32(0); ; {
+				info := (*syscall.FileNotifyInformation)(unsafe.Pointer(&buf[off]))
+				name := syscall.UTF16ToString(unsafe.Slice(&info.FileName, info.FileNameLength/2))
+				watchChanged(root, filepath.ToSlash(name), info.Action, q)
+				if info.NextEntryOffset == 0 {
+					break
+				}
+				off += info.NextEntryOffset
+			}
+		}
+	}()
+	// 待機中の ReadDirectoryChangesW を中断する。中断できなくても次の変更で終了する
+	return func() {
+		stopped.Store(true)
+		syscall.CancelIoEx(h, nil)
+	}, nil
+}
+
+// 変更のあったファイルのディレクトリを同期する。作成・移動されてきたディレクトリは配下も同期する
+func watchChanged(root, rel string, action uint32, q *watchQueue) {
+	dir := path.Dir(rel)
+	if dir == "." {
+		dir = ""
+	}
+	if action == syscall.FILE_ACTION_ADDED || action == syscall.FILE_ACTION_RENAMED_NEW_NAME {
+		src := filepath.Join(root, filepath.FromSlash(rel))
+		if info, err := os.Lstat(src); err == nil && info.IsDir() {
+			filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && d.IsDir() {
+					r, _ := filepath.Rel(root, p)
+					q.add(r, false)
+				}
+				return nil
+			})
+			q.add(dir, false)
+			return
+		}
+	}
+	// SRC_DIR の直下のファイルは同期しない（削除されたディレクトリは同期の後処理のみ行う）
+	if dir == "" && action != syscall.FILE_ACTION_REMOVED && action != syscall.FILE_ACTION_RENAMED_OLD_NAME {
+		return
+	}
+	q.add(dir, false)
+}
@@ -0,0 +1,324 @@
+package syncig
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// WebDAV のサーバー（Nextcloud・SharePoint など）に書き込む。davs:// は HTTPS、dav:// は HTTP で接続する
+
+// これ以下のファイルはメモリに読み込んでから送り、一時的なエラーの場合に送り直す。
+// これより大きいファイルは同期元から読みながら 1 回の PUT で送る
+const webdavBufferSize = 16 << 20
+
+// stat と readDir で要求するプロパティ
+const webdavPropfindBody = xml.Header + `<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+// dav://host/path・davs://host/path の同期先。リモートでのパスはサーバーのルートからのパス
+type webdavStore struct {
+	client *http.Client
+	// https://host:port
+	base     string
+	user     string
+	password string
+	// SharePoint Online などの OAuth のアクセストークン。指定した場合は Basic 認証の代わりに使う
+	bearer string
+	// 作成済み、または既にあることを確認したディレクトリ
+	dirs sync.Map
+}
+
+func openWebDAVStore(u *url.URL, job Job) (*webdavStore, error) {
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("%s: passwords in the URL are not supported; set WEBDAV_PASSWORD", u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: host is empty", u.Redacted())
+	}
+	scheme := "https"
+	if u.Scheme == "dav" {
+		scheme = "http"
+	}
+	client, err := newHTTPClient(job)
+	if err != nil {
+		return nil, err
+	}
+	s := &webdavStore{client: client, base: scheme + "://" + u.Host}
+	if s.password, err = credential(job, "WEBDAV_PASSWORD"); err != nil {
+		return nil, err
+	}
+	if s.bearer, err = credential(job, "WEBDAV_BEARER_TOKEN"); err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+	}
+	return s, nil
+}
+
+// リモートでのパスの URL。ディレクトリの場合は末尾に / を付ける（付けないとリダイレクトするサーバーがある）
+func (s *webdavStore) url(name string, dir bool) string {
+	name = path.Clean("/" + name)
+	u := s.base + (&url.URL{Path: name}).EscapedPath()
+	if dir && name != "/" {
+		u += "/"
+	}
+	return u
+}
+
+// 失敗した応答をエラーに変換して本文を閉じる。本文は Sabre（Nextcloud）の s:message があれば使う
+func (s *webdavStore) responseError(op, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var e struct {
+		Message string `xml:"http://sabredav.org/ns message"`
+	}
+	msg := resp.Status
+	if xml.Unmarshal(b, &e) == nil && e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return &fs.PathError{Op: op, Path: s.base + path.Clean("/"+name), Err: &httpStatusError{code: resp.StatusCode, msg: msg}}
+}
+
+func (s *webdavStore) do(ctx context.Context, method, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestBody(req, body)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.authorize(req)
+	return s.client.Do(req)
+}
+
+func (s *webdavStore) authorize(req *http.Request) {
+	switch {
+	case s.bearer != "":
+		req.Header.Set("Authorization", "Bearer "+s.bearer)
+	case s.user != "":
+		req.SetBasicAuth(s.user, s.password)
+	}
+}
+
+// 要求を送り、want のいずれかのステータスが返るまで一時的なエラーを送り直す
+func (s *webdavStore) send(ctx context.Context, op, name, method, rawURL string, header http.Header, body []byte, want ...int) (int, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.do(ctx, method, rawURL, header, body)
+		if err == nil {
+			for _, code := range want {
+				if resp.StatusCode == code {
+					resp.Body.Close()
+					return code, nil
+				}
+			}
+			err = s.responseError(op, name, resp)
+		}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return 0, err
+		}
+	}
+}
+
+// dir とその親のディレクトリを MKCOL で作る。既にある場合は 405 が返る
+func (s *webdavStore) mkdirAll(ctx context.Context, dir string) error {
+	dir = path.Clean("/" + dir)
+	if dir == "/" {
+		return nil
+	}
+	if _, ok := s.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	if _, err := s.send(ctx, "mkdir", dir, "MKCOL", s.url(dir, true), nil, nil, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+		return err
+	}
+	s.dirs.Store(dir, true)
+	return nil
+}
+
+// 同じディレクトリの <名前>.partial に PUT してから MOVE で置き換える
+func (s *webdavStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if err := s.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	tmp := name + partialExt
+	if err := s.upload(ctx, tmp, r, size); err != nil {
+		s.Remove(context.Background(), tmp)
+		return err
+	}
+	_, err := s.send(ctx, "rename", name, "MOVE", s.url(tmp, false), http.Header{
+		"Destination": {s.url(name, false)},
+		"Overwrite":   {"T"},
+	}, nil, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		s.Remove(context.Background(), tmp)
+	}
+	return err
+}
+
+func (s *webdavStore) upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	first, err := readPart(r, size, webdavBufferSize)
+	if err != nil {
+		return err
+	}
+	if len(first) <= webdavBufferSize {
+		_, err := s.send(ctx, "put", name, http.MethodPut, s.url(name, false), nil, first, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+		return err
+	}
+	// 大きさが分かっていれば Content-Length を付ける。付けないとチャンク形式で送るが、受け付けないサーバーがある
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url(name, false), activityReader{io.MultiReader(bytes.NewReader(first), r)})
+	if err != nil {
+		return err
+	}
+	req.ContentLength = -1
+	if size >= int64(len(first)) {
+		req.ContentLength = size
+	}
+	s.authorize(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusOK:
+		resp.Body.Close()
+		return nil
+	}
+	return s.responseError("put", name, resp)
+}
+
+// If-None-Match: * の条件で PUT する。既にある場合は 412 が返る
+func (s *webdavStore) Create(ctx context.Context, name string, data []byte) error {
+	if err := s.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	_, err := s.send(ctx, "create", name, http.MethodPut, s.url(name, false), http.Header{"If-None-Match": {"*"}}, data, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	var se *httpStatusError
+	if errors.As(err, &se) && se.code == http.StatusPreconditionFailed {
+		return &fs.PathError{Op: "create", Path: s.base + path.Clean("/"+name), Err: fs.ErrExist}
+	}
+	return err
+}
+
+func (s *webdavStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.url(name, false), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("open", name, resp)
+	}
+	return resp.Body, nil
+}
+
+// PROPFIND の応答（207 Multi-Status）
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength int64  `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// PROPFIND で name（depth が 1 の場合はその直下も）のプロパティを取得する。
+// 返す一覧のパスは、href を URL のデコードをしたサーバーのルートからのパス
+func (s *webdavStore) propfind(ctx context.Context, name, depth string) (map[string]*remoteFileInfo, error) {
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = s.do(ctx, "PROPFIND", s.url(name, depth == "1"), http.Header{
+			"Depth":        {depth},
+			"Content-Type": {"application/xml"},
+		}, []byte(webdavPropfindBody))
+		if err == nil {
+			if resp.StatusCode == http.StatusMultiStatus {
+				break
+			}
+			err = s.responseError("stat", name, resp)
+		}
+		if !retryTemporary(ctx, err, attempt, remoteRetries) {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav propfind %s: %w", name, err)
+	}
+	infos := map[string]*remoteFileInfo{}
+	for _, r := range ms.Responses {
+		// href はパスだけの場合と URL の場合がある
+		h, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		p := path.Clean("/" + h.Path)
+		for _, ps := range r.Propstat {
+			// 要求したプロパティのうち、ないものは 404 の propstat にまとめて返る
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			mtime, _ := http.ParseTime(ps.Prop.LastModified)
+			infos[p] = &remoteFileInfo{name: path.Base(p), size: ps.Prop.ContentLength, mtime: mtime, dir: ps.Prop.ResourceType.Collection != nil}
+		}
+	}
+	return infos, nil
+}
+
+func (s *webdavStore) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	infos, err := s.propfind(ctx, name, "0")
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		return info, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: s.base + path.Clean("/"+name), Err: fs.ErrNotExist}
+}
+
+func (s *webdavStore) Remove(ctx context.Context, name string) error {
+	_, err := s.send(ctx, "remove", name, http.MethodDelete, s.url(name, false), nil, nil, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+// Depth: 1 の PROPFIND で dir の直下を一覧にする。応答には dir 自身も含まれるため除く
+func (s *webdavStore) ReadDir(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	infos, err := s.propfind(ctx, dir, "1")
+	if err != nil {
+		return nil, err
+	}
+	dir = path.Clean("/" + dir)
+	var list []fs.FileInfo
+	for p, info := range infos {
+		if p != dir {
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
+
+func (s *webdavStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}